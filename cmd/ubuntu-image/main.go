@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/canonical/ubuntu-image/internal/commands"
 	"github.com/canonical/ubuntu-image/internal/helper"
@@ -15,62 +21,34 @@ import (
 // this is usually set at build time
 var Version string
 
-// osExit, captureStd, stateMachineInterface and imageType are helper variables for unit testing
+// osExit, captureStd, stateMachineInterface, imageType, execCommand and osGeteuid are
+// helper variables for unit testing
 var (
-	osExit = os.Exit
-	captureStd = helper.CaptureStd
+	osExit                = os.Exit
+	captureStd            = helper.CaptureStd
 	stateMachineInterface statemachine.SmInterface
-	imageType string
+	imageType             string
+	execCommand           = exec.Command
+	osGeteuid             = os.Geteuid
 )
 
+// retryBuildDelay is the time waited for before running a failed build again with --retry-build
+var retryBuildDelay = 5 * time.Second
+
+// unshareArgs make unshare run a command as root in new user and mount namespaces,
+// with the subordinate IDs of the user from /etc/subuid and /etc/subgid mapped
+var unshareArgs = []string{"--user", "--map-root-user", "--map-auto", "--mount", "--fork", "--"}
+
 const (
 	stateMachineLongDesc = `Options for controlling the internal state machine.
 Other than -w, these options are mutually exclusive. When -u or -t is given,
 the state machine can be resumed later with -r, but -w must be given in that
-case since the state is saved in a ubuntu-image.gob file in the working directory.`
+case since the state is saved in a ubuntu-image.gob file in the working directory,
+unless --state-file is given.`
 )
 
-func main() {
-	// Initialize parser
-	parser := flags.NewParser(&commands.Options, flags.Default)
-
-	// Parse command line arguments
-	args, err := parser.Parse()
-
-	// Check for parsing errors, print usage and exit with error code 2
-	if err != nil {
-		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
-			osExit(0)
-		} else if flagsErr != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		}
-		parser.WriteHelp(os.Stderr)
-		osExit(2)
-	}
-
-	// If we have args left after parsing, assume it's the image type
-	if len(args) > 0 {
-		imageType = args[0]
-	}
-
-	// Print version if requested
-	if commands.Options.Version {
-		fmt.Printf("ubuntu-image version %s\n", Version)
-		osExit(0)
-	}
-
-	// Run state machine commands
-	if commands.Options.StateMachine != nil {
-		stateMachineInterface = statemachine.New(imageType)
-		commands.RunStateMachineCommands(stateMachineInterface, commands.Options.StateMachine)
-		osExit(0)
-	}
-
-	// Print usage if no subcommand is given
-	parser.WriteHelp(os.Stderr)
-	osExit(2)
-func executeStateMachine(commonOpts *commands.CommonOpts, stateMachineOpts *commands.StateMachineOpts, ubuntuImageCommand *commands.UbuntuImageCommand) {
-	// Set up the state machine
+// newStateMachine sets up the state machine of the requested image type
+func newStateMachine(commonOpts *commands.CommonOpts, stateMachineOpts *commands.StateMachineOpts, ubuntuImageCommand *commands.UbuntuImageCommand) {
 	if imageType == "snap" {
 		stateMachine := new(statemachine.SnapStateMachine)
 		stateMachine.Opts = ubuntuImageCommand.Snap.SnapOptsPassed
@@ -84,26 +62,112 @@ func executeStateMachine(commonOpts *commands.CommonOpts, stateMachineOpts *comm
 		stateMachine.SetCommonOpts(commonOpts, stateMachineOpts)
 		stateMachineInterface = stateMachine
 	}
+}
 
-	// set up, run, and tear down the state machine
-	if err := stateMachineInterface.Setup(); err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		osExit(1)
-		return
+func executeStateMachine(commonOpts *commands.CommonOpts, stateMachineOpts *commands.StateMachineOpts, ubuntuImageCommand *commands.UbuntuImageCommand) {
+	// interrupting ubuntu-image stops the build and cleans up after it
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	retries := stateMachineOpts.RetryBuild
+	for attempt := 1; ; attempt++ {
+		// every attempt starts from a new state machine, since the states
+		// change the options they are given, like the work dir
+		attemptCommonOpts := *commonOpts
+		attemptStateMachineOpts := *stateMachineOpts
+		newStateMachine(&attemptCommonOpts, &attemptStateMachineOpts, ubuntuImageCommand)
+
+		// set up, run, and tear down the state machine. Setting it up can fail
+		// because of the network too, like when cloning a git gadget, so it is
+		// retried like the states
+		err := stateMachineInterface.Setup()
+		if err == nil {
+			err = stateMachineInterface.RunContext(ctx)
+			if err == nil {
+				break
+			}
+			printError(commonOpts, err)
+			// the state machine is still torn down to record the result of the build
+			if err := stateMachineInterface.Teardown(); err != nil {
+				printError(commonOpts, err)
+			}
+		} else {
+			printError(commonOpts, err)
+		}
+		if attempt > retries || ctx.Err() != nil ||
+			!(stateMachineOpts.RetryAnyError || statemachine.IsRetriableError(err)) {
+			osExit(1)
+			return
+		}
+		if err := stateMachineInterface.ResetWorkDir(); err != nil {
+			printError(commonOpts, err)
+			osExit(1)
+			return
+		}
+		if !commonOpts.Quiet {
+			fmt.Printf("%s: the build failed, running it again in %s (retry %d of %d)\n",
+				colorize(commonOpts, helper.ColorYellow, "WARNING"), retryBuildDelay, attempt, retries)
+		}
+		select {
+		case <-time.After(retryBuildDelay):
+		case <-ctx.Done():
+			osExit(1)
+			return
+		}
 	}
 
-	if err := stateMachineInterface.Run(); err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
+	if err := stateMachineInterface.Teardown(); err != nil {
+		printError(commonOpts, err)
 		osExit(1)
 		return
 	}
 
-	if err := stateMachineInterface.Teardown(); err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		osExit(1)
+}
+
+// runUnprivileged runs ubuntu-image again with the same arguments in a user namespace,
+// in which it is root without having root privileges, and returns its exit code
+func runUnprivileged() int {
+	executable, err := os.Executable()
+	if err != nil {
+		fmt.Printf("Error: could not find the ubuntu-image executable: %s\n", err.Error())
+		return 1
+	}
+	args := append([]string{}, unshareArgs...)
+	args = append(append(args, executable), os.Args[1:]...)
+	cmd := execCommand("unshare", args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	// interrupting ubuntu-image from the terminal interrupts the build in the
+	// namespace too, which cleans up after it before exiting
+	signal.Ignore(os.Interrupt)
+	defer signal.Reset(os.Interrupt)
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode()
+		}
+		fmt.Printf("Error: could not run ubuntu-image in a user namespace: %s\n", err.Error())
+		return 1
+	}
+	return 0
+}
+
+// printError prints an error from the state machine in the format requested with --log-format
+func printError(commonOpts *commands.CommonOpts, err error) {
+	if commonOpts.LogFormat == "json" {
+		json.NewEncoder(os.Stdout).Encode(map[string]string{
+			"status": "error",
+			"error":  err.Error(),
+		})
 		return
 	}
+	fmt.Printf("%s: %s\n", colorize(commonOpts, helper.ColorRed, "Error"), err.Error())
+}
 
+// colorize colors text in the human-readable output, when --color allows it
+func colorize(commonOpts *commands.CommonOpts, color, text string) string {
+	return helper.Colorize(helper.UseColor(commonOpts.Color, helper.StdoutIsTerminal()), color, text)
 }
 
 func main() {
@@ -152,8 +216,8 @@ func main() {
 				osExit(0)
 				return
 			case flags.ErrCommandRequired:
-				// if --resume was given, this is not an error
-				if !stateMachineOpts.Resume && !commonOpts.Version {
+				// if --resume or --resume-from was given, this is not an error
+				if !stateMachineOpts.Resume && stateMachineOpts.ResumeFrom == "" && !commonOpts.Version {
 					restoreStdout()
 					restoreStderr()
 					readStderr, err := io.ReadAll(stderr)
@@ -196,6 +260,13 @@ func main() {
 		imageType = parser.Command.Active.Name
 	}
 
+	// without root privileges, --unprivileged builds the image in a user namespace
+	if imageType == "classic" && ubuntuImageCommand.Classic.ClassicOptsPassed.Unprivileged &&
+		osGeteuid() != 0 {
+		osExit(runUnprivileged())
+		return
+	}
+
 	// let the state machine handle the image build
 	executeStateMachine(commonOpts, stateMachineOpts, ubuntuImageCommand)
 }
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"io"
 	"os"
+	"os/exec"
+	"reflect"
 	"testing"
 
 	"github.com/canonical/ubuntu-image/internal/commands"
@@ -14,12 +17,23 @@ import (
 
 type MockedStateMachine struct {
 	whenToFail string
+	// the errors returned by the successive runs, which succeed once they are used up
+	runErrs []error
+	runs    int
+	resets  int
+	// the errors returned by the successive setups, like runErrs
+	setupErrs []error
+	setups    int
 }
 
 func (mockSM *MockedStateMachine) Setup() error {
 	if mockSM.whenToFail == "Setup" {
 		return errors.New("Testing Error")
 	}
+	mockSM.setups++
+	if mockSM.setups <= len(mockSM.setupErrs) {
+		return mockSM.setupErrs[mockSM.setups-1]
+	}
 	return nil
 }
 
@@ -27,9 +41,17 @@ func (mockSM *MockedStateMachine) Run() error {
 	if mockSM.whenToFail == "Run" {
 		return errors.New("Testing Error")
 	}
+	mockSM.runs++
+	if mockSM.runs <= len(mockSM.runErrs) {
+		return mockSM.runErrs[mockSM.runs-1]
+	}
 	return nil
 }
 
+func (mockSM *MockedStateMachine) RunContext(ctx context.Context) error {
+	return mockSM.Run()
+}
+
 func (mockSM *MockedStateMachine) Teardown() error {
 	if mockSM.whenToFail == "Teardown" {
 		return errors.New("Testing Error")
@@ -37,6 +59,14 @@ func (mockSM *MockedStateMachine) Teardown() error {
 	return nil
 }
 
+func (mockSM *MockedStateMachine) ResetWorkDir() error {
+	if mockSM.whenToFail == "ResetWorkDir" {
+		return errors.New("Testing Error")
+	}
+	mockSM.resets++
+	return nil
+}
+
 var mockedStateMachine MockedStateMachine
 
 // TestValidCommands tests that certain valid commands are parsed correctly
@@ -145,6 +175,10 @@ func TestExitCode(t *testing.T) {
 		t.Run("test "+tc.name, func(t *testing.T) {
 			saveCWD := helper.SaveCWD()
 			defer saveCWD()
+			// the result of the failed builds is written to the current directory
+			if err := os.Chdir(t.TempDir()); err != nil {
+				t.Fatalf("Error changing to a temporary directory: %s", err.Error())
+			}
 			// Override os.Exit temporarily
 			oldOsExit := osExit
 			defer func() {
@@ -324,3 +358,143 @@ func TestFailedStateMachine(t *testing.T) {
 		})
 	}
 }
+
+// TestRetryBuild tests that --retry-build runs a build that failed with a retriable
+// error again from a clean work dir, up to the given number of times, and that
+// the other errors only are retried with --retry-any-error
+func TestRetryBuild(t *testing.T) {
+	networkErr := errors.New("Error running command \"chroot apt-get update\". Output is: \n" +
+		"W: Failed to fetch http://archive.ubuntu.com/ubuntu/dists/jammy/InRelease  " +
+		"Temporary failure resolving 'archive.ubuntu.com'")
+	yamlErr := errors.New("Schema validation failed: gadget: gadget is required")
+	testCases := []struct {
+		name         string
+		flags        []string
+		runErrs      []error
+		setupErrs    []error
+		whenToFail   string
+		expectedCode int
+		expectedRuns int
+	}{
+		{"no_retry", []string{}, []error{networkErr}, nil, "", 1, 1},
+		{"retry_succeeds", []string{"--retry-build", "2"}, []error{networkErr, networkErr}, nil, "", 0, 3},
+		{"retries_used_up", []string{"--retry-build", "1"}, []error{networkErr, networkErr}, nil, "", 1, 2},
+		{"deterministic_error", []string{"--retry-build", "2"}, []error{yamlErr}, nil, "", 1, 1},
+		{"retry_any_error", []string{"--retry-build", "2", "--retry-any-error"}, []error{yamlErr}, nil, "", 0, 2},
+		{"error_reset_work_dir", []string{"--retry-build", "2"}, []error{networkErr}, nil, "ResetWorkDir", 1, 1},
+		{"setup_retry_succeeds", []string{"--retry-build", "2"}, nil, []error{networkErr}, "", 0, 1},
+		{"setup_deterministic_error", []string{"--retry-build", "2"}, nil, []error{yamlErr}, "", 1, 0},
+	}
+	for _, tc := range testCases {
+		t.Run("test_retry_build_"+tc.name, func(t *testing.T) {
+			oldOsExit := osExit
+			oldRetryBuildDelay := retryBuildDelay
+			defer func() {
+				osExit = oldOsExit
+				retryBuildDelay = oldRetryBuildDelay
+			}()
+			retryBuildDelay = 0
+
+			got := 0
+			osExit = func(code int) {
+				got = code
+			}
+
+			flag.CommandLine = flag.NewFlagSet("retry_build", flag.ExitOnError)
+			os.Args = append([]string{"retry_build", "snap", "model_assertion", "--quiet"}, tc.flags...)
+
+			// this stops main from using the snapSM or classicSm
+			imageType = "test"
+
+			mockSM := &MockedStateMachine{whenToFail: tc.whenToFail, runErrs: tc.runErrs,
+				setupErrs: tc.setupErrs}
+			stateMachineInterface = mockSM
+			main()
+			if got != tc.expectedCode {
+				t.Errorf("Expected exit code %d, got %d", tc.expectedCode, got)
+			}
+			if mockSM.runs != tc.expectedRuns {
+				t.Errorf("Expected the build to run %d times, but it ran %d times", tc.expectedRuns, mockSM.runs)
+			}
+			// the work dir is reset after every failed attempt, at setup or when running
+			expectedResets := mockSM.setups - 1
+			if tc.whenToFail == "" && mockSM.resets != expectedResets {
+				t.Errorf("Expected the work dir to be reset %d times, but it was reset %d times",
+					expectedResets, mockSM.resets)
+			}
+		})
+	}
+}
+
+// TestPrintError tests that state machine errors are printed in the requested log format,
+// colored as --color says for the text one
+func TestPrintError(t *testing.T) {
+	testCases := []struct {
+		name      string
+		logFormat string
+		color     string
+		expected  string
+	}{
+		{"text", "text", "auto", "Error: Testing Error\n"},
+		{"text_color", "text", "always", "\x1b[31mError\x1b[0m: Testing Error\n"},
+		{"json", "json", "always", "{\"error\":\"Testing Error\",\"status\":\"error\"}\n"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_print_error_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			commonOpts := new(commands.CommonOpts)
+			commonOpts.LogFormat = tc.logFormat
+			commonOpts.Color = tc.color
+
+			stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+			defer restoreStdout()
+			asserter.AssertErrNil(err, true)
+
+			printError(commonOpts, errors.New("Testing Error"))
+
+			restoreStdout()
+			readStdout, err := io.ReadAll(stdout)
+			asserter.AssertErrNil(err, true)
+			if string(readStdout) != tc.expected {
+				t.Errorf("Expected \"%s\" to be printed, but got \"%s\"", tc.expected, string(readStdout))
+			}
+		})
+	}
+}
+
+// TestUnprivileged tests that --unprivileged runs ubuntu-image again in a user namespace
+// without root privileges, and exits with the exit code of the build in the namespace
+func TestUnprivileged(t *testing.T) {
+	oldOsExit := osExit
+	defer func() {
+		osExit = oldOsExit
+		execCommand = exec.Command
+		osGeteuid = os.Geteuid
+	}()
+	var got int
+	osExit = func(code int) {
+		got = code
+	}
+	osGeteuid = func() int {
+		return 1000
+	}
+	var gotArgs []string
+	execCommand = func(command string, args ...string) *exec.Cmd {
+		gotArgs = append([]string{command}, args...)
+		return exec.Command("sh", "-c", "exit 3")
+	}
+
+	flag.CommandLine = flag.NewFlagSet("unprivileged", flag.ExitOnError)
+	os.Args = []string{"ubuntu-image", "classic", "--unprivileged", "image_definition.yaml"}
+	imageType = ""
+	main()
+	if got != 3 {
+		t.Errorf("Expected exit code: 3, got: %d", got)
+	}
+	executable, _ := os.Executable()
+	expectedArgs := append(append([]string{"unshare"}, unshareArgs...), executable,
+		"classic", "--unprivileged", "image_definition.yaml")
+	if !reflect.DeepEqual(gotArgs, expectedArgs) {
+		t.Errorf("Expected command %v, but got %v", expectedArgs, gotArgs)
+	}
+}
@@ -2,12 +2,40 @@ package commands
 
 // ClassicArgs holds the gadget tree. positional arguments need their own struct
 type ClassicArgs struct {
-	ImageDefinition string `positional-arg-name:"image_definition" description:"Classic image definition file. This is used to define how the image is built and the outputs that are created."`
+	ImageDefinition string `positional-arg-name:"image_definition" description:"Classic image definition file. This is used to define how the image is built and the outputs that are created. Use - to read it from stdin."`
 }
 
 // ClassicOpts holds all flags that are specific to the classic command
 type ClassicOpts struct {
-	AptParams []string `long:"apt-params" description:"Any additional APT specific configuration needed for the image build."` // TODO: is this used?
+	AptParams              []string `long:"apt-params" description:"Any additional APT specific configuration needed for the image build."` // TODO: is this used?
+	Format                 string   `long:"format" description:"The format of the disk image files created from the img artifacts in the image definition. The raw images are converted to this format once they are assembled. With iso, a bootable live ISO booting the rootfs from a squashfs with casper is made instead of the disk image, named after the only img artifact." choice:"raw" choice:"qcow2" choice:"vmdk" choice:"vhdx" choice:"iso" value-name:"FORMAT" default:"raw"`
+	SnapCacheDir           string   `long:"snap-cache-dir" description:"Directory in which the downloaded snaps are cached so they can be reused by later builds. Defaults to the value of the UBUNTU_IMAGE_SNAP_CACHE_DIR environment variable. If neither is set, snaps are not cached." value-name:"DIRECTORY"`
+	Arch                   string   `long:"arch" description:"The architecture to build the image for, overriding the architecture in the image definition. When it differs from the architecture of the host, the commands run in the chroot are emulated with qemu-user-static, which must be installed and registered with binfmt_misc." value-name:"ARCH"`
+	Series                 string   `long:"series" description:"The Ubuntu series to build the image for, like jammy or noble, overriding the series in the image definition. It is used to build the rootfs and in the apt sources of the image." value-name:"SERIES"`
+	RootfsTarball          string   `long:"rootfs-tarball" description:"Extract this local tarball as the rootfs instead of building it from the rootfs section of the image definition. It must contain /etc/os-release. The customization of the image definition is applied on top of it." value-name:"FILE"`
+	Bootloader             string   `long:"bootloader" description:"The bootloader installed in the EFI system partition of the volumes using grub in gadget.yaml. The packages of the bootloader are installed in the rootfs and it is configured when the disk images are made." choice:"grub" choice:"systemd-boot" value-name:"BOOTLOADER"`
+	SBOM                   string   `long:"sbom" description:"Generate a Software Bill of Materials of the deb packages installed in the image, in the given format. It is written to the output directory as <image name>.spdx.json." choice:"spdx" value-name:"FORMAT"`
+	NoCache                bool     `long:"no-cache" description:"Do not use or update the snap cache, even if --snap-cache-dir or UBUNTU_IMAGE_SNAP_CACHE_DIR is set."`
+	AptCacheDir            string   `long:"apt-cache-dir" description:"Directory in which the apt lists downloaded by apt update in the rootfs are cached between builds, keyed by the apt sources of the rootfs and its architecture. apt update is skipped while the cached lists are younger than --apt-cache-ttl. Defaults to the value of the UBUNTU_IMAGE_APT_CACHE_DIR environment variable. If neither is set, the apt lists are not cached." value-name:"DIRECTORY"`
+	AptCacheTTL            string   `long:"apt-cache-ttl" description:"How long the apt lists of --apt-cache-dir are used before apt update is run again, like 30m or 6h." value-name:"DURATION" default:"6h"`
+	NoAptCache             bool     `long:"no-apt-cache" description:"Do not use the apt lists cache, even if --apt-cache-dir or UBUNTU_IMAGE_APT_CACHE_DIR is set, and always run apt update in the rootfs. The cache is not updated either."`
+	Comp                   string   `long:"comp" description:"The compressor used by mksquashfs for the rootfs-squashfs artifact, optionally followed by a compression level. The compressor can be one of gzip, lzo, lz4, xz or zstd. A level can be given for gzip and lzo (1-9) and zstd (1-22)." value-name:"COMPRESSOR[:LEVEL]" default:"gzip"`
+	CloudInitUserData      string   `long:"cloud-init-user-data" description:"Embed this user-data file in a cloud-init NoCloud seed. It must be a script starting with #! or valid cloud-config starting with #cloud-config." value-name:"FILE"`
+	CloudInitMetaData      string   `long:"cloud-init-meta-data" description:"Embed this meta-data file in the cloud-init NoCloud seed. An empty meta-data is used if not given." value-name:"FILE"`
+	CloudInitNetworkConfig string   `long:"cloud-init-network-config" description:"Embed this network-config file in the cloud-init NoCloud seed." value-name:"FILE"`
+	CloudInitSeedPartition string   `long:"cloud-init-seed-partition" description:"Write the cloud-init NoCloud seed to this partition of gadget.yaml, which must have a filesystem labelled cidata, instead of /var/lib/cloud/seed/nocloud-net in the rootfs." value-name:"PARTITION"`
+	ExtraPackages          []string `long:"extra-package" description:"Install this package in the rootfs, in addition to the extra-packages of the image definition. Can be given several times." value-name:"PACKAGE"`
+	ExtraPPAs              []string `long:"extra-ppa" description:"Add this public PPA to the rootfs, in addition to the extra-ppas of the image definition. It replaces a PPA of the same name in the image definition. Can be given several times." value-name:"USER/PPA"`
+	NoInstallRecommends    bool     `long:"no-install-recommends" description:"Do not install the packages recommended by the packages installed in the rootfs, unless install-recommends is set for an extra package of the image definition."`
+	NoInstallSuggests      bool     `long:"no-install-suggests" description:"Do not install the packages suggested by the packages installed in the rootfs, unless install-suggests is set for an extra package of the image definition."`
+	NoAutoDeps             bool     `long:"no-auto-deps" description:"Do not add the bases, the default providers of the content plugs and the snapd snap needed by the seeded snaps. The build fails if one of them is not listed instead."`
+	SkipUserDataValidation bool     `long:"skip-userdata-validation" description:"Do not validate the user-data passed with --cloud-init-user-data, neither its format nor against the cloud-init schema."`
+	Unprivileged           bool     `long:"unprivileged" description:"Build the image without root privileges. ubuntu-image runs as root in a user namespace, which needs unshare from util-linux 2.38 or later and a range of subordinate IDs for the user in /etc/subuid and /etc/subgid. Implies --no-loop."`
+	NoLoop                 bool     `long:"no-loop" description:"Do not use loop devices, which can not be set up on some CI systems. The bootloader is configured before the disk images are made and the partitions can not be encrypted. Without it, this is done when a loop device can not be set up to configure systemd-boot."`
+	Force                  bool     `long:"force" description:"Build the image even if the image definition, the options and the local files it is built from did not change since the last build to the same output directory."`
+	NoEnvExpand            bool     `long:"no-env-expand" description:"Do not replace the ${VAR} and ${VAR:-default} references of the image definition with the values of the environment variables, for image definitions containing them literally."`
+	ExtractKernel          bool     `long:"extract-kernel" description:"Copy the kernel and the initrd of the rootfs, the ones /boot/vmlinuz and /boot/initrd.img point to, to <name>.vmlinuz and <name>.initrd in the output directory once the rootfs is built, with <name> the name of the image definition."`
+	RootfsOnly             string   `long:"rootfs-only" description:"Only build the rootfs and write it to a rootfs tarball in the output directory, compressed with COMPRESSION, instead of making the disk images of the image definition. The compression defaults to gzip if not given." optional:"true" optional-value:"gzip" choice:"uncompressed" choice:"bzip2" choice:"gzip" choice:"xz" choice:"zstd" value-name:"COMPRESSION"`
 }
 
 type classicCommand struct {
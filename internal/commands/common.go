@@ -4,24 +4,68 @@ package commands
 
 // CommonOpts stores the options that are common to all image types
 type CommonOpts struct {
-	Debug      bool   `long:"debug" description:"Enable debugging output"`
-	Verbose    bool   `short:"v" long:"verbose" description:"Enable verbose output"`
-	Quiet      bool   `short:"q" long:"quiet" description:"Turn off all output"`
-	Size       string `short:"i" long:"image-size" description:"The suggested size of the generated disk image file. If this size is smaller than the minimum calculated size of the image a warning will be issued and --image-size will be ignored. The value is the size in bytes, with allowable suffixes \"M\" for MiB and \"G\" for GiB. Use an extended syntax to define the suggested size for the disk images generated by a multi-volume gadget.yaml spec" value-name:"SIZE"`
-	DiskInfo   string `long:"disk-info" description:"File to be used as .disk/info on the image's rootfs. This file can contain useful information about the target image, like image identification data, system name, build timestamp etc." value-name:"DISK-INFO-CONTENTS"`
-	OutputDir  string `short:"O" long:"output-dir" description:"The directory in which to put generated disk image files. For snap builds, the disk image files themselves will be named <volume>.img inside this directory, where <volume> is the volume name taken from the gadget.yaml file. For classic builds, the disk image files themselves will be named based on the image definition inside this directory. The output dir will default to the value of --workdir if --workdir is specified and --output-dir is not. If neither --output-dir or --workdir is used, the images will be placed in the current working directory." value-name:"DIRECTORY"`
-	Version    bool   `long:"version" description:"Print the version number of ubuntu-image and exit"`
-	Channel    string `short:"c" long:"channel" description:"The default snap channel to use" value-name:"CHANNEL"`
-	SectorSize string `long:"sector-size" description:"Sector size to use when creating the disk image. Only 512 and 4k sector sizes are supported." choice:"512" choice:"4096" value-name:"SECTOR-SIZE" default:"512"`
-	Validation string `long:"validation" description:"Control whether validations should be ignored or enforced" choice:"ignore" choice:"enforce"`
+	Debug             bool   `long:"debug" description:"Enable debugging output"`
+	Verbose           bool   `short:"v" long:"verbose" description:"Enable verbose output"`
+	DebugCommands     bool   `long:"debug-commands" description:"Print every external command run by the states, with its arguments, before running it, and stream its output. Credentials in the arguments, like passwords and the user information of URLs, are redacted."`
+	Quiet             bool   `short:"q" long:"quiet" description:"Turn off all output"`
+	Size              string `short:"i" long:"image-size" description:"The size of the generated disk image file, overriding the minimum calculated size. If this size is smaller than the minimum calculated size of the image, the build fails. The value is the size in bytes, with allowable suffixes \"M\" for MiB and \"G\" for GiB. Use an extended syntax to define the size of the disk images generated by a multi-volume gadget.yaml spec" value-name:"SIZE"`
+	DiskInfo          string `long:"disk-info" description:"File to be used as .disk/info on the image's rootfs. This file can contain useful information about the target image, like image identification data, system name, build timestamp etc." value-name:"DISK-INFO-CONTENTS"`
+	OutputDir         string `short:"O" long:"output-dir" description:"The directory in which to put generated disk image files. For snap builds, the disk image files themselves will be named <volume>.img inside this directory, where <volume> is the volume name taken from the gadget.yaml file. For classic builds, the disk image files themselves will be named based on the image definition inside this directory. The output dir will default to the value of --workdir if --workdir is specified and --output-dir is not. If neither --output-dir or --workdir is used, the images will be placed in the current working directory. It is created if it does not exist, and the other final artifacts, like manifests and checksums, are written to it as well." value-name:"DIRECTORY"`
+	Version           bool   `long:"version" description:"Print the version number of ubuntu-image and exit"`
+	Channel           string `short:"c" long:"channel" description:"The default snap channel to use" value-name:"CHANNEL"`
+	ForceChannel      bool   `long:"force-channel" description:"Use the channel given with --channel for all the snaps, even the ones whose channel is given with --snap or in the image definition. The snaps pinned to a revision are not changed. Requires --channel."`
+	SectorSize        string `long:"sector-size" description:"Sector size to use when creating the disk image. Only 512 and 4k sector sizes are supported." choice:"512" choice:"4096" value-name:"SECTOR-SIZE" default:"512"`
+	DeterministicUUID string `long:"deterministic-uuid" description:"Derive the UUIDs of the ext4 and vfat filesystems that gadget.yaml doesn't set a filesystem-uuid for from SEED, instead of using random ones, so that they are the same for every build. The GUIDs of the partition tables are derived from SEED too. With SOURCE_DATE_EPOCH as SEED, the value of the SOURCE_DATE_EPOCH environment variable is used" value-name:"SEED"`
+	HybridMBR         bool   `long:"hybrid-mbr" description:"Write a hybrid MBR instead of a protective MBR along with the GPT of the disk images, referencing their EFI system and BIOS boot partitions, so that the images boot with both UEFI and legacy BIOS"`
+	NoSparse          bool   `long:"no-sparse" description:"Write the disk images with all of their blocks allocated, instead of as sparse files in which the blocks of zeros take no space on disk, for the filesystems and tools that don't support sparse files"`
+	Validation        string `long:"validation" description:"Control whether validations should be ignored or enforced" choice:"ignore" choice:"enforce"`
+	DownloadRetries   int    `long:"download-retries" description:"The number of times a snap store request is retried when it fails with a transient error, like a network error or a 5xx response. The delay between retries starts at one second and doubles every time." value-name:"N" default:"3"`
+	ParallelDownloads int    `long:"parallel-downloads" description:"The maximum number of snap store requests to run at the same time while staging the snaps in the image" value-name:"N" default:"4"`
+	LogFormat         string `long:"log-format" description:"The format of the messages printed while the state machine runs. With json, one JSON object is printed for each state that was run, including the ones that failed." choice:"text" choice:"json" value-name:"FORMAT" default:"text"`
+	Color             string `long:"color" description:"Whether to color the human-readable output, like the states being run, the warnings, the errors and the progress bars. With auto, the output is colored when it goes to a terminal and the NO_COLOR environment variable is not set. The output of --log-format json is never colored." choice:"auto" choice:"always" choice:"never" value-name:"WHEN" default:"auto"`
+	SnapDir           string `long:"snap-dir" description:"A directory of snap files and assertions, as downloaded with \"snap download\". The snaps found in it are used instead of downloading them from the store." value-name:"DIRECTORY"`
+	SnapSnapshot      string `long:"snap-snapshot" description:"A JSON file mapping the names of the snaps to the revision the store served for their channel, like {\"core22\": 1033}. The snaps are taken from --snap-dir, which is required, at the revision of the snapshot instead of the one the store serves, and every snap of the image, including the bases and default providers, must be listed by it." value-name:"PATH"`
+	Offline           bool   `long:"offline" description:"Build without any network access. All the snaps, and their assertions, are taken from --snap-dir, which is required."`
+	AllowBaseMismatch bool   `long:"allow-base-mismatch" description:"Only warn about the seeded snaps whose base is not one of the bases of the model, instead of failing the build. The image may not boot, or its snaps may not run."`
+	EventSocket       string `long:"event-socket" description:"The path of a Unix domain socket to which an event is sent, as a line of JSON, every time a state starts or finishes. Events are dropped when nothing listens on the socket." value-name:"PATH"`
+	StatusAddr        string `long:"status-addr" description:"Serve the status of the build as JSON over HTTP on the TCP address ADDRESS, like :8080, while it runs: the state being run, the time elapsed since the build started and the last lines logged for the states. The endpoint stops when the build ends." value-name:"ADDRESS"`
+	Manifest          bool   `long:"manifest" description:"Write a build manifest listing every installed deb package with its version and every seeded snap with its revision and channel. It is named after the first disk image, with a .manifest suffix, in the output directory."`
+	ManifestPath      string `long:"manifest-path" description:"The path of the build manifest. Implies --manifest." value-name:"PATH"`
+	ResultFile        string `long:"result-file" description:"The path of the machine-readable result of the build, written once the build has succeeded or failed. Defaults to build-result.json in the output directory." value-name:"PATH"`
+	SummaryJSON       string `long:"summary-json" description:"Write a JSON summary of a successful build to PATH, for release tooling: the artifacts with their size and sha256 checksum, the number of seeded snaps and installed deb packages, and the duration of the build. The summary has a schema-version, which is increased when a field is changed or removed." value-name:"PATH"`
+	Checksum          string `long:"checksum" description:"Write a <ALGORITHM>SUMS file listing the checksums of all the generated disk image files to the output directory. The algorithm defaults to sha256 if not given." optional:"true" optional-value:"sha256" choice:"sha256" choice:"sha512" value-name:"ALGORITHM"`
+	Compress          string `long:"compress" description:"Compress the raw disk image files once they are assembled, optionally with a compression level. The compressor can be one of gzip (level 1-9), xz (level 0-9) or zstd (level 1-19). The uncompressed images are removed unless --debug is given, and checksums are calculated on the compressed images." value-name:"COMPRESSOR[:LEVEL]"`
+	CompressThreads   int    `long:"compress-threads" description:"The number of threads used to compress the disk images with xz or zstd. 0 uses as many threads as there are CPU cores." value-name:"THREADS"`
+	SignKey           string `long:"sign-key" description:"Sign the disk image files, and the checksum file of --checksum, with the GPG key KEYID once they are in their final format, including the compression of --compress. A detached ASCII armored signature is written next to each file, with an .asc suffix. gpg uses its default keyring, or the one of the GNUPGHOME environment variable. The build fails if a file can not be signed." value-name:"KEYID"`
+	OutputDevice      string `long:"output-device" description:"Write the disk image to the block device DEVICE, like /dev/sdb, once it is assembled, and read it back to verify it. The device must be removable, unless --force-device is given, and none of its partitions can be mounted. Only a single disk image can be written, before it is compressed with --compress." value-name:"DEVICE"`
+	ForceDevice       bool   `long:"force-device" description:"Write the disk image to the device given with --output-device even if it is not removable. Requires --output-device."`
+	Measure           string `long:"measure" description:"Predict the value of PCR 4 once a UEFI machine boots the image, from the Authenticode digests of the EFI application of the removable media boot path of the ESP, the grub it loads and the kernel, and write it with the measured events to FILENAME as JSON. This is a best effort prediction of the common shim and grub boot path." value-name:"FILENAME"`
+	VerifyFS          bool   `long:"verify-fs" description:"Check the filesystems of the partition images once they are populated, with e2fsck for ext4 and fsck.vfat for vfat, and fail the build if any error is found."`
+	HTTPProxy         string `long:"http-proxy" description:"The proxy used for HTTP requests, including the snap store and apt in the chroot of classic images. Defaults to the value of the HTTP_PROXY environment variable." value-name:"URL"`
+	HTTPSProxy        string `long:"https-proxy" description:"The proxy used for HTTPS requests, including the snap store and apt in the chroot of classic images. Defaults to the value of the HTTPS_PROXY environment variable." value-name:"URL"`
+	NoProxy           string `long:"no-proxy" description:"A comma separated list of hosts that are reached without going through the proxy. Defaults to the value of the NO_PROXY environment variable." value-name:"HOSTS"`
+	TmpDir            string `long:"tmp-dir" description:"The existing directory in which the large temporary files of the build, like the staged squashfs and the mount points of the loop devices, are created, instead of /tmp. It is also the TMPDIR of the commands the build runs, and the temporary directory created in it is removed once the build ends. Without --workdir, the temporary working directory is created in it too." value-name:"DIRECTORY"`
+	PostBuildHook     string `long:"post-build-hook" description:"A shell command run once the build has succeeded and the state machine is torn down. The type of image and the paths of the artifacts are passed in UBUNTU_IMAGE_* environment variables. The build fails if the command exits with a non-zero status." value-name:"COMMAND"`
+	OnFailureHook     string `long:"on-failure-hook" description:"A shell command run once the build has failed or was cancelled, with the same environment variables as --post-build-hook, as well as the failed state and its error." value-name:"COMMAND"`
 }
 
 // StateMachineOpts stores the options that are related to the state machine
 type StateMachineOpts struct {
-	WorkDir string `short:"w" long:"workdir" description:"The working directory in which to download and unpack all the source files for the image. This directory can exist or not, and it is not removed after this program exits. If not given, a temporary working directory is used instead, which *is* deleted after this program exits. Use -w if you want to be able to resume a partial state machine run." value-name:"DIRECTORY" group:"State Machine Options" default:""`
-	Until   string `short:"u" long:"until" description:"Run the state machine until the given STEP, non-inclusively. STEP must be the name of the step." value-name:"STEP" default:""`
-	Thru    string `short:"t" long:"thru" description:"Run the state machine through the given STEP, inclusively. STEP must be the name of the step." value-name:"STEP" default:""`
-	Resume  bool   `short:"r" long:"resume" description:"Continue the state machine from the previously saved state. It is an error if there is no previous state."`
+	WorkDir           string `short:"w" long:"workdir" description:"The working directory in which to download and unpack all the source files for the image. This directory can exist or not, and it is not removed after this program exits. If not given, a temporary working directory is used instead, which *is* deleted after this program exits successfully, and kept when the build fails so that it can be inspected. Use -w if you want to be able to resume a partial state machine run." value-name:"DIRECTORY" group:"State Machine Options" default:""`
+	Until             string `short:"u" long:"until" description:"Run the state machine until the given STEP, non-inclusively. STEP must be the name of the step." value-name:"STEP" default:""`
+	Thru              string `short:"t" long:"thru" description:"Run the state machine through the given STEP, inclusively. STEP must be the name of the step." value-name:"STEP" default:""`
+	Resume            bool   `short:"r" long:"resume" description:"Continue the state machine from the previously saved state. It is an error if there is no previous state."`
+	ResumeFrom        string `long:"resume-from" description:"Continue the state machine from the previously saved state, starting again at the given STEP. STEP must be the name of a step that was already reached in the saved run." value-name:"STEP" default:""`
+	StateFile         string `long:"state-file" description:"The file the state of the state machine is saved to when it stops, and read from with --resume or --resume-from. Defaults to ubuntu-image.gob in the working directory." value-name:"PATH" default:""`
+	ValidateOnly      bool   `long:"validate-only" description:"Only run the steps needed to get the gadget.yaml file, validate it, and exit. All the problems found in gadget.yaml are reported at once."`
+	KeepWorkDir       bool   `long:"keep-work-dir" description:"Keep the temporary working directory even if the build succeeds. Its path is printed at the end of the build."`
+	DryRun            bool   `long:"dry-run" description:"Print the states the state machine would run, in order, and exit without building anything. The image definition is still parsed and validated. Can be combined with --until and --thru."`
+	ListStates        bool   `long:"list-states" description:"Print every state of the state machine for this image, in order, followed by whether it is reachable with the given --until and --thru, and exit without building anything."`
+	ListSnapsResolved bool   `long:"list-snaps-resolved" description:"Print the revision, channel and base that the store resolves for every snap of the image, and exit without downloading the snaps or building anything. For classic images, the snaps of the seeds are not listed."`
+	PrintConfig       bool   `long:"print-config" description:"Print the configuration the image would be built with as YAML, and exit without building anything: the options, including the defaults they take from other options or from the environment, the environment variables changing the build and, for classic images, the image definition as it is parsed, with its defaults and the customizations of the command line applied. Credentials are redacted."`
+	StateTimeout      string `long:"state-timeout" description:"Fail the build when a single state runs for longer than DURATION, like 30m or 1h30m, killing the external commands it is running. The state machine is torn down as for any other failure." value-name:"DURATION"`
+	RetryBuild        int    `long:"retry-build" description:"Run the build again from the beginning, in a clean working directory, up to N times when it fails with an error that is likely to go away, like a network error. Errors that would happen again, like an invalid image definition, fail the build right away." value-name:"N"`
+	RetryAnyError     bool   `long:"retry-any-error" description:"With --retry-build, run the build again whatever the error it failed with."`
 }
 
 // UbuntuImageCommand is needed for the parser to store positional arguments and flags
@@ -7,14 +7,17 @@ type SnapArgs struct {
 
 // SnapOpts holds all flags that are specific to the snap command
 type SnapOpts struct {
-	DisableConsoleConf        bool           `long:"disable-console-conf" description:"Disable console-conf on the resulting image."`
-	FactoryImage              bool           `long:"factory-image" description:"Hint that the image is meant to boot in a device factory."`
-	Preseed                   bool           `long:"preseed" description:"Pressed the image (UC20 only)."`
-	AppArmorKernelFeaturesDir string         `long:"apparmor-features-dir" description:"Optional path to apparmor kernel features directory"`
-	PreseedSignKey            string         `long:"preseed-sign-key" description:"Name of the key to use to sign preseed assertion, otherwise use the default key"`
-	Snaps                     []string       `long:"snap" description:"Install extra snaps. These are passed through to \"snap prepare-image\". The snap argument can include additional information about the channel and/or risk with the following syntax: <snap>=<channel|risk>" value-name:"SNAP"`
-	CloudInit                 string         `long:"cloud-init" description:"cloud-config data to be copied to the image" value-name:"USER-DATA-FILE"`
-	Revisions                 map[string]int `long:"revision" description:"The revision of a specific snap to install in the image." value-name:"REVISION"`
+	DisableConsoleConf        bool              `long:"disable-console-conf" description:"Disable console-conf on the resulting image."`
+	FactoryImage              bool              `long:"factory-image" description:"Hint that the image is meant to boot in a device factory."`
+	Preseed                   bool              `long:"preseed" description:"Pressed the image (UC20 only)."`
+	AppArmorKernelFeaturesDir string            `long:"apparmor-features-dir" description:"Optional path to apparmor kernel features directory"`
+	PreseedSignKey            string            `long:"preseed-sign-key" description:"Name of the key to use to sign preseed assertion, otherwise use the default key"`
+	Snaps                     []string          `long:"snap" description:"Install extra snaps. These are passed through to \"snap prepare-image\". The snap argument can include additional information about the channel and/or risk with the following syntax: <snap>=<channel|risk>. Use <snap>=rev:<revision> to install an exact revision of the snap instead" value-name:"SNAP"`
+	Store                     string            `long:"store" description:"The ID of the brand store the image is built for. It must be the store of the model assertion, which the snaps are downloaded from." value-name:"STORE-ID"`
+	CloudInit                 string            `long:"cloud-init" description:"cloud-config data to be copied to the image" value-name:"USER-DATA-FILE"`
+	Revisions                 map[string]int    `long:"revision" description:"The revision of a specific snap to install in the image." value-name:"REVISION"`
+	Cohorts                   map[string]string `long:"cohort" description:"The cohort key of a specific snap, to install the revision the store serves to the cohort." value-name:"SNAP_NAME:COHORT_KEY"`
+	BaseSnap                  string            `long:"base-snap" description:"Seed the base snap from another channel or revision, to test a new base without changing the model. The argument has the syntax of --snap: <base>=<channel|rev:revision>. The base must be the base of the model, or a base snap the model lists." value-name:"BASE"`
 }
 
 type snapCommand struct {
@@ -3,13 +3,17 @@ package helper
 import (
 	"bytes"
 	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/canonical/ubuntu-image/internal/commands"
 	"github.com/invopop/jsonschema"
@@ -46,6 +50,7 @@ func InitCommonOpts() (*commands.CommonOpts, *commands.StateMachineOpts) {
 	// go-flags makes sure that the option has a sane value at all times, but
 	// for tests we'd have to set it manually all the time.
 	commonOpts.SectorSize = "512"
+	commonOpts.ParallelDownloads = 4
 	return commonOpts, new(commands.StateMachineOpts)
 }
 
@@ -69,26 +74,31 @@ func SaveCWD() func() {
 	}
 }
 
+// RunCommandFunc runs a command prepared by the helpers and waits for it to exit,
+// like exec.Cmd.Run. It lets the callers print or cancel the commands
+type RunCommandFunc func(*exec.Cmd) error
+
 // Du recurses through a directory similar to du and adds all the sizes of files together
-func Du(path string) (quantity.Size, error) {
+func Du(runCommand RunCommandFunc, path string) (quantity.Size, error) {
 	duCommand := *exec.Command("du", "-s", "-B1")
 	duCommand.Args = append(duCommand.Args, path)
 
-	duBytes, err := duCommand.Output()
-	if err != nil {
+	var duBytes bytes.Buffer
+	duCommand.Stdout = &duBytes
+	if err := runCommand(&duCommand); err != nil {
 		return quantity.Size(0), err
 	}
-	sizeString := strings.Split(string(duBytes), "\t")[0]
+	sizeString := strings.Split(duBytes.String(), "\t")[0]
 	size, err := quantity.ParseSize(sizeString)
 	return size, err
 }
 
 // CopyBlob runs `dd` to copy a blob to an image file
-func CopyBlob(ddArgs []string) error {
+func CopyBlob(runCommand RunCommandFunc, ddArgs []string) error {
 	ddCommand := *exec.Command("dd")
 	ddCommand.Args = append(ddCommand.Args, ddArgs...)
 
-	if err := ddCommand.Run(); err != nil {
+	if err := runCommand(&ddCommand); err != nil {
 		return fmt.Errorf("Command \"%s\" returned with %s", ddCommand.String(), err.Error())
 	}
 	return nil
@@ -96,7 +106,7 @@ func CopyBlob(ddArgs []string) error {
 
 // SetDefaults iterates through the keys in a struct and sets
 // default values if one is specified with a struct tag of "default".
-// Currently only default values of strings, slice of strings, and
+// Currently only default values of strings, slice of strings, ints and
 // bools are supported
 func SetDefaults(needsDefaults interface{}) error {
 	value := reflect.ValueOf(needsDefaults)
@@ -109,9 +119,9 @@ func SetDefaults(needsDefaults interface{}) error {
 		// if we're dealing with a slice of pointers to structs,
 		// iterate through it and set the defaults for each struct pointer
 		if field.Type().Kind() == reflect.Slice &&
-			field.Cap() > 0 &&
+			field.Len() > 0 &&
 			field.Index(0).Kind() == reflect.Pointer {
-			for i := 0; i < field.Cap(); i++ {
+			for i := 0; i < field.Len(); i++ {
 				SetDefaults(field.Index(i).Interface())
 			}
 		} else if field.Type().Kind() == reflect.Ptr {
@@ -134,6 +144,14 @@ func SetDefaults(needsDefaults interface{}) error {
 						defaultValues := strings.Split(defaultValue, ",")
 						field.Set(reflect.ValueOf(defaultValues))
 						break
+					case reflect.Int:
+						intValue, err := strconv.Atoi(defaultValue)
+						if err != nil {
+							return fmt.Errorf("Invalid default value \"%s\" for integer field %s",
+								defaultValue, elem.Type().Field(i).Name)
+						}
+						field.SetInt(int64(intValue))
+						break
 					case reflect.Bool:
 						if defaultValue == "true" {
 							field.SetBool(true)
@@ -169,7 +187,7 @@ func CheckEmptyFields(Interface interface{}, result *gojsonschema.Result, schema
 		// it and search for missing required fields in each
 		// element of the slice
 		if field.Type().Kind() == reflect.Slice {
-			for i := 0; i < field.Cap(); i++ {
+			for i := 0; i < field.Len(); i++ {
 				sliceElem := field.Index(i)
 				if sliceElem.Kind() == reflect.Ptr && sliceElem.Elem().Kind() == reflect.Struct {
 					err := CheckEmptyFields(sliceElem.Interface(), result, schema)
@@ -270,6 +288,58 @@ func SetCommandOutput(cmd *exec.Cmd, liveOutput bool) (cmdOutput *bytes.Buffer)
 	return cmdOutput
 }
 
+// SourceDateEpoch returns the time set in the SOURCE_DATE_EPOCH environment variable,
+// with which builds are reproducible, and whether it is set at all
+func SourceDateEpoch() (time.Time, bool, error) {
+	value := os.Getenv("SOURCE_DATE_EPOCH")
+	if value == "" {
+		return time.Time{}, false, nil
+	}
+	epoch, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || epoch < 0 {
+		return time.Time{}, false, fmt.Errorf("SOURCE_DATE_EPOCH must be a number of seconds "+
+			"since the Unix epoch, got \"%s\"", value)
+	}
+	return time.Unix(epoch, 0).UTC(), true, nil
+}
+
+// ANSI escape sequences of the colors used in the human-readable output
+const (
+	ColorBold   = "\033[1m"
+	ColorRed    = "\033[31m"
+	ColorGreen  = "\033[32m"
+	ColorYellow = "\033[33m"
+	colorReset  = "\033[0m"
+)
+
+// StdoutIsTerminal reports whether stdout is a terminal rather than a file or a pipe
+func StdoutIsTerminal() bool {
+	stdoutInfo, err := os.Stdout.Stat()
+	return err == nil && stdoutInfo.Mode()&os.ModeCharDevice != 0
+}
+
+// UseColor reports whether the output is colored for the value of --color. With
+// auto, the default, it is only colored on terminals, and never when the NO_COLOR
+// environment variable is set to a non-empty value. always and never override both
+func UseColor(mode string, isTerminal bool) bool {
+	switch mode {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	return isTerminal && os.Getenv("NO_COLOR") == ""
+}
+
+// Colorize wraps text in the ANSI escape sequence of color when enabled is true,
+// and returns it unchanged otherwise
+func Colorize(enabled bool, color, text string) string {
+	if !enabled || text == "" {
+		return text
+	}
+	return color + text + colorReset
+}
+
 // SafeQuantitySubtraction subtracts quantities while checking for integer underflow
 func SafeQuantitySubtraction(orig, subtract quantity.Size) quantity.Size {
 	if subtract > orig {
@@ -281,7 +351,7 @@ func SafeQuantitySubtraction(orig, subtract quantity.Size) quantity.Size {
 // CreateTarArchive places all of the files from a source directory into a tar.
 // Currently supported are uncompressed tar archives and the following
 // compression types: zip, gzip, xz bzip2, zstd
-func CreateTarArchive(src, dest, compression string, verbose, debug bool) error {
+func CreateTarArchive(runCommand RunCommandFunc, src, dest, compression string, verbose, debug bool) error {
 	tarCommand := *exec.Command(
 		"tar",
 		"--directory",
@@ -296,6 +366,20 @@ func CreateTarArchive(src, dest, compression string, verbose, debug bool) error
 	if debug {
 		tarCommand.Args = append(tarCommand.Args, "--verbose")
 	}
+	// make the archive reproducible: the entries are in a stable order and
+	// none of them is more recent than SOURCE_DATE_EPOCH
+	sourceDateEpoch, isSet, err := SourceDateEpoch()
+	if err != nil {
+		return err
+	}
+	if isSet {
+		tarCommand.Args = append(tarCommand.Args,
+			"--sort=name",
+			fmt.Sprintf("--mtime=@%d", sourceDateEpoch.Unix()),
+			"--clamp-mtime",
+			"--pax-option=exthdr.name=%d/PaxHeaders/%f,delete=atime,delete=ctime",
+		)
+	}
 	// set up any compression arguments
 	switch compression {
 	case "uncompressed":
@@ -304,7 +388,12 @@ func CreateTarArchive(src, dest, compression string, verbose, debug bool) error
 		tarCommand.Args = append(tarCommand.Args, "--bzip2")
 		break
 	case "gzip":
-		tarCommand.Args = append(tarCommand.Args, "--gzip")
+		if isSet {
+			// gzip stores the time it compresses a stream at in its header
+			tarCommand.Args = append(tarCommand.Args, "--use-compress-program=gzip --no-name")
+		} else {
+			tarCommand.Args = append(tarCommand.Args, "--gzip")
+		}
 		break
 	case "xz":
 		tarCommand.Args = append(tarCommand.Args, "--xz")
@@ -317,7 +406,7 @@ func CreateTarArchive(src, dest, compression string, verbose, debug bool) error
 	}
 
 	tarOutput := SetCommandOutput(&tarCommand, debug)
-	if err := tarCommand.Run(); err != nil {
+	if err := runCommand(&tarCommand); err != nil {
 		return fmt.Errorf("Error running \"tar\" command \"%s\". "+
 			"Error is \"%s\". Full output below:\n%s",
 			tarCommand.String(), err.Error(), tarOutput.String())
@@ -328,7 +417,7 @@ func CreateTarArchive(src, dest, compression string, verbose, debug bool) error
 // ExtractTarArchive extracts all the files from a tar. Currently supported are
 // uncompressed tar archives and the following compression types: zip, gzip, xz
 // bzip2, zstd
-func ExtractTarArchive(src, dest string, verbose, debug bool) error {
+func ExtractTarArchive(runCommand RunCommandFunc, src, dest string, verbose, debug bool) error {
 	tarCommand := *exec.Command(
 		"tar",
 		"--xattrs",
@@ -343,7 +432,7 @@ func ExtractTarArchive(src, dest string, verbose, debug bool) error {
 		tarCommand.Args = append(tarCommand.Args, "--verbose")
 	}
 	tarOutput := SetCommandOutput(&tarCommand, debug)
-	if err := tarCommand.Run(); err != nil {
+	if err := runCommand(&tarCommand); err != nil {
 		return fmt.Errorf("Error running \"tar\" command \"%s\". "+
 			"Error is \"%s\". Full output below:\n%s",
 			tarCommand.String(), err.Error(), tarOutput.String())
@@ -365,7 +454,25 @@ func CalculateSHA256(fileName string) (string, error) {
 		return "", fmt.Errorf("Error calculating SHA256 sum of file \"%s\": \"%s\"", fileName, err.Error())
 	}
 
-	return string(hasher.Sum(nil)), nil
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// CalculateChecksum calculates the hex encoded checksum of the file provided
+// as an argument using the hash returned by newHash
+func CalculateChecksum(fileName string, newHash func() hash.Hash) (string, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return "", fmt.Errorf("Error opening file \"%s\" to calculate checksum: \"%s\"", fileName, err.Error())
+	}
+	defer f.Close()
+
+	hasher := newHash()
+	_, err = io.Copy(hasher, f)
+	if err != nil {
+		return "", fmt.Errorf("Error calculating checksum of file \"%s\": \"%s\"", fileName, err.Error())
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
 
 // CheckTags iterates through the keys in a struct and looks for
@@ -383,9 +490,9 @@ func CheckTags(searchStruct interface{}, tag string) (string, error) {
 		// if we're dealing with a slice of pointers to structs,
 		// iterate through it and check the tags for each struct pointer
 		if field.Type().Kind() == reflect.Slice &&
-			field.Cap() > 0 &&
+			field.Len() > 0 &&
 			field.Index(0).Kind() == reflect.Pointer {
-			for i := 0; i < field.Cap(); i++ {
+			for i := 0; i < field.Len(); i++ {
 				tagUsed, err := CheckTags(field.Index(i).Interface(), tag)
 				if err != nil {
 					return "", err
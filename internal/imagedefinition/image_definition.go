@@ -5,7 +5,9 @@ image definition that will be parsed from a YAML file.
 package imagedefinition
 
 import (
+	"encoding/csv"
 	"fmt"
+	"os"
 	"strings"
 
 	"github.com/xeipuuv/gojsonschema"
@@ -20,21 +22,24 @@ type ImageDefinition struct {
 	Architecture   string         `yaml:"architecture"    json:"Architecture"`
 	Series         string         `yaml:"series"          json:"Series"`
 	Kernel         string         `yaml:"kernel"          json:"Kernel,omitempty"`
+	KernelCmdline  string         `yaml:"kernel-cmdline"  json:"KernelCmdline,omitempty"`
 	Gadget         *Gadget        `yaml:"gadget"          json:"Gadget,omitempty"`
 	ModelAssertion string         `yaml:"model-assertion" json:"ModelAssertion,omitempty" jsonschema:"type=string,format=uri"`
 	Rootfs         *Rootfs        `yaml:"rootfs"          json:"Rootfs"`
 	Customization  *Customization `yaml:"customization"   json:"Customization,omitempty"`
+	Recovery       *Recovery      `yaml:"recovery"        json:"Recovery,omitempty"`
 	Artifacts      *Artifact      `yaml:"artifacts"       json:"Artifacts"`
 	Class          string         `yaml:"class"           json:"Class"                    jsonschema:"enum=preinstalled,enum=cloud,enum=installer"`
 }
 
 // Gadget defines the gadget section of the image definition file
 type Gadget struct {
-	Ref          string `yaml:"ref"    json:"Ref,omitempty"`
-	GadgetTarget string `yaml:"target" json:"GadgetTarget,omitempty"`
-	GadgetBranch string `yaml:"branch" json:"GadgetBranch,omitempty"`
-	GadgetType   string `yaml:"type"   json:"GadgetType"             jsonschema:"enum=git,enum=directory,enum=prebuilt"`
-	GadgetURL    string `yaml:"url"    json:"GadgetURL,omitempty"    jsonschema:"type=string,format=uri"`
+	Ref          string `yaml:"ref"       json:"Ref,omitempty"`
+	GadgetTarget string `yaml:"target"    json:"GadgetTarget,omitempty"`
+	GadgetBranch string `yaml:"branch"    json:"GadgetBranch,omitempty"`
+	GadgetType   string `yaml:"type"      json:"GadgetType"             jsonschema:"enum=git,enum=directory,enum=tarball,enum=prebuilt"`
+	GadgetURL    string `yaml:"url"       json:"GadgetURL,omitempty"    jsonschema:"type=string,format=uri"`
+	SHA256sum    string `yaml:"sha256sum" json:"SHA256sum,omitempty"    jsonschema:"minLength=64,maxLength=64"`
 }
 
 // Rootfs defines the rootfs section of the image definition file
@@ -66,17 +71,38 @@ type Tarball struct {
 	SHA256sum  string `yaml:"sha256sum" json:"SHA256sum,omitempty" jsonschema:"minLength=64,maxLength=64"`
 }
 
+// Recovery defines the recovery system of the image, which is seeded from a
+// model assertion of its own to the structure of gadget.yaml marked as recovery
+type Recovery struct {
+	ModelAssertion string  `yaml:"model-assertion" json:"ModelAssertion"       jsonschema:"type=string,format=uri"`
+	Channel        string  `yaml:"channel"         json:"Channel,omitempty"`
+	ExtraSnaps     []*Snap `yaml:"extra-snaps"     json:"ExtraSnaps,omitempty"`
+}
+
 // Customization defines the customization section of the image definition file.
 // The extra_step_prebuilt_rootfs struct tag denotes that an extra state will
 // need to be added for image builds with prebuilt root filesystems.
 type Customization struct {
-	Installer     *Installer `yaml:"installer"      json:"Installer,omitempty"`
-	CloudInit     *CloudInit `yaml:"cloud-init"     json:"CloudInit,omitempty"`
-	ExtraPPAs     []*PPA     `yaml:"extra-ppas"     json:"ExtraPPAs,omitempty"     extra_step_prebuilt_rootfs:"add_extra_ppas"`
-	ExtraPackages []*Package `yaml:"extra-packages" json:"ExtraPackages,omitempty" extra_step_prebuilt_rootfs:"install_extra_packages"`
-	ExtraSnaps    []*Snap    `yaml:"extra-snaps"    json:"ExtraSnaps,omitempty"    extra_step_prebuilt_rootfs:"install_extra_snaps"`
-	Fstab         []*Fstab   `yaml:"fstab"          json:"Fstab,omitempty"`
-	Manual        *Manual    `yaml:"manual"         json:"Manual,omitempty"`
+	Installer           *Installer            `yaml:"installer"            json:"Installer,omitempty"`
+	CloudInit           *CloudInit            `yaml:"cloud-init"           json:"CloudInit,omitempty"`
+	ExtraPPAs           []*PPA                `yaml:"extra-ppas"           json:"ExtraPPAs,omitempty"           extra_step_prebuilt_rootfs:"add_extra_ppas"`
+	ExtraSources        []*AptSource          `yaml:"extra-sources"        json:"ExtraSources,omitempty"        extra_step_prebuilt_rootfs:"add_extra_sources"`
+	AptPins             []*AptPin             `yaml:"apt-pins"             json:"AptPins,omitempty"             extra_step_prebuilt_rootfs:"add_apt_pins"`
+	RemovePackages      []string              `yaml:"remove-packages"      json:"RemovePackages,omitempty"      extra_step_prebuilt_rootfs:"remove_packages"`
+	ExtraPackages       []*Package            `yaml:"extra-packages"       json:"ExtraPackages,omitempty"       extra_step_prebuilt_rootfs:"install_extra_packages"`
+	ExtraSnaps          []*Snap               `yaml:"extra-snaps"          json:"ExtraSnaps,omitempty"          extra_step_prebuilt_rootfs:"install_extra_snaps"`
+	Fstab               []*Fstab              `yaml:"fstab"                json:"Fstab,omitempty"`
+	GenerateFstab       bool                  `yaml:"generate-fstab"       json:"GenerateFstab,omitempty"`
+	Timezone            string                `yaml:"timezone"             json:"Timezone,omitempty"            jsonschema:"pattern=^[A-Za-z0-9_+-]+(/[A-Za-z0-9_+-]+)*$"`
+	Locale              string                `yaml:"locale"               json:"Locale,omitempty"              jsonschema:"pattern=^[A-Za-z]+(_[A-Za-z]+)?([.][A-Za-z0-9-]+)?(@[A-Za-z0-9]+)?$"`
+	Hostname            string                `yaml:"hostname"             json:"Hostname,omitempty"`
+	MachineID           string                `yaml:"machine-id"           json:"MachineID,omitempty"           jsonschema:"pattern=^(clear|[0-9a-f]{32})$"`
+	Users               []*User               `yaml:"users"                json:"Users,omitempty"`
+	Strip               *Strip                `yaml:"strip"                json:"Strip,omitempty"`
+	Overlays            []*Overlay            `yaml:"overlays"             json:"Overlays,omitempty"`
+	Manual              *Manual               `yaml:"manual"               json:"Manual,omitempty"`
+	Plugins             []*Plugin             `yaml:"plugins"              json:"Plugins,omitempty"`
+	EncryptedPartitions []*EncryptedPartition `yaml:"encrypted-partitions" json:"EncryptedPartitions,omitempty"`
 }
 
 // Installer provides customization options specific to installer images
@@ -97,12 +123,42 @@ type PPA struct {
 	PPAName     string `yaml:"name"         json:"PPAName"               jsonschema:"pattern=^[a-zA-Z0-9_.+-]+/[a-zA-Z0-9_.+-]+$"`
 	Auth        string `yaml:"auth"         json:"Auth,omitempty"        jsonschema:"pattern=^[a-zA-Z0-9_.+-]+:[a-zA-Z0-9]+$"`
 	Fingerprint string `yaml:"fingerprint"  json:"Fingerprint,omitempty"`
-	KeepEnabled bool   `yaml:"keep-enabled" json:"KeepEnabled"           default:"true"`
+	KeepEnabled *bool  `yaml:"keep-enabled" json:"KeepEnabled,omitempty"`
 }
 
-// Package contains information about packages
+// IsKeptEnabled returns whether the PPA stays configured in the resulting image.
+// KeepEnabled is a pointer so that an explicit "false" can be told apart from
+// the field not being set, which defaults to keeping the PPA
+func (ppa *PPA) IsKeptEnabled() bool {
+	return ppa.KeepEnabled == nil || *ppa.KeepEnabled
+}
+
+// AptSource contains information about an additional apt repository,
+// like an internal mirror, and the key its packages are signed with
+type AptSource struct {
+	Name        string   `yaml:"name"         json:"Name"                 jsonschema:"pattern=^[a-zA-Z0-9_.+-]+$"`
+	URI         string   `yaml:"uri"          json:"URI"                  jsonschema:"type=string,format=uri"`
+	Suite       string   `yaml:"suite"        json:"Suite,omitempty"`
+	Components  []string `yaml:"components"   json:"Components,omitempty"`
+	SigningKey  string   `yaml:"signing-key"  json:"SigningKey,omitempty"`
+	KeepEnabled bool     `yaml:"keep-enabled" json:"KeepEnabled,omitempty"`
+}
+
+// AptPin holds a package at a version, which can be a glob like "1.2.*", or at the
+// versions of a release like "jammy-updates", with the given apt pin priority
+type AptPin struct {
+	PackageName string `yaml:"package"  json:"PackageName"`
+	Version     string `yaml:"version"  json:"Version,omitempty" jsonschema:"oneof_required=Version"`
+	Release     string `yaml:"release"  json:"Release,omitempty" jsonschema:"oneof_required=Release"`
+	Priority    int    `yaml:"priority" json:"Priority"          jsonschema:"type=integer" default:"1001"`
+}
+
+// Package contains information about packages. InstallRecommends and InstallSuggests
+// override --no-install-recommends and --no-install-suggests for this package
 type Package struct {
-	PackageName string `yaml:"name" json:"PackageName"`
+	PackageName       string `yaml:"name"               json:"PackageName"`
+	InstallRecommends *bool  `yaml:"install-recommends" json:"InstallRecommends,omitempty"`
+	InstallSuggests   *bool  `yaml:"install-suggests"   json:"InstallSuggests,omitempty"`
 }
 
 // Snap contains information about snaps
@@ -110,10 +166,12 @@ type Snap struct {
 	SnapName     string `yaml:"name"     json:"SnapName"`
 	SnapRevision int    `yaml:"revision" json:"SnapRevision,omitempty" jsonschema:"type=integer"`
 	Store        string `yaml:"store"    json:"Store"                  default:"canonical"`
-	Channel      string `yaml:"channel"  json:"Channel"                default:"stable"`
+	Channel      string `yaml:"channel"  json:"Channel,omitempty"`
+	Cohort       string `yaml:"cohort"   json:"Cohort,omitempty"`
 }
 
-// Manual provides manual customization options
+// Manual provides manual customization options. They are run by kind, in the order
+// of the fields, unless a customization is ordered after named ones with After
 type Manual struct {
 	CopyFile  []*CopyFile  `yaml:"copy-file"  json:"CopyFile,omitempty"`
 	Execute   []*Execute   `yaml:"execute"    json:"Execute,omitempty"`
@@ -122,6 +180,17 @@ type Manual struct {
 	AddUser   []*AddUser   `yaml:"add-user"   json:"AddUser,omitempty"`
 }
 
+// Plugin is an executable of the host run on the rootfs before or after the other
+// customizations, for the customizations that can't be part of the image definition.
+// It gets the path of the rootfs and Config in a JSON object on stdin, and reports
+// its status with lines of JSON on stdout
+type Plugin struct {
+	PluginName string                 `yaml:"name"   json:"PluginName"       jsonschema:"pattern=^[a-zA-Z0-9][a-zA-Z0-9_.-]*$"`
+	Path       string                 `yaml:"path"   json:"Path"`
+	Stage      string                 `yaml:"stage"  json:"Stage"            jsonschema:"enum=before-customization,enum=after-customization" default:"after-customization"`
+	Config     map[string]interface{} `yaml:"config" json:"Config,omitempty"`
+}
+
 // Fstab defines the information that gets rendered into an fstab
 type Fstab struct {
 	Label        string `yaml:"label"           json:"Label"`
@@ -132,44 +201,96 @@ type Fstab struct {
 	FsckOrder    int    `yaml:"fsck-order"      json:"FsckOrder"`
 }
 
-// CopyFile allows users to copy files into the rootfs of an image
+// User defines a user to create in the rootfs, like the admin user of an
+// appliance. Password is a hash as written to /etc/shadow, never a plain password
+type User struct {
+	UserName          string   `yaml:"name"                json:"UserName"                    jsonschema:"pattern=^[a-z_][a-z0-9_-]*$"`
+	UserID            string   `yaml:"id"                  json:"UserID,omitempty"            jsonschema:"pattern=^[0-9]+$"`
+	Password          string   `yaml:"password"            json:"Password,omitempty"          jsonschema:"pattern=^[$][^:\\s]+$"`
+	SSHAuthorizedKeys []string `yaml:"ssh-authorized-keys" json:"SSHAuthorizedKeys,omitempty"`
+	Sudo              bool     `yaml:"sudo"                json:"Sudo,omitempty"`
+	Shell             string   `yaml:"shell"               json:"Shell"                       default:"/bin/bash"`
+}
+
+// Strip removes the files that are not needed to run the image from the rootfs,
+// to make it smaller. The copyright files of the packages are always kept
+type Strip struct {
+	Documentation bool     `yaml:"documentation" json:"Documentation,omitempty"`
+	Locales       bool     `yaml:"locales"       json:"Locales,omitempty"`
+	KeepLocales   []string `yaml:"keep-locales"  json:"KeepLocales,omitempty"`
+}
+
+// Overlay is a directory merged into the rootfs, keeping the modes and owners of
+// its files. Whiteout files like .wh.<name> are only handled as such when Whiteouts
+// is set, and are otherwise copied like any other file
+type Overlay struct {
+	Source    string `yaml:"source"    json:"Source"`
+	Whiteouts bool   `yaml:"whiteouts" json:"Whiteouts,omitempty"`
+}
+
+// EncryptedPartition marks a partition of gadget.yaml, by name, to be encrypted
+// with LUKS. The rootfs partition is named "writable". A key is generated next
+// to the disk images when no key file is given
+type EncryptedPartition struct {
+	PartitionName string `yaml:"name"     json:"PartitionName"`
+	KeyFile       string `yaml:"key-file" json:"KeyFile,omitempty"`
+}
+
+// CopyFile allows users to copy files into the rootfs of an image.
+// The source can be a glob pattern matching several files
 type CopyFile struct {
-	Dest   string `yaml:"destination" json:"Dest"`
-	Source string `yaml:"source"      json:"Source"`
+	Dest     string   `yaml:"destination" json:"Dest"`
+	Source   string   `yaml:"source"      json:"Source"`
+	Mode     string   `yaml:"mode"        json:"Mode,omitempty"     jsonschema:"pattern=^[0-7]?[0-7]{3}$"`
+	Owner    string   `yaml:"owner"       json:"Owner,omitempty"    jsonschema:"pattern=^[a-zA-Z0-9_.-]+(:[a-zA-Z0-9_.-]+)?$"`
+	StepName string   `yaml:"step"        json:"StepName,omitempty" jsonschema:"pattern=^[a-zA-Z0-9][a-zA-Z0-9_.-]*$"`
+	After    []string `yaml:"after"       json:"After,omitempty"`
 }
 
-// Execute allows users to execute a script in the rootfs of an image
+// Execute allows users to execute a script in the rootfs of an image,
+// with extra environment variables and a timeout given as a duration like "10m"
 type Execute struct {
-	ExecutePath string `yaml:"path" json:"ExecutePath"`
+	ExecutePath string            `yaml:"path"        json:"ExecutePath"`
+	Env         map[string]string `yaml:"environment" json:"Env,omitempty"`
+	Timeout     string            `yaml:"timeout"     json:"Timeout,omitempty"  jsonschema:"pattern=^([0-9]+([.][0-9]+)?(ns|us|ms|s|m|h))+$"`
+	StepName    string            `yaml:"step"        json:"StepName,omitempty" jsonschema:"pattern=^[a-zA-Z0-9][a-zA-Z0-9_.-]*$"`
+	After       []string          `yaml:"after"       json:"After,omitempty"`
 }
 
 // TouchFile allows users to touch a file in the rootfs of an image
 type TouchFile struct {
-	TouchPath string `yaml:"path" json:"TouchPath"`
+	TouchPath string   `yaml:"path"  json:"TouchPath"`
+	StepName  string   `yaml:"step"  json:"StepName,omitempty" jsonschema:"pattern=^[a-zA-Z0-9][a-zA-Z0-9_.-]*$"`
+	After     []string `yaml:"after" json:"After,omitempty"`
 }
 
 // AddGroup allows users to add a group in the image that is being built
 type AddGroup struct {
-	GroupName string `yaml:"name" json:"GroupName"`
-	GroupID   string `yaml:"id"   json:"GroupID,omitempty"`
+	GroupName string   `yaml:"name"  json:"GroupName"`
+	GroupID   string   `yaml:"id"    json:"GroupID,omitempty"`
+	StepName  string   `yaml:"step"  json:"StepName,omitempty" jsonschema:"pattern=^[a-zA-Z0-9][a-zA-Z0-9_.-]*$"`
+	After     []string `yaml:"after" json:"After,omitempty"`
 }
 
 // AddUser allows users to add a user in the image that is being built
 type AddUser struct {
-	UserName string `yaml:"name" json:"UserName"`
-	UserID   string `yaml:"id"   json:"UserID,omitempty"`
+	UserName string   `yaml:"name"  json:"UserName"`
+	UserID   string   `yaml:"id"    json:"UserID,omitempty"`
+	StepName string   `yaml:"step"  json:"StepName,omitempty" jsonschema:"pattern=^[a-zA-Z0-9][a-zA-Z0-9_.-]*$"`
+	After    []string `yaml:"after" json:"After,omitempty"`
 }
 
 // Artifact contains information about the files that are created
 // during and as a result of the image build process
 type Artifact struct {
-	Img       *[]Img     `yaml:"img"            json:"Img,omitempty"       is_disk:"true"`
-	Iso       *[]Iso     `yaml:"iso"            json:"Iso,omitempty"       is_disk:"true"`
-	Qcow2     *[]Qcow2   `yaml:"qcow2"          json:"Qcow2,omitempty"     is_disk:"true"`
-	Manifest  *Manifest  `yaml:"manifest"       json:"Manifest,omitempty"  is_disk:"false"`
-	Filelist  *Filelist  `yaml:"filelist"       json:"Filelist,omitempty"  is_disk:"false"`
-	Changelog *Changelog `yaml:"changelog"      json:"Changelog,omitempty" is_disk:"false"`
-	RootfsTar *RootfsTar `yaml:"rootfs-tarball" json:"RootfsTar,omitempty" is_disk:"false"`
+	Img            *[]Img          `yaml:"img"            json:"Img,omitempty"       is_disk:"true"`
+	Iso            *[]Iso          `yaml:"iso"            json:"Iso,omitempty"       is_disk:"true"`
+	Qcow2          *[]Qcow2        `yaml:"qcow2"          json:"Qcow2,omitempty"     is_disk:"true"`
+	Manifest       *Manifest       `yaml:"manifest"       json:"Manifest,omitempty"  is_disk:"false"`
+	Filelist       *Filelist       `yaml:"filelist"       json:"Filelist,omitempty"  is_disk:"false"`
+	Changelog      *Changelog      `yaml:"changelog"      json:"Changelog,omitempty" is_disk:"false"`
+	RootfsTar      *RootfsTar      `yaml:"rootfs-tarball" json:"RootfsTar,omitempty" is_disk:"false"`
+	RootfsSquashfs *RootfsSquashfs `yaml:"rootfs-squashfs" json:"RootfsSquashfs,omitempty" is_disk:"false"`
 }
 
 // Img specifies the name of the resulting .img file.
@@ -220,6 +341,12 @@ type RootfsTar struct {
 	Compression   string `yaml:"compression" json:"Compression"   jsonschema:"enum=uncompressed,enum=bzip2,enum=gzip,enum=xz,enum=zstd" default:"uncompressed"`
 }
 
+// RootfsSquashfs specifies the name of a squashfs image to create from the
+// rootfs build steps. It is compressed with the compressor passed with --comp
+type RootfsSquashfs struct {
+	RootfsSquashfsName string `yaml:"name" json:"RootfsSquashfsName"`
+}
+
 // NewMissingURLError fails the image definition parsing when a dict
 // requires a URL conditionally based on the value of other keys
 // in the dict but does not have one included
@@ -298,6 +425,213 @@ type DependentKeyError struct {
 	gojsonschema.ResultErrorFields
 }
 
+// NewKeyRequiresValueError fails the image definition parsing when
+// a field is only supported for one value of another field
+func NewKeyRequiresValueError(context *gojsonschema.JsonContext, value interface{}, details gojsonschema.ErrorDetails) *KeyRequiresValueError {
+	err := KeyRequiresValueError{}
+	err.SetContext(context)
+	err.SetType("key_requires_value_error")
+	err.SetDescriptionFormat("Key {{.key1}} can only be used when key {{.key2}} is {{.value}}")
+	err.SetValue(value)
+	err.SetDetails(details)
+
+	return &err
+}
+
+// KeyRequiresValueError implements gojsonschema.ErrorType.
+// It is used for custom errors for keys that are only
+// supported for one value of other keys
+type KeyRequiresValueError struct {
+	gojsonschema.ResultErrorFields
+}
+
+// NewUnknownSeriesError fails the image definition parsing when the series
+// is not the codename of an Ubuntu release
+func NewUnknownSeriesError(context *gojsonschema.JsonContext, value interface{}, details gojsonschema.ErrorDetails) *UnknownSeriesError {
+	err := UnknownSeriesError{}
+	err.SetContext(context)
+	err.SetType("unknown_series_error")
+	err.SetDescriptionFormat("Series {{.series}} is not a known Ubuntu series. {{.hint}}")
+	err.SetValue(value)
+	err.SetDetails(details)
+
+	return &err
+}
+
+// UnknownSeriesError implements gojsonschema.ErrorType. It is used for custom errors
+// when the series is not a known Ubuntu release
+type UnknownSeriesError struct {
+	gojsonschema.ResultErrorFields
+}
+
+// NewInvalidHostnameError fails the image definition parsing when the hostname
+// is not a valid RFC 1123 hostname
+func NewInvalidHostnameError(context *gojsonschema.JsonContext, value interface{}, details gojsonschema.ErrorDetails) *InvalidHostnameError {
+	err := InvalidHostnameError{}
+	err.SetContext(context)
+	err.SetType("invalid_hostname_error")
+	err.SetDescriptionFormat("Hostname {{.hostname}} is not valid: {{.reason}}")
+	err.SetValue(value)
+	err.SetDetails(details)
+
+	return &err
+}
+
+// InvalidHostnameError implements gojsonschema.ErrorType. It is used for custom errors
+// when the hostname is not a valid RFC 1123 hostname
+type InvalidHostnameError struct {
+	gojsonschema.ResultErrorFields
+}
+
+// maxHostnameLength is the longest hostname the kernel accepts
+const maxHostnameLength = 64
+
+// maxHostnameLabelLength is the longest a label of a hostname can be, per RFC 1123
+const maxHostnameLabelLength = 63
+
+// HostnameError returns why hostname is not a valid RFC 1123 hostname, or an
+// empty string if it is one. It is made of labels separated by dots, with
+// letters, digits and hyphens that can't start or end a label
+func HostnameError(hostname string) string {
+	if len(hostname) > maxHostnameLength {
+		return fmt.Sprintf("it is longer than %d characters", maxHostnameLength)
+	}
+	for _, label := range strings.Split(hostname, ".") {
+		switch {
+		case label == "":
+			return "it has an empty label"
+		case len(label) > maxHostnameLabelLength:
+			return fmt.Sprintf("its label %s is longer than %d characters", label, maxHostnameLabelLength)
+		case strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-"):
+			return fmt.Sprintf("its label %s starts or ends with a hyphen", label)
+		}
+		for _, char := range label {
+			if !(char >= 'a' && char <= 'z') && !(char >= 'A' && char <= 'Z') &&
+				!(char >= '0' && char <= '9') && char != '-' {
+				return fmt.Sprintf("it can only contain letters, digits, hyphens and dots, not %q", char)
+			}
+		}
+	}
+	return ""
+}
+
+// Release is an Ubuntu release
+type Release struct {
+	Codename string
+	Version  string
+}
+
+// KnownSeries lists the codenames of the Ubuntu releases, from the oldest to the newest,
+// with their version numbers
+var KnownSeries = []Release{
+	{"trusty", "14.04"},
+	{"xenial", "16.04"},
+	{"bionic", "18.04"},
+	{"focal", "20.04"},
+	{"jammy", "22.04"},
+	{"kinetic", "22.10"},
+	{"lunar", "23.04"},
+	{"mantic", "23.10"},
+	{"noble", "24.04"},
+	{"oracular", "24.10"},
+	{"plucky", "25.04"},
+	{"questing", "25.10"},
+	{"resolute", "26.04"},
+}
+
+// distroInfoFile is the list of the Ubuntu releases of distro-info-data, which
+// gets the releases that are newer than KnownSeries
+var distroInfoFile = "/usr/share/distro-info/ubuntu.csv"
+
+// knownSeries returns KnownSeries followed by the newer releases listed in
+// distroInfoFile, if it is installed, so that the releases made after this
+// version of ubuntu-image are known too
+func knownSeries() []Release {
+	releases := append([]Release{}, KnownSeries...)
+	distroInfo, err := os.Open(distroInfoFile)
+	if err != nil {
+		return releases
+	}
+	defer distroInfo.Close()
+	// the columns are version,codename,series,created,release,... with the
+	// releases from the oldest to the newest
+	records, err := csv.NewReader(distroInfo).ReadAll()
+	if err != nil {
+		return releases
+	}
+	newer := false
+	for _, record := range records {
+		if len(record) < 3 {
+			continue
+		}
+		if newer {
+			releases = append(releases, Release{Codename: record[2],
+				Version: strings.TrimSuffix(record[0], " LTS")})
+		}
+		if record[2] == KnownSeries[len(KnownSeries)-1].Codename {
+			newer = true
+		}
+	}
+	return releases
+}
+
+// IsKnownSeries returns whether series is the codename of an Ubuntu release
+func IsKnownSeries(series string) bool {
+	for _, knownSeries := range knownSeries() {
+		if knownSeries.Codename == series {
+			return true
+		}
+	}
+	return false
+}
+
+// SeriesHint returns a hint for an unknown series: the known series closest to it if
+// it looks like a typo, or the list of the known series otherwise
+func SeriesHint(series string) string {
+	closest := ""
+	closestDistance := 3
+	var codenames []string
+	for _, knownSeries := range knownSeries() {
+		codenames = append(codenames, knownSeries.Codename)
+		distance := editDistance(series, knownSeries.Codename)
+		if distance < closestDistance {
+			closest = knownSeries.Codename
+			closestDistance = distance
+		}
+	}
+	if closest != "" {
+		return fmt.Sprintf("Did you mean %s?", closest)
+	}
+	return fmt.Sprintf("The known series are: %s", strings.Join(codenames, ", "))
+}
+
+// editDistance returns the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			substitution := previous[j-1]
+			if a[i-1] != b[j-1] {
+				substitution++
+			}
+			current[j] = substitution
+			if previous[j]+1 < current[j] {
+				current[j] = previous[j] + 1
+			}
+			if current[j-1]+1 < current[j] {
+				current[j] = current[j-1] + 1
+			}
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
 func (imageDef ImageDefinition) securityMirror() string {
 	if imageDef.Architecture == "amd64" || imageDef.Architecture == "i386" {
 		return "http://security.ubuntu.com/ubuntu/"
@@ -1,6 +1,8 @@
 package imagedefinition
 
 import (
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -144,5 +146,128 @@ func TestCustomErrors(t *testing.T) {
 			t.Errorf("dependentKeyError description format \"%s\" is invalid",
 				dependentKeyErr.DescriptionFormat())
 		}
+		keyRequiresValueErr := NewKeyRequiresValueError(
+			gojsonschema.NewJsonContext("testKeyRequiresValue", jsonContext),
+			52,
+			errDetail,
+		)
+		// spot check the description format
+		if !strings.Contains(keyRequiresValueErr.DescriptionFormat(),
+			"Key {{.key1}} can only be used when key {{.key2}} is {{.value}}") {
+			t.Errorf("keyRequiresValueError description format \"%s\" is invalid",
+				keyRequiresValueErr.DescriptionFormat())
+		}
+		unknownSeriesErr := NewUnknownSeriesError(
+			gojsonschema.NewJsonContext("testUnknownSeries", jsonContext),
+			52,
+			errDetail,
+		)
+		// spot check the description format
+		if !strings.Contains(unknownSeriesErr.DescriptionFormat(),
+			"Series {{.series}} is not a known Ubuntu series. {{.hint}}") {
+			t.Errorf("unknownSeriesError description format \"%s\" is invalid",
+				unknownSeriesErr.DescriptionFormat())
+		}
+		invalidHostnameErr := NewInvalidHostnameError(
+			gojsonschema.NewJsonContext("testInvalidHostname", jsonContext),
+			52,
+			errDetail,
+		)
+		// spot check the description format
+		if !strings.Contains(invalidHostnameErr.DescriptionFormat(),
+			"Hostname {{.hostname}} is not valid: {{.reason}}") {
+			t.Errorf("invalidHostnameError description format \"%s\" is invalid",
+				invalidHostnameErr.DescriptionFormat())
+		}
 	})
 }
+
+// TestSeriesHint tests the hints given for series that are not known
+func TestSeriesHint(t *testing.T) {
+	testCases := []struct {
+		name     string
+		series   string
+		expected string
+	}{
+		{"extra_letter", "noblee", "Did you mean noble?"},
+		{"missing_letter", "jamy", "Did you mean jammy?"},
+		{"swapped_letters", "fcoal", "Did you mean focal?"},
+		{"not_a_typo", "bookworm", "The known series are: trusty, xenial, bionic, focal, jammy"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_series_hint_"+tc.name, func(t *testing.T) {
+			if IsKnownSeries(tc.series) {
+				t.Errorf("Expected %s not to be a known series", tc.series)
+			}
+			hint := SeriesHint(tc.series)
+			if !strings.Contains(hint, tc.expected) {
+				t.Errorf("Expected hint \"%s\" to contain \"%s\"", hint, tc.expected)
+			}
+		})
+	}
+}
+
+// TestDistroInfoSeries tests that the releases of distro-info-data that are newer
+// than the built-in ones are known series
+func TestDistroInfoSeries(t *testing.T) {
+	t.Run("test_distro_info_series", func(t *testing.T) {
+		tmpDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		if err != nil {
+			t.Fatalf("Failed to create a temporary directory: %s", err.Error())
+		}
+		defer os.RemoveAll(tmpDir)
+		defer func() {
+			distroInfoFile = "/usr/share/distro-info/ubuntu.csv"
+		}()
+
+		distroInfoFile = filepath.Join(tmpDir, "ubuntu.csv")
+		if IsKnownSeries("future") {
+			t.Errorf("Expected future not to be known without distro-info-data")
+		}
+		lastSeries := KnownSeries[len(KnownSeries)-1]
+		distroInfo := "version,codename,series,created,release,eol\n" +
+			"24.04 LTS,Noble Numbat,noble,2023-10-26,2024-04-25,2029-05-31\n" +
+			lastSeries.Version + " LTS,Some Release," + lastSeries.Codename + ",2025-10-09,2026-04-23,2031-05-29\n" +
+			"99.10,Future Release,future,2026-04-23,2026-10-08,2027-07-08\n"
+		err = os.WriteFile(distroInfoFile, []byte(distroInfo), 0644)
+		if err != nil {
+			t.Fatalf("Failed to write %s: %s", distroInfoFile, err.Error())
+		}
+		for _, series := range []string{"trusty", lastSeries.Codename, "future"} {
+			if !IsKnownSeries(series) {
+				t.Errorf("Expected %s to be a known series", series)
+			}
+		}
+		if hint := SeriesHint("futur"); hint != "Did you mean future?" {
+			t.Errorf("Expected the hint to suggest future, but got \"%s\"", hint)
+		}
+	})
+}
+
+// TestHostnameError tests the hostnames that are not valid RFC 1123 hostnames
+func TestHostnameError(t *testing.T) {
+	testCases := []struct {
+		name     string
+		hostname string
+		expected string
+	}{
+		{"valid", "ubuntu-1.example.com", ""},
+		{"digits", "1and1", ""},
+		{"too_long", strings.Repeat("a", 65), "it is longer than 64 characters"},
+		{"label_too_long", strings.Repeat("a", 64), "is longer than 63 characters"},
+		{"empty_label", "ubuntu..com", "it has an empty label"},
+		{"trailing_hyphen", "ubuntu-.com", "its label ubuntu- starts or ends with a hyphen"},
+		{"underscore", "ubuntu_image", "it can only contain letters, digits, hyphens and dots, not '_'"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_hostname_error_"+tc.name, func(t *testing.T) {
+			reason := HostnameError(tc.hostname)
+			if tc.expected == "" && reason != "" {
+				t.Errorf("Expected %s to be valid, but got \"%s\"", tc.hostname, reason)
+			}
+			if !strings.Contains(reason, tc.expected) {
+				t.Errorf("Expected reason \"%s\" to contain \"%s\"", reason, tc.expected)
+			}
+		})
+	}
+}
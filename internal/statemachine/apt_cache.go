@@ -0,0 +1,149 @@
+package statemachine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/snapcore/snapd/osutil"
+)
+
+// aptCacheDirEnv is the environment variable used to set the apt cache directory
+const aptCacheDirEnv = "UBUNTU_IMAGE_APT_CACHE_DIR"
+
+// defaultAptCacheTTL is how long the cached apt lists are used, without --apt-cache-ttl
+const defaultAptCacheTTL = 6 * time.Hour
+
+// aptCacheStamp is the file of a cache entry whose modification time is the time
+// the lists were downloaded
+const aptCacheStamp = "updated"
+
+// aptListsDir is the directory of the rootfs in which apt keeps the package lists
+var aptListsDir = filepath.Join("var", "lib", "apt", "lists")
+
+// aptCacheDir returns the directory used to cache the apt lists between builds,
+// or an empty string if they should not be cached
+func (classicStateMachine *ClassicStateMachine) aptCacheDir() string {
+	if classicStateMachine.Opts.NoAptCache {
+		return ""
+	}
+	if classicStateMachine.Opts.AptCacheDir != "" {
+		return classicStateMachine.Opts.AptCacheDir
+	}
+	return os.Getenv(aptCacheDirEnv)
+}
+
+// aptCacheTTL returns how long the cached apt lists are used before apt update
+// is run again
+func (classicStateMachine *ClassicStateMachine) aptCacheTTL() (time.Duration, error) {
+	if classicStateMachine.Opts.AptCacheTTL == "" {
+		return defaultAptCacheTTL, nil
+	}
+	ttl, err := time.ParseDuration(classicStateMachine.Opts.AptCacheTTL)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("--apt-cache-ttl must be a positive duration, like 30m or 6h")
+	}
+	return ttl, nil
+}
+
+// aptSourcesKey returns the key of the apt lists of a rootfs in the apt cache. The
+// lists only depend on the apt sources they are downloaded from and on the
+// architecture of the rootfs, so they are hashed together
+func aptSourcesKey(chroot, architecture string) (string, error) {
+	sourceFiles := []string{filepath.Join(chroot, "etc", "apt", "sources.list")}
+	sourcesDir, _ := filepath.Glob(filepath.Join(chroot, "etc", "apt", "sources.list.d", "*"))
+	sourceFiles = append(sourceFiles, sourcesDir...)
+
+	sourcesHash := sha256.New()
+	fmt.Fprintf(sourcesHash, "architecture %s\n", architecture)
+	for _, sourceFile := range sourceFiles {
+		content, err := os.ReadFile(sourceFile)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("Error reading the apt sources \"%s\": %s", sourceFile, err.Error())
+		}
+		relativePath, _ := filepath.Rel(chroot, sourceFile)
+		fmt.Fprintf(sourcesHash, "%s %d\n", relativePath, len(content))
+		sourcesHash.Write(content)
+	}
+	return hex.EncodeToString(sourcesHash.Sum(nil)), nil
+}
+
+// copyAptLists copies the package lists from one directory to another. The lock
+// file and the partial downloads of apt are left out
+func copyAptLists(sourceDir, destDir string) error {
+	if err := osMkdirAll(destDir, 0755); err != nil {
+		return fmt.Errorf("Error creating the apt lists directory: %s", err.Error())
+	}
+	entries, err := osReadDir(sourceDir)
+	if err != nil {
+		return fmt.Errorf("Error reading the apt lists: %s", err.Error())
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || entry.Name() == "lock" {
+			continue
+		}
+		// the modification times are kept, apt uses them to only download changed lists
+		if err := osutilCopyFile(filepath.Join(sourceDir, entry.Name()),
+			filepath.Join(destDir, entry.Name()), osutil.CopyFlagPreserveAll); err != nil {
+			return fmt.Errorf("Error copying the apt list \"%s\": %s", entry.Name(), err.Error())
+		}
+	}
+	return nil
+}
+
+// restoreAptLists copies the cached apt lists of the sources of the rootfs into it,
+// if they were downloaded less than ttl ago, and reports whether they were
+func restoreAptLists(cacheDir, key, chroot string, ttl time.Duration) (bool, error) {
+	unlock, err := lockCacheDir(cacheDir, "apt cache", syscall.LOCK_SH)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	entryDir := filepath.Join(cacheDir, key)
+	stamp, err := os.Stat(filepath.Join(entryDir, aptCacheStamp))
+	if err != nil || time.Since(stamp.ModTime()) >= ttl {
+		return false, nil
+	}
+	if err := copyAptLists(filepath.Join(entryDir, "lists"), filepath.Join(chroot, aptListsDir)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// saveAptLists stores the apt lists of the rootfs in the apt cache, replacing the
+// ones cached for the same sources
+func saveAptLists(cacheDir, key, chroot string) error {
+	unlock, err := lockCacheDir(cacheDir, "apt cache", syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// the new entry is only put in place once it is complete
+	entryDir := filepath.Join(cacheDir, key)
+	newEntryDir := entryDir + ".new"
+	if err := osRemoveAll(newEntryDir); err != nil {
+		return fmt.Errorf("Error removing the incomplete apt cache entry: %s", err.Error())
+	}
+	if err := copyAptLists(filepath.Join(chroot, aptListsDir), filepath.Join(newEntryDir, "lists")); err != nil {
+		return err
+	}
+	if err := osWriteFile(filepath.Join(newEntryDir, aptCacheStamp), []byte{}, 0644); err != nil {
+		return fmt.Errorf("Error writing the apt cache entry: %s", err.Error())
+	}
+	if err := osRemoveAll(entryDir); err != nil {
+		return fmt.Errorf("Error removing the previous apt cache entry: %s", err.Error())
+	}
+	if err := os.Rename(newEntryDir, entryDir); err != nil {
+		return fmt.Errorf("Error writing the apt cache entry: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package statemachine
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// aptPinsFile is the file of /etc/apt/preferences.d the apt pins are written to.
+// apt ignores the files of preferences.d with an extension other than .pref
+const aptPinsFile = "ubuntu-image.pref"
+
+// removedPackagesPinsFile is the file of /etc/apt/preferences.d that keeps the
+// packages of remove-packages from being installed again
+const removedPackagesPinsFile = "ubuntu-image-removed-packages.pref"
+
+// removedPackagesPreferences renders the apt preferences forbidding the installation
+// of the removed packages. A negative priority keeps apt from installing any version
+// of them, so that installing a package that depends on them fails
+func removedPackagesPreferences(removedPackages []string) string {
+	return fmt.Sprintf("Package: %s\nPin: release *\nPin-Priority: -1\n",
+		strings.Join(removedPackages, " "))
+}
+
+// aptPreferences renders the apt pins of the image definition as apt preferences
+func aptPreferences(aptPins []*imagedefinition.AptPin) string {
+	var preferences strings.Builder
+	for i, aptPin := range aptPins {
+		if i > 0 {
+			preferences.WriteString("\n")
+		}
+		pin := "version " + aptPin.Version
+		if aptPin.Release != "" {
+			pin = "release a=" + aptPin.Release
+		}
+		fmt.Fprintf(&preferences, "Package: %s\nPin: %s\nPin-Priority: %d\n",
+			aptPin.PackageName, pin, aptPin.Priority)
+	}
+	return preferences.String()
+}
+
+// aptPackageVersion is a version of a package served by the apt sources of the
+// chroot, with the suite it is served from, like jammy-updates
+type aptPackageVersion struct {
+	version string
+	suite   string
+}
+
+// parseMadisonOutput returns the versions of a package listed by apt-cache madison,
+// whose lines look like "hello | 2.10-2 | http://archive.ubuntu.com/ubuntu jammy/main
+// amd64 Packages". The versions of the source packages are left out
+func parseMadisonOutput(output string) []aptPackageVersion {
+	var versions []aptPackageVersion
+	for _, line := range strings.Split(output, "\n") {
+		columns := strings.Split(line, "|")
+		if len(columns) != 3 {
+			continue
+		}
+		sourceFields := strings.Fields(columns[2])
+		if len(sourceFields) < 2 || sourceFields[len(sourceFields)-1] != "Packages" {
+			continue
+		}
+		versions = append(versions, aptPackageVersion{
+			version: strings.TrimSpace(columns[1]),
+			suite:   strings.SplitN(sourceFields[1], "/", 2)[0],
+		})
+	}
+	return versions
+}
+
+// aptPinSatisfied returns whether one of the versions of a package matches its pin
+func aptPinSatisfied(aptPin *imagedefinition.AptPin, versions []aptPackageVersion) bool {
+	for _, version := range versions {
+		if aptPin.Release != "" {
+			if version.suite == aptPin.Release {
+				return true
+			}
+			continue
+		}
+		if matched, _ := path.Match(aptPin.Version, version.version); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// describeAptVersions lists the versions of a package for the errors of the apt pins
+func describeAptVersions(versions []aptPackageVersion) string {
+	if len(versions) == 0 {
+		return "the package is not available"
+	}
+	var described []string
+	for _, version := range versions {
+		described = append(described, version.version+" from "+version.suite)
+	}
+	return "available: " + strings.Join(described, ", ")
+}
+
+// addAptPins writes the apt pins of the image definition to /etc/apt/preferences.d
+// in the chroot, before the packages are installed, and keeps them in the image so
+// that the packages stay at their versions when it is upgraded. The package lists
+// are then updated to make sure that every pin matches a version of its package
+// served by the configured sources, so that the build fails before anything is
+// installed if one of them can't be satisfied
+func (stateMachine *StateMachine) addAptPins() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+	aptPins := classicStateMachine.ImageDef.Customization.AptPins
+
+	preferencesDir := filepath.Join(stateMachine.tempDirs.chroot, "etc", "apt", "preferences.d")
+	if err := osMkdirAll(preferencesDir, 0755); err != nil {
+		return fmt.Errorf("Error creating preferences.d in the chroot: %s", err.Error())
+	}
+	if err := osWriteFile(filepath.Join(preferencesDir, aptPinsFile),
+		[]byte(aptPreferences(aptPins)), 0644); err != nil {
+		return fmt.Errorf("Error writing the apt pins: %s", err.Error())
+	}
+
+	// the package lists are downloaded like when the packages are installed
+	removeProxyConf, err := stateMachine.setUpChrootNetwork()
+	if err != nil {
+		return err
+	}
+	defer removeProxyConf()
+
+	var updateCmds, umountCmds []*exec.Cmd
+	for _, mountPoint := range []string{"/dev", "/proc", "/sys"} {
+		mountCmd, umountCmd := mountFromHost(stateMachine.tempDirs.chroot, mountPoint)
+		defer umountCmd.Run()
+		updateCmds = append(updateCmds, mountCmd)
+		umountCmds = append(umountCmds, umountCmd)
+	}
+	updateCmds = append(updateCmds,
+		execCommand("chroot", stateMachine.tempDirs.chroot, "apt-get", "update", "--quiet"))
+	for _, cmd := range updateCmds {
+		cmdOutput := helper.SetCommandOutput(cmd, classicStateMachine.commonFlags.Debug)
+		if err := runCommand(stateMachine.context(), cmd); err != nil {
+			return fmt.Errorf("Error running command \"%s\". Error is \"%s\". Output is: \n%s",
+				cmd.String(), err.Error(), cmdOutput.String())
+		}
+	}
+
+	var unsatisfied []string
+	for _, aptPin := range aptPins {
+		madisonCmd := execCommand("chroot", stateMachine.tempDirs.chroot,
+			"apt-cache", "madison", aptPin.PackageName)
+		var madisonOutput, madisonErr bytes.Buffer
+		madisonCmd.Stdout = &madisonOutput
+		madisonCmd.Stderr = &madisonErr
+		if err := runCommand(stateMachine.context(), madisonCmd); err != nil {
+			return fmt.Errorf("Error running command \"%s\". Error is \"%s\". Output is: \n%s",
+				madisonCmd.String(), err.Error(), madisonOutput.String()+madisonErr.String())
+		}
+		versions := parseMadisonOutput(madisonOutput.String())
+		if aptPinSatisfied(aptPin, versions) {
+			continue
+		}
+		pin := "version " + aptPin.Version
+		if aptPin.Release != "" {
+			pin = "release " + aptPin.Release
+		}
+		unsatisfied = append(unsatisfied, fmt.Sprintf("%s at %s (%s)",
+			aptPin.PackageName, pin, describeAptVersions(versions)))
+	}
+
+	for _, cmd := range umountCmds {
+		cmdOutput := helper.SetCommandOutput(cmd, classicStateMachine.commonFlags.Debug)
+		if err := runCommand(stateMachine.context(), cmd); err != nil {
+			return fmt.Errorf("Error running command \"%s\". Error is \"%s\". Output is: \n%s",
+				cmd.String(), err.Error(), cmdOutput.String())
+		}
+	}
+
+	if len(unsatisfied) > 0 {
+		return fmt.Errorf("The apt pins can not be satisfied by the configured sources: %s",
+			strings.Join(unsatisfied, "; "))
+	}
+	return nil
+}
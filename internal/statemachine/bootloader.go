@@ -0,0 +1,309 @@
+package statemachine
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/snapcore/snapd/gadget"
+)
+
+// bootloaderPackages are the packages installed in the rootfs for the bootloaders
+// that can be selected with --bootloader, for each architecture they support
+var bootloaderPackages = map[string]map[string][]string{
+	"grub": {
+		"amd64":   {"grub-efi-amd64"},
+		"arm64":   {"grub-efi-arm64"},
+		"armhf":   {"grub-efi-arm"},
+		"riscv64": {"grub-efi-riscv64"},
+	},
+	"systemd-boot": {
+		"amd64":   {"systemd-boot"},
+		"arm64":   {"systemd-boot"},
+		"armhf":   {"systemd-boot"},
+		"riscv64": {"systemd-boot"},
+	},
+}
+
+// validateBootloader makes sure that the bootloader selected with --bootloader
+// can be installed for the architecture of the image, before anything is built
+func (classicStateMachine *ClassicStateMachine) validateBootloader() error {
+	bootloader := classicStateMachine.Opts.Bootloader
+	if bootloader == "" {
+		return nil
+	}
+	if classicStateMachine.ImageDef.Gadget == nil {
+		return fmt.Errorf("--bootloader can only be used with a gadget, which defines the EFI system partition")
+	}
+	packages := bootloaderPackages[bootloader]
+	if _, found := packages[classicStateMachine.ImageDef.Architecture]; !found {
+		var supported []string
+		for arch := range packages {
+			supported = append(supported, arch)
+		}
+		sort.Strings(supported)
+		return fmt.Errorf("bootloader %s is not supported on architecture %s, only on %s",
+			bootloader, classicStateMachine.ImageDef.Architecture, strings.Join(supported, ", "))
+	}
+	return nil
+}
+
+// noLoop returns whether loop devices must not be used, with --no-loop or with
+// --unprivileged since they can not be set up in a user namespace
+func (classicStateMachine *ClassicStateMachine) noLoop() bool {
+	return classicStateMachine.Opts.NoLoop || classicStateMachine.Opts.Unprivileged
+}
+
+// loopDevicesAvailable returns whether a loop device can be set up, which is not
+// the case in most containers
+func (stateMachine *StateMachine) loopDevicesAvailable() bool {
+	losetupCmd := execCommand("losetup", "--find")
+	helper.SetCommandOutput(losetupCmd, stateMachine.commonFlags.Debug)
+	return runCommand(stateMachine.context(), losetupCmd) == nil
+}
+
+// volumeBootloader returns the bootloader of a volume. The volumes of classic
+// images using grub in gadget.yaml use the bootloader selected with --bootloader
+func (stateMachine *StateMachine) volumeBootloader(volumeName string) (string, error) {
+	bootloader := stateMachine.GadgetInfo.Volumes[volumeName].Bootloader
+	classicStateMachine, ok := stateMachine.parent.(*ClassicStateMachine)
+	if !ok || classicStateMachine.Opts.Bootloader == "" || bootloader == "" {
+		return bootloader, nil
+	}
+	if bootloader != "grub" {
+		return "", fmt.Errorf("--bootloader %s can not replace bootloader %s of volume %s, "+
+			"only grub can be replaced", classicStateMachine.Opts.Bootloader, bootloader, volumeName)
+	}
+	return classicStateMachine.Opts.Bootloader, nil
+}
+
+// validateBootloaderUpdate makes sure that the bootloader of the volume holding the
+// rootfs can be updated, so that a build that would make an image that doesn't boot
+// fails before the rootfs is built. update-grub finds the root filesystem from the
+// device it is mounted from, so grub can't be configured without loop devices
+func (stateMachine *StateMachine) validateBootloaderUpdate() error {
+	classicStateMachine, ok := stateMachine.parent.(*ClassicStateMachine)
+	if !ok || !classicStateMachine.noLoop() {
+		return nil
+	}
+	for _, volumeName := range stateMachine.VolumeOrder {
+		for _, structure := range stateMachine.GadgetInfo.Volumes[volumeName].Structure {
+			if structure.Role != gadget.SystemData {
+				continue
+			}
+			bootloader, err := stateMachine.volumeBootloader(volumeName)
+			if err != nil {
+				return err
+			}
+			if bootloader != "grub" {
+				continue
+			}
+			if classicStateMachine.Opts.Unprivileged {
+				return fmt.Errorf("grub can not be configured with --unprivileged, as update-grub " +
+					"needs the rootfs mounted from a loop device, which can not be set up in a " +
+					"user namespace. Use --bootloader systemd-boot, or build the image as root")
+			}
+			return fmt.Errorf("grub can not be configured with --no-loop, as update-grub needs " +
+				"the rootfs mounted from a loop device. Use --bootloader systemd-boot, or build " +
+				"the image with loop devices")
+		}
+	}
+	return nil
+}
+
+// isESP returns whether a structure of gadget.yaml is the EFI system partition
+func isESP(structure gadget.VolumeStructure) bool {
+	gptType := structure.Type
+	if strings.Contains(gptType, ",") {
+		gptType = strings.Split(gptType, ",")[1]
+	}
+	return structure.Role == gadget.SystemBoot || structure.Label == gadget.SystemBoot ||
+		strings.ToUpper(gptType) == espPartitionType
+}
+
+// partitionNumber returns the number of a structure of a volume in its partition
+// table, which doesn't have the structures that are not partitions, like the mbr
+func partitionNumber(volume *gadget.Volume, structureNumber int) int {
+	partNum := 0
+	for i := 0; i <= structureNumber && i < len(volume.Structure); i++ {
+		if volume.Structure[i].IsPartition() {
+			partNum++
+		}
+	}
+	return partNum
+}
+
+// loopMountCmds sets up a loop device for the disk image of a volume, and returns the
+// commands mounting its rootfs partition, with its ESP partition on /boot/efi unless
+// espPartNum is 0, and the commands unmounting them and detaching the loop device.
+// The partition numbers are the ones of the partition table
+func (stateMachine *StateMachine) loopMountCmds(volumeName string, rootfsPartNum int,
+	espPartNum int) (mountDir string, mountCmds []*exec.Cmd, umountCmds []*exec.Cmd, err error) {
+	// create a directory in which to mount the rootfs
+	mountDir = filepath.Join(stateMachine.tempDir(stateMachine.tempDirs.scratch), "loopback")
+	err = osMkdir(mountDir, 0755)
+	if err != nil && !os.IsExist(err) {
+		return "", nil, nil, fmt.Errorf("Error creating scratch/loopback directory: %s", err.Error())
+	}
+
+	// run the losetup command and read the output to determine which loopback was used
+	losetupCmd := execCommand("losetup",
+		"--find",
+		"--show",
+		"--partscan",
+		"--sector-size",
+		stateMachine.commonFlags.SectorSize,
+		stateMachine.volumeImagePath(volumeName),
+	)
+	var losetupOutput bytes.Buffer
+	losetupCmd.Stdout = &losetupOutput
+	if err := runCommand(stateMachine.context(), losetupCmd); err != nil {
+		return "", nil, nil, fmt.Errorf("Error running losetup command \"%s\". Error is %s",
+			losetupCmd.String(),
+			err.Error(),
+		)
+	}
+	loopUsed := strings.TrimSpace(losetupOutput.String())
+
+	mountCmds = []*exec.Cmd{
+		execCommand("mount", fmt.Sprintf("%sp%d", loopUsed, rootfsPartNum), mountDir),
+	}
+	umountCmds = []*exec.Cmd{
+		execCommand("losetup", "--detach", loopUsed),
+		execCommand("umount", mountDir),
+	}
+	if espPartNum != 0 {
+		espDir := filepath.Join(mountDir, "boot", "efi")
+		mountCmds = append(mountCmds,
+			execCommand("mkdir", "-p", espDir),
+			execCommand("mount", fmt.Sprintf("%sp%d", loopUsed, espPartNum), espDir),
+		)
+		umountCmds = append(umountCmds, execCommand("umount", espDir))
+	}
+	return mountDir, mountCmds, umountCmds, nil
+}
+
+// mountBootloaderRootfs runs mountCmds to mount the rootfs in which the bootloader is
+// updated on mountDir, and mounts the mountpoints of the host in it. The returned
+// function runs umountCmds and unmounts the mountpoints of the host, in the reverse
+// order of the mounts. It has to be called whether mounting succeeds or not
+func (stateMachine *StateMachine) mountBootloaderRootfs(mountDir string, mountCmds []*exec.Cmd,
+	umountCmds []*exec.Cmd) (func(), error) {
+	umounts := append([]*exec.Cmd{}, umountCmds...)
+	for _, mountPoint := range []string{"/dev", "/proc", "/sys"} {
+		mountCmd, umountCmd := mountFromHost(mountDir, mountPoint)
+		mountCmds = append(mountCmds, mountCmd)
+		umounts = append(umounts, umountCmd)
+	}
+	ctx := withoutCancel(stateMachine.context())
+	unmount := func() {
+		for i := len(umounts) - 1; i >= 0; i-- {
+			_ = runCommand(ctx, umounts[i])
+		}
+	}
+	return unmount, stateMachine.runBootloaderCommands(mountCmds...)
+}
+
+// runBootloaderCommands runs the commands updating a bootloader, one after the other
+func (stateMachine *StateMachine) runBootloaderCommands(cmds ...*exec.Cmd) error {
+	for _, cmd := range cmds {
+		cmdOutput := helper.SetCommandOutput(cmd, stateMachine.commonFlags.Debug)
+		if err := runCommand(stateMachine.context(), cmd); err != nil {
+			return fmt.Errorf("Error running command \"%s\". Error is \"%s\". Output is: \n%s",
+				cmd.String(), err.Error(), cmdOutput.String())
+		}
+	}
+	return nil
+}
+
+// updateSystemdBoot mounts the rootfs and the EFI system partition of the resulting
+// image, installs systemd-boot to the ESP and adds a boot entry for each kernel.
+// Without loop devices, the contents of the partitions are updated instead
+func (stateMachine *StateMachine) updateSystemdBoot(rootfsVolName string, rootfsStructure int,
+	noLoop bool) error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	volume := stateMachine.GadgetInfo.Volumes[rootfsVolName]
+	espStructure := -1
+	for structureNumber, structure := range volume.Structure {
+		if isESP(structure) {
+			espStructure = structureNumber
+			break
+		}
+	}
+	if espStructure == -1 {
+		return fmt.Errorf("Volume %s has no EFI system partition to install systemd-boot to",
+			rootfsVolName)
+	}
+	rootfsLabel := volume.Structure[rootfsStructure].Label
+	if rootfsLabel == "" {
+		rootfsLabel = "writable"
+	}
+
+	var mountDir string
+	var mountCmds, umountCmds []*exec.Cmd
+	if noLoop {
+		// the rootfs and the contents of the ESP are updated, and the
+		// partitions are created from them afterwards
+		mountDir = stateMachine.tempDirs.rootfs
+		espDir := filepath.Join(mountDir, "boot", "efi")
+		mountCmds = []*exec.Cmd{
+			execCommand("mkdir", "-p", espDir),
+			execCommand("mount", "--bind", filepath.Join(stateMachine.tempDirs.volumes,
+				rootfsVolName, "part"+strconv.Itoa(espStructure)), espDir),
+		}
+		umountCmds = []*exec.Cmd{
+			execCommand("umount", espDir),
+		}
+	} else {
+		var err error
+		mountDir, mountCmds, umountCmds, err = stateMachine.loopMountCmds(rootfsVolName,
+			partitionNumber(volume, rootfsStructure), partitionNumber(volume, espStructure))
+		if err != nil {
+			return err
+		}
+	}
+	unmount, err := stateMachine.mountBootloaderRootfs(mountDir, mountCmds, umountCmds)
+	defer unmount()
+	if err != nil {
+		return err
+	}
+
+	// kernel-install reads the command line of the boot entries from /etc/kernel/cmdline,
+	// and uses the one of the host if it doesn't exist
+	cmdline := fmt.Sprintf("root=LABEL=%s ro", rootfsLabel)
+	if classicStateMachine.ImageDef.KernelCmdline != "" {
+		cmdline += " " + classicStateMachine.ImageDef.KernelCmdline
+	}
+	if err := osMkdirAll(filepath.Join(mountDir, "etc", "kernel"), 0755); err != nil {
+		return fmt.Errorf("Error creating /etc/kernel in the rootfs: %s", err.Error())
+	}
+	err = osWriteFile(filepath.Join(mountDir, "etc", "kernel", "cmdline"), []byte(cmdline+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("Error writing the kernel command line: %s", err.Error())
+	}
+
+	updateCmds := []*exec.Cmd{
+		execCommand("chroot", mountDir, "bootctl", "install", "--no-variables",
+			"--esp-path=/boot/efi"),
+	}
+	kernels, _ := filepath.Glob(filepath.Join(mountDir, "boot", "vmlinuz-*"))
+	for _, kernel := range kernels {
+		kernelVersion := strings.TrimPrefix(filepath.Base(kernel), "vmlinuz-")
+		installArgs := []string{mountDir, "kernel-install", "add", kernelVersion,
+			"/boot/" + filepath.Base(kernel)}
+		initrd := "initrd.img-" + kernelVersion
+		if _, err := os.Stat(filepath.Join(mountDir, "boot", initrd)); err == nil {
+			installArgs = append(installArgs, "/boot/"+initrd)
+		}
+		updateCmds = append(updateCmds, execCommand("chroot", installArgs...))
+	}
+	return stateMachine.runBootloaderCommands(updateCmds...)
+}
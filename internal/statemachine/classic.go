@@ -1,13 +1,16 @@
 package statemachine
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/canonical/ubuntu-image/internal/commands"
 	"github.com/canonical/ubuntu-image/internal/imagedefinition"
 )
 
 // classicStates are the names and function variables to be executed by the state machine for classic images
 var startingClassicStates = []stateFunc{
-	{"parse_image_definition", (*StateMachine).parseImageDefinition},
+	{"parse_image_definition", (*StateMachine).parseImageDefinitionOnce},
 	{"calculate_states", (*StateMachine).calculateStates},
 	{"make_temporary_directories", (*StateMachine).makeTemporaryDirectories},
 	{"determine_output_directory", (*StateMachine).determineOutputDirectory},
@@ -32,10 +35,24 @@ type ClassicStateMachine struct {
 	Args     commands.ClassicArgs
 	Packages []string
 	Snaps    []string
+
+	// the image definition, when it is read from stdin
+	stdinImageDefinition []byte
+
+	// whether ImageDef was already parsed, so that Setup and the
+	// parse_image_definition state only parse it once
+	imageDefinitionParsed bool
 }
 
 // Setup assigns variables and calls other functions that must be executed before Run()
 func (classicStateMachine *ClassicStateMachine) Setup() error {
+	setupStart := time.Now()
+	return classicStateMachine.recordSetupResult(setupStart, classicStateMachine.setup())
+}
+
+// setup validates the options and sets up the states of the build. Its error
+// is recorded in the build result by Setup
+func (classicStateMachine *ClassicStateMachine) setup() error {
 	// set the parent pointer of the embedded struct
 	classicStateMachine.parent = classicStateMachine
 
@@ -47,10 +64,103 @@ func (classicStateMachine *ClassicStateMachine) Setup() error {
 		return err
 	}
 
-	// if --resume was passed, figure out where to start
+	// make sure the requested disk image format is supported before the build starts
+	if err := classicStateMachine.validateFormat(classicStateMachine.Opts.Format); err != nil {
+		return err
+	}
+
+	// the rootfs-squashfs artifact can only be checked once the image definition
+	// is parsed, but the syntax of --comp can be validated right away
+	if _, _, err := parseSquashfsCompression(classicStateMachine.Opts.Comp); err != nil {
+		return err
+	}
+
+	// a typo in --series would only be reported once the image definition is parsed
+	if err := validateSeries(classicStateMachine.Opts.Series); err != nil {
+		return err
+	}
+
+	// the apt lists are only cached once the packages are installed
+	if _, err := classicStateMachine.aptCacheTTL(); err != nil {
+		return err
+	}
+
+	// the cloud-init seed is embedded late in the build, so check it right away
+	if err := classicStateMachine.validateCloudInitSeed(); err != nil {
+		return err
+	}
+
+	// the classic states depend on the image definition, so they have to be
+	// calculated again before the saved state can be matched against them
+	resuming := classicStateMachine.stateMachineFlags.Resume ||
+		classicStateMachine.stateMachineFlags.ResumeFrom != ""
+	if resuming && classicStateMachine.Args.ImageDefinition != "" {
+		if err := classicStateMachine.parseImageDefinitionOnce(); err != nil {
+			return err
+		}
+		if err := classicStateMachine.calculateStates(); err != nil {
+			return err
+		}
+	}
+
+	// with --offline, make sure that nothing has to be fetched before building
+	// anything. Resumed builds are only checked when the snaps are staged
+	if classicStateMachine.commonFlags.Offline && !resuming {
+		if err := classicStateMachine.parseImageDefinitionOnce(); err != nil {
+			return err
+		}
+		if err := classicStateMachine.checkOfflineImageDefinition(); err != nil {
+			return err
+		}
+	}
+
+	// skip the build if nothing it depends on changed since the last one
+	if classicStateMachine.shouldSkipUnchangedBuild() {
+		if err := classicStateMachine.parseImageDefinitionOnce(); err != nil {
+			return err
+		}
+		upToDate, err := classicStateMachine.isBuildUpToDate()
+		if err != nil {
+			return err
+		}
+		if upToDate {
+			classicStateMachine.buildUpToDate = true
+			if !classicStateMachine.commonFlags.Quiet {
+				fmt.Printf("The image definition and the build inputs did not change since " +
+					"the last build, skipping it. Use --force to build the image again\n")
+			}
+			return nil
+		}
+	}
+
+	// make sure the local files the image is built from are there before anything
+	// is built. Resumed builds may have already used, and removed, some of them,
+	// and the options that only print or validate something don't read them
+	flags := classicStateMachine.stateMachineFlags
+	buildsImage := !flags.DryRun && !flags.ListStates && !flags.ListSnapsResolved &&
+		!flags.PrintConfig && !flags.ValidateOnly
+	if classicStateMachine.Args.ImageDefinition != "" && !resuming && buildsImage {
+		if err := classicStateMachine.parseImageDefinitionOnce(); err != nil {
+			return err
+		}
+		if err := classicStateMachine.checkReferencedPaths(); err != nil {
+			return err
+		}
+	}
+
+	// if --resume or --resume-from was passed, figure out where to start
 	if err := classicStateMachine.readMetadata(); err != nil {
 		return err
 	}
 
+	// if calculate_states still has to run, drop the states it would add again
+	if resuming {
+		for i, state := range startingClassicStates {
+			if state.name == "calculate_states" && classicStateMachine.StepsTaken <= i {
+				classicStateMachine.states = startingClassicStates[classicStateMachine.StepsTaken:]
+			}
+		}
+	}
+
 	return nil
 }
@@ -2,7 +2,7 @@ package statemachine
 
 import (
 	"bufio"
-	"context"
+	"bytes"
 	"fmt"
 	"io"
 	"net/url"
@@ -22,25 +22,100 @@ import (
 	"github.com/snapcore/snapd/image/preseed"
 	"github.com/snapcore/snapd/osutil"
 	"github.com/snapcore/snapd/snap"
-	"github.com/snapcore/snapd/store"
 	"github.com/xeipuuv/gojsonschema"
 
 	"gopkg.in/yaml.v2"
 )
 
+// imageDefinitionStdin is the image definition argument that reads it from stdin
+const imageDefinitionStdin = "-"
+
+// parseImageDefinitionOnce parses the image definition, unless it was already parsed.
+// Setup needs it for some options, and the parse_image_definition state then reuses it
+func (stateMachine *StateMachine) parseImageDefinitionOnce() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+	if classicStateMachine.imageDefinitionParsed {
+		return nil
+	}
+	if err := stateMachine.parseImageDefinition(); err != nil {
+		return err
+	}
+	classicStateMachine.imageDefinitionParsed = true
+	return nil
+}
+
 // parseImageDefinition parses the provided yaml file and ensures it is valid
 func (stateMachine *StateMachine) parseImageDefinition() error {
 	var classicStateMachine *ClassicStateMachine
 	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
 
-	// Open and decode the yaml file
+	// Open and decode the yaml file. The relative paths it contains are
+	// relative to the current working directory, even when read from stdin
 	var imageDefinition imagedefinition.ImageDefinition
-	imageFile, err := os.Open(classicStateMachine.Args.ImageDefinition)
-	if err != nil {
-		return fmt.Errorf("Error opening image definition file: %s", err.Error())
+	var imageData []byte
+	if classicStateMachine.Args.ImageDefinition == imageDefinitionStdin {
+		// stdin can only be read once
+		if classicStateMachine.stdinImageDefinition == nil {
+			stdinData, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				return fmt.Errorf("Error reading image definition from stdin: %s", err.Error())
+			}
+			classicStateMachine.stdinImageDefinition = stdinData
+		}
+		imageData = classicStateMachine.stdinImageDefinition
+	} else {
+		imageFile, err := os.Open(classicStateMachine.Args.ImageDefinition)
+		if err != nil {
+			return fmt.Errorf("Error opening image definition file: %s", err.Error())
+		}
+		defer imageFile.Close()
+		imageData, err = io.ReadAll(imageFile)
+		if err != nil {
+			return fmt.Errorf("Error reading image definition file: %s", err.Error())
+		}
+	}
+
+	// the environment variables are expanded in the values of the YAML before it is decoded
+	if !classicStateMachine.Opts.NoEnvExpand {
+		var err error
+		imageData, err = expandEnvironment(imageData)
+		if err != nil {
+			return fmt.Errorf("Error expanding the environment variables of the image definition: %s",
+				err.Error())
+		}
+	}
+	if err := yaml.NewDecoder(bytes.NewReader(imageData)).Decode(&imageDefinition); err != nil {
+		return err
+	}
+	convertPluginConfigs(&imageDefinition)
+
+	// --arch takes precedence over the architecture in the image definition
+	if classicStateMachine.Opts.Arch != "" {
+		imageDefinition.Architecture = classicStateMachine.Opts.Arch
+	}
+
+	// --series takes precedence over the series in the image definition. The series
+	// appears in apt sources, where it is always lower-cased
+	if classicStateMachine.Opts.Series != "" {
+		imageDefinition.Series = classicStateMachine.Opts.Series
+	}
+	imageDefinition.Series = strings.ToLower(strings.TrimSpace(imageDefinition.Series))
+
+	// --rootfs-tarball replaces the way the rootfs is built in the image definition
+	if classicStateMachine.Opts.RootfsTarball != "" {
+		overrideRootfsTarball(&imageDefinition, classicStateMachine.Opts.RootfsTarball)
+	}
+
+	// --rootfs-only replaces the disk images of the image definition with a rootfs tarball
+	if classicStateMachine.Opts.RootfsOnly != "" {
+		overrideRootfsOnly(&imageDefinition, classicStateMachine.Opts.RootfsOnly)
 	}
-	defer imageFile.Close()
-	if err := yaml.NewDecoder(imageFile).Decode(&imageDefinition); err != nil {
+
+	// the packages and PPAs passed on the command line are validated along
+	// with the ones of the image definition
+	if err := addCommandLineCustomization(&imageDefinition,
+		classicStateMachine.Opts.ExtraPackages, classicStateMachine.Opts.ExtraPPAs); err != nil {
 		return err
 	}
 
@@ -72,8 +147,43 @@ func (stateMachine *StateMachine) parseImageDefinition() error {
 		return fmt.Errorf("Schema validation returned an error: %s", err.Error())
 	}
 
+	// do custom validation for the series being an Ubuntu release. A missing series
+	// is reported by helperCheckEmptyFields
+	if imageDefinition.Series != "" && !imagedefinition.IsKnownSeries(imageDefinition.Series) {
+		jsonContext := gojsonschema.NewJsonContext("series_validation", nil)
+		errDetail := gojsonschema.ErrorDetails{
+			"series": imageDefinition.Series,
+			"hint":   imagedefinition.SeriesHint(imageDefinition.Series),
+		}
+		result.AddError(
+			imagedefinition.NewUnknownSeriesError(
+				gojsonschema.NewJsonContext("unknownSeries", jsonContext),
+				52,
+				errDetail,
+			),
+			errDetail,
+		)
+	}
+
 	// do custom validation for gadgetURL being required if gadget is not pre-built
+	// and for the sha256sum, which can only verify tarballs
 	if imageDefinition.Gadget != nil {
+		if imageDefinition.Gadget.SHA256sum != "" && imageDefinition.Gadget.GadgetType != "tarball" {
+			jsonContext := gojsonschema.NewJsonContext("gadget_sha256sum_validation", nil)
+			errDetail := gojsonschema.ErrorDetails{
+				"key1":  "gadget:sha256sum",
+				"key2":  "gadget:type",
+				"value": "tarball",
+			}
+			result.AddError(
+				imagedefinition.NewKeyRequiresValueError(
+					gojsonschema.NewJsonContext("keyRequiresValue", jsonContext),
+					52,
+					errDetail,
+				),
+				errDetail,
+			)
+		}
 		if imageDefinition.Gadget.GadgetType != "prebuilt" && imageDefinition.Gadget.GadgetURL == "" {
 			jsonContext := gojsonschema.NewJsonContext("gadget_validation", nil)
 			errDetail := gojsonschema.ErrorDetails{
@@ -133,6 +243,26 @@ func (stateMachine *StateMachine) parseImageDefinition() error {
 				)
 			}
 		}
+		// do custom validation for the hostname, since the pattern of a valid
+		// hostname can't be written in the struct tags
+		hostname := imageDefinition.Customization.Hostname
+		if hostname != "" {
+			if reason := imagedefinition.HostnameError(hostname); reason != "" {
+				jsonContext := gojsonschema.NewJsonContext("hostname_validation", nil)
+				errDetail := gojsonschema.ErrorDetails{
+					"hostname": hostname,
+					"reason":   reason,
+				}
+				result.AddError(
+					imagedefinition.NewInvalidHostnameError(
+						gojsonschema.NewJsonContext("invalidHostname", jsonContext),
+						52,
+						errDetail,
+					),
+					errDetail,
+				)
+			}
+		}
 		// do custom validation for manual customization paths
 		if imageDefinition.Customization.Manual != nil {
 			jsonContext := gojsonschema.NewJsonContext("manual_path_validation", nil)
@@ -193,6 +323,13 @@ func (stateMachine *StateMachine) parseImageDefinition() error {
 		return fmt.Errorf("Schema validation failed: %s", result.Errors())
 	}
 
+	// make sure the manual customizations can be ordered before anything is built
+	if imageDefinition.Customization != nil {
+		if _, err := orderManualSteps(imageDefinition.Customization.Manual); err != nil {
+			return err
+		}
+	}
+
 	// Validation succeeded, so set the value in the parent struct
 	classicStateMachine.ImageDef = imageDefinition
 
@@ -210,11 +347,45 @@ func (stateMachine *StateMachine) calculateStates() error {
 
 	var rootfsCreationStates []stateFunc
 
+	// building the rootfs runs commands in a chroot of the target architecture.
+	// Make sure they can be emulated before anything is downloaded or built
+	if classicStateMachine.ImageDef.Rootfs.Tarball == nil &&
+		isForeignArch(classicStateMachine.ImageDef.Architecture, getHostArch()) {
+		rootfsCreationStates = append(rootfsCreationStates,
+			stateFunc{"check_qemu_user", (*StateMachine).checkQemuUser})
+	}
+
+	// the packages of the bootloader are installed early, so check that it
+	// supports the architecture of the image first
+	if err := classicStateMachine.validateBootloader(); err != nil {
+		return err
+	}
+
+	// with --format iso, the rootfs boots from a squashfs of a live ISO instead of
+	// partitions. Make sure the tools making it are there before the rootfs is built
+	liveIso := classicStateMachine.Opts.Format == liveIsoFormat
+	if liveIso {
+		if err := classicStateMachine.validateLiveIso(); err != nil {
+			return err
+		}
+		rootfsCreationStates = append(rootfsCreationStates,
+			stateFunc{"check_iso_tools", (*StateMachine).checkIsoTools})
+	}
+
+	// the rootfs is packed at the very end of the build, so make sure the host
+	// mksquashfs supports the requested compressor before anything else is done
+	if classicStateMachine.ImageDef.Artifacts.RootfsSquashfs != nil || liveIso {
+		rootfsCreationStates = append(rootfsCreationStates,
+			stateFunc{"check_mksquashfs", (*StateMachine).checkMksquashfs})
+	}
+
 	if classicStateMachine.ImageDef.Gadget != nil {
 		// determine the states needed for preparing the gadget
 		switch classicStateMachine.ImageDef.Gadget.GadgetType {
 		case "git":
 			fallthrough
+		case "tarball":
+			fallthrough
 		case "directory":
 			rootfsCreationStates = append(rootfsCreationStates,
 				stateFunc{"build_gadget_tree", (*StateMachine).buildGadgetTree})
@@ -225,9 +396,12 @@ func (stateMachine *StateMachine) calculateStates() error {
 			break
 		}
 
-		// Load the gadget yaml after the gadget is built
+		// Validate and load the gadget yaml after the gadget is built
 		rootfsCreationStates = append(rootfsCreationStates,
+			stateFunc{"validate_gadget_yaml", (*StateMachine).validateGadgetYaml},
 			stateFunc{"load_gadget_yaml", (*StateMachine).loadGadgetYaml})
+	} else if stateMachine.stateMachineFlags.ValidateOnly {
+		return fmt.Errorf("cannot use --validate-only: the image definition has no gadget")
 	}
 
 	// if artifacts are specified, verify the correctness and store them in the struct
@@ -261,15 +435,32 @@ func (stateMachine *StateMachine) calculateStates() error {
 	} else if classicStateMachine.ImageDef.Rootfs.Seed != nil {
 		rootfsCreationStates = append(rootfsCreationStates, rootfsSeedStates...)
 		if classicStateMachine.ImageDef.Customization != nil {
+			// the packages are removed from the rootfs built by debootstrap,
+			// before the seeded and extra packages are installed
+			if len(classicStateMachine.ImageDef.Customization.RemovePackages) > 0 {
+				rootfsCreationStates = append(rootfsCreationStates,
+					stateFunc{"remove_packages", (*StateMachine).removePackages})
+			}
 			if len(classicStateMachine.ImageDef.Customization.ExtraPPAs) > 0 {
 				rootfsCreationStates = append(rootfsCreationStates,
 					stateFunc{"add_extra_ppas", (*StateMachine).addExtraPPAs})
 			}
+			if len(classicStateMachine.ImageDef.Customization.ExtraSources) > 0 {
+				rootfsCreationStates = append(rootfsCreationStates,
+					stateFunc{"add_extra_sources", (*StateMachine).addExtraSources})
+			}
+			// the pins are checked against the sources once they are all configured
+			if len(classicStateMachine.ImageDef.Customization.AptPins) > 0 {
+				rootfsCreationStates = append(rootfsCreationStates,
+					stateFunc{"add_apt_pins", (*StateMachine).addAptPins})
+			}
 		}
 		rootfsCreationStates = append(rootfsCreationStates,
 			[]stateFunc{
 				{"install_packages", (*StateMachine).installPackages},
 				{"prepare_image", (*StateMachine).prepareClassicImage},
+				{"check_seed", (*StateMachine).checkSeed},
+				{"check_snap_bases", (*StateMachine).checkSnapBases},
 				{"preseed_image", (*StateMachine).preseedClassicImage},
 			}...,
 		)
@@ -281,24 +472,108 @@ func (stateMachine *StateMachine) calculateStates() error {
 	// Determine any customization that needs to run before the image is created
 	//TODO: installer image customization... eventually.
 	if classicStateMachine.ImageDef.Customization != nil {
+		if hasPluginsAt(classicStateMachine.ImageDef.Customization, pluginStageBefore) {
+			rootfsCreationStates = append(rootfsCreationStates,
+				stateFunc{"run_plugins_before_customize", (*StateMachine).runPluginsBeforeCustomization})
+		}
 		if classicStateMachine.ImageDef.Customization.CloudInit != nil {
 			rootfsCreationStates = append(rootfsCreationStates,
 				stateFunc{"customize_cloud_init", (*StateMachine).customizeCloudInit})
 		}
-		if len(classicStateMachine.ImageDef.Customization.Fstab) > 0 {
+		// a generated fstab gets the entries of the image definition appended instead
+		if len(classicStateMachine.ImageDef.Customization.Fstab) > 0 &&
+			!classicStateMachine.ImageDef.Customization.GenerateFstab {
 			rootfsCreationStates = append(rootfsCreationStates,
 				stateFunc{"customize_fstab", (*StateMachine).customizeFstab})
 		}
+		if classicStateMachine.ImageDef.Customization.Timezone != "" {
+			rootfsCreationStates = append(rootfsCreationStates,
+				stateFunc{"customize_timezone", (*StateMachine).customizeTimezone})
+		}
+		if classicStateMachine.ImageDef.Customization.Locale != "" {
+			rootfsCreationStates = append(rootfsCreationStates,
+				stateFunc{"customize_locale", (*StateMachine).customizeLocale})
+		}
+		if classicStateMachine.ImageDef.Customization.Hostname != "" {
+			rootfsCreationStates = append(rootfsCreationStates,
+				stateFunc{"customize_hostname", (*StateMachine).customizeHostname})
+		}
+		if len(classicStateMachine.ImageDef.Customization.Users) > 0 {
+			rootfsCreationStates = append(rootfsCreationStates,
+				stateFunc{"customize_users", (*StateMachine).customizeUsers})
+		}
+		if len(classicStateMachine.ImageDef.Customization.Overlays) > 0 {
+			rootfsCreationStates = append(rootfsCreationStates,
+				stateFunc{"apply_overlays", (*StateMachine).applyOverlays})
+		}
 		if classicStateMachine.ImageDef.Customization.Manual != nil {
 			rootfsCreationStates = append(rootfsCreationStates,
 				stateFunc{"perform_manual_customization", (*StateMachine).manualCustomization})
 		}
+		if hasPluginsAt(classicStateMachine.ImageDef.Customization, pluginStageAfter) {
+			rootfsCreationStates = append(rootfsCreationStates,
+				stateFunc{"run_plugins_after_customize", (*StateMachine).runPluginsAfterCustomization})
+		}
+		// the packages and the other customizations may have set a machine-id, so
+		// it is handled last
+		if classicStateMachine.ImageDef.Customization.MachineID != "" {
+			rootfsCreationStates = append(rootfsCreationStates,
+				stateFunc{"customize_machine_id", (*StateMachine).customizeMachineID})
+		}
+	}
+
+	// the kernel command line is configured once the gadget is loaded, so that
+	// its bootloader is known
+	if classicStateMachine.ImageDef.KernelCmdline != "" {
+		if classicStateMachine.ImageDef.Gadget == nil {
+			return fmt.Errorf("kernel-cmdline can only be used with a gadget, which defines the bootloader")
+		}
+		if strings.ContainsAny(classicStateMachine.ImageDef.KernelCmdline, "\"$`\\\n") {
+			return fmt.Errorf("invalid kernel-cmdline \"%s\": it can not contain quotes, "+
+				"backslashes, $, ` or newlines", classicStateMachine.ImageDef.KernelCmdline)
+		}
+		rootfsCreationStates = append(rootfsCreationStates,
+			stateFunc{"configure_kernel_cmdline", (*StateMachine).configureKernelCmdline})
+	}
+
+	// the extra PPAs and apt sources are only used to build the rootfs, unless
+	// the image definition asks to keep them enabled in the image
+	var cleanupStates []stateFunc
+	for _, state := range rootfsCreationStates {
+		switch {
+		case state.name == "add_extra_ppas" &&
+			hasDisabledPPAs(classicStateMachine.ImageDef.Customization.ExtraPPAs):
+			cleanupStates = append(cleanupStates,
+				stateFunc{"remove_extra_ppas", (*StateMachine).removeExtraPPAs})
+		case state.name == "add_extra_sources" &&
+			hasDisabledSources(classicStateMachine.ImageDef.Customization.ExtraSources):
+			cleanupStates = append(cleanupStates,
+				stateFunc{"remove_extra_sources", (*StateMachine).removeExtraSources})
+		}
+	}
+	rootfsCreationStates = append(rootfsCreationStates, cleanupStates...)
+
+	// files are stripped once nothing is installed in the rootfs anymore
+	if classicStateMachine.ImageDef.Customization != nil &&
+		classicStateMachine.ImageDef.Customization.Strip != nil {
+		rootfsCreationStates = append(rootfsCreationStates,
+			stateFunc{"strip_rootfs", (*StateMachine).stripRootfs})
 	}
 
 	// The rootfs is laid out in a staging area, now populate it in the correct location
 	rootfsCreationStates = append(rootfsCreationStates,
 		stateFunc{"populate_rootfs_contents", (*StateMachine).populateClassicRootfsContents})
 
+	// the fstab is generated from the partitions of gadget.yaml once the rootfs is in place
+	if classicStateMachine.ImageDef.Customization != nil &&
+		classicStateMachine.ImageDef.Customization.GenerateFstab {
+		if classicStateMachine.ImageDef.Gadget == nil {
+			return fmt.Errorf("generate-fstab can only be used with a gadget, which defines the partitions")
+		}
+		rootfsCreationStates = append(rootfsCreationStates,
+			stateFunc{"generate_fstab", (*StateMachine).generateFstab})
+	}
+
 	// if the --disk-info flag was used on the command line place it in the correct
 	// location in the rootfs
 	if stateMachine.commonFlags.DiskInfo != "" {
@@ -306,11 +581,34 @@ func (stateMachine *StateMachine) calculateStates() error {
 			stateFunc{"generate_disk_info", (*StateMachine).generateDiskInfo})
 	}
 
-	if classicStateMachine.ImageDef.Gadget != nil {
+	// the cloud-init seed is written once the rootfs is in place, and before the
+	// partitions it can be written to are created
+	if classicStateMachine.Opts.CloudInitUserData != "" {
+		rootfsCreationStates = append(rootfsCreationStates,
+			stateFunc{"embed_cloud_init_seed", (*StateMachine).embedCloudInitSeed})
+	}
+
+	// the SBOM describes the fully populated rootfs, before it is packed in any artifact
+	if classicStateMachine.Opts.SBOM != "" {
+		rootfsCreationStates = append(rootfsCreationStates,
+			stateFunc{"generate_sbom", (*StateMachine).generateSBOM})
+	}
+
+	// with --rootfs-only and --format iso, the gadget is still validated but no
+	// partition is made from it
+	makesPartitions := classicStateMachine.ImageDef.Gadget != nil &&
+		classicStateMachine.Opts.RootfsOnly == "" && !liveIso
+	if makesPartitions {
 		// Add the "always there" states that populate partitions, build the disk, etc.
 		// This includes the no-op "finish" state to signify successful setup
 		rootfsCreationStates = append(rootfsCreationStates, imageCreationStates...)
 
+		// the filesystems are checked before they are written to the disk images
+		if stateMachine.commonFlags.VerifyFS {
+			rootfsCreationStates = append(rootfsCreationStates,
+				stateFunc{"verify_filesystems", (*StateMachine).verifyFilesystems})
+		}
+
 		// only run makeDisk if there is an artifact to make
 		if classicStateMachine.ImageDef.Artifacts.Img != nil {
 			rootfsCreationStates = append(rootfsCreationStates,
@@ -320,6 +618,35 @@ func (stateMachine *StateMachine) calculateStates() error {
 		}
 	}
 
+	// the recovery system is seeded in the background once gadget.yaml is known to
+	// have a recovery structure, and its seed is copied to the partition along with
+	// the contents of the other partitions
+	populatedPartitions := "populate_bootfs_contents"
+	if classicStateMachine.ImageDef.Recovery != nil {
+		if classicStateMachine.ImageDef.Gadget == nil {
+			return fmt.Errorf("recovery can only be used with a gadget, which defines the recovery partition")
+		}
+		if makesPartitions {
+			rootfsCreationStates = insertStatesAfter(rootfsCreationStates, "load_gadget_yaml",
+				stateFunc{"start_recovery_seed", (*StateMachine).startRecoverySeed})
+			rootfsCreationStates = insertStatesAfter(rootfsCreationStates, "populate_bootfs_contents",
+				stateFunc{"populate_recovery_partition", (*StateMachine).populateRecoveryPartition})
+			populatedPartitions = "populate_recovery_partition"
+		}
+	}
+
+	// with SOURCE_DATE_EPOCH, the modification times are clamped once the rootfs and
+	// the contents of the partitions are in place, before anything is built from them
+	if _, isSet, _ := helper.SourceDateEpoch(); isSet {
+		clampState := stateFunc{"clamp_mtimes", (*StateMachine).clampMtimes}
+		if makesPartitions {
+			rootfsCreationStates = insertStatesAfter(rootfsCreationStates,
+				populatedPartitions, clampState)
+		} else {
+			rootfsCreationStates = append(rootfsCreationStates, clampState)
+		}
+	}
+
 	// only run makeDisk if there is an artifact to make
 	if classicStateMachine.ImageDef.Artifacts.Qcow2 != nil {
 		// only run make_disk once
@@ -339,6 +666,46 @@ func (stateMachine *StateMachine) calculateStates() error {
 			stateFunc{"make_qcow2_image", (*StateMachine).makeQcow2Img})
 	}
 
+	// the partition tables are checked against gadget.yaml once they are written, after
+	// the bootloader is installed since it makes the disk images again when no loop
+	// device can be set up. With --no-loop, the bootloader is installed before the
+	// partitions are made, so the tables are checked right after make_disk
+	verifiedState := "update_bootloader"
+	if classicStateMachine.noLoop() {
+		verifiedState = "make_disk"
+	}
+	rootfsCreationStates = insertStatesAfter(rootfsCreationStates, verifiedState,
+		stateFunc{"verify_partition_tables", (*StateMachine).verifyPartitionTables})
+
+	// without loop devices, the bootloader is configured in the contents
+	// of the partitions before their filesystems are made
+	if classicStateMachine.noLoop() {
+		rootfsCreationStates = moveStateBefore(rootfsCreationStates,
+			"update_bootloader", "populate_prepare_partitions")
+	}
+
+	// the boot components are measured once the ESP and the rootfs are populated.
+	// systemd-boot is installed to the ESP by update_bootloader, which only updates
+	// the contents of the partitions without loop devices
+	if stateMachine.commonFlags.Measure != "" {
+		if !makesPartitions {
+			return fmt.Errorf("--measure can only predict the measurements of the disk " +
+				"images made from a gadget")
+		}
+		measuredState := populatedPartitions
+		if classicStateMachine.Opts.Bootloader == "systemd-boot" &&
+			hasState(rootfsCreationStates, "update_bootloader") {
+			if !classicStateMachine.noLoop() {
+				return fmt.Errorf("--measure can only be used with --bootloader systemd-boot " +
+					"and --no-loop, as systemd-boot is otherwise installed once the disk " +
+					"images are made")
+			}
+			measuredState = "update_bootloader"
+		}
+		rootfsCreationStates = insertStatesAfter(rootfsCreationStates, measuredState,
+			stateFunc{"measure_boot_components", (*StateMachine).measureBootComponents})
+	}
+
 	// only run generatePackageManifest if there is a manifest in the image definition
 	if classicStateMachine.ImageDef.Artifacts.Manifest != nil {
 		rootfsCreationStates = append(rootfsCreationStates,
@@ -357,6 +724,67 @@ func (stateMachine *StateMachine) calculateStates() error {
 			stateFunc{"generate_rootfs_tarball", (*StateMachine).generateRootfsTarball})
 	}
 
+	// only run generateRootfsSquashfs if there is a rootfs-squashfs in the image definition
+	if classicStateMachine.ImageDef.Artifacts.RootfsSquashfs != nil {
+		rootfsCreationStates = append(rootfsCreationStates,
+			stateFunc{"generate_rootfs_squashfs", (*StateMachine).generateRootfsSquashfs})
+	}
+
+	// the kernel and the initrd are copied from the rootfs in its final state
+	if classicStateMachine.Opts.ExtractKernel {
+		rootfsCreationStates = append(rootfsCreationStates,
+			stateFunc{"extract_kernel", (*StateMachine).extractKernel})
+	}
+
+	// the raw disk image is written to the device before it is converted or compressed
+	if stateMachine.commonFlags.OutputDevice != "" {
+		rootfsCreationStates = append(rootfsCreationStates,
+			stateFunc{"write_output_device", (*StateMachine).writeOutputDevice})
+	}
+
+	// convert the raw disk images to the format requested with --format. This
+	// is done last so that any other artifacts can still make use of the raw images.
+	// The live ISO is made from the rootfs instead, once it is in its final state
+	if liveIso {
+		rootfsCreationStates = append(rootfsCreationStates,
+			stateFunc{"make_live_iso", (*StateMachine).makeLiveIso})
+	} else if classicStateMachine.Opts.Format != "" && classicStateMachine.Opts.Format != "raw" &&
+		classicStateMachine.ImageDef.Artifacts.Img != nil {
+		rootfsCreationStates = append(rootfsCreationStates,
+			stateFunc{"convert_disk_images", (*StateMachine).convertDiskImages})
+	}
+
+	// the raw disk images are compressed once nothing else needs them
+	if stateMachine.commonFlags.Compress != "" {
+		rootfsCreationStates = append(rootfsCreationStates,
+			stateFunc{"compress_disk_images", (*StateMachine).compressDiskImages})
+	}
+
+	// the build manifest is named after the disk images, so it is written once they
+	// all have their final name
+	if stateMachine.commonFlags.Manifest || stateMachine.commonFlags.ManifestPath != "" {
+		rootfsCreationStates = append(rootfsCreationStates,
+			stateFunc{"generate_build_manifest", (*StateMachine).generateBuildManifest})
+	}
+
+	// checksums are calculated once all the disk images are in their final format
+	if stateMachine.commonFlags.Checksum != "" {
+		rootfsCreationStates = append(rootfsCreationStates,
+			stateFunc{"generate_checksums", (*StateMachine).generateChecksums})
+	}
+
+	// the final artifacts are signed last, once they are compressed and their
+	// checksums are known
+	if stateMachine.commonFlags.SignKey != "" {
+		rootfsCreationStates = append(rootfsCreationStates,
+			stateFunc{"sign_artifacts", (*StateMachine).signArtifacts})
+	}
+
+	// the hash of the build inputs is only recorded once all the artifacts exist,
+	// so that a failed build is never skipped by the next one
+	rootfsCreationStates = append(rootfsCreationStates,
+		stateFunc{"record_build_hash", (*StateMachine).recordBuildHash})
+
 	// add the no-op "finish" state
 	rootfsCreationStates = append(rootfsCreationStates,
 		stateFunc{"finish", (*StateMachine).finish})
@@ -396,10 +824,15 @@ func (stateMachine *StateMachine) buildGadgetTree() error {
 	var sourceDir string
 	switch classicStateMachine.ImageDef.Gadget.GadgetType {
 	case "git":
-		err := cloneGitRepo(classicStateMachine.ImageDef, gadgetDir)
+		commit, err := cloneGitRepo(stateMachine.context(), classicStateMachine.ImageDef, gadgetDir)
 		if err != nil {
 			return fmt.Errorf("Error cloning gadget repository: \"%s\"", err.Error())
 		}
+		stateMachine.GadgetCommit = fmt.Sprintf("%s %s",
+			gitRemoteURL(classicStateMachine.ImageDef.Gadget.GadgetURL), commit)
+		if stateMachine.commonFlags.Verbose || stateMachine.commonFlags.Debug {
+			fmt.Printf("Cloned commit %s of the gadget repository\n", commit)
+		}
 		sourceDir = gadgetDir
 		break
 	case "directory":
@@ -421,6 +854,21 @@ func (stateMachine *StateMachine) buildGadgetTree() error {
 
 		sourceDir = filepath.Join(gadgetDir)
 		break
+	case "tarball":
+		// download the tarball next to the gadget directory if needed,
+		// and verify it before extracting it
+		tarPath, err := fetchSource(stateMachine.context(), classicStateMachine.ImageDef.Gadget.GadgetURL,
+			stateMachine.tempDirs.scratch, "gadget tarball",
+			classicStateMachine.ImageDef.Gadget.SHA256sum)
+		if err != nil {
+			return err
+		}
+		if err := helper.ExtractTarArchive(stateMachine.commandRunner(), tarPath, gadgetDir,
+			stateMachine.commonFlags.Verbose, stateMachine.commonFlags.Debug); err != nil {
+			return fmt.Errorf("Error extracting gadget tarball: %s", err.Error())
+		}
+		sourceDir = gadgetDir
+		break
 	}
 
 	// now run "make" to build the gadget tree
@@ -442,7 +890,7 @@ func (stateMachine *StateMachine) buildGadgetTree() error {
 
 	makeOutput := helper.SetCommandOutput(makeCmd, classicStateMachine.commonFlags.Debug)
 
-	if err := makeCmd.Run(); err != nil {
+	if err := runCommand(stateMachine.context(), makeCmd); err != nil {
 		return fmt.Errorf("Error running \"make\" in gadget source. "+
 			"Error is \"%s\". Full output below:\n%s",
 			err.Error(), makeOutput.String())
@@ -486,6 +934,80 @@ func (stateMachine *StateMachine) prepareGadgetTree() error {
 	return nil
 }
 
+// checkMksquashfs makes sure that mksquashfs is installed on the host and was
+// built with the compressor passed with --comp
+func (stateMachine *StateMachine) checkMksquashfs() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	compressor, _, err := parseSquashfsCompression(classicStateMachine.Opts.Comp)
+	if err != nil {
+		return err
+	}
+	if _, err := execLookPath("mksquashfs"); err != nil {
+		return fmt.Errorf("Cannot create the squashfs of the rootfs: mksquashfs was not found. " +
+			"Install squashfs-tools to create it")
+	}
+	// some versions of mksquashfs exit with an error after printing their
+	// help, so only the output is looked at
+	var helpOutput bytes.Buffer
+	helpCmd := execCommand("mksquashfs", "-help")
+	helpCmd.Stdout = &helpOutput
+	helpCmd.Stderr = &helpOutput
+	_ = runCommand(stateMachine.context(), helpCmd)
+	if !mksquashfsSupportsCompressor(helpOutput.String(), compressor) {
+		return fmt.Errorf("The mksquashfs of the host does not support the %s compressor "+
+			"requested with --comp", compressor)
+	}
+	return nil
+}
+
+// checkQemuUser makes sure that the binaries of the target architecture can be run
+// in the chroot through qemu-user-static and binfmt_misc, so that a cross build
+// fails right away instead of when the first maintainer script is run
+func (stateMachine *StateMachine) checkQemuUser() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+	arch := classicStateMachine.ImageDef.Architecture
+
+	qemuStatic := getQemuStaticForArch(arch)
+	if qemuStatic == "" {
+		return fmt.Errorf("Cannot build an image for architecture %s on %s: "+
+			"there is no known qemu-user emulator for it", arch, getHostArch())
+	}
+	if _, err := execLookPath(qemuStatic); err != nil {
+		return fmt.Errorf("Cannot build an image for architecture %s: %s was not found. "+
+			"Install qemu-user-static to build images for foreign architectures", arch, qemuStatic)
+	}
+
+	handlerName := strings.TrimSuffix(qemuStatic, "-static")
+	handlerFile := filepath.Join(binfmtMiscDir, handlerName)
+	handlerBytes, err := osReadFile(handlerFile)
+	if err != nil {
+		return fmt.Errorf("Cannot build an image for architecture %s: the binfmt_misc handler "+
+			"\"%s\" is not registered. Make sure binfmt_misc is mounted and that the "+
+			"qemu-user-static binfmt handlers are registered: \"%s\"", arch, handlerName, err.Error())
+	}
+
+	// the handler must be enabled and use the F flag, which makes the
+	// kernel open the emulator when the handler is registered instead of
+	// looking it up inside the chroot
+	handler := strings.Split(string(handlerBytes), "\n")
+	if strings.TrimSpace(handler[0]) != "enabled" {
+		return fmt.Errorf("Cannot build an image for architecture %s: the binfmt_misc handler "+
+			"\"%s\" is disabled", arch, handlerName)
+	}
+	for _, line := range handler {
+		if strings.HasPrefix(line, "flags:") && !strings.Contains(line, "F") {
+			return fmt.Errorf("Cannot build an image for architecture %s: the binfmt_misc handler "+
+				"\"%s\" is not registered with the F (fix binary) flag, so it cannot be used "+
+				"in the chroot", arch, handlerName)
+		}
+	}
+
+	return nil
+}
+
 // Bootstrap a chroot environment to install packages in. It will eventually
 // become the rootfs of the image
 func (stateMachine *StateMachine) createChroot() error {
@@ -503,7 +1025,7 @@ func (stateMachine *StateMachine) createChroot() error {
 
 	debootstrapOutput := helper.SetCommandOutput(debootstrapCmd, classicStateMachine.commonFlags.Debug)
 
-	if err := debootstrapCmd.Run(); err != nil {
+	if err := runCommand(stateMachine.context(), debootstrapCmd); err != nil {
 		return fmt.Errorf("Error running debootstrap command \"%s\". Error is \"%s\". Output is: \n%s",
 			debootstrapCmd.String(), err.Error(), debootstrapOutput.String())
 	}
@@ -533,7 +1055,7 @@ func (stateMachine *StateMachine) addExtraPPAs() error {
 	}
 
 	// now create the ppa sources.list files
-	tmpGPGDir, err := osMkdirTemp("/tmp", "ubuntu-image-gpg")
+	tmpGPGDir, err := osMkdirTemp(stateMachine.tempDir("/tmp"), "ubuntu-image-gpg")
 	if err != nil {
 		return fmt.Errorf("Error creating temp dir for gpg imports: %s", err.Error())
 	}
@@ -559,7 +1081,8 @@ func (stateMachine *StateMachine) addExtraPPAs() error {
 		keyFileName := strings.Replace(ppaFileName, ".list", ".gpg", 1)
 		keyFilePath := filepath.Join(classicStateMachine.tempDirs.chroot,
 			"etc", "apt", "trusted.gpg.d", keyFileName)
-		err = importPPAKeys(ppa, tmpGPGDir, keyFilePath, stateMachine.commonFlags.Debug)
+		err = importPPAKeys(stateMachine.context(), ppa, tmpGPGDir, keyFilePath,
+			stateMachine.commonFlags.Debug)
 		if err != nil {
 			return fmt.Errorf("Error retrieving signing key for ppa \"%s\": %s",
 				ppa.PPAName, err.Error())
@@ -572,50 +1095,236 @@ func (stateMachine *StateMachine) addExtraPPAs() error {
 	return nil
 }
 
-// Install packages in the chroot environment. This is accomplished by
-// running commands to do the following:
-// 1. Mount /proc /sys /dev and /run in the chroot
-// 2. Run `apt update` in the chroot
-// 3. Run `apt install <package list>` in the chroot
-// 4. Unmount /proc /sys /dev and /run
-func (stateMachine *StateMachine) installPackages() error {
+// remove the extra PPAs that should not stay enabled in the image,
+// along with their signing keys
+func (stateMachine *StateMachine) removeExtraPPAs() error {
 	var classicStateMachine *ClassicStateMachine
 	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
 
-	// copy /etc/resolv.conf from the host system into the chroot
-	err := helperBackupAndCopyResolvConf(classicStateMachine.tempDirs.chroot)
-	if err != nil {
-		return fmt.Errorf("Error setting up /etc/resolv.conf in the chroot: \"%s\"", err.Error())
+	for _, ppa := range classicStateMachine.ImageDef.Customization.ExtraPPAs {
+		if ppa.IsKeptEnabled() {
+			continue
+		}
+		ppaFileName, _ := createPPAInfo(ppa, classicStateMachine.ImageDef.Series)
+		keyFileName := strings.Replace(ppaFileName, ".list", ".gpg", 1)
+		for _, ppaPath := range []string{
+			filepath.Join(stateMachine.tempDirs.chroot, "etc", "apt", "sources.list.d", ppaFileName),
+			filepath.Join(stateMachine.tempDirs.chroot, "etc", "apt", "trusted.gpg.d", keyFileName),
+		} {
+			if err := osRemoveAll(ppaPath); err != nil {
+				return fmt.Errorf("Error removing ppa \"%s\": %s", ppa.PPAName, err.Error())
+			}
+		}
 	}
+	return nil
+}
 
-	// if any extra packages are specified, install them alongside the seeded packages
-	if classicStateMachine.ImageDef.Customization != nil {
-		for _, packageInfo := range classicStateMachine.ImageDef.Customization.ExtraPackages {
-			classicStateMachine.Packages = append(classicStateMachine.Packages,
-				packageInfo.PackageName)
+// add the extra apt sources to the chroot and import their signing keys
+func (stateMachine *StateMachine) addExtraSources() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	// create the apt configuration directories in the chroot if they don't already exist
+	sourcesListD := filepath.Join(stateMachine.tempDirs.chroot, "etc", "apt", "sources.list.d")
+	trustedGPGD := filepath.Join(stateMachine.tempDirs.chroot, "etc", "apt", "trusted.gpg.d")
+	for _, dir := range []string{sourcesListD, trustedGPGD} {
+		if err := osMkdirAll(dir, 0755); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("Failed to create apt directory \"%s\": %s", dir, err.Error())
 		}
 	}
 
-	// Make sure to install the extra kernel if it is specified
-	if classicStateMachine.ImageDef.Kernel != "" {
-		classicStateMachine.Packages = append(classicStateMachine.Packages,
-			classicStateMachine.ImageDef.Kernel)
+	tmpGPGDir, err := osMkdirTemp(stateMachine.tempDir("/tmp"), "ubuntu-image-gpg")
+	if err != nil {
+		return fmt.Errorf("Error creating temp dir for gpg imports: %s", err.Error())
 	}
+	defer osRemoveAll(tmpGPGDir)
+	for _, source := range classicStateMachine.ImageDef.Customization.ExtraSources {
+		sourceFileName, sourceFileContents := createAptSourceInfo(source,
+			classicStateMachine.ImageDef.Series)
+		sourceFile := filepath.Join(sourcesListD, sourceFileName)
+		if err := osWriteFile(sourceFile, []byte(sourceFileContents), 0644); err != nil {
+			return fmt.Errorf("Error creating %s: %s", sourceFile, err.Error())
+		}
 
-	// Slice used to store all the commands that need to be run
-	// to install the packages
-	var installPackagesCmds []*exec.Cmd
+		if source.SigningKey == "" {
+			continue
+		}
+		keyFilePath := filepath.Join(trustedGPGD, source.Name+".gpg")
+		err = importAptSourceKey(stateMachine.context(), source, tmpGPGDir, keyFilePath, stateMachine.commonFlags.Debug)
+		if err != nil {
+			return fmt.Errorf("Error importing signing key for apt source \"%s\": %s",
+				source.Name, err.Error())
+		}
+	}
+	if err := osRemoveAll(tmpGPGDir); err != nil {
+		return fmt.Errorf("Error removing temporary gpg directory \"%s\": %s", tmpGPGDir, err.Error())
+	}
 
-	// mount some necessary partitions from the host in the chroot
-	type mountPoint struct {
-		dest     string
-		fromHost bool
+	return nil
+}
+
+// remove the extra apt sources that should not stay enabled in the image,
+// along with their signing keys
+func (stateMachine *StateMachine) removeExtraSources() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	for _, source := range classicStateMachine.ImageDef.Customization.ExtraSources {
+		if source.KeepEnabled {
+			continue
+		}
+		sourceFileName, _ := createAptSourceInfo(source, classicStateMachine.ImageDef.Series)
+		for _, sourcePath := range []string{
+			filepath.Join(stateMachine.tempDirs.chroot, "etc", "apt", "sources.list.d", sourceFileName),
+			filepath.Join(stateMachine.tempDirs.chroot, "etc", "apt", "trusted.gpg.d", source.Name+".gpg"),
+		} {
+			if err := osRemoveAll(sourcePath); err != nil {
+				return fmt.Errorf("Error removing apt source \"%s\": %s", source.Name, err.Error())
+			}
+		}
 	}
-	mountPoints := []mountPoint{
-		{
-			dest:     "/dev",
-			fromHost: true,
-		},
+	return nil
+}
+
+// aptSimulatedRemoval matches the packages that apt-get --simulate reports it would remove
+var aptSimulatedRemoval = regexp.MustCompile(`(?m)^(?:Purg|Remv) ([^ :]+)`)
+
+// removePackages purges the packages listed in remove-packages from the base rootfs,
+// before the other packages are installed. apt-get is first run with --simulate, and
+// nothing is removed if other packages depend on them, since apt-get would remove
+// those too. apt-get check then makes sure the dependencies are still satisfied.
+// The packages are then pinned with a negative priority in /etc/apt/preferences.d,
+// so that the packages installed afterwards can't pull them in again
+func (stateMachine *StateMachine) removePackages() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	removedPackages := classicStateMachine.ImageDef.Customization.RemovePackages
+	purgeArgs := append([]string{stateMachine.tempDirs.chroot, "apt-get", "purge", "--quiet"},
+		removedPackages...)
+
+	simulateCmd := execCommand("chroot", append(purgeArgs, "--simulate")...)
+	var simulateOutput, simulateErr bytes.Buffer
+	simulateCmd.Stdout = &simulateOutput
+	simulateCmd.Stderr = &simulateErr
+	if err := runCommand(stateMachine.context(), simulateCmd); err != nil {
+		return fmt.Errorf("Error running command \"%s\". Error is \"%s\". Output is: \n%s",
+			simulateCmd.String(), err.Error(), simulateOutput.String()+simulateErr.String())
+	}
+	var dependents []string
+	for _, match := range aptSimulatedRemoval.FindAllStringSubmatch(simulateOutput.String(), -1) {
+		if !helper.SliceHasElement(removedPackages, match[1]) {
+			dependents = append(dependents, match[1])
+		}
+	}
+	if len(dependents) > 0 {
+		return fmt.Errorf("Removing the packages %s would also remove the packages that depend "+
+			"on them: %s. Add them to remove-packages too, or keep the packages",
+			strings.Join(removedPackages, ", "), strings.Join(dependents, ", "))
+	}
+
+	// the maintainer scripts of the packages can need /dev, /proc and /sys
+	var removeCmds, umountCmds []*exec.Cmd
+	for _, mountPoint := range []string{"/dev", "/proc", "/sys"} {
+		mountCmd, umountCmd := mountFromHost(stateMachine.tempDirs.chroot, mountPoint)
+		defer umountCmd.Run()
+		removeCmds = append(removeCmds, mountCmd)
+		umountCmds = append(umountCmds, umountCmd)
+	}
+	purgeCmd := execCommand("chroot", append(purgeArgs, "--assume-yes")...)
+	if purgeCmd.Env == nil {
+		purgeCmd.Env = os.Environ()
+	}
+	purgeCmd.Env = append(purgeCmd.Env, "DEBIAN_FRONTEND=noninteractive")
+	removeCmds = append(removeCmds, purgeCmd,
+		execCommand("chroot", stateMachine.tempDirs.chroot, "apt-get", "check", "--quiet"))
+	removeCmds = append(removeCmds, umountCmds...)
+
+	for _, cmd := range removeCmds {
+		cmdOutput := helper.SetCommandOutput(cmd, classicStateMachine.commonFlags.Debug)
+		if err := runCommand(stateMachine.context(), cmd); err != nil {
+			return fmt.Errorf("Error running command \"%s\". Error is \"%s\". Output is: \n%s",
+				cmd.String(), err.Error(), cmdOutput.String())
+		}
+	}
+
+	preferencesDir := filepath.Join(stateMachine.tempDirs.chroot, "etc", "apt", "preferences.d")
+	if err := osMkdirAll(preferencesDir, 0755); err != nil {
+		return fmt.Errorf("Error creating preferences.d in the chroot: %s", err.Error())
+	}
+	if err := osWriteFile(filepath.Join(preferencesDir, removedPackagesPinsFile),
+		[]byte(removedPackagesPreferences(removedPackages)), 0644); err != nil {
+		return fmt.Errorf("Error writing the apt pins of the removed packages: %s", err.Error())
+	}
+	return nil
+}
+
+// Install packages in the chroot environment. This is accomplished by
+// running commands to do the following:
+// 1. Mount /proc /sys /dev and /run in the chroot
+// 2. Run `apt update` in the chroot, unless the lists are restored from the apt cache
+// 3. Run `apt install <package list>` in the chroot
+// 4. Unmount /proc /sys /dev and /run
+func (stateMachine *StateMachine) installPackages() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	// copy /etc/resolv.conf from the host system into the chroot, and make apt use
+	// the proxies of the host while the packages are installed
+	removeProxyConf, err := stateMachine.setUpChrootNetwork()
+	if err != nil {
+		return err
+	}
+	defer removeProxyConf()
+
+	// if any extra packages are specified, install them alongside the seeded packages.
+	// The ones overriding --no-install-recommends or --no-install-suggests are
+	// installed afterwards, grouped by the apt options they need
+	packageGroups := make(map[string][]string)
+	var packageGroupOptions []string
+	if classicStateMachine.ImageDef.Customization != nil {
+		for _, packageInfo := range classicStateMachine.ImageDef.Customization.ExtraPackages {
+			aptOptions := aptPackageOptions(packageInfo, classicStateMachine.Opts.NoInstallRecommends,
+				classicStateMachine.Opts.NoInstallSuggests)
+			if len(aptOptions) == 0 {
+				classicStateMachine.Packages = append(classicStateMachine.Packages,
+					packageInfo.PackageName)
+				continue
+			}
+			groupOptions := strings.Join(aptOptions, " ")
+			if _, found := packageGroups[groupOptions]; !found {
+				packageGroupOptions = append(packageGroupOptions, groupOptions)
+			}
+			packageGroups[groupOptions] = append(packageGroups[groupOptions], packageInfo.PackageName)
+		}
+	}
+
+	// install the bootloader selected with --bootloader
+	if classicStateMachine.Opts.Bootloader != "" {
+		classicStateMachine.Packages = append(classicStateMachine.Packages,
+			bootloaderPackages[classicStateMachine.Opts.Bootloader][classicStateMachine.ImageDef.Architecture]...)
+	}
+
+	// Make sure to install the extra kernel if it is specified
+	if classicStateMachine.ImageDef.Kernel != "" {
+		classicStateMachine.Packages = append(classicStateMachine.Packages,
+			classicStateMachine.ImageDef.Kernel)
+	}
+
+	// Slice used to store all the commands that need to be run
+	// to install the packages
+	var installPackagesCmds []*exec.Cmd
+
+	// mount some necessary partitions from the host in the chroot
+	type mountPoint struct {
+		dest     string
+		fromHost bool
+	}
+	mountPoints := []mountPoint{
+		{
+			dest:     "/dev",
+			fromHost: true,
+		},
 		{
 			dest:     "/proc",
 			fromHost: true,
@@ -638,7 +1347,7 @@ func (stateMachine *StateMachine) installPackages() error {
 		} else {
 			var err error
 			mountCmd, umountCmd, err = mountTempFS(stateMachine.tempDirs.chroot,
-				stateMachine.tempDirs.scratch,
+				stateMachine.tempDir(stateMachine.tempDirs.scratch),
 				mount.dest,
 			)
 			if err != nil {
@@ -654,20 +1363,72 @@ func (stateMachine *StateMachine) installPackages() error {
 		umounts = append(umounts, umountCmd)
 	}
 
+	// --no-install-recommends and --no-install-suggests only apply to the packages
+	// installed by ubuntu-image, so the apt defaults are kept in the image
+	if aptConf := classicStateMachine.aptRecommendsConf(); aptConf != "" {
+		aptConfDir := filepath.Join(stateMachine.tempDirs.chroot, "etc", "apt", "apt.conf.d")
+		if err := osMkdirAll(aptConfDir, 0755); err != nil {
+			return fmt.Errorf("Error creating apt.conf.d in the chroot: %s", err.Error())
+		}
+		aptConfPath := filepath.Join(aptConfDir, "99ubuntu-image-recommends")
+		if err := osWriteFile(aptConfPath, []byte(aptConf), 0644); err != nil {
+			return fmt.Errorf("Error writing the apt recommends configuration: %s", err.Error())
+		}
+		defer osRemoveAll(aptConfPath)
+	}
+
+	// the apt lists cached for the same sources replace apt update while they are fresh
+	aptCacheDir := classicStateMachine.aptCacheDir()
+	var aptCacheKey string
+	restoredAptLists := false
+	if aptCacheDir != "" {
+		ttl, err := classicStateMachine.aptCacheTTL()
+		if err != nil {
+			return err
+		}
+		aptCacheKey, err = aptSourcesKey(stateMachine.tempDirs.chroot,
+			classicStateMachine.ImageDef.Architecture)
+		if err != nil {
+			return err
+		}
+		restoredAptLists, err = restoreAptLists(aptCacheDir, aptCacheKey,
+			stateMachine.tempDirs.chroot, ttl)
+		if err != nil {
+			return err
+		}
+	}
+
 	// generate the apt update/install commands and append them to the slice of commands
-	aptCmds := generateAptCmds(stateMachine.tempDirs.chroot, classicStateMachine.Packages)
-	installPackagesCmds = append(installPackagesCmds, aptCmds...)
+	if restoredAptLists {
+		installPackagesCmds = append(installPackagesCmds,
+			generateAptInstallCmd(stateMachine.tempDirs.chroot, classicStateMachine.Packages))
+	} else {
+		aptCmds := generateAptCmds(stateMachine.tempDirs.chroot, classicStateMachine.Packages)
+		installPackagesCmds = append(installPackagesCmds, aptCmds...)
+	}
+	for _, groupOptions := range packageGroupOptions {
+		installPackagesCmds = append(installPackagesCmds,
+			generateAptInstallCmd(stateMachine.tempDirs.chroot, packageGroups[groupOptions],
+				strings.Split(groupOptions, " ")...))
+	}
 	installPackagesCmds = append(installPackagesCmds, umounts...) // don't forget to unmount!
 
 	for _, cmd := range installPackagesCmds {
 		cmdOutput := helper.SetCommandOutput(cmd, classicStateMachine.commonFlags.Debug)
-		err := cmd.Run()
+		err := runCommand(stateMachine.context(), cmd)
 		if err != nil {
 			return fmt.Errorf("Error running command \"%s\". Error is \"%s\". Output is: \n%s",
 				cmd.String(), err.Error(), cmdOutput.String())
 		}
 	}
 
+	// installing the packages doesn't change the lists apt update downloaded
+	if aptCacheDir != "" && !restoredAptLists {
+		if err := saveAptLists(aptCacheDir, aptCacheKey, stateMachine.tempDirs.chroot); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -678,16 +1439,31 @@ func (stateMachine *StateMachine) verifyArtifactNames() error {
 	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
 
 	stateMachine.VolumeNames = make(map[string]string)
+	stateMachine.IntermediateVolumes = make(map[string]bool)
 
 	if len(stateMachine.GadgetInfo.Volumes) > 1 {
 		// first handle .img files if they are specified
+		// an image without a volume is written for each volume that doesn't
+		// have its own image, named after the volume like for snap images
 		if classicStateMachine.ImageDef.Artifacts.Img != nil {
+			allVolumes := false
 			for _, img := range *classicStateMachine.ImageDef.Artifacts.Img {
 				if img.ImgVolume == "" {
-					return fmt.Errorf("Volume names must be specified for each image when using a gadget with more than one volume")
+					if allVolumes {
+						return fmt.Errorf("Volume names must be specified for each image when using a gadget with more than one volume, except for a single image written for all the other volumes")
+					}
+					allVolumes = true
+					continue
 				}
 				stateMachine.VolumeNames[img.ImgVolume] = img.ImgName
 			}
+			if allVolumes {
+				for volumeName := range stateMachine.GadgetInfo.Volumes {
+					if _, found := stateMachine.VolumeNames[volumeName]; !found {
+						stateMachine.VolumeNames[volumeName] = volumeName + ".img"
+					}
+				}
+			}
 		}
 		// qcow2 img logic is more complicated. If .img artifacts are already specified
 		// in the image definition for corresponding volumes, we will re-use those and
@@ -702,22 +1478,11 @@ func (stateMachine *StateMachine) verifyArtifactNames() error {
 				}
 				// We can save a whole lot of disk I/O here if the volume is
 				// already specified as a .img file
-				if classicStateMachine.ImageDef.Artifacts.Img != nil {
-					found := false
-					for _, img := range *classicStateMachine.ImageDef.Artifacts.Img {
-						if img.ImgVolume == qcow2.Qcow2Volume {
-							found = true
-						}
-					}
-					if !found {
-						// if a .img artifact for this volume isn't explicitly stated in
-						// the image definition, then create one
-						stateMachine.VolumeNames[qcow2.Qcow2Volume] = fmt.Sprintf("%s.img", qcow2.Qcow2Name)
-					}
-				} else {
-					// no .img artifacts exist in the image definition,
-					// but we still need to create one to convert to qcow2
+				if _, found := stateMachine.VolumeNames[qcow2.Qcow2Volume]; !found {
+					// if a .img artifact for this volume isn't explicitly stated in
+					// the image definition, then create one
 					stateMachine.VolumeNames[qcow2.Qcow2Volume] = fmt.Sprintf("%s.img", qcow2.Qcow2Name)
+					stateMachine.IntermediateVolumes[qcow2.Qcow2Volume] = true
 				}
 			}
 		}
@@ -749,6 +1514,7 @@ func (stateMachine *StateMachine) verifyArtifactNames() error {
 				}
 				// there is only one volume, so get it from the map
 				stateMachine.VolumeNames[volName] = fmt.Sprintf("%s.img", qcow2.Qcow2Name)
+				stateMachine.IntermediateVolumes[volName] = true
 				qcow2.Qcow2Volume = volName
 				(*classicStateMachine.ImageDef.Artifacts.Qcow2)[0] = qcow2
 			} else {
@@ -756,6 +1522,7 @@ func (stateMachine *StateMachine) verifyArtifactNames() error {
 					return nil // We will re-use the .img file in this case
 				}
 				stateMachine.VolumeNames[qcow2.Qcow2Volume] = fmt.Sprintf("%s.img", qcow2.Qcow2Name)
+				stateMachine.IntermediateVolumes[qcow2.Qcow2Volume] = true
 			}
 		}
 	}
@@ -778,30 +1545,25 @@ func (stateMachine *StateMachine) extractRootfsTar() error {
 		return fmt.Errorf("Failed to create chroot directory: %s", err.Error())
 	}
 
-	// convert the URL to a file path
-	// no need to check error here as the validity of the URL
-	// has been confirmed by the schema validation
-	tarPath := strings.TrimPrefix(classicStateMachine.ImageDef.Rootfs.Tarball.TarballURL, "file://")
-	if !filepath.IsAbs(tarPath) {
-		tarPath, _ = filepath.Abs(tarPath)
-	}
-
-	// if the sha256 sum of the tarball is provided, make sure it matches
-	if classicStateMachine.ImageDef.Rootfs.Tarball.SHA256sum != "" {
-		tarSHA256, err := helper.CalculateSHA256(tarPath)
-		if err != nil {
-			return err
-		}
-		if tarSHA256 != classicStateMachine.ImageDef.Rootfs.Tarball.SHA256sum {
-			return fmt.Errorf("Calculated SHA256 sum of rootfs tarball \"%s\" does not match "+
-				"the expected value specified in the image definition: \"%s\"",
-				tarSHA256, classicStateMachine.ImageDef.Rootfs.Tarball.SHA256sum)
-		}
+	// convert the URL to a file path, downloading the tarball if needed. If the
+	// sha256 sum of the tarball is provided, make sure it matches
+	tarPath, err := fetchSource(stateMachine.context(), classicStateMachine.ImageDef.Rootfs.Tarball.TarballURL,
+		stateMachine.tempDirs.scratch, "rootfs tarball",
+		classicStateMachine.ImageDef.Rootfs.Tarball.SHA256sum)
+	if err != nil {
+		return err
 	}
 
 	// now extract the archive
-	return helper.ExtractTarArchive(tarPath, stateMachine.tempDirs.chroot,
+	err = helper.ExtractTarArchive(stateMachine.commandRunner(), tarPath, stateMachine.tempDirs.chroot,
 		stateMachine.commonFlags.Verbose, stateMachine.commonFlags.Debug)
+	if err != nil || classicStateMachine.Opts.RootfsTarball == "" {
+		return err
+	}
+
+	// the tarball passed with --rootfs-tarball replaces the whole base
+	// rootfs, so make sure it is one before customizing it
+	return stateMachine.identifyRootfsTarball(tarPath)
 }
 
 // germinate runs the germinate binary and parses the output to create
@@ -817,25 +1579,42 @@ func (stateMachine *StateMachine) germinate() error {
 		return fmt.Errorf("Error creating germinate directory: \"%s\"", err.Error())
 	}
 
+	packages, snaps, err := stateMachine.germinateSeeds(germinateDir)
+	if err != nil {
+		return err
+	}
+	classicStateMachine.Packages = append(classicStateMachine.Packages, packages...)
+	classicStateMachine.Snaps = append(classicStateMachine.Snaps, snaps...)
+
+	return nil
+}
+
+// germinateSeeds runs germinate in germinateDir and returns the packages and the
+// snaps of the seeds of the image definition
+func (stateMachine *StateMachine) germinateSeeds(germinateDir string) (packages []string,
+	snaps []string, err error) {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
 	germinateCmd := generateGerminateCmd(classicStateMachine.ImageDef)
 	germinateCmd.Dir = germinateDir
 
 	germinateOutput := helper.SetCommandOutput(germinateCmd, classicStateMachine.commonFlags.Debug)
 
-	if err := germinateCmd.Run(); err != nil {
-		return fmt.Errorf("Error running germinate command \"%s\". Error is \"%s\". Output is: \n%s",
+	if err := runCommand(stateMachine.context(), germinateCmd); err != nil {
+		return nil, nil, fmt.Errorf("Error running germinate command \"%s\". Error is \"%s\". Output is: \n%s",
 			germinateCmd.String(), err.Error(), germinateOutput.String())
 	}
 
 	packageMap := make(map[string]*[]string)
-	packageMap[".seed"] = &classicStateMachine.Packages
-	packageMap[".snaps"] = &classicStateMachine.Snaps
+	packageMap[".seed"] = &packages
+	packageMap[".snaps"] = &snaps
 	for fileExtension, packageList := range packageMap {
 		for _, fileName := range classicStateMachine.ImageDef.Rootfs.Seed.Names {
 			seedFilePath := filepath.Join(germinateDir, fileName+fileExtension)
 			seedFile, err := osOpen(seedFilePath)
 			if err != nil {
-				return fmt.Errorf("Error opening seed file %s: \"%s\"", seedFilePath, err.Error())
+				return nil, nil, fmt.Errorf("Error opening seed file %s: \"%s\"", seedFilePath, err.Error())
 			}
 			defer seedFile.Close()
 
@@ -851,7 +1630,7 @@ func (stateMachine *StateMachine) germinate() error {
 		}
 	}
 
-	return nil
+	return packages, snaps, nil
 }
 
 // Customize Cloud init with the values in the image definition YAML
@@ -919,6 +1698,52 @@ func (stateMachine *StateMachine) customizeCloudInit() error {
 	return err
 }
 
+// embedCloudInitSeed writes the cloud-init NoCloud seed passed on the command line to
+// the partition given with --cloud-init-seed-partition, or to the rootfs otherwise
+func (stateMachine *StateMachine) embedCloudInitSeed() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+	opts := classicStateMachine.Opts
+
+	seedDir := filepath.Join(stateMachine.tempDirs.rootfs, "var", "lib", "cloud", "seed", "nocloud-net")
+	if opts.CloudInitSeedPartition != "" {
+		partitionDir, err := stateMachine.cloudInitSeedPartitionDir(opts.CloudInitSeedPartition)
+		if err != nil {
+			return err
+		}
+		seedDir = partitionDir
+	}
+	if err := osMkdirAll(seedDir, 0755); err != nil {
+		return fmt.Errorf("Error creating cloud-init seed directory: %s", err.Error())
+	}
+
+	seedFiles := []struct {
+		name   string
+		source string
+	}{
+		{"user-data", opts.CloudInitUserData},
+		{"meta-data", opts.CloudInitMetaData},
+		{"network-config", opts.CloudInitNetworkConfig},
+	}
+	for _, seedFile := range seedFiles {
+		var data []byte
+		if seedFile.source != "" {
+			var err error
+			data, err = osReadFile(seedFile.source)
+			if err != nil {
+				return fmt.Errorf("Error reading cloud-init %s: %s", seedFile.name, err.Error())
+			}
+		} else if seedFile.name != "meta-data" {
+			// the NoCloud datasource requires meta-data, even if it is empty
+			continue
+		}
+		if err := osWriteFile(filepath.Join(seedDir, seedFile.name), data, 0644); err != nil {
+			return fmt.Errorf("Error writing cloud-init %s: %s", seedFile.name, err.Error())
+		}
+	}
+	return nil
+}
+
 // Customize /etc/fstab based on values in the image definition
 func (stateMachine *StateMachine) customizeFstab() error {
 	var classicStateMachine *ClassicStateMachine
@@ -934,26 +1759,313 @@ func (stateMachine *StateMachine) customizeFstab() error {
 
 	var fstabEntries []string
 	for _, fstab := range classicStateMachine.ImageDef.Customization.Fstab {
-		var dumpString string
-		if fstab.Dump {
-			dumpString = "1"
-		} else {
-			dumpString = "0"
-		}
-		fstabEntry := fmt.Sprintf("LABEL=%s\t%s\t%s\t%s\t%s\t%d",
-			fstab.Label,
-			fstab.Mountpoint,
-			fstab.FSType,
-			fstab.MountOptions,
-			dumpString,
-			fstab.FsckOrder,
-		)
-		fstabEntries = append(fstabEntries, fstabEntry)
+		fstabEntries = append(fstabEntries, renderFstabEntry(fstab))
 	}
 	fstabIO.Write([]byte(strings.Join(fstabEntries, "\n")))
 	return nil
 }
 
+// customizeTimezone sets the timezone of the image definition in the rootfs. The
+// timezone must be part of the tzdata installed in the rootfs
+func (stateMachine *StateMachine) customizeTimezone() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	timezone := classicStateMachine.ImageDef.Customization.Timezone
+	zoneinfo := filepath.Join("/usr", "share", "zoneinfo", timezone)
+	if fileInfo, err := os.Stat(filepath.Join(stateMachine.tempDirs.chroot, zoneinfo)); err != nil ||
+		!fileInfo.Mode().IsRegular() {
+		return fmt.Errorf("Timezone \"%s\" is not part of the tzdata installed in the rootfs", timezone)
+	}
+
+	err := osWriteFile(filepath.Join(stateMachine.tempDirs.chroot, "etc", "timezone"),
+		[]byte(timezone+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("Error writing /etc/timezone: %s", err.Error())
+	}
+	localtime := filepath.Join(stateMachine.tempDirs.chroot, "etc", "localtime")
+	if err := osRemoveAll(localtime); err != nil {
+		return fmt.Errorf("Error removing /etc/localtime: %s", err.Error())
+	}
+	if err := os.Symlink(zoneinfo, localtime); err != nil {
+		return fmt.Errorf("Error linking /etc/localtime to %s: %s", zoneinfo, err.Error())
+	}
+	return nil
+}
+
+// customizeHostname writes the hostname of the image definition to /etc/hostname,
+// and makes it resolve to 127.0.1.1 in /etc/hosts like the Debian installer does
+func (stateMachine *StateMachine) customizeHostname() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	hostname := classicStateMachine.ImageDef.Customization.Hostname
+	err := osWriteFile(filepath.Join(stateMachine.tempDirs.chroot, "etc", "hostname"),
+		[]byte(hostname+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("Error writing /etc/hostname: %s", err.Error())
+	}
+
+	hostsFile := filepath.Join(stateMachine.tempDirs.chroot, "etc", "hosts")
+	hosts, err := os.ReadFile(hostsFile)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error reading /etc/hosts: %s", err.Error())
+	}
+	hostsEntry := "127.0.1.1\t" + hostname
+	hostsLines := []string{"127.0.0.1\tlocalhost"}
+	if len(hosts) > 0 {
+		hostsLines = strings.Split(strings.TrimSuffix(string(hosts), "\n"), "\n")
+	}
+	found := false
+	for i, line := range hostsLines {
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] == "127.0.1.1" {
+			hostsLines[i] = hostsEntry
+			found = true
+		}
+	}
+	if !found {
+		hostsLines = append(hostsLines, hostsEntry)
+	}
+	if err := osWriteFile(hostsFile, []byte(strings.Join(hostsLines, "\n")+"\n"), 0644); err != nil {
+		return fmt.Errorf("Error writing /etc/hosts: %s", err.Error())
+	}
+	return nil
+}
+
+// machineIDClear is the value of machine-id clearing the machine ID of the rootfs
+const machineIDClear = "clear"
+
+// customizeMachineID clears or sets the machine ID of the rootfs. A cleared machine
+// ID is an empty /etc/machine-id, which systemd fills with a new ID on the first
+// boot, so that every machine booting the image gets its own. The machine ID of
+// D-Bus is made a link to the one of systemd so that they can't differ
+func (stateMachine *StateMachine) customizeMachineID() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	machineID := ""
+	if classicStateMachine.ImageDef.Customization.MachineID != machineIDClear {
+		machineID = classicStateMachine.ImageDef.Customization.MachineID + "\n"
+	}
+	// the file is read-only, so it is replaced rather than written to
+	machineIDFile := filepath.Join(stateMachine.tempDirs.chroot, "etc", "machine-id")
+	if err := osRemoveAll(machineIDFile); err != nil {
+		return fmt.Errorf("Error removing /etc/machine-id: %s", err.Error())
+	}
+	if err := osWriteFile(machineIDFile, []byte(machineID), 0444); err != nil {
+		return fmt.Errorf("Error writing /etc/machine-id: %s", err.Error())
+	}
+
+	dbusMachineID := filepath.Join(stateMachine.tempDirs.chroot, "var", "lib", "dbus", "machine-id")
+	fileInfo, err := os.Lstat(dbusMachineID)
+	if err != nil || fileInfo.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	if err := osRemoveAll(dbusMachineID); err != nil {
+		return fmt.Errorf("Error removing /var/lib/dbus/machine-id: %s", err.Error())
+	}
+	if err := os.Symlink("/etc/machine-id", dbusMachineID); err != nil {
+		return fmt.Errorf("Error linking /var/lib/dbus/machine-id to /etc/machine-id: %s", err.Error())
+	}
+	return nil
+}
+
+// builtinLocales are always available, so they don't have to be generated
+var builtinLocales = map[string]bool{
+	"C":       true,
+	"C.UTF-8": true,
+	"POSIX":   true,
+}
+
+// customizeLocale generates the locale of the image definition in the rootfs and
+// makes it the default one. The locale must be supported by the locales package
+func (stateMachine *StateMachine) customizeLocale() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	locale := classicStateMachine.ImageDef.Customization.Locale
+	if !builtinLocales[locale] {
+		supported, err := osReadFile(filepath.Join(stateMachine.tempDirs.chroot,
+			"usr", "share", "i18n", "SUPPORTED"))
+		if err != nil {
+			return fmt.Errorf("Error reading the supported locales, the locales package " +
+				"must be installed in the rootfs to set the locale")
+		}
+		found := false
+		for _, line := range strings.Split(string(supported), "\n") {
+			if fields := strings.Fields(line); len(fields) > 0 && fields[0] == locale {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("Locale \"%s\" can not be generated, it is not in "+
+				"/usr/share/i18n/SUPPORTED in the rootfs", locale)
+		}
+
+		localeGenCmd := execCommand("chroot", stateMachine.tempDirs.chroot, "locale-gen", locale)
+		localeGenOutput := helper.SetCommandOutput(localeGenCmd, stateMachine.commonFlags.Debug)
+		if err := runCommand(stateMachine.context(), localeGenCmd); err != nil {
+			return fmt.Errorf("Error running command \"%s\". Error is \"%s\". Output is: \n%s",
+				localeGenCmd.String(), err.Error(), localeGenOutput.String())
+		}
+	}
+
+	err := osWriteFile(filepath.Join(stateMachine.tempDirs.chroot, "etc", "default", "locale"),
+		[]byte("LANG="+locale+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("Error writing /etc/default/locale: %s", err.Error())
+	}
+	return nil
+}
+
+// readChrootUsers returns the names of the users that already exist in a chroot
+func readChrootUsers(chroot string) (map[string]bool, error) {
+	passwd, err := osReadFile(filepath.Join(chroot, "etc", "passwd"))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading /etc/passwd: %s", err.Error())
+	}
+	users := make(map[string]bool)
+	for _, line := range strings.Split(string(passwd), "\n") {
+		if name, _, found := strings.Cut(line, ":"); found {
+			users[name] = true
+		}
+	}
+	return users, nil
+}
+
+// customizeUsers creates the users of the image definition in the rootfs. Users that
+// already exist, like the system users of the packages, are never modified. The home
+// directories are only readable by their user and group, and ~/.ssh by the user
+func (stateMachine *StateMachine) customizeUsers() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	chroot := stateMachine.tempDirs.chroot
+	existingUsers, err := readChrootUsers(chroot)
+	if err != nil {
+		return err
+	}
+	for _, user := range classicStateMachine.ImageDef.Customization.Users {
+		if existingUsers[user.UserName] {
+			return fmt.Errorf("User \"%s\" already exists in the rootfs", user.UserName)
+		}
+		homeDir := filepath.Join("/home", user.UserName)
+		useraddArgs := []string{"--create-home", "--home-dir", homeDir, "--user-group",
+			"--shell", user.Shell}
+		if user.Sudo {
+			useraddArgs = append(useraddArgs, "--groups", "sudo")
+		}
+		if err := addChrootUser(stateMachine.context(), chroot, user.UserName, user.UserID,
+			useraddArgs, stateMachine.commonFlags.Debug); err != nil {
+			return err
+		}
+		existingUsers[user.UserName] = true
+
+		if user.Password != "" {
+			// the hash is passed on stdin so that it does not show up in the process list
+			chpasswdCmd := execCommand("chroot", chroot, "chpasswd", "--encrypted")
+			chpasswdCmd.Stdin = strings.NewReader(user.UserName + ":" + user.Password + "\n")
+			chpasswdOutput := helper.SetCommandOutput(chpasswdCmd, stateMachine.commonFlags.Debug)
+			if err := runCommand(stateMachine.context(), chpasswdCmd); err != nil {
+				return fmt.Errorf("Error setting the password of user \"%s\". Error is \"%s\". "+
+					"Output is: \n%s", user.UserName, err.Error(), chpasswdOutput.String())
+			}
+		}
+
+		if err := os.Chmod(filepath.Join(chroot, homeDir), 0750); err != nil {
+			return fmt.Errorf("Error setting the permissions of %s: %s", homeDir, err.Error())
+		}
+		if len(user.SSHAuthorizedKeys) == 0 {
+			continue
+		}
+		sshDir := filepath.Join(homeDir, ".ssh")
+		if err := osMkdirAll(filepath.Join(chroot, sshDir), 0700); err != nil {
+			return fmt.Errorf("Error creating %s: %s", sshDir, err.Error())
+		}
+		authorizedKeys := strings.Join(user.SSHAuthorizedKeys, "\n") + "\n"
+		err := osWriteFile(filepath.Join(chroot, sshDir, "authorized_keys"),
+			[]byte(authorizedKeys), 0600)
+		if err != nil {
+			return fmt.Errorf("Error writing the SSH authorized keys of user \"%s\": %s",
+				user.UserName, err.Error())
+		}
+		// the IDs of the user only make sense inside of the chroot
+		chownCmd := execCommand("chroot", chroot, "chown", "-R",
+			user.UserName+":"+user.UserName, sshDir)
+		chownOutput := helper.SetCommandOutput(chownCmd, stateMachine.commonFlags.Debug)
+		if err := runCommand(stateMachine.context(), chownCmd); err != nil {
+			return fmt.Errorf("Error running command \"%s\". Error is \"%s\". Output is: \n%s",
+				chownCmd.String(), err.Error(), chownOutput.String())
+		}
+	}
+	return nil
+}
+
+// knownBootloaders are the bootloaders a gadget can use, and whether the kernel
+// command line of the image definition can be configured for them
+var knownBootloaders = map[string]bool{
+	"grub":         true,
+	"systemd-boot": true,
+	"u-boot":       false,
+	"piboot":       false,
+	"lk":           false,
+	"android-boot": false,
+}
+
+// configureKernelCmdline adds the kernel command line of the image definition to
+// the bootloader configuration in the rootfs. For grub, it is written to
+// /etc/default/grub.d so that update-grub adds it to grub.cfg in update_bootloader
+// and whenever grub.cfg is generated again in the installed system
+func (stateMachine *StateMachine) configureKernelCmdline() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	foundBootloader := false
+	for _, volumeName := range stateMachine.VolumeOrder {
+		bootloader, err := stateMachine.volumeBootloader(volumeName)
+		if err != nil {
+			return err
+		}
+		if bootloader == "" {
+			continue
+		}
+		foundBootloader = true
+		supported, known := knownBootloaders[bootloader]
+		if !known {
+			return fmt.Errorf("Volume %s uses unknown bootloader \"%s\"", volumeName, bootloader)
+		}
+		if !supported {
+			if !stateMachine.commonFlags.Quiet {
+				stateMachine.printWarning("the kernel-cmdline of the image definition can not be "+
+					"applied to bootloader %s of volume %s, it has to be set in the gadget",
+					bootloader, volumeName)
+			}
+			continue
+		}
+		// the boot entries of systemd-boot are only created in update_bootloader,
+		// along with the root filesystem they boot
+		if bootloader == "systemd-boot" {
+			continue
+		}
+		grubConfDir := filepath.Join(stateMachine.tempDirs.chroot, "etc", "default", "grub.d")
+		if err := osMkdirAll(grubConfDir, 0755); err != nil {
+			return fmt.Errorf("Error creating grub.d in the chroot: %s", err.Error())
+		}
+		grubConf := fmt.Sprintf("GRUB_CMDLINE_LINUX_DEFAULT=\"$GRUB_CMDLINE_LINUX_DEFAULT %s\"\n",
+			classicStateMachine.ImageDef.KernelCmdline)
+		err = osWriteFile(filepath.Join(grubConfDir, "90-ubuntu-image-cmdline.cfg"),
+			[]byte(grubConf), 0644)
+		if err != nil {
+			return fmt.Errorf("Error writing the grub kernel command line: %s", err.Error())
+		}
+	}
+	if !foundBootloader {
+		return fmt.Errorf("Error setting the kernel command line: the gadget does not define a bootloader")
+	}
+	return nil
+}
+
 // Handle any manual customizations specified in the image definition
 func (stateMachine *StateMachine) manualCustomization() error {
 	var classicStateMachine *ClassicStateMachine
@@ -965,35 +2077,14 @@ func (stateMachine *StateMachine) manualCustomization() error {
 		return fmt.Errorf("Error setting up /etc/resolv.conf in the chroot: \"%s\"", err.Error())
 	}
 
-	type customizationHandler struct {
-		inputData   interface{}
-		handlerFunc func(interface{}, string, bool) error
-	}
-	customizationHandlers := []customizationHandler{
-		{
-			inputData:   classicStateMachine.ImageDef.Customization.Manual.CopyFile,
-			handlerFunc: manualCopyFile,
-		},
-		{
-			inputData:   classicStateMachine.ImageDef.Customization.Manual.Execute,
-			handlerFunc: manualExecute,
-		},
-		{
-			inputData:   classicStateMachine.ImageDef.Customization.Manual.TouchFile,
-			handlerFunc: manualTouchFile,
-		},
-		{
-			inputData:   classicStateMachine.ImageDef.Customization.Manual.AddGroup,
-			handlerFunc: manualAddGroup,
-		},
-		{
-			inputData:   classicStateMachine.ImageDef.Customization.Manual.AddUser,
-			handlerFunc: manualAddUser,
-		},
+	// the order has already been checked when parsing the image definition
+	steps, err := orderManualSteps(classicStateMachine.ImageDef.Customization.Manual)
+	if err != nil {
+		return err
 	}
-
-	for _, customization := range customizationHandlers {
-		err := customization.handlerFunc(customization.inputData, stateMachine.tempDirs.chroot, stateMachine.commonFlags.Debug)
+	for _, customization := range groupManualSteps(steps) {
+		err := customization.handlerFunc(stateMachine.context(), customization.inputData,
+			stateMachine.tempDirs.chroot, stateMachine.commonFlags.Debug)
 		if err != nil {
 			return err
 		}
@@ -1007,39 +2098,21 @@ func (stateMachine *StateMachine) prepareClassicImage() error {
 	var classicStateMachine *ClassicStateMachine
 	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
 
-	var imageOpts image.Options
+	// the recovery seed can be prepared at the same time
+	imagePrepareMutex.Lock()
+	defer imagePrepareMutex.Unlock()
 
-	var err error
-	imageOpts.Snaps, imageOpts.SnapChannels, err = parseSnapsAndChannels(classicStateMachine.Snaps)
+	imageOpts, cohorts, err := stateMachine.classicImageOptions(classicStateMachine.Snaps)
 	if err != nil {
 		return err
 	}
-	if stateMachine.commonFlags.Channel != "" {
-		imageOpts.Channel = stateMachine.commonFlags.Channel
-	}
 
 	// plug/slot sanitization not used by snap image.Prepare, make it no-op.
 	snap.SanitizePlugsSlots = func(snapInfo *snap.Info) {}
 
-	// check if the rootfs is already preseeded. This can happen when building from a
-	// rootfs tarball
+	// the snaps of a preseeded rootfs, which can come from a rootfs tarball, are
+	// seeded again, so the preseeding is reset
 	if osutil.FileExists(filepath.Join(stateMachine.tempDirs.chroot, "var", "lib", "snapd", "state.json")) {
-		// first get a list of all preseeded snaps
-		// seededSnaps maps the snap name and channel that was seeded
-		preseededSnaps, err := getPreseededSnaps(classicStateMachine.tempDirs.chroot)
-		if err != nil {
-			return fmt.Errorf("Error getting list of preseeded snaps from existing rootfs: %s",
-				err.Error())
-		}
-		for snap, channel := range preseededSnaps {
-			// if a channel is specified on the command line for a snap that was already
-			// preseeded, use the channel from the command line instead of the channel
-			// that was originally used for the preseeding
-			if !helper.SliceHasElement(imageOpts.Snaps, snap) {
-				imageOpts.Snaps = append(imageOpts.Snaps, snap)
-				imageOpts.SnapChannels[snap] = channel
-			}
-		}
 		// preseed.ClassicReset automatically has some output that we only want for
 		// verbose or greater logging
 		if !stateMachine.commonFlags.Debug && !stateMachine.commonFlags.Verbose {
@@ -1055,27 +2128,132 @@ func (stateMachine *StateMachine) prepareClassicImage() error {
 		}
 	}
 
-	// iterate through the list of snaps and ensure that all of their bases
-	// are also set to be installed. Note we only do this for snaps that are
-	// seeded. Users are expected to specify all base and content provider
-	// snaps in the image definition.
-	for _, seededSnap := range imageOpts.Snaps {
-		snapStore := store.New(nil, nil)
-		snapSpec := store.SnapSpec{Name: seededSnap}
-		snapContext := context.TODO() //context can be empty, just not nil
-		snapInfo, err := snapStore.SnapInfo(snapContext, snapSpec, nil)
+	stateMachine.recordPinnedRevisions(imageOpts.Revisions)
+	stateMachine.SnapCohorts, err = stateMachine.pinCohortRevisions(stateMachine.context(),
+		stateMachine.printWarning, imageOpts, cohorts)
+	if err != nil {
+		return err
+	}
+
+	// iterate through the list of snaps and ensure that all of their bases, the
+	// default providers of their content plugs and snapd are also set to be
+	// installed, from the default channel, unless --no-auto-deps was passed.
+	// The store is queried for several snaps at the same time, but the
+	// dependencies are added in the order of the snaps
+	dependencies, err := stateMachine.addSeedDependencies(imageOpts)
+	if err != nil {
+		return err
+	}
+	if len(dependencies) > 0 && !stateMachine.commonFlags.Quiet {
+		fmt.Printf("Automatically adding the snaps needed by the seeded snaps: %s\n",
+			strings.Join(dependencies, ", "))
+	}
+
+	// reuse the snaps downloaded by previous builds. image.Prepare verifies
+	// them against the revision from the store before using them
+	seedDir := filepath.Join(classicStateMachine.tempDirs.chroot, "var", "lib", "snapd", "seed")
+	snapCacheDir := classicStateMachine.snapCacheDir()
+	var restoredSnaps []string
+	if snapCacheDir != "" {
+		snapChannels := make(map[string]string)
+		for _, snapName := range imageOpts.Snaps {
+			snapChannels[snapName] = imageOpts.Channel
+			if snapChannel, found := imageOpts.SnapChannels[snapName]; found {
+				snapChannels[snapName] = snapChannel
+			}
+		}
+		restoredSnaps, err = restoreCachedSnaps(snapCacheDir, filepath.Join(seedDir, "snaps"), snapChannels)
+		if err != nil {
+			return err
+		}
+	}
+
+	// use the snaps of --snap-dir, including the ones that are only listed in the model
+	var modelSnaps []string
+	if stateMachine.commonFlags.SnapDir != "" && imageOpts.ModelFile != "" {
+		modelSnaps, err = modelSnapNames(imageOpts.ModelFile)
+		if err != nil {
+			return err
+		}
+	}
+	storeURL, stopStore, err := stateMachine.useLocalSnaps(imageOpts, modelSnaps)
+	if err != nil {
+		return err
+	}
+	defer stopStore()
+
+	prefetchedSnaps, err := stateMachine.prefetchSnaps(imageOpts, filepath.Join(seedDir, "snaps"))
+	if err != nil {
+		return err
+	}
+
+	// image.Prepare reuses the snaps that were already downloaded when it is retried
+	downloads, stopTracking := stateMachine.trackDownloads("Downloading snaps")
+	err = stateMachine.retryDownloadWarning(stateMachine.context(), "Preparing the image",
+		stateMachine.warningAbove(downloads), func() error {
+			return stateMachine.runImagePrepare(imageOpts, storeURL)
+		})
+	stopTracking()
+	if err != nil {
+		return fmt.Errorf("Error preparing image: %s", err.Error())
+	}
+	if err := removeUnusedSnaps(classicStateMachine.tempDirs.chroot, prefetchedSnaps); err != nil {
+		return err
+	}
+
+	if snapCacheDir != "" {
+		if err := updateSnapCache(snapCacheDir, seedDir, restoredSnaps); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// classicImageOptions returns the options image.Prepare is called with to seed
+// seedSnaps, the snaps of the seeds, along with the snaps already preseeded in the
+// rootfs and the extra snaps of the image definition. The cohort keys of the extra
+// snaps are returned, as their revisions are not pinned yet
+func (stateMachine *StateMachine) classicImageOptions(seedSnaps []string) (*image.Options,
+	map[string]string, error) {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	var imageOpts image.Options
+
+	var err error
+	imageOpts.Snaps, imageOpts.SnapChannels, imageOpts.Revisions, err = parseSnapsAndChannels(seedSnaps)
+	if err != nil {
+		return nil, nil, err
+	}
+	if stateMachine.commonFlags.Channel != "" {
+		imageOpts.Channel = stateMachine.commonFlags.Channel
+	}
+
+	// check if the rootfs is already preseeded. This can happen when building from a
+	// rootfs tarball
+	if osutil.FileExists(filepath.Join(stateMachine.tempDirs.chroot, "var", "lib", "snapd", "state.json")) {
+		// first get a list of all preseeded snaps
+		// seededSnaps maps the snap name and channel that was seeded
+		preseededSnaps, err := getPreseededSnaps(classicStateMachine.tempDirs.chroot)
 		if err != nil {
-			return fmt.Errorf("Error getting info for snap %s: \"%s\"",
-				seededSnap, err.Error())
+			return nil, nil, fmt.Errorf("Error getting list of preseeded snaps from existing rootfs: %s",
+				err.Error())
 		}
-		if snapInfo.Base != "" && !helper.SliceHasElement(imageOpts.Snaps, snapInfo.Base) {
-			imageOpts.Snaps = append(imageOpts.Snaps, snapInfo.Base)
+		for snap, channel := range preseededSnaps {
+			// if a channel is specified on the command line for a snap that was already
+			// preseeded, use the channel from the command line instead of the channel
+			// that was originally used for the preseeding
+			if !helper.SliceHasElement(imageOpts.Snaps, snap) {
+				imageOpts.Snaps = append(imageOpts.Snaps, snap)
+				imageOpts.SnapChannels[snap] = channel
+			}
 		}
 	}
 
-	imageOpts.Revisions = make(map[string]snap.Revision)
 	// add any extra snaps from the image definition to the list
-	// this is done last to ensure the correct channels are being used
+	// this is done after the seeded snaps to ensure the correct channels are being used
+	cohorts := make(map[string]string)
 	if classicStateMachine.ImageDef.Customization != nil {
 		for _, extraSnap := range classicStateMachine.ImageDef.Customization.ExtraSnaps {
 			if !helper.SliceHasElement(imageOpts.Snaps, extraSnap.SnapName) {
@@ -1085,36 +2263,72 @@ func (stateMachine *StateMachine) prepareClassicImage() error {
 				imageOpts.SnapChannels[extraSnap.SnapName] = extraSnap.Channel
 			}
 			if extraSnap.SnapRevision != 0 {
-				fmt.Printf("WARNING: revision %d for snap %s may not be the latest available version!\n",
-					extraSnap.SnapRevision,
-					extraSnap.SnapName,
-				)
 				imageOpts.Revisions[extraSnap.SnapName] = snap.Revision{N: extraSnap.SnapRevision}
 			}
+			if extraSnap.Cohort != "" {
+				cohorts[extraSnap.SnapName] = extraSnap.Cohort
+			}
 		}
 	}
-
-	imageOpts.Classic = true
+	stateMachine.forceChannel(imageOpts.Snaps, imageOpts.SnapChannels, imageOpts.Revisions)
 	imageOpts.ModelFile = strings.TrimPrefix(classicStateMachine.ImageDef.ModelAssertion, "file://")
 	imageOpts.Architecture = classicStateMachine.ImageDef.Architecture
+
+	imageOpts.Classic = true
 	imageOpts.PrepareDir = classicStateMachine.tempDirs.chroot
 	imageOpts.Customizations = *new(image.Customizations)
 	imageOpts.Customizations.Validation = stateMachine.commonFlags.Validation
 
-	// image.Prepare automatically has some output that we only want for
-	// verbose or greater logging
-	if !stateMachine.commonFlags.Debug && !stateMachine.commonFlags.Verbose {
-		oldImageStdout := image.Stdout
-		image.Stdout = io.Discard
-		defer func() {
-			image.Stdout = oldImageStdout
-		}()
-	}
+	return &imageOpts, cohorts, nil
+}
 
-	if err := imagePrepare(&imageOpts); err != nil {
-		return fmt.Errorf("Error preparing image: %s", err.Error())
+// addSeedDependencies adds the snaps needed by the snaps of imageOpts that are not
+// listed to them, and returns them. It fails instead with --no-auto-deps
+func (stateMachine *StateMachine) addSeedDependencies(imageOpts *image.Options) ([]string, error) {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	dependencies, err := stateMachine.seedDependencies(imageOpts.Snaps)
+	if err != nil {
+		return nil, err
 	}
+	var dependencyList []string
+	for _, dependency := range dependencies {
+		dependencyList = append(dependencyList, dependency.String())
+	}
+	if len(dependencies) > 0 && classicStateMachine.Opts.NoAutoDeps {
+		return nil, fmt.Errorf("The seeded snaps need snaps that are not listed, which are not "+
+			"added with --no-auto-deps: %s", strings.Join(dependencyList, ", "))
+	}
+	for _, dependency := range dependencies {
+		imageOpts.Snaps = append(imageOpts.Snaps, dependency.name)
+	}
+	return dependencyList, nil
+}
 
+// checkSeed makes sure that the bases and the default providers of all the snaps
+// seeded in the chroot are seeded too, since the snaps can not run at first boot
+// otherwise. All the missing snaps are reported at once
+func (stateMachine *StateMachine) checkSeed() error {
+	seedSnaps, err := readSeedSnaps(stateMachine.tempDirs.chroot)
+	if err != nil {
+		return err
+	}
+	var snapInfos []*snap.Info
+	for _, seedSnap := range seedSnaps {
+		snapInfo, err := readLocalSnapInfo(seedSnap.Path)
+		if err != nil {
+			return err
+		}
+		snapInfos = append(snapInfos, snapInfo)
+	}
+	if errs := snap.ValidateBasesAndProviders(snapInfos); len(errs) > 0 {
+		var problems []string
+		for _, err := range errs {
+			problems = append(problems, err.Error())
+		}
+		return fmt.Errorf("The seed of the image is incomplete:\n%s", strings.Join(problems, "\n"))
+	}
 	return nil
 }
 
@@ -1159,7 +2373,7 @@ func (stateMachine *StateMachine) preseedClassicImage() error {
 	preseedCmds = append(preseedCmds, umountCmds...)
 	for _, cmd := range preseedCmds {
 		cmdOutput := helper.SetCommandOutput(cmd, classicStateMachine.commonFlags.Debug)
-		err := cmd.Run()
+		err := runCommand(stateMachine.context(), cmd)
 		if err != nil {
 			return fmt.Errorf("Error running command \"%s\". Error is \"%s\". Output is: \n%s",
 				cmd.String(), err.Error(), cmdOutput.String())
@@ -1211,7 +2425,8 @@ func (stateMachine *StateMachine) populateClassicRootfsContents() error {
 			}
 		}
 	}
-	return nil
+	// the parts of the rootfs with a partition of their own are mounted at boot
+	return stateMachine.addRootfsPartitionsToFstab()
 }
 
 // Generate the manifest
@@ -1225,7 +2440,7 @@ func (stateMachine *StateMachine) generatePackageManifest() error {
 	cmd := execCommand("chroot", stateMachine.tempDirs.rootfs, "dpkg-query", "-W", "--showformat=${Package} ${Version}\n")
 	cmdOutput := helper.SetCommandOutput(cmd, classicStateMachine.commonFlags.Debug)
 
-	if err := cmd.Run(); err != nil {
+	if err := runCommand(stateMachine.context(), cmd); err != nil {
 		return fmt.Errorf("Error generating package manifest with command \"%s\". "+
 			"Error is \"%s\". Full output below:\n%s",
 			cmd.String(), err.Error(), cmdOutput.String())
@@ -1238,6 +2453,44 @@ func (stateMachine *StateMachine) generatePackageManifest() error {
 	}
 	defer manifest.Close()
 	manifest.Write(cmdOutput.Bytes())
+	stateMachine.addArtifact(outputPath)
+	return nil
+}
+
+// generateSBOM writes a Software Bill of Materials of the deb packages
+// installed in the rootfs, in the format requested with --sbom
+func (stateMachine *StateMachine) generateSBOM() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	if classicStateMachine.Opts.SBOM != sbomFormatSPDX {
+		return fmt.Errorf("Unsupported SBOM format \"%s\"", classicStateMachine.Opts.SBOM)
+	}
+
+	// the dpkg database is read from the host with --admindir so that no
+	// binary of the target architecture has to run
+	var packages, cmdErr bytes.Buffer
+	cmd := execCommand("dpkg-query",
+		"--admindir="+filepath.Join(stateMachine.tempDirs.rootfs, "var", "lib", "dpkg"),
+		"-W", "--showformat="+sbomDpkgQueryFormat)
+	cmd.Stdout = &packages
+	cmd.Stderr = &cmdErr
+	if err := runCommand(stateMachine.context(), cmd); err != nil {
+		return fmt.Errorf("Error listing the installed packages with command \"%s\". "+
+			"Error is \"%s\". Full output below:\n%s",
+			cmd.String(), err.Error(), cmdErr.String())
+	}
+
+	document := newSPDXDocument(classicStateMachine.ImageDef.ImageName,
+		classicStateMachine.ImageDef.Series, stateMachine.tempDirs.rootfs,
+		parseDpkgQueryOutput(packages.String()))
+
+	outputPath := filepath.Join(stateMachine.commonFlags.OutputDir,
+		classicStateMachine.ImageDef.ImageName+".spdx.json")
+	if err := writeSPDXDocument(document, outputPath); err != nil {
+		return err
+	}
+	stateMachine.addArtifact(outputPath)
 	return nil
 }
 
@@ -1252,7 +2505,7 @@ func (stateMachine *StateMachine) generateFilelist() error {
 	cmd := execCommand("chroot", stateMachine.tempDirs.rootfs, "find", "-xdev")
 	cmdOutput := helper.SetCommandOutput(cmd, classicStateMachine.commonFlags.Debug)
 
-	if err := cmd.Run(); err != nil {
+	if err := runCommand(stateMachine.context(), cmd); err != nil {
 		return fmt.Errorf("Error generating file list with command \"%s\". "+
 			"Error is \"%s\". Full output below:\n%s",
 			cmd.String(), err.Error(), cmdOutput.String())
@@ -1265,6 +2518,7 @@ func (stateMachine *StateMachine) generateFilelist() error {
 	}
 	defer filelist.Close()
 	filelist.Write(cmdOutput.Bytes())
+	stateMachine.addArtifact(outputPath)
 	return nil
 }
 
@@ -1277,9 +2531,33 @@ func (stateMachine *StateMachine) generateRootfsTarball() error {
 	rootfsSrc := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "root")
 	rootfsDst := filepath.Join(stateMachine.commonFlags.OutputDir,
 		classicStateMachine.ImageDef.Artifacts.RootfsTar.RootfsTarName)
-	return helper.CreateTarArchive(rootfsSrc, rootfsDst,
+	if err := helper.CreateTarArchive(stateMachine.commandRunner(), rootfsSrc, rootfsDst,
 		classicStateMachine.ImageDef.Artifacts.RootfsTar.Compression,
-		stateMachine.commonFlags.Verbose, stateMachine.commonFlags.Debug)
+		stateMachine.commonFlags.Verbose, stateMachine.commonFlags.Debug); err != nil {
+		return err
+	}
+	// the tarball of --rootfs-only takes the place of the disk images, so that it
+	// gets checksummed and signed like them
+	if classicStateMachine.Opts.RootfsOnly != "" {
+		stateMachine.addImageFile(rootfsDst)
+	} else {
+		stateMachine.addArtifact(rootfsDst)
+	}
+	return nil
+}
+
+// Generate the rootfs squashfs image, with the compressor passed with --comp
+func (stateMachine *StateMachine) generateRootfsSquashfs() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	rootfsDst := filepath.Join(stateMachine.commonFlags.OutputDir,
+		classicStateMachine.ImageDef.Artifacts.RootfsSquashfs.RootfsSquashfsName)
+	if err := stateMachine.packRootfsSquashfs(rootfsDst); err != nil {
+		return err
+	}
+	stateMachine.addArtifact(rootfsDst)
+	return nil
 }
 
 // makeQcow2Img converts raw .img artifacts into qcow2 artifacts
@@ -1288,7 +2566,7 @@ func (stateMachine *StateMachine) makeQcow2Img() error {
 	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
 
 	for _, qcow2 := range *classicStateMachine.ImageDef.Artifacts.Qcow2 {
-		backingFile := filepath.Join(stateMachine.commonFlags.OutputDir, stateMachine.VolumeNames[qcow2.Qcow2Volume])
+		backingFile := stateMachine.volumeImagePath(qcow2.Qcow2Volume)
 		resultingFile := filepath.Join(stateMachine.commonFlags.OutputDir, qcow2.Qcow2Name)
 		qemuImgCommand := execCommand("qemu-img",
 			"convert",
@@ -1301,11 +2579,40 @@ func (stateMachine *StateMachine) makeQcow2Img() error {
 			resultingFile,
 		)
 		qemuOutput := helper.SetCommandOutput(qemuImgCommand, classicStateMachine.commonFlags.Debug)
-		if err := qemuImgCommand.Run(); err != nil {
+		if err := runCommand(stateMachine.context(), qemuImgCommand); err != nil {
 			return fmt.Errorf("Error creating qcow2 artifact with command \"%s\". "+
 				"Error is \"%s\". Full output below:\n%s",
 				qemuImgCommand.String(), err.Error(), qemuOutput.String())
 		}
+		stateMachine.addImageFile(resultingFile)
+	}
+	return nil
+}
+
+// convertDiskImages converts the raw .img artifacts into the format
+// requested with --format. The raw images are removed afterwards
+// unless --debug was passed
+func (stateMachine *StateMachine) convertDiskImages() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	// the format has already been validated in Setup()
+	converter := diskImageConverters[classicStateMachine.Opts.Format]
+	for _, img := range *classicStateMachine.ImageDef.Artifacts.Img {
+		rawFile := filepath.Join(stateMachine.commonFlags.OutputDir, img.ImgName)
+		convertedFile, err := converter.convert(stateMachine.context(), rawFile, stateMachine.commonFlags.Debug)
+		if err != nil {
+			return err
+		}
+		stateMachine.addImageFile(convertedFile)
+		// keep the intermediate raw image around for debugging purposes
+		if !stateMachine.commonFlags.Debug {
+			if err := osRemoveAll(rawFile); err != nil {
+				return fmt.Errorf("Error removing raw disk image \"%s\": %s",
+					rawFile, err.Error())
+			}
+			stateMachine.removeImageFile(rawFile)
+		}
 	}
 	return nil
 }
@@ -1313,6 +2620,9 @@ func (stateMachine *StateMachine) makeQcow2Img() error {
 // updateBootloader determines the bootloader for each volume
 // and runs the correct helper function to update the bootloader
 func (stateMachine *StateMachine) updateBootloader() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
 	// determine which partition number is the rootfs and which volume it is in
 	// TODO should this be stored in the struct earlier on?
 	rootfsPartNum := -1
@@ -1321,15 +2631,43 @@ func (stateMachine *StateMachine) updateBootloader() error {
 		for structureNumber, structure := range volume.Structure {
 			if structure.Role == gadget.SystemData {
 				rootfsPartNum = structureNumber
-				switch volume.Bootloader {
+				bootloader, err := stateMachine.volumeBootloader(volumeName)
+				if err != nil {
+					return err
+				}
+				switch bootloader {
 				case "grub":
-					err := stateMachine.updateGrub(volumeName, rootfsPartNum)
+					// load_gadget_yaml already fails without loop devices
+					if err := stateMachine.validateBootloaderUpdate(); err != nil {
+						return err
+					}
+					err := stateMachine.updateGrub(volumeName, partitionNumber(volume, rootfsPartNum))
 					if err != nil {
 						return err
 					}
+				case "systemd-boot":
+					noLoop := classicStateMachine.noLoop()
+					rebuild := !noLoop && !stateMachine.loopDevicesAvailable()
+					if rebuild {
+						stateMachine.printWarning("no loop device can be set up, the partitions and " +
+							"the disk images are made again once their contents are updated")
+					}
+					err := stateMachine.updateSystemdBoot(volumeName, rootfsPartNum, noLoop || rebuild)
+					if err != nil {
+						return err
+					}
+					if rebuild {
+						// the partition tables are the same, only the contents of the partitions change
+						if err := stateMachine.populatePreparePartitions(); err != nil {
+							return err
+						}
+						if err := stateMachine.makeDisk(); err != nil {
+							return err
+						}
+					}
 				default:
-					fmt.Printf("WARNING: updating bootloader %s not yet supported\n",
-						volume.Bootloader,
+					stateMachine.printWarning("updating bootloader %s not yet supported",
+						bootloader,
 					)
 				}
 			}
@@ -0,0 +1,94 @@
+package statemachine
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// commandEnvKey is the key of the environment variables of a context
+type commandEnvKey struct{}
+
+// withCommandEnv returns a context with which runCommand sets the variables of env,
+// given as NAME=value, in the environment of the commands it runs, on top of the
+// variables of ctx
+func withCommandEnv(ctx context.Context, env ...string) context.Context {
+	if len(env) == 0 {
+		return ctx
+	}
+	parentEnv, _ := ctx.Value(commandEnvKey{}).([]string)
+	return context.WithValue(ctx, commandEnvKey{}, append(append([]string{}, parentEnv...), env...))
+}
+
+// lookupEnv returns the value of the variable name in env, like os.LookupEnv.
+// Like for exec.Cmd, the last value of the variable is the one that counts
+func lookupEnv(env []string, name string) (string, bool) {
+	for i := len(env) - 1; i >= 0; i-- {
+		if strings.HasPrefix(env[i], name+"=") {
+			return strings.TrimPrefix(env[i], name+"="), true
+		}
+	}
+	return "", false
+}
+
+// applyCommandEnv sets the variables of ctx in the environment of cmd. They replace
+// the variables of the process, but not the ones that cmd sets to another value itself
+func applyCommandEnv(ctx context.Context, cmd *exec.Cmd) {
+	env, _ := ctx.Value(commandEnvKey{}).([]string)
+	if len(env) == 0 {
+		return
+	}
+	if cmd.Env == nil {
+		cmd.Env = append(os.Environ(), env...)
+		return
+	}
+	for _, variable := range env {
+		name := strings.SplitN(variable, "=", 2)[0]
+		if value, found := lookupEnv(cmd.Env, name); found {
+			if processValue, inherited := os.LookupEnv(name); !inherited || value != processValue {
+				continue
+			}
+		}
+		cmd.Env = append(cmd.Env, variable)
+	}
+}
+
+// proxyKey is the key of the proxy function of a context
+type proxyKey struct{}
+
+// withProxy returns a context with which the clients of the snap store and of the
+// other HTTP servers choose the proxy of their requests with proxy
+func withProxy(ctx context.Context, proxy func(*http.Request) (*url.URL, error)) context.Context {
+	return context.WithValue(ctx, proxyKey{}, proxy)
+}
+
+// contextProxy returns the proxy function of ctx. Without one, the proxies
+// are taken from the environment
+func contextProxy(ctx context.Context) func(*http.Request) (*url.URL, error) {
+	if proxy, ok := ctx.Value(proxyKey{}).(func(*http.Request) (*url.URL, error)); ok {
+		return proxy
+	}
+	return http.ProxyFromEnvironment
+}
+
+// detachedContext keeps the values of its parent, like the environment and the
+// echo of the commands, but is never cancelled
+type detachedContext struct {
+	parent context.Context
+}
+
+func (ctx detachedContext) Deadline() (time.Time, bool)       { return time.Time{}, false }
+func (ctx detachedContext) Done() <-chan struct{}             { return nil }
+func (ctx detachedContext) Err() error                        { return nil }
+func (ctx detachedContext) Value(key interface{}) interface{} { return ctx.parent.Value(key) }
+
+// withoutCancel returns a context with the values of ctx that is not cancelled with
+// it. It is used to run the commands that clean up after a state, like unmounting
+// the filesystems it mounted, which must run even when the build is interrupted
+func withoutCancel(ctx context.Context) context.Context {
+	return detachedContext{parent: ctx}
+}
@@ -1,10 +1,15 @@
 package statemachine
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
 	"fmt"
+	"hash"
 	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -16,11 +21,21 @@ import (
 	"github.com/snapcore/snapd/osutil"
 )
 
+// checksumAlgorithms maps the values of --checksum to the hash used to calculate them
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
 // generate work directory file structure
 func (stateMachine *StateMachine) makeTemporaryDirectories() error {
-	// if no workdir was specified, open a /tmp dir
+	// if no workdir was specified, open a /tmp dir, or one in the directory of --tmp-dir
 	if stateMachine.stateMachineFlags.WorkDir == "" {
-		stateMachine.stateMachineFlags.WorkDir = filepath.Join("/tmp", "ubuntu-image-"+uuid.NewString())
+		parentDir := "/tmp"
+		if stateMachine.commonFlags.TmpDir != "" {
+			parentDir = stateMachine.commonFlags.TmpDir
+		}
+		stateMachine.stateMachineFlags.WorkDir = filepath.Join(parentDir, "ubuntu-image-"+uuid.NewString())
 		if err := osMkdir(stateMachine.stateMachineFlags.WorkDir, 0755); err != nil {
 			return fmt.Errorf("Failed to create temporary directory: %s", err.Error())
 		}
@@ -30,6 +45,15 @@ func (stateMachine *StateMachine) makeTemporaryDirectories() error {
 		if err != nil && !os.IsExist(err) {
 			return fmt.Errorf("Error creating work directory: %s", err.Error())
 		}
+		// the files that are already there are kept when the work dir is reset
+		entries, err := osReadDir(stateMachine.stateMachineFlags.WorkDir)
+		if err != nil {
+			return fmt.Errorf("Error reading work directory: %s", err.Error())
+		}
+		stateMachine.workDirEntries = make(map[string]bool)
+		for _, entry := range entries {
+			stateMachine.workDirEntries[entry.Name()] = true
+		}
 	}
 
 	stateMachine.tempDirs.rootfs = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "root")
@@ -67,6 +91,30 @@ func (stateMachine *StateMachine) determineOutputDirectory() error {
 	return nil
 }
 
+// validateGadgetYaml checks the volumes defined in gadget.yaml before anything
+// is built with them, so that a broken gadget.yaml does not only show up when
+// the disk is partitioned at the end of the build
+func (stateMachine *StateMachine) validateGadgetYaml() error {
+	gadgetYamlBytes, err := osReadFile(stateMachine.YamlFilePath)
+	if err != nil {
+		return fmt.Errorf("Error reading gadget.yaml bytes: %s", err.Error())
+	}
+
+	problems, err := findGadgetYamlErrors(gadgetYamlBytes)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("gadget.yaml is invalid, found %d problem(s):\n  - %s",
+			len(problems), strings.Join(problems, "\n  - "))
+	}
+
+	if stateMachine.stateMachineFlags.ValidateOnly && !stateMachine.commonFlags.Quiet {
+		fmt.Printf("%s is valid\n", stateMachine.YamlFilePath)
+	}
+	return nil
+}
+
 // Load gadget.yaml, do some validation, and store the relevant info in the StateMachine struct
 func (stateMachine *StateMachine) loadGadgetYaml() error {
 	gadgetYamlDst := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "gadget.yaml")
@@ -104,10 +152,60 @@ func (stateMachine *StateMachine) loadGadgetYaml() error {
 	// order of the volumes as an array in the StateMachine struct
 	stateMachine.saveVolumeOrder(string(gadgetYamlBytes))
 
+	// the fields snapd ignores are parsed once for all of the extensions
+	stateMachine.gadgetExtensions, err = parseGadgetYamlExtensions(gadgetYamlBytes)
+	if err != nil {
+		return err
+	}
+	stateMachine.PartitionAttributes, err = parsePartitionAttributes(stateMachine.gadgetExtensions,
+		stateMachine.GadgetInfo)
+	if err != nil {
+		return err
+	}
+	stateMachine.FilesystemUUIDs, err = parseFilesystemUUIDs(stateMachine.gadgetExtensions,
+		stateMachine.GadgetInfo)
+	if err != nil {
+		return err
+	}
+	stateMachine.MountPoints, err = parseMountPoints(stateMachine.gadgetExtensions, stateMachine.GadgetInfo)
+	if err != nil {
+		return err
+	}
+	var mkfsWarnings []string
+	stateMachine.MkfsOptions, mkfsWarnings, err = parseMkfsOptions(stateMachine.gadgetExtensions,
+		stateMachine.GadgetInfo)
+	if err != nil {
+		return err
+	}
+	if !stateMachine.commonFlags.Quiet {
+		for _, warning := range mkfsWarnings {
+			stateMachine.printWarning("%s", warning)
+		}
+	}
+	stateMachine.Recovery, err = parseRecoveryStructure(stateMachine.gadgetExtensions, stateMachine.GadgetInfo)
+	if err != nil {
+		return err
+	}
+	if err := stateMachine.checkRecoveryStructure(); err != nil {
+		return err
+	}
+	// the rootfs of snap images is laid out by snapd
+	if _, ok := stateMachine.parent.(*ClassicStateMachine); !ok && len(stateMachine.MountPoints) > 0 {
+		return fmt.Errorf("mount points can only be set in the gadget.yaml of classic images")
+	}
+
 	if err := stateMachine.postProcessGadgetYaml(); err != nil {
 		return err
 	}
 
+	if err := stateMachine.validateEncryptedPartitions(); err != nil {
+		return err
+	}
+
+	if err := stateMachine.validateBootloaderUpdate(); err != nil {
+		return err
+	}
+
 	if err := stateMachine.parseImageSizes(); err != nil {
 		return err
 	}
@@ -140,10 +238,16 @@ func (stateMachine *StateMachine) generateDiskInfo() error {
 // metadata. Use 8MB as a minimum padding here
 func (stateMachine *StateMachine) calculateRootfsSize() error {
 	// use `du` to calculate the size of the rootfs
-	rootfsSize, err := helper.Du(stateMachine.tempDirs.rootfs)
+	rootfsSize, err := helper.Du(stateMachine.commandRunner(), stateMachine.tempDirs.rootfs)
 	if err != nil {
 		return fmt.Errorf("Error getting rootfs size: %s", err.Error())
 	}
+	// the parts of the rootfs with a partition of their own are not in the rootfs partition
+	partitionsSize, err := stateMachine.rootfsPartitionsSize()
+	if err != nil {
+		return fmt.Errorf("Error getting the size of the rootfs partitions: %s", err.Error())
+	}
+	rootfsSize = helper.SafeQuantitySubtraction(rootfsSize, partitionsSize)
 	var rootfsQuantity quantity.Size = rootfsSize
 
 	// fudge factor for incidentals
@@ -173,17 +277,20 @@ func (stateMachine *StateMachine) calculateRootfsSize() error {
 			}
 		}
 
+		// the size of each volume can be given separately, in which case the
+		// volume holding the rootfs might not have one
+		hasSize := true
 		if !strings.Contains(stateMachine.commonFlags.Size, ":") {
 			// this scenario has just one size for each volume
 			// no need to check error as it has already been done by
 			// the parseImageSizes function
 			parsedSize, _ = quantity.ParseSize(stateMachine.commonFlags.Size)
 		} else {
-			parsedSize = stateMachine.ImageSizes[rootfsVolumeName]
+			parsedSize, hasSize = stateMachine.ImageSizes[rootfsVolumeName]
 		}
 
 		// subtract the size and offsets of the existing volumes
-		if rootfsVolume != nil {
+		if rootfsVolume != nil && hasSize {
 			for _, structure := range rootfsVolume.Structure {
 				parsedSize = helper.SafeQuantitySubtraction(parsedSize, structure.Size)
 				if structure.Offset != nil {
@@ -267,14 +374,9 @@ func (stateMachine *StateMachine) populateBootfsContents() error {
 				}
 			}
 			if laidOutStructure.HasFilesystem() {
-				mountedFilesystemWriter, err := gadgetNewMountedFilesystemWriter(&laidOutStructure, nil)
-				if err != nil {
-					return fmt.Errorf("Error creating NewMountedFilesystemWriter: %s", err.Error())
-				}
-
-				err = mountedFilesystemWriter.Write(targetDir, preserve)
-				if err != nil {
-					return fmt.Errorf("Error in mountedFilesystem.Write(): %s", err.Error())
+				if err := stateMachine.writeStructureContent(&laidOutStructure, targetDir,
+					preserve); err != nil {
+					return err
 				}
 			}
 		}
@@ -286,7 +388,31 @@ func (stateMachine *StateMachine) populateBootfsContents() error {
 // gadget.yaml, this involves using dd to copy the content blobs into a .img file. For
 // partitions that do have filesystem: specified, we use the Mkfs functions from snapd.
 // Throughout this process, the offset is tracked to ensure partitions are not overlapping.
-func (stateMachine *StateMachine) populatePreparePartitions() error {
+func (stateMachine *StateMachine) populatePreparePartitions() (err error) {
+	// the parts of the rootfs that have a partition of their own are moved out
+	// of it while the partitions are created
+	splitRoots, err := stateMachine.splitRootfs()
+	defer func() {
+		if joinErr := stateMachine.joinRootfs(splitRoots); err == nil {
+			err = joinErr
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	// creating the filesystems can take a while, so show the progress per structure
+	numStructures := 0
+	for _, volumeName := range stateMachine.VolumeOrder {
+		for _, structure := range stateMachine.GadgetInfo.Volumes[volumeName].Structure {
+			if !shouldSkipStructure(structure, stateMachine.IsSeeded) {
+				numStructures++
+			}
+		}
+	}
+	progress := stateMachine.newProgress("Creating partition images", numStructures)
+	defer progress.finish()
+
 	// iterate through all the volumes
 	for _, volumeName := range stateMachine.VolumeOrder {
 		volume := stateMachine.GadgetInfo.Volumes[volumeName]
@@ -299,6 +425,8 @@ func (stateMachine *StateMachine) populatePreparePartitions() error {
 			var contentRoot string
 			if structure.Role == gadget.SystemData || structure.Role == gadget.SystemSeed {
 				contentRoot = stateMachine.tempDirs.rootfs
+			} else if splitRoot, found := splitRoots[volumeName][structureNumber]; found {
+				contentRoot = splitRoot
 			} else {
 				contentRoot = filepath.Join(stateMachine.tempDirs.volumes, volumeName,
 					"part"+strconv.Itoa(structureNumber))
@@ -316,9 +444,55 @@ func (stateMachine *StateMachine) populatePreparePartitions() error {
 				structureNumber, contentRoot, partImg); err != nil {
 				return err
 			}
+			if fsUUID := stateMachine.filesystemUUID(volumeName, structureNumber,
+				structure); fsUUID != "" {
+				if err := stateMachine.setFilesystemUUID(structure.Filesystem,
+					partImg, fsUUID); err != nil {
+					return err
+				}
+			}
+			progress.increment()
 		}
 		// set the image size values to be used by make_disk
-		stateMachine.handleContentSizes(farthestOffset, volumeName)
+		if err := stateMachine.handleContentSizes(farthestOffset, volumeName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// filesystemCheckers are the commands checking each filesystem of gadget.yaml
+// without modifying it. They exit with a non-zero status when an error is found
+var filesystemCheckers = map[string][]string{
+	"ext4": {"e2fsck", "-f", "-n"},
+	"vfat": {"fsck.vfat", "-n"},
+}
+
+// verifyFilesystems checks the filesystems of the partition images before they are
+// written to the disk images, so that a corrupted filesystem fails the build
+func (stateMachine *StateMachine) verifyFilesystems() error {
+	for _, volumeName := range stateMachine.VolumeOrder {
+		volume := stateMachine.GadgetInfo.Volumes[volumeName]
+		for structureNumber, structure := range volume.Structure {
+			checker, found := filesystemCheckers[structure.Filesystem]
+			if !found || shouldSkipStructure(structure, stateMachine.IsSeeded) {
+				continue
+			}
+			partImg := filepath.Join(stateMachine.tempDirs.volumes, volumeName,
+				"part"+strconv.Itoa(structureNumber)+".img")
+			checkCmd := execCommand(checker[0], append(checker[1:], partImg)...)
+			checkOutput := helper.SetCommandOutput(checkCmd, stateMachine.commonFlags.Debug)
+			checkCtx := stateMachine.context()
+			if structure.Filesystem == "ext4" {
+				checkCtx = stateMachine.e2fsprogsContext()
+			}
+			if err := runCommand(checkCtx, checkCmd); err != nil {
+				return fmt.Errorf("The %s filesystem of structure \"%s\" in volume \"%s\" "+
+					"failed verification. Command \"%s\" failed with \"%s\". Output is: \n%s",
+					structure.Filesystem, structure.Name, volumeName, checkCmd.String(),
+					err.Error(), checkOutput.String())
+			}
+		}
 	}
 	return nil
 }
@@ -327,14 +501,22 @@ func (stateMachine *StateMachine) populatePreparePartitions() error {
 func (stateMachine *StateMachine) makeDisk() error {
 	// TODO: this is only temporarily needed until go-diskfs is fixed - see below
 	var existingDiskIds [][]byte
+	numDisks := 0
+	for volumeName := range stateMachine.GadgetInfo.Volumes {
+		if _, found := stateMachine.VolumeNames[volumeName]; found {
+			numDisks++
+		}
+	}
+	progress := stateMachine.newProgress("Creating disk images", numDisks)
+	defer progress.finish()
 	for volumeName, volume := range stateMachine.GadgetInfo.Volumes {
 		if _, found := stateMachine.VolumeNames[volumeName]; found {
-			imgName := filepath.Join(stateMachine.commonFlags.OutputDir, stateMachine.VolumeNames[volumeName])
+			imgName := stateMachine.volumeImagePath(volumeName)
 
 			// Create the disk image
 			imgSize, found := stateMachine.ImageSizes[volumeName]
 			if !found {
-				imgSize, _ = stateMachine.calculateImageSize()
+				imgSize, _ = stateMachine.calculateImageSize(volumeName)
 			}
 
 			if err := osRemoveAll(imgName); err != nil {
@@ -349,13 +531,20 @@ func (stateMachine *StateMachine) makeDisk() error {
 			// make sure the disk image size is a multiple of its block/sector size
 			imgSize = quantity.Size(math.Ceil(float64(imgSize)/float64(stateMachine.SectorSize))) *
 				stateMachine.SectorSize
+			// some disk image formats need the image to be aligned even further
+			if stateMachine.imageAlignment != 0 {
+				imgSize = quantity.Size(math.Ceil(float64(imgSize)/float64(stateMachine.imageAlignment))) *
+					stateMachine.imageAlignment
+			}
 			if err := osTruncate(diskImg.File.Name(), int64(imgSize)); err != nil {
 				return fmt.Errorf("Error resizing disk image to a multiple of its block size: %s",
 					err.Error())
 			}
 
 			// set up the partitions on the device
-			partitionTable := createPartitionTable(volumeName, volume, uint64(stateMachine.SectorSize), stateMachine.IsSeeded)
+			partitionTable := createPartitionTable(volumeName, volume, uint64(stateMachine.SectorSize),
+				stateMachine.IsSeeded, stateMachine.PartitionAttributes[volumeName])
+			stateMachine.setDeterministicGUIDs(volumeName, *partitionTable)
 
 			// Write the partition table to disk
 			if err := diskImg.Partition(*partitionTable); err != nil {
@@ -369,6 +558,9 @@ func (stateMachine *StateMachine) makeDisk() error {
 				if err != nil {
 					return fmt.Errorf("Error generating disk ID: %s", err.Error())
 				}
+				if stateMachine.deterministicSeed() != "" {
+					randomBytes = stateMachine.deterministicDiskID(volumeName)
+				}
 				diskFile, err := osOpenFile(imgName, os.O_RDWR, 0755)
 				defer diskFile.Close()
 				if err != nil {
@@ -382,16 +574,258 @@ func (stateMachine *StateMachine) makeDisk() error {
 				diskFile.Close()
 			}
 
+			if stateMachine.commonFlags.HybridMBR {
+				if err := stateMachine.writeHybridMBR(volumeName, volume, imgName); err != nil {
+					return err
+				}
+			}
+
 			// After the partitions have been created, copy the data into the correct locations
 			if err := stateMachine.copyDataToImage(volumeName, volume, diskImg); err != nil {
 				return err
 			}
 
+			if err := stateMachine.encryptPartitions(volumeName, volume, imgName); err != nil {
+				return err
+			}
+
 			// Open the file and write any OffsetWrite values
 			if err := writeOffsetValues(volume, imgName, uint64(stateMachine.SectorSize), uint64(imgSize)); err != nil {
 				return err
 			}
+
+			if err := stateMachine.writeSparseImage(imgName); err != nil {
+				return err
+			}
+
+			// intermediate images are not artifacts of the build
+			if !stateMachine.IntermediateVolumes[volumeName] {
+				stateMachine.addImageFile(imgName)
+			}
+			progress.increment()
+		}
+	}
+	return nil
+}
+
+// verifyPartitionTables reads back the partition tables of the disk images and compares
+// their partitions to the structures of gadget.yaml, so that a partition that is not
+// where gadget.yaml puts it, like one off by a sector, fails the build
+func (stateMachine *StateMachine) verifyPartitionTables() error {
+	for _, volumeName := range stateMachine.VolumeOrder {
+		if _, found := stateMachine.VolumeNames[volumeName]; !found {
+			continue
+		}
+		volume := stateMachine.GadgetInfo.Volumes[volumeName]
+		expected := gadgetPartitions(volume, stateMachine.IsSeeded)
+		actual, err := readPartitionTable(stateMachine.volumeImagePath(volumeName),
+			volume.Schema, uint64(stateMachine.SectorSize))
+		if err != nil {
+			return fmt.Errorf("Error reading the partition table of volume \"%s\": %s",
+				volumeName, err.Error())
+		}
+
+		var discrepancies []string
+		if len(actual) != len(expected) {
+			discrepancies = append(discrepancies, fmt.Sprintf("it has %d partitions instead of %d",
+				len(actual), len(expected)))
+		}
+		for i := 0; i < len(actual) && i < len(expected); i++ {
+			check := func(field string, got, want interface{}) {
+				if got != want {
+					discrepancies = append(discrepancies, fmt.Sprintf(
+						"partition %d has %s %v instead of %v", i+1, field, got, want))
+				}
+			}
+			check("name", actual[i].name, expected[i].name)
+			check("type", actual[i].ptype, expected[i].ptype)
+			check("offset", actual[i].offset, expected[i].offset)
+			check("size", actual[i].size, expected[i].size)
+		}
+		if len(discrepancies) > 0 {
+			return fmt.Errorf("The partition table of volume \"%s\" does not match gadget.yaml: %s",
+				volumeName, strings.Join(discrepancies, ", "))
+		}
+	}
+	return nil
+}
+
+// generateBuildManifest writes a manifest listing every deb package installed in
+// the rootfs and every snap in its seed, so that releases have a record of
+// exactly what went into the image
+func (stateMachine *StateMachine) generateBuildManifest() error {
+	var manifestLines []string
+
+	// only classic images have a dpkg database. It is read from the host with
+	// --admindir so that no binary of the target architecture has to run
+	dpkgDir := filepath.Join(stateMachine.tempDirs.rootfs, "var", "lib", "dpkg")
+	if osutil.IsDirectory(dpkgDir) {
+		var packages, cmdErr bytes.Buffer
+		cmd := execCommand("dpkg-query", "--admindir="+dpkgDir, "-W",
+			"--showformat=${Package} ${Version}\n")
+		cmd.Stdout = &packages
+		cmd.Stderr = &cmdErr
+		if err := runCommand(stateMachine.context(), cmd); err != nil {
+			return fmt.Errorf("Error listing the installed packages with command \"%s\". "+
+				"Error is \"%s\". Full output below:\n%s",
+				cmd.String(), err.Error(), cmdErr.String())
+		}
+		for _, line := range strings.Split(packages.String(), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				manifestLines = append(manifestLines, "deb "+line)
+			}
+		}
+	}
+
+	seedSnaps, err := readSeedSnaps(stateMachine.tempDirs.rootfs)
+	if err != nil {
+		return err
+	}
+	for _, seedSnap := range seedSnaps {
+		snapChannel := seedSnap.Channel
+		if snapChannel == "" {
+			snapChannel = "-"
+		}
+		manifestLine := fmt.Sprintf("snap %s %s %s",
+			seedSnap.SnapName(), seedSnap.SideInfo.Revision, snapChannel)
+		if _, pinned := stateMachine.SnapRevisions[seedSnap.SnapName()]; pinned {
+			manifestLine += " pinned"
+		}
+		if cohort, found := stateMachine.SnapCohorts[seedSnap.SnapName()]; found {
+			manifestLine += " cohort=" + cohort
+		}
+		manifestLines = append(manifestLines, manifestLine)
+	}
+	sort.Strings(manifestLines)
+
+	// the sources the image was built from come before its contents. The gadget
+	// of a git repository is identified by the commit that was checked out
+	if stateMachine.GadgetCommit != "" {
+		manifestLines = append([]string{"gadget-git " + stateMachine.GadgetCommit}, manifestLines...)
+	}
+	// the base rootfs comes first, as the packages were installed on top of it
+	if stateMachine.BaseRootfs != "" {
+		manifestLines = append([]string{"rootfs-tarball " + stateMachine.BaseRootfs}, manifestLines...)
+	}
+	// the base was not seeded from the channel of the model
+	if snapStateMachine, ok := stateMachine.parent.(*SnapStateMachine); ok &&
+		snapStateMachine.Opts.BaseSnap != "" {
+		manifestLines = append([]string{"base-snap " + snapStateMachine.Opts.BaseSnap}, manifestLines...)
+	}
+
+	outputPath := stateMachine.buildManifestPath()
+	if err := osMkdirAll(filepath.Dir(outputPath), 0755); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("Error creating the build manifest directory: %s", err.Error())
+	}
+	manifest, err := osCreate(outputPath)
+	if err != nil {
+		return fmt.Errorf("Error creating build manifest file: %s", err.Error())
+	}
+	defer manifest.Close()
+	for _, line := range manifestLines {
+		fmt.Fprintln(manifest, line)
+	}
+	stateMachine.addArtifact(outputPath)
+	return nil
+}
+
+// compressDiskImages compresses the raw disk images with the compressor passed
+// with --compress. The uncompressed images are removed afterwards unless --debug
+// was passed
+func (stateMachine *StateMachine) compressDiskImages() error {
+	// the compressor has already been validated in Setup()
+	name, level, _ := parseDiskImageCompression(stateMachine.commonFlags.Compress)
+	compressor := diskImageCompressors[name]
+	for _, volumeName := range stateMachine.VolumeOrder {
+		if _, found := stateMachine.VolumeNames[volumeName]; !found ||
+			stateMachine.IntermediateVolumes[volumeName] {
+			continue
+		}
+		rawFile := stateMachine.volumeImagePath(volumeName)
+		compressedFile, err := compressor.compress(stateMachine.context(), name, rawFile, level,
+			stateMachine.commonFlags.CompressThreads, stateMachine.commonFlags.Debug)
+		if err != nil {
+			return err
+		}
+		stateMachine.addImageFile(compressedFile)
+		// keep the uncompressed image around for debugging purposes
+		if !stateMachine.commonFlags.Debug {
+			if err := osRemoveAll(rawFile); err != nil {
+				return fmt.Errorf("Error removing uncompressed disk image \"%s\": %s",
+					rawFile, err.Error())
+			}
+			stateMachine.removeImageFile(rawFile)
+		}
+	}
+	return nil
+}
+
+// generateChecksums writes a <ALGORITHM>SUMS file to the output directory
+// listing the checksums of all the disk image files that were created
+func (stateMachine *StateMachine) generateChecksums() error {
+	algorithm := stateMachine.commonFlags.Checksum
+	newHash, found := checksumAlgorithms[algorithm]
+	if !found {
+		return fmt.Errorf("Unsupported checksum algorithm \"%s\"", algorithm)
+	}
+
+	// sort the images so the file is the same regardless of the volume order
+	imageFiles := make([]string, len(stateMachine.ImageFiles))
+	copy(imageFiles, stateMachine.ImageFiles)
+	sort.Strings(imageFiles)
+
+	// use the coreutils format so that the file can be verified with e.g. sha256sum -c
+	var checksums strings.Builder
+	for _, imageFile := range imageFiles {
+		checksum, err := helperCalculateChecksum(imageFile, newHash)
+		if err != nil {
+			return err
+		}
+		relativePath, err := filepathRel(stateMachine.commonFlags.OutputDir, imageFile)
+		if err != nil {
+			return fmt.Errorf("Error determining path of \"%s\" relative to the output directory: %s",
+				imageFile, err.Error())
+		}
+		fmt.Fprintf(&checksums, "%s  %s\n", checksum, relativePath)
+	}
+
+	checksumFile := stateMachine.checksumFile()
+	if err := osWriteFile(checksumFile, []byte(checksums.String()), 0644); err != nil {
+		return fmt.Errorf("Error writing checksum file \"%s\": %s", checksumFile, err.Error())
+	}
+	stateMachine.addArtifact(checksumFile)
+	return nil
+}
+
+// checksumFile returns the path of the <ALGORITHM>SUMS file written with --checksum
+func (stateMachine *StateMachine) checksumFile() string {
+	return filepath.Join(stateMachine.commonFlags.OutputDir,
+		strings.ToUpper(stateMachine.commonFlags.Checksum)+"SUMS")
+}
+
+// signArtifacts writes a detached GPG signature next to each disk image file, and
+// to the checksum file of --checksum, with the key passed with --sign-key. The
+// signatures are ASCII armored and named after the signed file with an .asc suffix
+func (stateMachine *StateMachine) signArtifacts() error {
+	signedFiles := make([]string, len(stateMachine.ImageFiles))
+	copy(signedFiles, stateMachine.ImageFiles)
+	sort.Strings(signedFiles)
+	if stateMachine.commonFlags.Checksum != "" {
+		signedFiles = append(signedFiles, stateMachine.checksumFile())
+	}
+
+	for _, signedFile := range signedFiles {
+		signature := signedFile + ".asc"
+		signCmd := execCommand("gpg", "--batch", "--yes", "--armor",
+			"--local-user", stateMachine.commonFlags.SignKey,
+			"--output", signature, "--detach-sign", signedFile)
+		signOutput := helper.SetCommandOutput(signCmd, stateMachine.commonFlags.Debug)
+		if err := runCommand(stateMachine.context(), signCmd); err != nil {
+			return fmt.Errorf("Error signing \"%s\". Error running command \"%s\". "+
+				"Error is \"%s\". Output is: \n%s",
+				signedFile, signCmd.String(), err.Error(), signOutput.String())
 		}
+		stateMachine.addArtifact(signature)
 	}
 	return nil
 }
@@ -4,19 +4,35 @@ package statemachine
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/canonical/ubuntu-image/internal/helper"
 	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/partition/gpt"
 	"github.com/google/uuid"
+	"github.com/snapcore/snapd/asserts"
 	"github.com/snapcore/snapd/gadget"
 	"github.com/snapcore/snapd/gadget/quantity"
 	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/seed"
+	"github.com/snapcore/snapd/snap"
+	"github.com/snapcore/snapd/timings"
+	"golang.org/x/sys/unix"
 )
 
 // TestMakeTemporaryDirectories tests a successful execution of the
@@ -266,6 +282,87 @@ func TestFailedLoadGadgetYaml(t *testing.T) {
 	})
 }
 
+// TestValidateGadgetYaml runs the validateGadgetYaml state on the valid gadget.yaml
+// files of the test data and makes sure no problems are reported
+func TestValidateGadgetYaml(t *testing.T) {
+	testCases := []struct {
+		name       string
+		gadgetYaml string
+	}{
+		{"gadget_tree", filepath.Join("testdata", "gadget_tree", "meta", "gadget.yaml")},
+		{"mbr", filepath.Join("testdata", "gadget-mbr.yaml")},
+		{"gpt", filepath.Join("testdata", "gadget-gpt.yaml")},
+		{"hybrid", filepath.Join("testdata", "gadget-hybrid.yaml")},
+		{"multi_volume", filepath.Join("testdata", "gadget-multi.yaml")},
+	}
+	for _, tc := range testCases {
+		t.Run("test_validate_gadget_yaml_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.stateMachineFlags.ValidateOnly = true
+			stateMachine.YamlFilePath = tc.gadgetYaml
+
+			stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+			defer restoreStdout()
+			asserter.AssertErrNil(err, true)
+
+			err = stateMachine.validateGadgetYaml()
+			asserter.AssertErrNil(err, true)
+
+			restoreStdout()
+			readStdout, err := io.ReadAll(stdout)
+			asserter.AssertErrNil(err, true)
+			if !strings.Contains(string(readStdout), tc.gadgetYaml+" is valid") {
+				t.Errorf("Expected \"%s is valid\" to be printed, but got \"%s\"",
+					tc.gadgetYaml, string(readStdout))
+			}
+		})
+	}
+}
+
+// TestFailedValidateGadgetYaml tests failures in the validateGadgetYaml state, including
+// a gadget.yaml with several problems that all have to be reported
+func TestFailedValidateGadgetYaml(t *testing.T) {
+	t.Run("test_failed_validate_gadget_yaml", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget_tree", "meta", "gadget.yaml")
+
+		// mock osReadFile
+		osReadFile = mockReadFile
+		defer func() {
+			osReadFile = os.ReadFile
+		}()
+		err := stateMachine.validateGadgetYaml()
+		asserter.AssertErrContains(err, "Error reading gadget.yaml bytes")
+		osReadFile = os.ReadFile
+
+		// a file that isn't yaml at all
+		stateMachine.YamlFilePath = filepath.Join("testdata",
+			"gadget_tree_invalid", "meta", "gadget.yaml")
+		err = stateMachine.validateGadgetYaml()
+		asserter.AssertErrContains(err, "cannot parse gadget.yaml")
+
+		// every problem in the volumes is reported at once
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-invalid-volumes.yaml")
+		err = stateMachine.validateGadgetYaml()
+		asserter.AssertErrContains(err, "found 6 problem(s)")
+		expectedProblems := []string{
+			"volume \"-data\": invalid name",
+			"volume \"-data\": invalid schema \"gpt2\"",
+			"volume \"pc\": structure #0 (\"mbr\"): has \"mbr\" role and must start at offset 0",
+			"volume \"pc\": structure #2 (\"EFI System\"): invalid filesystem \"fat32\"",
+			"volume \"pc\": structure #3 (\"missing-size\"): missing size",
+			"volume \"pc\": structure #2 (\"EFI System\"): overlaps with the preceding structure #1 (\"BIOS Boot\")",
+		}
+		for _, expectedProblem := range expectedProblems {
+			asserter.AssertErrContains(err, expectedProblem)
+		}
+	})
+}
+
 // TestGenerateDiskInfo tests that diskInfo can be generated
 func TestGenerateDiskInfo(t *testing.T) {
 	t.Run("test_generate_disk_info", func(t *testing.T) {
@@ -412,6 +509,39 @@ func TestCalculateRootfsSizeImageSize(t *testing.T) {
 	}
 }
 
+// TestCalculateRootfsSizeOtherVolumeSize tests that the size of a volume that
+// doesn't hold the rootfs does not change the size of the rootfs
+func TestCalculateRootfsSizeOtherVolumeSize(t *testing.T) {
+	t.Run("test_calculate_rootfs_size_other_volume_size", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.tempDirs.rootfs = filepath.Join("testdata", "gadget_tree")
+
+		// need workdir set up for this
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+		// the rootfs is in the fourth volume of this gadget.yaml
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-multi.yaml")
+		err = stateMachine.loadGadgetYaml()
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.calculateRootfsSize()
+		asserter.AssertErrNil(err, true)
+		minimumSize := stateMachine.RootfsSize
+
+		stateMachine.commonFlags.Size = "first:4G"
+		err = stateMachine.loadGadgetYaml()
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.calculateRootfsSize()
+		asserter.AssertErrNil(err, true)
+		if stateMachine.RootfsSize != minimumSize {
+			t.Errorf("Expected rootfs size %d, but got %d", minimumSize, stateMachine.RootfsSize)
+		}
+	})
+}
+
 // TestFailedCalculateRootfsSize tests a failure when calculating the rootfs size
 // this is accomplished by setting rootfs to a directory that does not exist
 func TestFailedCalculateRootfsSize(t *testing.T) {
@@ -898,275 +1028,2056 @@ func TestMakeDiskPartitionSchemes(t *testing.T) {
 	}
 }
 
-// TestFailedMakeDisk tests failures in the MakeDisk state
-func TestFailedMakeDisk(t *testing.T) {
-	t.Run("test_failed_make_disk", func(t *testing.T) {
+// TestPartitionAttributes tests that the GPT partition attribute flags of gadget.yaml
+// are written to the partition table and can be read back from the disk image
+func TestPartitionAttributes(t *testing.T) {
+	t.Run("test_partition_attributes", func(t *testing.T) {
 		asserter := helper.Asserter{T: t}
 		var stateMachine StateMachine
 		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 
-		// need workdir set up for this
 		err := stateMachine.makeTemporaryDirectories()
 		asserter.AssertErrNil(err, true)
 		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
 
-		// also set up an output directory
-		outDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
-		asserter.AssertErrNil(err, true)
-		defer os.RemoveAll(outDir)
-		stateMachine.commonFlags.OutputDir = outDir
-		err = stateMachine.determineOutputDirectory()
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-gpt-attributes.yaml")
+		err = stateMachine.loadGadgetYaml()
 		asserter.AssertErrNil(err, true)
 
-		// set up volume names
-		stateMachine.VolumeNames = map[string]string{
-			"pc": "pc.img",
+		expected := map[string]map[int]uint64{"pc": {1: 0b101, 2: 0b010}}
+		if !reflect.DeepEqual(stateMachine.PartitionAttributes, expected) {
+			t.Errorf("Expected partition attributes %v, but got %v",
+				expected, stateMachine.PartitionAttributes)
 		}
 
-		// set a valid yaml file and load it in
-		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-mbr.yaml")
-		// ensure unpack exists
-		os.MkdirAll(filepath.Join(stateMachine.tempDirs.unpack, "gadget"), 0755)
-		err = stateMachine.loadGadgetYaml()
-		asserter.AssertErrNil(err, true)
+		// the rootfs size is only known once it's populated
+		volume := stateMachine.GadgetInfo.Volumes["pc"]
+		volume.Structure[len(volume.Structure)-1].Size = 10 * quantity.SizeMiB
 
-		// also need to set the rootfs size to avoid partition errors
-		err = stateMachine.calculateRootfsSize()
+		imgFile := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "pc.img")
+		diskImg, err := diskfs.Create(imgFile, 100*1024*1024, diskfs.Raw, diskfs.SectorSizeDefault)
 		asserter.AssertErrNil(err, true)
+		partitionTable := createPartitionTable("pc", volume, 512, false, stateMachine.PartitionAttributes["pc"])
+		err = diskImg.Partition(*partitionTable)
+		asserter.AssertErrNil(err, true)
+		diskImg.File.Close()
 
-		// ensure volumes exists
-		os.MkdirAll(stateMachine.tempDirs.volumes, 0755)
-
-		// populate unpack
-		files, _ := os.ReadDir(filepath.Join("testdata", "gadget_tree"))
-		for _, srcFile := range files {
-			srcFile := filepath.Join("testdata", "gadget_tree", srcFile.Name())
-			osutilCopySpecialFile(srcFile, filepath.Join(stateMachine.tempDirs.unpack, "gadget"))
+		diskImg, err = diskfs.Open(imgFile)
+		asserter.AssertErrNil(err, true)
+		defer diskImg.File.Close()
+		readTable, err := diskImg.GetPartitionTable()
+		asserter.AssertErrNil(err, true)
+		gptTable, ok := readTable.(*gpt.Table)
+		if !ok {
+			t.Fatalf("Expected a GPT partition table, but got %T", readTable)
 		}
+		var readAttributes []uint64
+		for _, gptPartition := range gptTable.Partitions {
+			if gptPartition.Type != gpt.Unused {
+				readAttributes = append(readAttributes, gptPartition.Attributes)
+			}
+		}
+		// the mbr structure is not a partition, the rootfs was added without attributes
+		expectedAttributes := []uint64{0b101, 0b010, 0}
+		if !reflect.DeepEqual(readAttributes, expectedAttributes) {
+			t.Errorf("Expected partition attributes %v to be read back, but got %v",
+				expectedAttributes, readAttributes)
+		}
+	})
+}
 
-		// mock os.RemoveAll
-		osRemoveAll = mockRemoveAll
-		defer func() {
-			osRemoveAll = os.RemoveAll
-		}()
-		err = stateMachine.makeDisk()
-		asserter.AssertErrContains(err, "Error removing old disk image")
-		osRemoveAll = os.RemoveAll
-
-		// mock diskfs.Create
-		diskfsCreate = mockDiskfsCreate
-		defer func() {
-			diskfsCreate = diskfs.Create
-		}()
-		err = stateMachine.makeDisk()
-		asserter.AssertErrContains(err, "Error creating disk image")
-		diskfsCreate = diskfs.Create
-
-		// mock os.Truncate
-		osTruncate = mockTruncate
-		defer func() {
-			osTruncate = os.Truncate
-		}()
-		err = stateMachine.makeDisk()
-		asserter.AssertErrContains(err, "Error resizing disk image")
-		osTruncate = os.Truncate
-
-		// mock diskfs.Create to create a read only disk
-		diskfsCreate = readOnlyDiskfsCreate
-		defer func() {
-			diskfsCreate = diskfs.Create
-		}()
-		err = stateMachine.makeDisk()
-		asserter.AssertErrContains(err, "Error partitioning image file")
-		diskfsCreate = diskfs.Create
-
-		// mock os.OpenFile
-		// errors in file.WriteAt()
-		osOpenFile = mockOpenFile
-		defer func() {
-			osOpenFile = os.OpenFile
-		}()
-		err = stateMachine.makeDisk()
-		asserter.AssertErrContains(err, "Error opening disk to write MBR disk identifier")
-		osOpenFile = os.OpenFile
+// gadgetYamlExtensionsOf parses the extensions of a gadget.yaml, as load_gadget_yaml does
+func gadgetYamlExtensionsOf(t *testing.T, gadgetYaml []byte) *gadgetYamlExtensions {
+	t.Helper()
+	extensions, err := parseGadgetYamlExtensions(gadgetYaml)
+	if err != nil {
+		t.Fatalf("Error parsing the extensions of gadget.yaml: %s", err.Error())
+	}
+	return extensions
+}
 
-		// mock rand.Read
-		// errors in generateUniqueDiskID()
-		randRead = mockRandRead
-		defer func() {
-			randRead = rand.Read
-		}()
-		err = stateMachine.makeDisk()
-		asserter.AssertErrContains(err, "Error generating disk ID")
-		randRead = rand.Read
+// TestFailedPartitionAttributes tests that unknown partition attributes, and partition
+// attributes of volumes that don't use a GPT, are rejected
+func TestFailedPartitionAttributes(t *testing.T) {
+	testCases := []struct {
+		name   string
+		schema string
+		flag   string
+		errMsg string
+	}{
+		{"unknown", "gpt", "hidden", "volumes:pc:structure:0: unknown partition attribute \"hidden\""},
+		{"mbr", "mbr", "required-partition", "partition attributes can only be set with the gpt schema"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_failed_partition_attributes_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			gadgetYaml := []byte(fmt.Sprintf(`volumes:
+  pc:
+    schema: %s
+    bootloader: grub
+    structure:
+      - name: data
+        type: 83,0FC63DAF-8483-4772-8E79-3D69D8477DE4
+        size: 1M
+        attributes: [%s]
+`, tc.schema, tc.flag))
+			gadgetInfo, err := gadget.InfoFromGadgetYaml(gadgetYaml, nil)
+			asserter.AssertErrNil(err, true)
+			_, err = parsePartitionAttributes(gadgetYamlExtensionsOf(t, gadgetYaml), gadgetInfo)
+			asserter.AssertErrContains(err, tc.errMsg)
+		})
+	}
+}
 
-		// mock os.OpenFile to force it to use os.O_APPEND, which causes
-		// errors in file.WriteAt()
-		osOpenFile = mockOpenFileAppend
-		defer func() {
-			osOpenFile = os.OpenFile
-		}()
-		err = stateMachine.makeDisk()
-		asserter.AssertErrContains(err, "Error writing MBR disk identifier")
-		osOpenFile = os.OpenFile
+// TestHybridMBR tests that --hybrid-mbr references the BIOS boot and EFI system
+// partitions in the MBR, after the protective partition of the GPT
+func TestHybridMBR(t *testing.T) {
+	t.Run("test_hybrid_mbr", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 
-		// mock helper.CopyBlob to simulate a failure in copyDataToImage
-		helperCopyBlob = mockCopyBlob
-		defer func() {
-			helperCopyBlob = helper.CopyBlob
-		}()
-		err = stateMachine.makeDisk()
-		asserter.AssertErrContains(err, "Error writing disk image")
-		helperCopyBlob = helper.CopyBlob
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
 
-		// Change to GPT for these next tests
 		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-gpt.yaml")
 		err = stateMachine.loadGadgetYaml()
 		asserter.AssertErrNil(err, true)
+		volume := stateMachine.GadgetInfo.Volumes["pc"]
+		volume.Structure[len(volume.Structure)-1].Size = 10 * quantity.SizeMiB
 
-		err = stateMachine.populateBootfsContents()
+		imgFile := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "pc.img")
+		diskImg, err := diskfs.Create(imgFile, 100*1024*1024, diskfs.Raw, diskfs.SectorSizeDefault)
 		asserter.AssertErrNil(err, true)
-
-		err = stateMachine.populatePreparePartitions()
+		err = diskImg.Partition(*createPartitionTable("pc", volume, 512, false, nil))
 		asserter.AssertErrNil(err, true)
+		diskImg.File.Close()
 
-		// mock os.OpenFile to simulate a failure in writeOffsetValues
-		osOpenFile = mockOpenFile
-		defer func() {
-			osOpenFile = os.OpenFile
-		}()
-		// also mock helperCopyBlob to ignore missing files and return success
-		helperCopyBlob = mockCopyBlobSuccess
-		defer func() {
-			helperCopyBlob = helper.CopyBlob
-		}()
-		err = stateMachine.makeDisk()
-		asserter.AssertErrContains(err, "Error opening image file")
-		osOpenFile = os.OpenFile
-		helperCopyBlob = helper.CopyBlob
-
-		helperCopyBlob = mockCopyBlob
-		defer func() {
-			helperCopyBlob = helper.CopyBlob
-		}()
-		stateMachine.cleanWorkDir = true // for coverage!
-		stateMachine.commonFlags.OutputDir = ""
-		defer os.Remove("pc.img")
-		err = stateMachine.makeDisk()
-		asserter.AssertErrContains(err, "Error writing disk image")
-		helperCopyBlob = helper.CopyBlob
+		stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+		defer restoreStdout()
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.writeHybridMBR("pc", volume, imgFile)
+		asserter.AssertErrNil(err, true)
+		restoreStdout()
+		readStdout, err := io.ReadAll(stdout)
+		asserter.AssertErrNil(err, true)
+		if len(readStdout) != 0 {
+			t.Errorf("Expected the layout to boot with UEFI and legacy BIOS, but got \"%s\"",
+				string(readStdout))
+		}
 
-		// make sure with no OutputDir the image was created in the cwd
-		_, err = os.Stat("pc.img")
+		imgBytes, err := os.ReadFile(imgFile)
 		asserter.AssertErrNil(err, true)
+		expected := []byte{
+			0x00, 0xFE, 0xFF, 0xFF, 0xEE, 0xFE, 0xFF, 0xFF, 0x01, 0x00, 0x00, 0x00, 0xFF, 0x07, 0x00, 0x00,
+			0x80, 0xFE, 0xFF, 0xFF, 0xDA, 0xFE, 0xFF, 0xFF, 0x00, 0x08, 0x00, 0x00, 0x00, 0x08, 0x00, 0x00,
+			0x00, 0xFE, 0xFF, 0xFF, 0xEF, 0xFE, 0xFF, 0xFF, 0x00, 0x10, 0x00, 0x00, 0x00, 0x90, 0x01, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		}
+		if !bytes.Equal(imgBytes[446:510], expected) {
+			t.Errorf("Expected hybrid MBR entries %x, but got %x", expected, imgBytes[446:510])
+		}
 	})
 }
 
-// TestImageSizeFlag performs a successful call to StateMachine.MakeDisk with the
-// --image-size flag, and ensures that the resulting image is the size specified
-// with the flag (LP: #1947867)
-func TestImageSizeFlag(t *testing.T) {
+// TestHybridMBRWarnings tests that --hybrid-mbr warns about the layouts that can't
+// boot with both UEFI and legacy BIOS
+func TestHybridMBRWarnings(t *testing.T) {
 	testCases := []struct {
 		name       string
-		sizeArg    string
-		gadgetTree string
-		imageSize  map[string]quantity.Size
-		volNames   map[string]string
+		gadgetYaml string
+		expected   string
 	}{
-		{
-			"one_volume",
-			"4G",
-			filepath.Join("testdata", "gadget_tree"),
-			map[string]quantity.Size{
-				"pc": 4 * quantity.SizeGiB,
-			},
-			map[string]string{
-				"pc": "pc.img",
-			},
-		},
-		{
-			"multi_volume",
-			"first:4G,second:1G",
-			filepath.Join("testdata", "gadget_tree_multi"),
-			map[string]quantity.Size{
-				"first":  4 * quantity.SizeGiB,
-				"second": 1 * quantity.SizeGiB,
-			},
-			map[string]string{
-				"first":  "first.img",
-				"second": "second.img",
-			},
-		},
+		{"mbr_schema", "gadget-mbr.yaml", "--hybrid-mbr is ignored for volume pc"},
+		{"no_esp", "gadget-no-content.yaml", "volume pc has no EFI system partition"},
 	}
 	for _, tc := range testCases {
-
-		t.Run("test_image_size_flag_"+tc.name, func(t *testing.T) {
+		t.Run("test_hybrid_mbr_warnings_"+tc.name, func(t *testing.T) {
 			asserter := helper.Asserter{T: t}
 			var stateMachine StateMachine
 			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
-			stateMachine.IsSeeded = true
-			stateMachine.commonFlags.Size = tc.sizeArg
 
-			// need workdir set up for this
 			err := stateMachine.makeTemporaryDirectories()
 			asserter.AssertErrNil(err, true)
-			//defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+			defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
 
-			// also set up an output directory
-			outDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+			stateMachine.YamlFilePath = filepath.Join("testdata", tc.gadgetYaml)
+			err = stateMachine.loadGadgetYaml()
 			asserter.AssertErrNil(err, true)
-			//defer os.RemoveAll(outDir)
-			stateMachine.commonFlags.OutputDir = outDir
-
-			// set up volume names
-			stateMachine.VolumeNames = tc.volNames
 
-			// set up a "rootfs" that we can eventually copy into the disk
-			os.MkdirAll(stateMachine.tempDirs.rootfs, 0755)
-			osutil.CopySpecialFile(tc.gadgetTree, stateMachine.tempDirs.rootfs)
+			// the image only needs to exist for the MBR to be written
+			imgFile := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "pc.img")
+			err = os.WriteFile(imgFile, make([]byte, 512), 0644)
+			asserter.AssertErrNil(err, true)
 
-			// set a valid yaml file and load it in
-			stateMachine.YamlFilePath = filepath.Join(tc.gadgetTree, "meta", "gadget.yaml")
-			// ensure unpack exists
-			os.MkdirAll(filepath.Join(stateMachine.tempDirs.unpack, "gadget"), 0755)
-			err = stateMachine.loadGadgetYaml()
+			stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+			defer restoreStdout()
+			asserter.AssertErrNil(err, true)
+			err = stateMachine.writeHybridMBR("pc", stateMachine.GadgetInfo.Volumes["pc"], imgFile)
 			asserter.AssertErrNil(err, true)
+			restoreStdout()
+			readStdout, err := io.ReadAll(stdout)
+			asserter.AssertErrNil(err, true)
+			if !strings.Contains(string(readStdout), tc.expected) {
+				t.Errorf("Expected \"%s\" in the output, but got \"%s\"", tc.expected, string(readStdout))
+			}
+		})
+	}
+}
 
-			// ensure volumes exists
-			os.MkdirAll(stateMachine.tempDirs.volumes, 0755)
+// TestFilesystemUUIDs tests that the filesystem UUIDs of gadget.yaml are used, and
+// that the other ones are derived from --deterministic-uuid when it is given
+func TestFilesystemUUIDs(t *testing.T) {
+	t.Run("test_filesystem_uuids", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 
-			// populate unpack
-			files, _ := os.ReadDir(tc.gadgetTree)
-			for _, srcFile := range files {
-				srcFile := filepath.Join(tc.gadgetTree, srcFile.Name())
-				osutil.CopySpecialFile(srcFile, filepath.Join(stateMachine.tempDirs.unpack, "gadget"))
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-fs-uuid.yaml")
+		err = stateMachine.loadGadgetYaml()
+		asserter.AssertErrNil(err, true)
+		expected := map[string]map[int]string{"pc": {2: "ABCD-1234"}}
+		if !reflect.DeepEqual(stateMachine.FilesystemUUIDs, expected) {
+			t.Errorf("Expected filesystem UUIDs %v, but got %v", expected, stateMachine.FilesystemUUIDs)
+		}
+
+		volume := stateMachine.GadgetInfo.Volumes["pc"]
+		if fsUUID := stateMachine.filesystemUUID("pc", 2, volume.Structure[2]); fsUUID != "ABCD-1234" {
+			t.Errorf("Expected the filesystem UUID of gadget.yaml, but got \"%s\"", fsUUID)
+		}
+		// the rootfs added to the volume keeps the random UUID of mkfs
+		if fsUUID := stateMachine.filesystemUUID("pc", 3, volume.Structure[3]); fsUUID != "" {
+			t.Errorf("Expected no filesystem UUID without --deterministic-uuid, but got \"%s\"", fsUUID)
+		}
+
+		stateMachine.commonFlags.DeterministicUUID = "test"
+		rootfsUUID := stateMachine.filesystemUUID("pc", 3, volume.Structure[3])
+		if _, err := uuid.Parse(rootfsUUID); err != nil {
+			t.Errorf("Expected a valid UUID for the rootfs, but got \"%s\"", rootfsUUID)
+		}
+		if stateMachine.filesystemUUID("pc", 3, volume.Structure[3]) != rootfsUUID {
+			t.Errorf("Expected the same UUID to be derived from the same seed")
+		}
+		// raw structures have no filesystem UUID
+		if fsUUID := stateMachine.filesystemUUID("pc", 1, volume.Structure[1]); fsUUID != "" {
+			t.Errorf("Expected no filesystem UUID for a raw structure, but got \"%s\"", fsUUID)
+		}
+		vfatStructure := volume.Structure[2]
+		delete(stateMachine.FilesystemUUIDs["pc"], 2)
+		if fsUUID := stateMachine.filesystemUUID("pc", 2, vfatStructure); !vfatVolumeIDRegex.MatchString(fsUUID) {
+			t.Errorf("Expected a vfat volume ID, but got \"%s\"", fsUUID)
+		}
+
+		stateMachine.commonFlags.DeterministicUUID = "other"
+		if stateMachine.filesystemUUID("pc", 3, volume.Structure[3]) == rootfsUUID {
+			t.Errorf("Expected a different UUID to be derived from a different seed")
+		}
+	})
+}
+
+// TestSourceDateEpochSeed tests that --deterministic-uuid SOURCE_DATE_EPOCH derives the
+// UUIDs from the value of SOURCE_DATE_EPOCH, which must then be set
+func TestSourceDateEpochSeed(t *testing.T) {
+	t.Run("test_source_date_epoch_seed", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		rootfsStructure := gadget.VolumeStructure{Filesystem: "ext4"}
+
+		stateMachine.commonFlags.DeterministicUUID = "SOURCE_DATE_EPOCH"
+		err := stateMachine.validateSourceDateEpoch()
+		asserter.AssertErrContains(err, "requires the SOURCE_DATE_EPOCH environment variable to be set")
+
+		os.Setenv("SOURCE_DATE_EPOCH", "yesterday")
+		defer os.Unsetenv("SOURCE_DATE_EPOCH")
+		err = stateMachine.validateSourceDateEpoch()
+		asserter.AssertErrContains(err, "SOURCE_DATE_EPOCH must be a number of seconds")
+
+		os.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+		err = stateMachine.validateSourceDateEpoch()
+		asserter.AssertErrNil(err, true)
+		if _, isSet := os.LookupEnv("E2FSPROGS_FAKE_TIME"); isSet {
+			t.Errorf("Expected E2FSPROGS_FAKE_TIME not to be set in the environment of ubuntu-image")
+		}
+		tune2fsCmd := exec.Command("tune2fs")
+		applyCommandEnv(stateMachine.e2fsprogsContext(), tune2fsCmd)
+		if fakeTime, _ := lookupEnv(tune2fsCmd.Env, "E2FSPROGS_FAKE_TIME"); fakeTime != "1700000000" {
+			t.Errorf("Expected E2FSPROGS_FAKE_TIME to be set to SOURCE_DATE_EPOCH, but got \"%s\"", fakeTime)
+		}
+
+		epochUUID := stateMachine.filesystemUUID("pc", 3, rootfsStructure)
+		stateMachine.commonFlags.DeterministicUUID = "1700000000"
+		if stateMachine.filesystemUUID("pc", 3, rootfsStructure) != epochUUID {
+			t.Errorf("Expected the UUID to be derived from the value of SOURCE_DATE_EPOCH")
+		}
+	})
+}
+
+// TestDeterministicGUIDs tests that the GUIDs of GPT partition tables and the MBR
+// disk identifiers are derived from --deterministic-uuid when it is given
+func TestDeterministicGUIDs(t *testing.T) {
+	t.Run("test_deterministic_guids", func(t *testing.T) {
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		newTable := func() *gpt.Table {
+			return &gpt.Table{Partitions: []*gpt.Partition{{Name: "boot"}, {Name: "rootfs"}}}
+		}
+
+		table := newTable()
+		stateMachine.setDeterministicGUIDs("pc", table)
+		if table.GUID != "" || table.Partitions[0].GUID != "" {
+			t.Errorf("Expected random GUIDs without --deterministic-uuid")
+		}
+
+		stateMachine.commonFlags.DeterministicUUID = "test"
+		stateMachine.setDeterministicGUIDs("pc", table)
+		guids := []string{table.GUID, table.Partitions[0].GUID, table.Partitions[1].GUID}
+		for i, guid := range guids {
+			if _, err := uuid.Parse(guid); err != nil {
+				t.Errorf("Expected a valid GUID, but got \"%s\"", guid)
+			}
+			for _, otherGUID := range guids[i+1:] {
+				if guid == otherGUID {
+					t.Errorf("Expected the disk and each partition to have their own GUID, but got %v", guids)
+				}
 			}
+		}
+		otherTable := newTable()
+		stateMachine.setDeterministicGUIDs("pc", otherTable)
+		if !reflect.DeepEqual(otherTable, table) {
+			t.Errorf("Expected the same GUIDs to be derived from the same seed")
+		}
+		stateMachine.setDeterministicGUIDs("other", otherTable)
+		if otherTable.GUID == table.GUID {
+			t.Errorf("Expected the GUIDs of different volumes to be different")
+		}
 
-			// also need to set the rootfs size to avoid partition errors
-			err = stateMachine.calculateRootfsSize()
+		diskID := stateMachine.deterministicDiskID("pc")
+		if len(diskID) != 4 || bytes.Equal(diskID, stateMachine.deterministicDiskID("other")) {
+			t.Errorf("Expected a 4 bytes disk ID unique to the volume, but got %v", diskID)
+		}
+	})
+}
+
+// TestClampMtimes tests that the files more recent than SOURCE_DATE_EPOCH, including
+// symbolic links, get SOURCE_DATE_EPOCH as their modification time
+func TestClampMtimes(t *testing.T) {
+	t.Run("test_clamp_mtimes", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		tmpDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(tmpDir)
+
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.tempDirs.rootfs = filepath.Join(tmpDir, "root")
+		stateMachine.tempDirs.volumes = filepath.Join(tmpDir, "volumes")
+		err = os.MkdirAll(filepath.Join(stateMachine.tempDirs.rootfs, "etc"), 0755)
+		asserter.AssertErrNil(err, true)
+		err = os.WriteFile(filepath.Join(stateMachine.tempDirs.rootfs, "etc", "hostname"), []byte("ubuntu"), 0644)
+		asserter.AssertErrNil(err, true)
+		oldFile := filepath.Join(stateMachine.tempDirs.rootfs, "etc", "old")
+		err = os.WriteFile(oldFile, []byte("old"), 0644)
+		asserter.AssertErrNil(err, true)
+		oldTime := time.Unix(1600000000, 0)
+		err = os.Chtimes(oldFile, oldTime, oldTime)
+		asserter.AssertErrNil(err, true)
+		err = os.Symlink("old", filepath.Join(stateMachine.tempDirs.rootfs, "etc", "link"))
+		asserter.AssertErrNil(err, true)
+
+		// nothing is done without SOURCE_DATE_EPOCH
+		err = stateMachine.clampMtimes()
+		asserter.AssertErrNil(err, true)
+		fileInfo, err := os.Stat(filepath.Join(stateMachine.tempDirs.rootfs, "etc", "hostname"))
+		asserter.AssertErrNil(err, true)
+		if fileInfo.ModTime().Unix() == 1700000000 {
+			t.Errorf("Expected the modification times to be kept without SOURCE_DATE_EPOCH")
+		}
+
+		os.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+		defer os.Unsetenv("SOURCE_DATE_EPOCH")
+		err = stateMachine.clampMtimes()
+		asserter.AssertErrNil(err, true)
+		expectedMtimes := map[string]int64{
+			"":             1700000000,
+			"etc":          1700000000,
+			"etc/hostname": 1700000000,
+			"etc/link":     1700000000,
+			"etc/old":      1600000000,
+		}
+		for path, expectedMtime := range expectedMtimes {
+			fileInfo, err := os.Lstat(filepath.Join(stateMachine.tempDirs.rootfs, path))
 			asserter.AssertErrNil(err, true)
+			if fileInfo.ModTime().Unix() != expectedMtime {
+				t.Errorf("Expected \"%s\" to have modification time %d, but got %d",
+					path, expectedMtime, fileInfo.ModTime().Unix())
+			}
+		}
+	})
+}
 
-			// run through the rest of the states
-			err = stateMachine.populateBootfsContents()
+// TestFailedFilesystemUUIDs tests that invalid filesystem UUIDs in gadget.yaml are rejected
+func TestFailedFilesystemUUIDs(t *testing.T) {
+	testCases := []struct {
+		name       string
+		filesystem string
+		fsUUID     string
+		errMsg     string
+	}{
+		{"ext4", "ext4", "1234", "invalid filesystem UUID \"1234\""},
+		{"vfat", "vfat", "0b1d1a6e-492e-4c43-b9a4-92f9d4bd7ad5", "vfat UUIDs have the format XXXX-XXXX"},
+		{"raw", "", "ABCD-1234", "filesystem UUIDs can only be set on ext4 and vfat filesystems"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_failed_filesystem_uuids_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			gadgetYaml := []byte(fmt.Sprintf(`volumes:
+  pc:
+    bootloader: grub
+    structure:
+      - name: data
+        type: 0FC63DAF-8483-4772-8E79-3D69D8477DE4
+        filesystem: "%s"
+        size: 1M
+        filesystem-uuid: "%s"
+`, tc.filesystem, tc.fsUUID))
+			gadgetInfo, err := gadget.InfoFromGadgetYaml(gadgetYaml, nil)
 			asserter.AssertErrNil(err, true)
+			_, err = parseFilesystemUUIDs(gadgetYamlExtensionsOf(t, gadgetYaml), gadgetInfo)
+			asserter.AssertErrContains(err, tc.errMsg)
+		})
+	}
+}
 
-			err = stateMachine.populatePreparePartitions()
+// TestSetFilesystemUUID tests that the UUID of ext4 filesystems is set with tune2fs,
+// and that the volume ID of vfat filesystems is written to their boot sectors
+func TestSetFilesystemUUID(t *testing.T) {
+	t.Run("test_set_filesystem_uuid", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+
+		tmpDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(tmpDir)
+
+		var commands []string
+		testCaseName = "TestSetFilesystemUUID"
+		execCommand = func(command string, args ...string) *exec.Cmd {
+			commands = append(commands, strings.Join(append([]string{command}, args...), " "))
+			return fakeExecCommand(command, args...)
+		}
+		defer func() {
+			execCommand = exec.Command
+		}()
+		err = stateMachine.setFilesystemUUID("ext4", "part3.img", "0b1d1a6e-492e-4c43-b9a4-92f9d4bd7ad5")
+		asserter.AssertErrNil(err, true)
+		expectedCommands := []string{"tune2fs -U 0b1d1a6e-492e-4c43-b9a4-92f9d4bd7ad5 part3.img"}
+		if !reflect.DeepEqual(commands, expectedCommands) {
+			t.Errorf("Expected commands %v, but got %v", expectedCommands, commands)
+		}
+
+		// a FAT16 boot sector has its count of sectors per FAT set
+		fat16Img := filepath.Join(tmpDir, "fat16.img")
+		fat16 := make([]byte, 1024)
+		fat16[0x16] = 0x20
+		err = os.WriteFile(fat16Img, fat16, 0644)
+		asserter.AssertErrNil(err, true)
+		err = setVfatVolumeID(fat16Img, "ABCD-1234")
+		asserter.AssertErrNil(err, true)
+		fat16, err = os.ReadFile(fat16Img)
+		asserter.AssertErrNil(err, true)
+		if !bytes.Equal(fat16[0x27:0x2B], []byte{0x34, 0x12, 0xCD, 0xAB}) {
+			t.Errorf("Expected the FAT16 volume ID to be written, but got %x", fat16[0x27:0x2B])
+		}
+
+		// a FAT32 boot sector has a backup boot sector, here in sector 1
+		fat32Img := filepath.Join(tmpDir, "fat32.img")
+		fat32 := make([]byte, 1024)
+		binary.LittleEndian.PutUint16(fat32[0x0B:0x0D], 512)
+		binary.LittleEndian.PutUint16(fat32[0x32:0x34], 1)
+		err = os.WriteFile(fat32Img, fat32, 0644)
+		asserter.AssertErrNil(err, true)
+		err = setVfatVolumeID(fat32Img, "abcd-1234")
+		asserter.AssertErrNil(err, true)
+		fat32, err = os.ReadFile(fat32Img)
+		asserter.AssertErrNil(err, true)
+		for _, offset := range []int{0x43, 512 + 0x43} {
+			if !bytes.Equal(fat32[offset:offset+4], []byte{0x34, 0x12, 0xCD, 0xAB}) {
+				t.Errorf("Expected the FAT32 volume ID to be written at %d, but got %x",
+					offset, fat32[offset:offset+4])
+			}
+		}
+	})
+}
+
+// TestVerifyPartitionTables tests that the partition tables read back from the disk
+// images are compared to gadget.yaml, and that any difference fails the build
+func TestVerifyPartitionTables(t *testing.T) {
+	testCases := []struct {
+		name   string
+		schema string
+		types  []string
+	}{
+		{"gpt", "gpt", []string{"EF,C12A7328-F81F-11D2-BA4B-00A0C93EC93B", "0fc63daf-8483-4772-8e79-3d69d8477de4"}},
+		{"mbr", "mbr", []string{"EF,C12A7328-F81F-11D2-BA4B-00A0C93EC93B", "83"}},
+	}
+	for _, tc := range testCases {
+		t.Run("test_verify_partition_tables_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			tmpDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
 			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(tmpDir)
 
-			err = stateMachine.makeDisk()
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.commonFlags.OutputDir = tmpDir
+			stateMachine.SectorSize = 512
+			espOffset := quantity.Offset(quantity.SizeMiB)
+			rootfsOffset := quantity.Offset(9 * quantity.SizeMiB)
+			volume := &gadget.Volume{
+				Schema: tc.schema,
+				Structure: []gadget.VolumeStructure{
+					{Name: "mbr", Role: "mbr", Type: "mbr", Size: 440, Offset: new(quantity.Offset)},
+					{Name: "EFI System", Type: tc.types[0], Size: 8 * quantity.SizeMiB, Offset: &espOffset},
+					{Name: "rootfs", Role: gadget.SystemData, Type: tc.types[1], Size: 16 * quantity.SizeMiB, Offset: &rootfsOffset},
+				},
+			}
+			stateMachine.GadgetInfo = &gadget.Info{Volumes: map[string]*gadget.Volume{"pc": volume}}
+			stateMachine.VolumeOrder = []string{"pc"}
+			stateMachine.VolumeNames = map[string]string{"pc": "pc.img"}
+
+			diskImg, err := diskfs.Create(filepath.Join(tmpDir, "pc.img"), int64(32*quantity.SizeMiB),
+				diskfs.Raw, diskfs.SectorSize512)
 			asserter.AssertErrNil(err, true)
+			err = diskImg.Partition(*createPartitionTable("pc", volume, 512, false, nil))
+			asserter.AssertErrNil(err, true)
+			diskImg.File.Close()
 
-			// check the size of the disk(s)
-			for volume, expectedSize := range tc.imageSize {
-				imgFile := filepath.Join(stateMachine.commonFlags.OutputDir, volume+".img")
-				diskImg, err := os.Stat(imgFile)
-				asserter.AssertErrNil(err, true)
-				if diskImg.Size() != int64(expectedSize) {
-					t.Errorf("--image-size %d was specified, but resulting image is %d bytes",
-						expectedSize, diskImg.Size())
-				}
+			err = stateMachine.verifyPartitionTables()
+			asserter.AssertErrNil(err, true)
+
+			// the partition table no longer matches once gadget.yaml changes
+			rootfsOffset += 512
+			volume.Structure[2].Size -= 512
+			err = stateMachine.verifyPartitionTables()
+			asserter.AssertErrContains(err, "The partition table of volume \"pc\" does not match gadget.yaml: "+
+				"partition 2 has offset 9437184 instead of 9437696, partition 2 has size 16777216 instead of 16776704")
+
+			volume.Structure = volume.Structure[:2]
+			err = stateMachine.verifyPartitionTables()
+			asserter.AssertErrContains(err, "it has 2 partitions instead of 1")
+
+			if tc.schema == "gpt" {
+				volume.Structure[1].Name = "ESP"
+				err = stateMachine.verifyPartitionTables()
+				asserter.AssertErrContains(err, "partition 1 has name EFI System instead of ESP")
 			}
+
+			stateMachine.commonFlags.OutputDir = filepath.Join(tmpDir, "missing")
+			err = stateMachine.verifyPartitionTables()
+			asserter.AssertErrContains(err, "Error reading the partition table of volume \"pc\"")
 		})
+	}
+}
+
+// TestWriteSparseImage tests that the blocks of zeros of the disk images are turned
+// into holes without changing their checksum, and that --no-sparse allocates them
+func TestWriteSparseImage(t *testing.T) {
+	t.Run("test_write_sparse_image", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		tmpDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(tmpDir)
+		imgName := filepath.Join(tmpDir, "pc.img")
+
+		// data, 4 MiB of written zeros, a partial block of data and a trailing hole
+		content := bytes.Repeat([]byte{1}, sparseBlockSize)
+		content = append(content, make([]byte, 4*1024*1024)...)
+		content = append(content, bytes.Repeat([]byte{2}, 100)...)
+		err = os.WriteFile(imgName, content, 0644)
+		asserter.AssertErrNil(err, true)
+		err = os.Truncate(imgName, int64(len(content))+1024*1024)
+		asserter.AssertErrNil(err, true)
+		checksum, err := helper.CalculateChecksum(imgName, sha256.New)
+		asserter.AssertErrNil(err, true)
+		allocatedBlocks := func() int64 {
+			var stat unix.Stat_t
+			err := unix.Stat(imgName, &stat)
+			asserter.AssertErrNil(err, true)
+			return stat.Blocks * 512
+		}
+		denseSize := allocatedBlocks()
+
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		err = stateMachine.writeSparseImage(imgName)
+		asserter.AssertErrNil(err, true)
+		sparseChecksum, err := helper.CalculateChecksum(imgName, sha256.New)
+		asserter.AssertErrNil(err, true)
+		if sparseChecksum != checksum {
+			t.Errorf("Expected the checksum %s to be kept, but got %s", checksum, sparseChecksum)
+		}
+		sparseSize := allocatedBlocks()
+		if sparseSize >= denseSize || sparseSize > 4*sparseBlockSize {
+			t.Skipf("The filesystem of %s does not support sparse files", tmpDir)
+		}
+
+		stateMachine.commonFlags.NoSparse = true
+		err = stateMachine.writeSparseImage(imgName)
+		asserter.AssertErrNil(err, true)
+		if allocatedBlocks() < int64(len(content)) {
+			t.Errorf("Expected all the blocks of the image to be allocated with --no-sparse")
+		}
+		allocatedChecksum, err := helper.CalculateChecksum(imgName, sha256.New)
+		asserter.AssertErrNil(err, true)
+		if allocatedChecksum != checksum {
+			t.Errorf("Expected the checksum %s to be kept, but got %s", checksum, allocatedChecksum)
+		}
+	})
+}
+
+// TestFailedMakeDisk tests failures in the MakeDisk state
+func TestFailedMakeDisk(t *testing.T) {
+	t.Run("test_failed_make_disk", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+
+		// need workdir set up for this
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+		// also set up an output directory
+		outDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(outDir)
+		stateMachine.commonFlags.OutputDir = outDir
+		err = stateMachine.determineOutputDirectory()
+		asserter.AssertErrNil(err, true)
+
+		// set up volume names
+		stateMachine.VolumeNames = map[string]string{
+			"pc": "pc.img",
+		}
+
+		// set a valid yaml file and load it in
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-mbr.yaml")
+		// ensure unpack exists
+		os.MkdirAll(filepath.Join(stateMachine.tempDirs.unpack, "gadget"), 0755)
+		err = stateMachine.loadGadgetYaml()
+		asserter.AssertErrNil(err, true)
+
+		// also need to set the rootfs size to avoid partition errors
+		err = stateMachine.calculateRootfsSize()
+		asserter.AssertErrNil(err, true)
+
+		// ensure volumes exists
+		os.MkdirAll(stateMachine.tempDirs.volumes, 0755)
+
+		// populate unpack
+		files, _ := os.ReadDir(filepath.Join("testdata", "gadget_tree"))
+		for _, srcFile := range files {
+			srcFile := filepath.Join("testdata", "gadget_tree", srcFile.Name())
+			osutilCopySpecialFile(srcFile, filepath.Join(stateMachine.tempDirs.unpack, "gadget"))
+		}
+
+		// mock os.RemoveAll
+		osRemoveAll = mockRemoveAll
+		defer func() {
+			osRemoveAll = os.RemoveAll
+		}()
+		err = stateMachine.makeDisk()
+		asserter.AssertErrContains(err, "Error removing old disk image")
+		osRemoveAll = os.RemoveAll
 
+		// mock diskfs.Create
+		diskfsCreate = mockDiskfsCreate
+		defer func() {
+			diskfsCreate = diskfs.Create
+		}()
+		err = stateMachine.makeDisk()
+		asserter.AssertErrContains(err, "Error creating disk image")
+		diskfsCreate = diskfs.Create
+
+		// mock os.Truncate
+		osTruncate = mockTruncate
+		defer func() {
+			osTruncate = os.Truncate
+		}()
+		err = stateMachine.makeDisk()
+		asserter.AssertErrContains(err, "Error resizing disk image")
+		osTruncate = os.Truncate
+
+		// mock diskfs.Create to create a read only disk
+		diskfsCreate = readOnlyDiskfsCreate
+		defer func() {
+			diskfsCreate = diskfs.Create
+		}()
+		err = stateMachine.makeDisk()
+		asserter.AssertErrContains(err, "Error partitioning image file")
+		diskfsCreate = diskfs.Create
+
+		// mock os.OpenFile
+		// errors in file.WriteAt()
+		osOpenFile = mockOpenFile
+		defer func() {
+			osOpenFile = os.OpenFile
+		}()
+		err = stateMachine.makeDisk()
+		asserter.AssertErrContains(err, "Error opening disk to write MBR disk identifier")
+		osOpenFile = os.OpenFile
+
+		// mock rand.Read
+		// errors in generateUniqueDiskID()
+		randRead = mockRandRead
+		defer func() {
+			randRead = rand.Read
+		}()
+		err = stateMachine.makeDisk()
+		asserter.AssertErrContains(err, "Error generating disk ID")
+		randRead = rand.Read
+
+		// mock os.OpenFile to force it to use os.O_APPEND, which causes
+		// errors in file.WriteAt()
+		osOpenFile = mockOpenFileAppend
+		defer func() {
+			osOpenFile = os.OpenFile
+		}()
+		err = stateMachine.makeDisk()
+		asserter.AssertErrContains(err, "Error writing MBR disk identifier")
+		osOpenFile = os.OpenFile
+
+		// mock helper.CopyBlob to simulate a failure in copyDataToImage
+		helperCopyBlob = mockCopyBlob
+		defer func() {
+			helperCopyBlob = helper.CopyBlob
+		}()
+		err = stateMachine.makeDisk()
+		asserter.AssertErrContains(err, "Error writing disk image")
+		helperCopyBlob = helper.CopyBlob
+
+		// Change to GPT for these next tests
+		stateMachine.YamlFilePath = filepath.Join("testdata", "gadget-gpt.yaml")
+		err = stateMachine.loadGadgetYaml()
+		asserter.AssertErrNil(err, true)
+
+		err = stateMachine.populateBootfsContents()
+		asserter.AssertErrNil(err, true)
+
+		err = stateMachine.populatePreparePartitions()
+		asserter.AssertErrNil(err, true)
+
+		// mock os.OpenFile to simulate a failure in writeOffsetValues
+		osOpenFile = mockOpenFile
+		defer func() {
+			osOpenFile = os.OpenFile
+		}()
+		// also mock helperCopyBlob to ignore missing files and return success
+		helperCopyBlob = mockCopyBlobSuccess
+		defer func() {
+			helperCopyBlob = helper.CopyBlob
+		}()
+		err = stateMachine.makeDisk()
+		asserter.AssertErrContains(err, "Error opening image file")
+		osOpenFile = os.OpenFile
+		helperCopyBlob = helper.CopyBlob
+
+		helperCopyBlob = mockCopyBlob
+		defer func() {
+			helperCopyBlob = helper.CopyBlob
+		}()
+		stateMachine.cleanWorkDir = true // for coverage!
+		stateMachine.commonFlags.OutputDir = ""
+		defer os.Remove("pc.img")
+		err = stateMachine.makeDisk()
+		asserter.AssertErrContains(err, "Error writing disk image")
+		helperCopyBlob = helper.CopyBlob
+
+		// make sure with no OutputDir the image was created in the cwd
+		_, err = os.Stat("pc.img")
+		asserter.AssertErrNil(err, true)
+	})
+}
+
+// TestImageSizeFlag performs a successful call to StateMachine.MakeDisk with the
+// --image-size flag, and ensures that the resulting image is the size specified
+// with the flag (LP: #1947867)
+func TestImageSizeFlag(t *testing.T) {
+	testCases := []struct {
+		name       string
+		sizeArg    string
+		gadgetTree string
+		imageSize  map[string]quantity.Size
+		volNames   map[string]string
+	}{
+		{
+			"one_volume",
+			"4G",
+			filepath.Join("testdata", "gadget_tree"),
+			map[string]quantity.Size{
+				"pc": 4 * quantity.SizeGiB,
+			},
+			map[string]string{
+				"pc": "pc.img",
+			},
+		},
+		{
+			"multi_volume",
+			"first:4G,second:1G",
+			filepath.Join("testdata", "gadget_tree_multi"),
+			map[string]quantity.Size{
+				"first":  4 * quantity.SizeGiB,
+				"second": 1 * quantity.SizeGiB,
+			},
+			map[string]string{
+				"first":  "first.img",
+				"second": "second.img",
+			},
+		},
+	}
+	for _, tc := range testCases {
+
+		t.Run("test_image_size_flag_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.IsSeeded = true
+			stateMachine.commonFlags.Size = tc.sizeArg
+
+			// need workdir set up for this
+			err := stateMachine.makeTemporaryDirectories()
+			asserter.AssertErrNil(err, true)
+			//defer os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+
+			// also set up an output directory
+			outDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+			asserter.AssertErrNil(err, true)
+			//defer os.RemoveAll(outDir)
+			stateMachine.commonFlags.OutputDir = outDir
+
+			// set up volume names
+			stateMachine.VolumeNames = tc.volNames
+
+			// set up a "rootfs" that we can eventually copy into the disk
+			os.MkdirAll(stateMachine.tempDirs.rootfs, 0755)
+			osutil.CopySpecialFile(tc.gadgetTree, stateMachine.tempDirs.rootfs)
+
+			// set a valid yaml file and load it in
+			stateMachine.YamlFilePath = filepath.Join(tc.gadgetTree, "meta", "gadget.yaml")
+			// ensure unpack exists
+			os.MkdirAll(filepath.Join(stateMachine.tempDirs.unpack, "gadget"), 0755)
+			err = stateMachine.loadGadgetYaml()
+			asserter.AssertErrNil(err, true)
+
+			// ensure volumes exists
+			os.MkdirAll(stateMachine.tempDirs.volumes, 0755)
+
+			// populate unpack
+			files, _ := os.ReadDir(tc.gadgetTree)
+			for _, srcFile := range files {
+				srcFile := filepath.Join(tc.gadgetTree, srcFile.Name())
+				osutil.CopySpecialFile(srcFile, filepath.Join(stateMachine.tempDirs.unpack, "gadget"))
+			}
+
+			// also need to set the rootfs size to avoid partition errors
+			err = stateMachine.calculateRootfsSize()
+			asserter.AssertErrNil(err, true)
+
+			// run through the rest of the states
+			err = stateMachine.populateBootfsContents()
+			asserter.AssertErrNil(err, true)
+
+			err = stateMachine.populatePreparePartitions()
+			asserter.AssertErrNil(err, true)
+
+			err = stateMachine.makeDisk()
+			asserter.AssertErrNil(err, true)
+
+			// check the size of the disk(s)
+			for volume, expectedSize := range tc.imageSize {
+				imgFile := filepath.Join(stateMachine.commonFlags.OutputDir, volume+".img")
+				diskImg, err := os.Stat(imgFile)
+				asserter.AssertErrNil(err, true)
+				if diskImg.Size() != int64(expectedSize) {
+					t.Errorf("--image-size %d was specified, but resulting image is %d bytes",
+						expectedSize, diskImg.Size())
+				}
+			}
+		})
+
+	}
+}
+
+// fakeSeed is a seed that contains the given snaps without any assertion
+type fakeSeed struct {
+	seed.Seed
+	snaps []*seed.Snap
+}
+
+func (fake *fakeSeed) LoadAssertions(asserts.RODatabase, func(*asserts.Batch) error) error {
+	return nil
+}
+
+func (fake *fakeSeed) LoadMeta(string, seed.SnapHandler, timings.Measurer) error {
+	return nil
+}
+
+func (fake *fakeSeed) Iter(f func(sn *seed.Snap) error) error {
+	for _, sn := range fake.snaps {
+		if err := f(sn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TestGenerateBuildManifest tests that the build manifest lists the packages
+// installed in the rootfs and is written to the default or the requested path
+func TestGenerateBuildManifest(t *testing.T) {
+	testCases := []struct {
+		name         string
+		manifestPath string
+		gadgetCommit string
+		expectedName string
+	}{
+		{"default_path", "", "", "pc.manifest"},
+		{"custom_path", "release/build.manifest", "", filepath.Join("release", "build.manifest")},
+		{"gadget_git", "", "https://git.example.com/gadget.git 0123456789abcdef0123456789abcdef01234567", "pc.manifest"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_generate_build_manifest_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			testCaseName = "TestGenerateBuildManifest"
+			execCommand = fakeExecCommand
+			defer func() {
+				execCommand = exec.Command
+			}()
+
+			tmpDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(tmpDir)
+
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.commonFlags.OutputDir = tmpDir
+			if tc.manifestPath != "" {
+				stateMachine.commonFlags.ManifestPath = filepath.Join(tmpDir, tc.manifestPath)
+			}
+			stateMachine.ImageFiles = []string{filepath.Join(tmpDir, "pc.img")}
+			stateMachine.tempDirs.rootfs = filepath.Join(tmpDir, "root")
+			err = os.MkdirAll(filepath.Join(stateMachine.tempDirs.rootfs, "var", "lib", "dpkg"), 0755)
+			asserter.AssertErrNil(err, true)
+			err = os.MkdirAll(filepath.Join(stateMachine.tempDirs.rootfs, "var", "lib", "snapd", "seed"), 0755)
+			asserter.AssertErrNil(err, true)
+
+			stateMachine.GadgetCommit = tc.gadgetCommit
+			// the revision of core was pinned
+			stateMachine.SnapRevisions = map[string]int{"core": 16}
+			// and hello was installed from a cohort
+			stateMachine.SnapCohorts = map[string]string{"hello": "MSBjb2hvcnQ"}
+			seedOpen = func(string, string) (seed.Seed, error) {
+				return &fakeSeed{snaps: []*seed.Snap{
+					{
+						Path:     "hello_42.snap",
+						SideInfo: &snap.SideInfo{RealName: "hello", Revision: snap.R(42)},
+						Channel:  "stable",
+					},
+					{
+						Path:     "core_16.snap",
+						SideInfo: &snap.SideInfo{RealName: "core", Revision: snap.R(16)},
+					},
+				}}, nil
+			}
+			defer func() {
+				seedOpen = seed.Open
+			}()
+
+			err = stateMachine.generateBuildManifest()
+			asserter.AssertErrNil(err, true)
+
+			manifestPath := filepath.Join(tmpDir, tc.expectedName)
+			manifestBytes, err := os.ReadFile(manifestPath)
+			asserter.AssertErrNil(err, true)
+			expected := "deb bar 1.4-1ubuntu4.1\ndeb foo 1.2\nsnap core 16 - pinned\nsnap hello 42 stable cohort=MSBjb2hvcnQ\n"
+			if tc.gadgetCommit != "" {
+				expected = "gadget-git " + tc.gadgetCommit + "\n" + expected
+			}
+			if string(manifestBytes) != expected {
+				t.Errorf("Expected build manifest:\n%s\nbut got:\n%s", expected, string(manifestBytes))
+			}
+			if !reflect.DeepEqual(stateMachine.Artifacts, []string{manifestPath}) {
+				t.Errorf("Expected %s to be recorded as an artifact, but got %v",
+					manifestPath, stateMachine.Artifacts)
+			}
+		})
+	}
+}
+
+// TestFailedGenerateBuildManifest tests failures in the generateBuildManifest state
+func TestFailedGenerateBuildManifest(t *testing.T) {
+	t.Run("test_failed_generate_build_manifest", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		tmpDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(tmpDir)
+
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.commonFlags.OutputDir = tmpDir
+		stateMachine.tempDirs.rootfs = filepath.Join(tmpDir, "root")
+
+		// mock osCreate
+		osCreate = mockCreate
+		defer func() {
+			osCreate = os.Create
+		}()
+		err = stateMachine.generateBuildManifest()
+		asserter.AssertErrContains(err, "Error creating build manifest file")
+		osCreate = os.Create
+
+		// fail to read the seed
+		err = os.MkdirAll(filepath.Join(stateMachine.tempDirs.rootfs, "var", "lib", "snapd", "seed"), 0755)
+		asserter.AssertErrNil(err, true)
+		seedOpen = mockSeedOpen
+		defer func() {
+			seedOpen = seed.Open
+		}()
+		err = stateMachine.generateBuildManifest()
+		asserter.AssertErrContains(err, "Error opening seed to list the seeded snaps")
+		seedOpen = seed.Open
+
+		// fail to list the packages
+		err = os.MkdirAll(filepath.Join(stateMachine.tempDirs.rootfs, "var", "lib", "dpkg"), 0755)
+		asserter.AssertErrNil(err, true)
+		testCaseName = "TestFailedGenerateBuildManifest"
+		execCommand = fakeExecCommand
+		defer func() {
+			execCommand = exec.Command
+		}()
+		err = stateMachine.generateBuildManifest()
+		asserter.AssertErrContains(err, "Error listing the installed packages")
+	})
+}
+
+// TestVerifyFilesystems ensures that the filesystems of the partition images are
+// checked with the checker of each filesystem, and that errors fail the build
+func TestVerifyFilesystems(t *testing.T) {
+	testCases := []struct {
+		name     string
+		testCase string
+		errMsg   string
+	}{
+		{"success", "TestVerifyFilesystems", ""},
+		{"corrupted_ext4", "TestFailedVerifyFilesystems",
+			"The ext4 filesystem of structure \"writable\" in volume \"pc\" failed verification"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_verify_filesystems_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.tempDirs.volumes = filepath.Join("/tmp", "volumes")
+			stateMachine.VolumeOrder = []string{"pc"}
+			stateMachine.GadgetInfo = &gadget.Info{
+				Volumes: map[string]*gadget.Volume{
+					"pc": {
+						Structure: []gadget.VolumeStructure{
+							{Name: "mbr", Type: "mbr", Role: "mbr"},
+							{Name: "BIOS Boot", Type: "21686148-6449-6E6F-744E-656564454649"},
+							{Name: "EFI System", Type: "C12A7328-F81F-11D2-BA4B-00A0C93EC93B", Filesystem: "vfat"},
+							{Name: "raw", Type: "0FC63DAF-8483-4772-8E79-3D69D8477DE4", Filesystem: "none"},
+							{Name: "writable", Type: "0FC63DAF-8483-4772-8E79-3D69D8477DE4",
+								Role: gadget.SystemData, Filesystem: "ext4"},
+						},
+					},
+				},
+			}
+
+			var commandArgs [][]string
+			testCaseName = tc.testCase
+			execCommand = func(command string, args ...string) *exec.Cmd {
+				commandArgs = append(commandArgs, append([]string{command}, args...))
+				return fakeExecCommand(command, args...)
+			}
+			defer func() {
+				execCommand = exec.Command
+			}()
+
+			err := stateMachine.verifyFilesystems()
+			if tc.errMsg != "" {
+				asserter.AssertErrContains(err, tc.errMsg)
+				asserter.AssertErrContains(err, "Inode 12 has illegal block(s)")
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			expectedArgs := [][]string{
+				{"fsck.vfat", "-n", "/tmp/volumes/pc/part2.img"},
+				{"e2fsck", "-f", "-n", "/tmp/volumes/pc/part4.img"},
+			}
+			if !reflect.DeepEqual(commandArgs, expectedArgs) {
+				t.Errorf("Expected commands %v, but got %v", expectedArgs, commandArgs)
+			}
+		})
+	}
+}
+
+// TestCompressDiskImages ensures that the raw disk images are compressed with the
+// compressor, level and threads passed on the command line, and replace the raw
+// images in the list of image files
+func TestCompressDiskImages(t *testing.T) {
+	testCases := []struct {
+		name         string
+		compress     string
+		threads      int
+		debug        bool
+		expectedArgs []string
+		expectedFile string
+	}{
+		{"xz_level_threads", "xz:9", 4, false, []string{"xz", "--force", "--keep", "--quiet", "-9", "--threads=4"}, "pc.img.xz"},
+		{"zstd", "zstd", 0, false, []string{"zstd", "--force", "--keep", "--quiet", "--threads=0"}, "pc.img.zst"},
+		{"gzip_debug", "gzip:1", 0, true, []string{"gzip", "--force", "--keep", "--quiet", "-1"}, "pc.img.gz"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_compress_disk_images_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.commonFlags.Compress = tc.compress
+			stateMachine.commonFlags.CompressThreads = tc.threads
+			stateMachine.commonFlags.Debug = tc.debug
+
+			outDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(outDir)
+			stateMachine.commonFlags.OutputDir = outDir
+			stateMachine.VolumeOrder = []string{"pc", "data"}
+			stateMachine.VolumeNames = map[string]string{"pc": "pc.img", "data": "data.img"}
+			stateMachine.IntermediateVolumes = map[string]bool{"data": true}
+			rawFile := filepath.Join(outDir, "pc.img")
+			err = os.WriteFile(rawFile, []byte("pc.img"), 0644)
+			asserter.AssertErrNil(err, true)
+			stateMachine.addImageFile(rawFile)
+
+			var commandArgs [][]string
+			testCaseName = "TestCompressDiskImages"
+			execCommand = func(command string, args ...string) *exec.Cmd {
+				commandArgs = append(commandArgs, append([]string{command}, args...))
+				return fakeExecCommand(command, args...)
+			}
+			defer func() {
+				execCommand = exec.Command
+			}()
+
+			err = stateMachine.compressDiskImages()
+			asserter.AssertErrNil(err, true)
+
+			// the intermediate image of the data volume is not compressed
+			expectedArgs := [][]string{append(tc.expectedArgs, rawFile)}
+			if !reflect.DeepEqual(commandArgs, expectedArgs) {
+				t.Errorf("Expected commands %v, but got %v", expectedArgs, commandArgs)
+			}
+			expectedFiles := []string{filepath.Join(outDir, tc.expectedFile)}
+			if tc.debug {
+				expectedFiles = append([]string{rawFile}, expectedFiles...)
+			}
+			if !reflect.DeepEqual(stateMachine.ImageFiles, expectedFiles) {
+				t.Errorf("Expected image files %v, but got %v", expectedFiles, stateMachine.ImageFiles)
+			}
+			_, err = os.Stat(rawFile)
+			if tc.debug != !os.IsNotExist(err) {
+				t.Errorf("Expected the raw image to be kept only with --debug")
+			}
+		})
+	}
+}
+
+// TestValidateCompression tests the values of --compress and --compress-threads
+// that are rejected, including --compress with a disk image format other than raw
+func TestValidateCompression(t *testing.T) {
+	testCases := []struct {
+		name     string
+		compress string
+		threads  int
+		format   string
+		errMsg   string
+	}{
+		{"valid", "zstd:19", 2, "raw", ""},
+		{"xz_level_zero", "xz:0", 0, "", ""},
+		{"unsupported", "bzip2", 0, "", "unsupported disk image compressor \"bzip2\""},
+		{"level_too_high", "gzip:10", 0, "", "it must be between 1 and 9"},
+		{"level_not_a_number", "xz:max", 0, "", "invalid compression level \"max\" for xz"},
+		{"threads_without_compress", "", 2, "", "--compress-threads requires --compress"},
+		{"negative_threads", "xz", -1, "", "--compress-threads cannot be negative"},
+		{"gzip_threads", "gzip", 2, "", "--compress-threads cannot be used with gzip"},
+		{"qcow2_format", "xz", 0, "qcow2", "--compress cannot be used with --format qcow2"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_validate_compression_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.commonFlags.Compress = tc.compress
+			stateMachine.commonFlags.CompressThreads = tc.threads
+
+			err := stateMachine.validateCompression()
+			if err == nil {
+				err = stateMachine.validateFormat(tc.format)
+			}
+			if tc.errMsg != "" {
+				asserter.AssertErrContains(err, tc.errMsg)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+		})
+	}
+}
+
+// TestGenerateChecksums tests that a checksum file is written for all the image files
+func TestGenerateChecksums(t *testing.T) {
+	testCases := []struct {
+		name         string
+		algorithm    string
+		newHash      func() hash.Hash
+		checksumFile string
+	}{
+		{"sha256", "sha256", sha256.New, "SHA256SUMS"},
+		{"sha512", "sha512", sha512.New, "SHA512SUMS"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_generate_checksums_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.commonFlags.Checksum = tc.algorithm
+
+			outDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(outDir)
+			stateMachine.commonFlags.OutputDir = outDir
+
+			// create some image files, intentionally out of order
+			var expected string
+			for _, imgName := range []string{"pc.img", "mmcblk0.img"} {
+				imgFile := filepath.Join(outDir, imgName)
+				err = os.WriteFile(imgFile, []byte(imgName), 0644)
+				asserter.AssertErrNil(err, true)
+				stateMachine.addImageFile(imgFile)
+			}
+			for _, imgName := range []string{"mmcblk0.img", "pc.img"} {
+				hasher := tc.newHash()
+				hasher.Write([]byte(imgName))
+				expected += fmt.Sprintf("%s  %s\n", hex.EncodeToString(hasher.Sum(nil)), imgName)
+			}
+
+			err = stateMachine.generateChecksums()
+			asserter.AssertErrNil(err, true)
+
+			checksums, err := os.ReadFile(filepath.Join(outDir, tc.checksumFile))
+			asserter.AssertErrNil(err, true)
+			if string(checksums) != expected {
+				t.Errorf("Expected checksum file contents \"%s\", but got \"%s\"",
+					expected, string(checksums))
+			}
+		})
+	}
+}
+
+// TestFailedGenerateChecksums tests failures in the generateChecksums state
+func TestFailedGenerateChecksums(t *testing.T) {
+	t.Run("test_failed_generate_checksums", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.commonFlags.Checksum = "sha256"
+
+		outDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(outDir)
+		stateMachine.commonFlags.OutputDir = outDir
+
+		imgFile := filepath.Join(outDir, "pc.img")
+		err = os.WriteFile(imgFile, []byte("pc.img"), 0644)
+		asserter.AssertErrNil(err, true)
+		stateMachine.addImageFile(imgFile)
+
+		// mock filepath.Rel
+		filepathRel = mockRel
+		defer func() {
+			filepathRel = filepath.Rel
+		}()
+		err = stateMachine.generateChecksums()
+		asserter.AssertErrContains(err, "Error determining path of")
+		filepathRel = filepath.Rel
+
+		// mock os.WriteFile
+		osWriteFile = mockWriteFile
+		defer func() {
+			osWriteFile = os.WriteFile
+		}()
+		err = stateMachine.generateChecksums()
+		asserter.AssertErrContains(err, "Error writing checksum file")
+		osWriteFile = os.WriteFile
+
+		// image file that no longer exists
+		stateMachine.addImageFile(filepath.Join(outDir, "missing.img"))
+		err = stateMachine.generateChecksums()
+		asserter.AssertErrContains(err, "Error opening file")
+
+		// unsupported algorithm
+		stateMachine.commonFlags.Checksum = "md5"
+		err = stateMachine.generateChecksums()
+		asserter.AssertErrContains(err, "Unsupported checksum algorithm")
+	})
+}
+
+// TestSignArtifacts tests that a detached signature is made of each disk image file
+// and of the checksum file with the key passed with --sign-key
+func TestSignArtifacts(t *testing.T) {
+	t.Run("test_sign_artifacts", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.commonFlags.OutputDir = "/tmp/out"
+		stateMachine.commonFlags.Checksum = "sha256"
+		stateMachine.commonFlags.SignKey = "0123456789ABCDEF"
+		stateMachine.addImageFile("/tmp/out/pc.img.xz")
+		stateMachine.addImageFile("/tmp/out/mmcblk0.img.xz")
+
+		var commands []string
+		testCaseName = "TestSignArtifacts"
+		execCommand = func(command string, args ...string) *exec.Cmd {
+			commands = append(commands, command+" "+strings.Join(args, " "))
+			return fakeExecCommand(command, args...)
+		}
+		defer func() {
+			execCommand = exec.Command
+		}()
+
+		err := stateMachine.signArtifacts()
+		asserter.AssertErrNil(err, true)
+		gpgArgs := "gpg --batch --yes --armor --local-user 0123456789ABCDEF --output "
+		expectedCommands := []string{
+			gpgArgs + "/tmp/out/mmcblk0.img.xz.asc --detach-sign /tmp/out/mmcblk0.img.xz",
+			gpgArgs + "/tmp/out/pc.img.xz.asc --detach-sign /tmp/out/pc.img.xz",
+			gpgArgs + "/tmp/out/SHA256SUMS.asc --detach-sign /tmp/out/SHA256SUMS",
+		}
+		if !reflect.DeepEqual(commands, expectedCommands) {
+			t.Errorf("Expected commands %v, but got %v", expectedCommands, commands)
+		}
+		expectedArtifacts := []string{
+			"/tmp/out/mmcblk0.img.xz.asc",
+			"/tmp/out/pc.img.xz.asc",
+			"/tmp/out/SHA256SUMS.asc",
+		}
+		if !reflect.DeepEqual(stateMachine.Artifacts, expectedArtifacts) {
+			t.Errorf("Expected artifacts %v, but got %v", expectedArtifacts, stateMachine.Artifacts)
+		}
+
+		// the build fails when gpg can not sign a file
+		testCaseName = "TestFailedSignArtifacts"
+		err = stateMachine.signArtifacts()
+		asserter.AssertErrContains(err, "Error signing \"/tmp/out/mmcblk0.img.xz\"")
+	})
+}
+
+// TestFailedMountPoints tests that the mount points of gadget.yaml that can't hold
+// a part of the rootfs are rejected
+func TestFailedMountPoints(t *testing.T) {
+	testCases := []struct {
+		name       string
+		mountPoint string
+		extra      string
+		errMsg     string
+	}{
+		{"relative", "var", "filesystem-label: var", "invalid mount point \"var\""},
+		{"root", "/", "filesystem-label: var", "invalid mount point \"/\""},
+		{"usr", "/usr", "filesystem-label: usr", "/usr is needed to boot"},
+		{"no_filesystem", "/var", "", "a mount point can only be set on a structure with a filesystem"},
+		{"no_label", "/var", "filesystem: ext4", "needs a filesystem-label or a filesystem-uuid"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_failed_mount_points_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			gadgetYaml := []byte(fmt.Sprintf(`volumes:
+  pc:
+    bootloader: grub
+    structure:
+      - name: data
+        type: 0FC63DAF-8483-4772-8E79-3D69D8477DE4
+        size: 1M
+        mount-point: "%s"
+        %s
+`, tc.mountPoint, tc.extra))
+			if strings.HasPrefix(tc.extra, "filesystem-label") {
+				gadgetYaml = append(gadgetYaml, []byte("        filesystem: ext4\n")...)
+			}
+			gadgetInfo, err := gadget.InfoFromGadgetYaml(gadgetYaml, nil)
+			asserter.AssertErrNil(err, true)
+			_, err = parseMountPoints(gadgetYamlExtensionsOf(t, gadgetYaml), gadgetInfo)
+			asserter.AssertErrContains(err, tc.errMsg)
+		})
+	}
+}
+
+// TestSplitRootfs tests that the parts of the rootfs with a partition of their own are
+// moved out of it and back, and that they are mounted by the fstab of the rootfs
+func TestSplitRootfs(t *testing.T) {
+	t.Run("test_split_rootfs", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+
+		tmpDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(tmpDir)
+		stateMachine.tempDirs.rootfs = filepath.Join(tmpDir, "root")
+		stateMachine.tempDirs.volumes = filepath.Join(tmpDir, "volumes")
+
+		gadgetYaml := []byte(`volumes:
+  pc:
+    bootloader: grub
+    structure:
+      - name: var
+        type: 0FC63DAF-8483-4772-8E79-3D69D8477DE4
+        size: 1M
+        filesystem: ext4
+        filesystem-label: var
+        mount-point: /var
+      - name: log
+        type: 0FC63DAF-8483-4772-8E79-3D69D8477DE4
+        size: 1M
+        filesystem: ext4
+        filesystem-uuid: 0b1d1a6e-492e-4c43-b9a4-92f9d4bd7ad5
+        mount-point: /var/log
+      - name: srv
+        type: 0FC63DAF-8483-4772-8E79-3D69D8477DE4
+        size: 1M
+        filesystem: ext4
+        filesystem-label: srv
+        mount-point: /srv
+`)
+		stateMachine.GadgetInfo, err = gadget.InfoFromGadgetYaml(gadgetYaml, nil)
+		asserter.AssertErrNil(err, true)
+		stateMachine.MountPoints, err = parseMountPoints(gadgetYamlExtensionsOf(t, gadgetYaml), stateMachine.GadgetInfo)
+		asserter.AssertErrNil(err, true)
+		stateMachine.FilesystemUUIDs, err = parseFilesystemUUIDs(gadgetYamlExtensionsOf(t, gadgetYaml), stateMachine.GadgetInfo)
+		asserter.AssertErrNil(err, true)
+
+		for _, dir := range []string{"etc", "var/lib", "var/log", filepath.Join("..", "volumes", "pc")} {
+			err = os.MkdirAll(filepath.Join(stateMachine.tempDirs.rootfs, dir), 0755)
+			asserter.AssertErrNil(err, true)
+		}
+		err = os.Chmod(filepath.Join(stateMachine.tempDirs.rootfs, "var", "log"), 0775)
+		asserter.AssertErrNil(err, true)
+		for _, file := range []string{"var/lib/foo", "var/log/bar"} {
+			err = os.WriteFile(filepath.Join(stateMachine.tempDirs.rootfs, file), []byte("test"), 0644)
+			asserter.AssertErrNil(err, true)
+		}
+
+		splitRoots, err := stateMachine.splitRootfs()
+		asserter.AssertErrNil(err, true)
+		expectedFiles := map[string]bool{
+			filepath.Join(splitRoots["pc"][0], "lib", "foo"):          true,
+			filepath.Join(splitRoots["pc"][0], "log"):                 true,
+			filepath.Join(splitRoots["pc"][1], "bar"):                 true,
+			filepath.Join(splitRoots["pc"][0], "log", "bar"):          false,
+			filepath.Join(splitRoots["pc"][2]):                        true,
+			filepath.Join(stateMachine.tempDirs.rootfs, "srv"):        true,
+			filepath.Join(stateMachine.tempDirs.rootfs, "var", "lib"): false,
+		}
+		for path, exists := range expectedFiles {
+			_, err := os.Stat(path)
+			if exists && err != nil {
+				t.Errorf("Expected %s to exist, but got %s", path, err.Error())
+			} else if !exists && !os.IsNotExist(err) {
+				t.Errorf("Expected %s to not exist", path)
+			}
+		}
+		// the mount points keep the mode of the directories they replace
+		fileInfo, err := os.Stat(filepath.Join(splitRoots["pc"][0], "log"))
+		asserter.AssertErrNil(err, true)
+		if fileInfo.Mode().Perm() != 0775 {
+			t.Errorf("Expected mount point /var/log to have mode 0775, but got %o", fileInfo.Mode().Perm())
+		}
+
+		err = stateMachine.joinRootfs(splitRoots)
+		asserter.AssertErrNil(err, true)
+		for _, file := range []string{"var/lib/foo", "var/log/bar", "srv"} {
+			_, err := os.Stat(filepath.Join(stateMachine.tempDirs.rootfs, file))
+			asserter.AssertErrNil(err, true)
+		}
+
+		fstabPath := filepath.Join(stateMachine.tempDirs.rootfs, "etc", "fstab")
+		err = os.WriteFile(fstabPath, []byte("LABEL=writable\t/\text4\tdefaults\t0\t1\n"+
+			"LABEL=other\t/srv\text4\tdefaults\t0\t2"), 0644)
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.addRootfsPartitionsToFstab()
+		asserter.AssertErrNil(err, true)
+		fstab, err := os.ReadFile(fstabPath)
+		asserter.AssertErrNil(err, true)
+		expectedFstab := "LABEL=writable\t/\text4\tdefaults\t0\t1\n" +
+			"LABEL=other\t/srv\text4\tdefaults\t0\t2\n" +
+			"LABEL=var\t/var\text4\tdiscard,errors=remount-ro\t0\t2\n" +
+			"UUID=0b1d1a6e-492e-4c43-b9a4-92f9d4bd7ad5\t/var/log\text4\tdiscard,errors=remount-ro\t0\t2\n"
+		if string(fstab) != expectedFstab {
+			t.Errorf("Expected fstab \"%s\", but got \"%s\"", expectedFstab, string(fstab))
+		}
+	})
+}
+
+// TestMkfsOptions tests that the mkfs options of gadget.yaml are validated, and that
+// they are appended to the arguments of mkfs when the filesystems are created
+func TestMkfsOptions(t *testing.T) {
+	testCases := []struct {
+		name       string
+		filesystem string
+		options    string
+		errMsg     string
+	}{
+		{"ext4", "ext4", `["-i", "4096", "-O", "^has_journal", "-E", "lazy_itable_init=0"]`, ""},
+		{"vfat", "vfat", `["-F", "16", "-r512"]`, ""},
+		{"unsupported", "", `["-i", "4096"]`, "can only be set on ext4 and vfat filesystems"},
+		{"positional", "ext4", `["4096"]`, "\"4096\" is not an option nor the value of one"},
+		{"two_values", "ext4", `["-i", "4096", "8192"]`, "\"8192\" is not an option nor the value of one"},
+		{"empty", "ext4", `["-i", ""]`, "invalid mkfs option \"\""},
+		{"label", "ext4", `["-Lwritable"]`, "mkfs option -L can not be set for ext4 filesystems: use filesystem-label"},
+		{"vfat_volume_id", "vfat", `["-i", "1234ABCD"]`, "use filesystem-uuid instead"},
+		{"fs_type", "ext4", `["-t", "ext2"]`, "use ext-variant instead"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_mkfs_options_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			filesystem := ""
+			if tc.filesystem != "" {
+				filesystem = "filesystem: " + tc.filesystem
+			}
+			gadgetYaml := []byte(fmt.Sprintf(`volumes:
+  pc:
+    bootloader: grub
+    structure:
+      - name: data
+        type: 0FC63DAF-8483-4772-8E79-3D69D8477DE4
+        size: 1M
+        mkfs-options: %s
+        %s
+`, tc.options, filesystem))
+			gadgetInfo, err := gadget.InfoFromGadgetYaml(gadgetYaml, nil)
+			asserter.AssertErrNil(err, true)
+			mkfsOptions, _, err := parseMkfsOptions(gadgetYamlExtensionsOf(t, gadgetYaml), gadgetInfo)
+			if tc.errMsg != "" {
+				asserter.AssertErrContains(err, "volumes:pc:structure:0: ")
+				asserter.AssertErrContains(err, tc.errMsg)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			if len(mkfsOptions["pc"][0]) == 0 {
+				t.Errorf("Expected the mkfs options of structure 0 to be parsed, but got %v", mkfsOptions)
+			}
+		})
+	}
+
+	t.Run("test_mkfs_with_options", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		tmpDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(tmpDir)
+		contentRoot := filepath.Join(tmpDir, "part0")
+		err = os.MkdirAll(filepath.Join(contentRoot, "EFI"), 0755)
+		asserter.AssertErrNil(err, true)
+
+		var commands []string
+		testCaseName = "TestMkfsWithOptions"
+		execCommand = func(command string, args ...string) *exec.Cmd {
+			commands = append(commands, command+" "+strings.Join(args, " "))
+			return fakeExecCommand(command, args...)
+		}
+		defer func() {
+			execCommand = exec.Command
+		}()
+
+		err = stateMachine.mkfsWithOptions("vfat", "part0.img", "system-boot", contentRoot,
+			quantity.SizeMiB, 512, []string{"-F", "16"})
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.mkfsWithOptions("ext4", "part1.img", "writable", "",
+			64*quantity.SizeMiB, 512, []string{"-i", "4096"})
+		asserter.AssertErrNil(err, true)
+		mkfsExt4 := "mkfs.ext4 -L writable -i 4096 part1.img"
+		if os.Geteuid() != 0 {
+			mkfsExt4 = "fakeroot " + mkfsExt4
+		}
+		expectedCommands := []string{
+			"mkfs.vfat -S 512 -s 1 -F 32 -n system-boot -F 16 part0.img",
+			"mcopy -s -i part0.img " + contentRoot + "/EFI ::",
+			mkfsExt4,
+		}
+		if !reflect.DeepEqual(commands, expectedCommands) {
+			t.Errorf("Expected commands %v, but got %v", expectedCommands, commands)
+		}
+	})
+	// FAKEROOT_FLAGS is passed to fakeroot when not running as root, like snapd does
+	t.Run("test_mkfs_with_options_fakeroot_flags", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+
+		var commands []string
+		testCaseName = "TestMkfsWithOptions"
+		execCommand = func(command string, args ...string) *exec.Cmd {
+			commands = append(commands, command+" "+strings.Join(args, " "))
+			return fakeExecCommand(command, args...)
+		}
+		osGeteuid = func() int { return 1000 }
+		defer func() {
+			execCommand = exec.Command
+			osGeteuid = os.Geteuid
+		}()
+
+		t.Setenv("FAKEROOT_FLAGS", "--lib '/snap/ubuntu-image/current/usr/lib/libfakeroot.so'")
+		err := stateMachine.mkfsWithOptions("ext4", "part1.img", "writable", "",
+			64*quantity.SizeMiB, 512, nil)
+		asserter.AssertErrNil(err, true)
+		expectedCommands := []string{
+			"fakeroot --lib /snap/ubuntu-image/current/usr/lib/libfakeroot.so -- " +
+				"mkfs.ext4 -L writable part1.img",
+		}
+		if !reflect.DeepEqual(commands, expectedCommands) {
+			t.Errorf("Expected commands %v, but got %v", expectedCommands, commands)
+		}
+
+		t.Setenv("FAKEROOT_FLAGS", "--lib '/snap")
+		err = stateMachine.mkfsWithOptions("ext4", "part1.img", "writable", "",
+			64*quantity.SizeMiB, 512, nil)
+		asserter.AssertErrContains(err, "Error splitting FAKEROOT_FLAGS")
+	})
+}
+
+// TestExtFilesystemOptions tests that the ext-variant and ext-features of ext4
+// structures are turned into mkfs options, that incompatible features are rejected
+// and that the features breaking GRUB legacy are warned about
+func TestExtFilesystemOptions(t *testing.T) {
+	testCases := []struct {
+		name            string
+		variant         string
+		features        []string
+		expectedOptions []string
+		expectedWarning string
+		errMsg          string
+	}{
+		{"default", "", nil, nil, "ext features 64bit, extent, flex_bg, huge_file and metadata_csum " +
+			"are known to keep GRUB legacy from reading the filesystem", ""},
+		{"ext4", "ext4", nil, nil, "ext features 64bit, extent, flex_bg, huge_file and metadata_csum " +
+			"are known to keep GRUB legacy from reading the filesystem", ""},
+		{"ext2", "ext2", nil, []string{"-t", "ext2"}, "", ""},
+		{"ext3_features", "ext3", []string{"^dir_index", "large_file"},
+			[]string{"-t", "ext3", "-O", "^dir_index,large_file"}, "", ""},
+		{"disabled_features", "", []string{"^64bit", "^metadata_csum"},
+			[]string{"-O", "^64bit,^metadata_csum"}, "ext features extent, flex_bg and huge_file " +
+				"are known to keep GRUB legacy from reading the filesystem", ""},
+		{"no_extents", "", []string{"^extents", "^64bit", "^flex_bg", "^huge_file"},
+			[]string{"-O", "^extents,^64bit,^flex_bg,^huge_file"}, "ext feature metadata_csum " +
+				"is known to keep GRUB legacy from reading the filesystem", ""},
+		{"grub_legacy_compatible", "", []string{"^extents", "^64bit", "^flex_bg", "^huge_file",
+			"^metadata_csum"}, []string{"-O", "^extents,^64bit,^flex_bg,^huge_file,^metadata_csum"}, "", ""},
+		{"ext3_grub_legacy", "ext3", []string{"^dir_index"}, []string{"-t", "ext3", "-O", "^dir_index"}, "", ""},
+		{"invalid_variant", "btrfs", nil, nil, "", "invalid ext-variant \"btrfs\""},
+		{"unknown_feature", "", []string{"^turbo"}, nil, "", "unknown ext feature \"turbo\""},
+		{"duplicate_feature", "", []string{"extent", "^extents"}, nil, "", "ext feature extent is given more than once"},
+		{"ext4_feature", "ext3", []string{"64bit"}, nil, "", "ext feature 64bit requires an ext4 filesystem"},
+		{"ext2_journal", "ext2", []string{"has_journal"}, nil, "", "use the ext3 ext-variant instead"},
+		{"64bit_without_extents", "", []string{"^extent"}, nil, "", "64bit requires extents"},
+		{"csum_seed_without_csum", "", []string{"metadata_csum_seed", "^metadata_csum"}, nil, "",
+			"metadata_csum_seed requires metadata_csum"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_ext_filesystem_options_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			options, warnings, err := extFilesystemOptions(tc.variant, tc.features)
+			if tc.errMsg != "" {
+				asserter.AssertErrContains(err, tc.errMsg)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			if !reflect.DeepEqual(options, tc.expectedOptions) {
+				t.Errorf("Expected mkfs options %v, but got %v", tc.expectedOptions, options)
+			}
+			if (tc.expectedWarning == "" && len(warnings) > 0) ||
+				(tc.expectedWarning != "" && !reflect.DeepEqual(warnings, []string{tc.expectedWarning})) {
+				t.Errorf("Expected the warning \"%s\", but got %v", tc.expectedWarning, warnings)
+			}
+		})
+	}
+
+	t.Run("test_parse_ext_filesystem_options", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		gadgetYaml := []byte(`volumes:
+  pc:
+    bootloader: grub
+    structure:
+      - name: boot
+        type: 0FC63DAF-8483-4772-8E79-3D69D8477DE4
+        size: 1M
+        filesystem: ext4
+        ext-variant: ext3
+        mkfs-options: ["-i", "4096"]
+      - name: data
+        type: 0FC63DAF-8483-4772-8E79-3D69D8477DE4
+        size: 1M
+        filesystem: ext4
+        ext-features: [flex_bg]
+      - name: esp
+        type: C12A7328-F81F-11D2-BA4B-00A0C93EC93B
+        size: 1M
+        filesystem: vfat
+`)
+		gadgetInfo, err := gadget.InfoFromGadgetYaml(gadgetYaml, nil)
+		asserter.AssertErrNil(err, true)
+		mkfsOptions, warnings, err := parseMkfsOptions(gadgetYamlExtensionsOf(t, gadgetYaml), gadgetInfo)
+		asserter.AssertErrNil(err, true)
+		expectedOptions := map[string]map[int][]string{"pc": {
+			0: {"-t", "ext3", "-i", "4096"},
+			1: {"-O", "flex_bg"},
+		}}
+		if !reflect.DeepEqual(mkfsOptions, expectedOptions) {
+			t.Errorf("Expected mkfs options %v, but got %v", expectedOptions, mkfsOptions)
+		}
+		expectedWarnings := []string{"volumes:pc:structure:1: ext features 64bit, extent, flex_bg, " +
+			"huge_file and metadata_csum are known to keep GRUB legacy from reading the filesystem"}
+		if !reflect.DeepEqual(warnings, expectedWarnings) {
+			t.Errorf("Expected warnings %v, but got %v", expectedWarnings, warnings)
+		}
+
+		// only ext4 structures can select an ext variant
+		vfatGadgetYaml := []byte(strings.Replace(string(gadgetYaml), "filesystem: vfat",
+			"filesystem: vfat\n        ext-variant: ext2", 1))
+		gadgetInfo, err = gadget.InfoFromGadgetYaml(vfatGadgetYaml, nil)
+		asserter.AssertErrNil(err, true)
+		_, _, err = parseMkfsOptions(gadgetYamlExtensionsOf(t, vfatGadgetYaml), gadgetInfo)
+		asserter.AssertErrContains(err, "volumes:pc:structure:2: ext-variant and ext-features "+
+			"can only be set on ext4 filesystems")
+	})
+}
+
+// fakeOutputDevice creates the entries of /sys/block and /proc/self/mounts of a
+// fake sdz disk, with a sdz1 partition, and returns its path in /dev
+func fakeOutputDevice(t *testing.T, tmpDir string, removable string, size int64, mounts string) string {
+	t.Helper()
+	asserter := helper.Asserter{T: t}
+	devDir := filepath.Join(tmpDir, "dev")
+	sysDir := filepath.Join(tmpDir, "sys", "block")
+	err := os.MkdirAll(filepath.Join(sysDir, "sdz", "sdz1"), 0755)
+	asserter.AssertErrNil(err, true)
+	err = os.MkdirAll(devDir, 0755)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(sysDir, "sdz", "removable"), []byte(removable+"\n"), 0644)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(sysDir, "sdz", "size"),
+		[]byte(strconv.FormatInt(size/512, 10)+"\n"), 0644)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(tmpDir, "mounts"), []byte(mounts), 0644)
+	asserter.AssertErrNil(err, true)
+	device := filepath.Join(devDir, "sdz")
+	err = os.WriteFile(device, []byte{}, 0644)
+	asserter.AssertErrNil(err, true)
+
+	sysBlockDir = sysDir
+	procMountsFile = filepath.Join(tmpDir, "mounts")
+	return device
+}
+
+// TestCheckOutputDevice tests that the images are only written to removable
+// whole disks, unless --force-device is given, and never to mounted ones
+func TestCheckOutputDevice(t *testing.T) {
+	testCases := []struct {
+		name      string
+		removable string
+		force     bool
+		mounts    string
+		errMsg    string
+	}{
+		{"removable", "1", false, "/dev/sda1 / ext4 rw 0 0\n", ""},
+		{"not_removable", "0", false, "", "is not a removable device. Use --force-device"},
+		{"not_removable_forced", "0", true, "", ""},
+		{"partition_mounted", "1", false, "/dev/sdz1 /media/usb vfat rw 0 0\n", "/dev/sdz1 is mounted on /media/usb"},
+		{"disk_mounted_forced", "0", true, "DEV /mnt ext4 rw 0 0\n", "is mounted on /mnt"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_check_output_device_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+
+			tmpDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(tmpDir)
+			device := fakeOutputDevice(t, tmpDir, tc.removable, 1<<20,
+				strings.ReplaceAll(tc.mounts, "DEV", filepath.Join(tmpDir, "dev", "sdz")))
+			defer func() {
+				sysBlockDir = "/sys/block"
+				procMountsFile = "/proc/self/mounts"
+			}()
+			stateMachine.commonFlags.OutputDevice = device
+			stateMachine.commonFlags.ForceDevice = tc.force
+
+			err = stateMachine.checkOutputDevice()
+			if tc.errMsg != "" {
+				asserter.AssertErrContains(err, tc.errMsg)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+		})
+	}
+
+	t.Run("test_check_output_device_not_a_disk", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		tmpDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(tmpDir)
+		fakeOutputDevice(t, tmpDir, "1", 1<<20, "")
+		defer func() {
+			sysBlockDir = "/sys/block"
+			procMountsFile = "/proc/self/mounts"
+		}()
+		partition := filepath.Join(tmpDir, "dev", "sdz1")
+		err = os.WriteFile(partition, []byte{}, 0644)
+		asserter.AssertErrNil(err, true)
+		stateMachine.commonFlags.OutputDevice = partition
+
+		err = stateMachine.checkOutputDevice()
+		asserter.AssertErrContains(err, "is not a whole disk block device")
+	})
+
+	t.Run("test_force_device_without_output_device", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.commonFlags.ForceDevice = true
+
+		err := stateMachine.validateInput()
+		asserter.AssertErrContains(err, "--force-device requires --output-device")
+	})
+}
+
+// TestWriteOutputDevice tests that the disk image is written to the output
+// device and read back, and that the images that can't be written are refused
+func TestWriteOutputDevice(t *testing.T) {
+	testCases := []struct {
+		name       string
+		volumes    []string
+		deviceSize int64
+		chunkSize  int
+		errMsg     string
+	}{
+		{"single_chunk", []string{"pc"}, 1 << 20, 4 << 20, ""},
+		{"several_chunks", []string{"pc"}, 1 << 20, 4096, ""},
+		{"too_small", []string{"pc"}, 512, 4096, "is too small for the disk image"},
+		{"several_images", []string{"pc", "data"}, 1 << 20, 4096, "but 2 were created"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_write_output_device_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.commonFlags.Quiet = true
+
+			tmpDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(tmpDir)
+			device := fakeOutputDevice(t, tmpDir, "1", tc.deviceSize, "")
+			outputDeviceChunkSize = tc.chunkSize
+			defer func() {
+				sysBlockDir = "/sys/block"
+				procMountsFile = "/proc/self/mounts"
+				outputDeviceChunkSize = 4 << 20
+			}()
+			stateMachine.commonFlags.OutputDevice = device
+			stateMachine.commonFlags.OutputDir = tmpDir
+			stateMachine.VolumeOrder = tc.volumes
+			stateMachine.VolumeNames = make(map[string]string)
+
+			// the image does not end on a chunk boundary
+			image := make([]byte, 10000)
+			_, err = rand.Read(image)
+			asserter.AssertErrNil(err, true)
+			for _, volume := range tc.volumes {
+				stateMachine.VolumeNames[volume] = volume + ".img"
+				err = os.WriteFile(filepath.Join(tmpDir, volume+".img"), image, 0644)
+				asserter.AssertErrNil(err, true)
+			}
+
+			err = stateMachine.writeOutputDevice()
+			if tc.errMsg != "" {
+				asserter.AssertErrContains(err, tc.errMsg)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			written, err := os.ReadFile(device)
+			asserter.AssertErrNil(err, true)
+			if !bytes.Equal(written, image) {
+				t.Errorf("Expected the disk image to be written to the output device")
+			}
+		})
+	}
+}
+
+// TestMeasureBootComponents tests that the value of PCR 4 is predicted from the EFI
+// applications of the ESP and the kernel, in the order they are loaded
+func TestMeasureBootComponents(t *testing.T) {
+	bootEvents := []pcrEvent{
+		{"EV_EFI_ACTION", "Calling EFI Application from Boot Option",
+			"3d6772b4f84ed47595d72a2c4c5ffd15f5bb72c7507fe26f2aaee2c69d5633ba"},
+		{"EV_SEPARATOR", "", "df3f619804a92fdb4057192dc43dd748ea778adc52bc498ce80524c014b81119"},
+		{"EV_EFI_BOOT_SERVICES_APPLICATION", "/EFI/BOOT/BOOTX64.EFI",
+			"2d437a5ced101a7013d89abe2200513941455c1fae2340fb0eb95bf9308d689b"},
+		{"EV_EFI_BOOT_SERVICES_APPLICATION", "/EFI/BOOT/grubx64.efi",
+			"fe5bb3a8f714aa9719487988c9f1583f38225e9138eedeb28c3fc3cfa3e93675"},
+	}
+	kernelDigest := "274955b58d974ae1df86c5180377e6f66e16ae44b470b8a87dfb1660284c0e04"
+	testCases := []struct {
+		name      string
+		classic   bool
+		kernel    bool
+		grub      string
+		value     string
+		kernelLog string
+		errMsg    string
+	}{
+		{"classic", true, true, "grubx64.efi",
+			"2f64bfe7796724c68c54b14bc8690012f9e29c907dc900831dd12f912f20b2b3", "/boot/vmlinuz-6.0", ""},
+		{"classic_no_kernel", true, false, "grubx64.efi",
+			"0be5778cf7dc607879649babc5e9a622fafdad66f3511639ea8419bc4d606d86", "", ""},
+		{"kernel_snap", false, true, "grubx64.efi",
+			"2f64bfe7796724c68c54b14bc8690012f9e29c907dc900831dd12f912f20b2b3", "pc-kernel:kernel.efi", ""},
+		{"no_boot_application", true, true, "", "", "",
+			"--measure could not find an EFI application in the EFI/BOOT directory"},
+		{"invalid_application", true, true, filepath.Join("..", "gadget_tree", "grubx64.efi"), "", "",
+			"Error computing the digest of EFI application"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_measure_boot_components_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			tmpDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(tmpDir)
+
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.commonFlags.Measure = filepath.Join(tmpDir, "measurements.json")
+			if tc.classic {
+				stateMachine.parent = &ClassicStateMachine{}
+			} else {
+				stateMachine.parent = &SnapStateMachine{}
+			}
+			stateMachine.tempDirs.volumes = filepath.Join(tmpDir, "volumes")
+			stateMachine.tempDirs.rootfs = filepath.Join(tmpDir, "root")
+			stateMachine.tempDirs.scratch = filepath.Join(tmpDir, "scratch")
+			stateMachine.VolumeOrder = []string{"pc"}
+			stateMachine.GadgetInfo = &gadget.Info{Volumes: map[string]*gadget.Volume{
+				"pc": {Structure: []gadget.VolumeStructure{
+					{Name: "mbr", Role: "mbr"},
+					{Name: "ESP", Role: gadget.SystemBoot, Filesystem: "vfat"},
+				}},
+			}}
+
+			testDataDir := filepath.Join("testdata", "measure")
+			bootDir := filepath.Join(tmpDir, "volumes", "pc", "part1", "EFI", "BOOT")
+			if tc.grub != "" {
+				err = os.MkdirAll(bootDir, 0755)
+				asserter.AssertErrNil(err, true)
+				err = osutil.CopyFile(filepath.Join(testDataDir, "shim.efi.signed"),
+					filepath.Join(bootDir, "BOOTX64.EFI"), 0)
+				asserter.AssertErrNil(err, true)
+				err = osutil.CopyFile(filepath.Join(testDataDir, tc.grub),
+					filepath.Join(bootDir, "grubx64.efi"), 0)
+				asserter.AssertErrNil(err, true)
+			}
+
+			if tc.classic && tc.kernel {
+				err = os.MkdirAll(filepath.Join(tmpDir, "root", "boot"), 0755)
+				asserter.AssertErrNil(err, true)
+				err = osutil.CopyFile(filepath.Join(testDataDir, "kernel.efi"),
+					filepath.Join(tmpDir, "root", "boot", "vmlinuz-6.0"), 0)
+				asserter.AssertErrNil(err, true)
+				err = os.Symlink("vmlinuz-6.0", filepath.Join(tmpDir, "root", "boot", "vmlinuz"))
+				asserter.AssertErrNil(err, true)
+			} else if !tc.classic {
+				// the seed of Ubuntu Core 20 images is in the rootfs
+				err = os.MkdirAll(filepath.Join(tmpDir, "root", "systems", "20231010"), 0755)
+				asserter.AssertErrNil(err, true)
+				kernelSnap := filepath.Join(tmpDir, "pc-kernel")
+				err = os.MkdirAll(filepath.Join(kernelSnap, "meta"), 0755)
+				asserter.AssertErrNil(err, true)
+				err = os.WriteFile(filepath.Join(kernelSnap, "meta", "snap.yaml"),
+					[]byte("name: pc-kernel\nversion: 1\ntype: kernel\n"), 0644)
+				asserter.AssertErrNil(err, true)
+				err = osutil.CopyFile(filepath.Join(testDataDir, "kernel.efi"),
+					filepath.Join(kernelSnap, "kernel.efi"), 0)
+				asserter.AssertErrNil(err, true)
+				seedOpen = func(string, string) (seed.Seed, error) {
+					return &fakeSeed{snaps: []*seed.Snap{
+						{
+							Path:          filepath.Join(tmpDir, "pc-gadget"),
+							SideInfo:      &snap.SideInfo{RealName: "pc", Revision: snap.R(1)},
+							EssentialType: snap.TypeGadget,
+						},
+						{
+							Path:          kernelSnap,
+							SideInfo:      &snap.SideInfo{RealName: "pc-kernel", Revision: snap.R(2)},
+							EssentialType: snap.TypeKernel,
+						},
+					}}, nil
+				}
+				defer func() {
+					seedOpen = seed.Open
+				}()
+			}
+
+			stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+			defer restoreStdout()
+			asserter.AssertErrNil(err, true)
+			err = stateMachine.measureBootComponents()
+			restoreStdout()
+			readStdout, readErr := io.ReadAll(stdout)
+			asserter.AssertErrNil(readErr, true)
+			if tc.errMsg != "" {
+				asserter.AssertErrContains(err, tc.errMsg)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+
+			measurementsBytes, err := os.ReadFile(stateMachine.commonFlags.Measure)
+			asserter.AssertErrNil(err, true)
+			var measurements bootMeasurements
+			err = json.Unmarshal(measurementsBytes, &measurements)
+			asserter.AssertErrNil(err, true)
+			events := append([]pcrEvent{}, bootEvents...)
+			if tc.kernelLog != "" {
+				events = append(events, pcrEvent{"EV_EFI_BOOT_SERVICES_APPLICATION", tc.kernelLog, kernelDigest})
+			}
+			expected := bootMeasurements{Algorithm: "sha256", PCRs: []pcrPrediction{
+				{PCR: 4, Value: tc.value, Events: events},
+			}}
+			if !reflect.DeepEqual(measurements, expected) {
+				t.Errorf("Expected the measurements %+v, but got %+v", expected, measurements)
+			}
+			if !reflect.DeepEqual(stateMachine.Artifacts, []string{stateMachine.commonFlags.Measure}) {
+				t.Errorf("Expected the measurements to be recorded as an artifact, but got %v",
+					stateMachine.Artifacts)
+			}
+			warned := strings.Contains(string(readStdout), "the predicted measurements leave it out")
+			if warned != (tc.kernelLog == "") {
+				t.Errorf("Unexpected warning about the kernel: \"%s\"", string(readStdout))
+			}
+		})
 	}
 }
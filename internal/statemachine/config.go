@@ -0,0 +1,130 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+	"gopkg.in/yaml.v2"
+)
+
+// configEnvironment are the environment variables that change how an image is
+// built, other than the proxies, which are printed with the options they default to
+var configEnvironment = []string{
+	"SOURCE_DATE_EPOCH",
+	"UBUNTU_IMAGE_PRESERVE_UNPACK",
+	aptCacheDirEnv,
+	snapCacheDirEnv,
+	"UBUNTU_STORE_ID",
+	"UBUNTU_STORE_URL",
+}
+
+// redactedValue replaces the credentials printed by --print-config
+const redactedValue = "***"
+
+// optionsConfig returns the options of a struct of command line options by their
+// long name, in the order they are defined
+func optionsConfig(opts interface{}) yaml.MapSlice {
+	var config yaml.MapSlice
+	optsValue := reflect.ValueOf(opts)
+	for i := 0; i < optsValue.NumField(); i++ {
+		name := optsValue.Type().Field(i).Tag.Get("long")
+		if name == "" {
+			continue
+		}
+		config = append(config, yaml.MapItem{Key: name, Value: optsValue.Field(i).Interface()})
+	}
+	return config
+}
+
+// redactImageDefinition returns a copy of an image definition with the credentials
+// of the private PPAs and the password hashes of the users replaced
+func redactImageDefinition(imageDef imagedefinition.ImageDefinition) imagedefinition.ImageDefinition {
+	if imageDef.Customization == nil {
+		return imageDef
+	}
+	customization := *imageDef.Customization
+	customization.ExtraPPAs = nil
+	for _, ppa := range imageDef.Customization.ExtraPPAs {
+		redactedPPA := *ppa
+		if redactedPPA.Auth != "" {
+			redactedPPA.Auth = redactedValue
+		}
+		customization.ExtraPPAs = append(customization.ExtraPPAs, &redactedPPA)
+	}
+	customization.Users = nil
+	for _, user := range imageDef.Customization.Users {
+		redactedUser := *user
+		if redactedUser.Password != "" {
+			redactedUser.Password = redactedValue
+		}
+		customization.Users = append(customization.Users, &redactedUser)
+	}
+	imageDef.Customization = &customization
+	return imageDef
+}
+
+// effectiveConfig returns the configuration the image is built with: the options,
+// with the defaults that depend on other options or on the environment applied,
+// the environment variables changing the build, and for classic images the image
+// definition as it was parsed, with its defaults and the customizations of the
+// command line
+func (stateMachine *StateMachine) effectiveConfig() yaml.MapSlice {
+	commonFlags := *stateMachine.commonFlags
+	commonFlags.OutputDir = stateMachine.outputDirectory()
+	proxies := []*string{&commonFlags.HTTPProxy, &commonFlags.HTTPSProxy, &commonFlags.NoProxy}
+	for i, proxy := range proxyEnvironment {
+		if *proxies[i] == "" {
+			*proxies[i] = proxyFromEnvironment(proxy.variable)
+		}
+	}
+
+	config := yaml.MapSlice{
+		{Key: "common", Value: optionsConfig(commonFlags)},
+		{Key: "state-machine", Value: optionsConfig(*stateMachine.stateMachineFlags)},
+	}
+	switch parent := stateMachine.parent.(type) {
+	case *ClassicStateMachine:
+		classicOpts := parent.Opts
+		classicOpts.SnapCacheDir = parent.snapCacheDir()
+		classicOpts.AptCacheDir = parent.aptCacheDir()
+		config = append(config,
+			yaml.MapItem{Key: "classic", Value: optionsConfig(classicOpts)},
+			yaml.MapItem{Key: "image-definition-path", Value: parent.Args.ImageDefinition},
+			yaml.MapItem{Key: "image-definition", Value: redactImageDefinition(parent.ImageDef)},
+		)
+	case *SnapStateMachine:
+		config = append(config,
+			yaml.MapItem{Key: "snap", Value: optionsConfig(parent.Opts)},
+			yaml.MapItem{Key: "model-assertion", Value: parent.Args.ModelAssertion},
+		)
+	}
+
+	environment := yaml.MapSlice{}
+	for _, variable := range configEnvironment {
+		if value, isSet := os.LookupEnv(variable); isSet {
+			environment = append(environment, yaml.MapItem{Key: variable, Value: value})
+		}
+	}
+	return append(config, yaml.MapItem{Key: "environment", Value: environment})
+}
+
+// printConfig prints the configuration the image would be built with as YAML, and
+// exits without building anything. The image definition is still parsed and validated.
+// The user information of the URLs is redacted, like the proxy credentials
+func (stateMachine *StateMachine) printConfig() error {
+	for i := 0; i < len(stateMachine.states); i++ {
+		if dryRunStates[stateMachine.states[i].name] {
+			if err := stateMachine.states[i].function(stateMachine); err != nil {
+				return err
+			}
+		}
+	}
+	configYaml, err := yaml.Marshal(stateMachine.effectiveConfig())
+	if err != nil {
+		return fmt.Errorf("Error marshalling the configuration: %s", err.Error())
+	}
+	fmt.Print(credentialInURL.ReplaceAllString(string(configYaml), "://"+redactedValue+"@"))
+	return nil
+}
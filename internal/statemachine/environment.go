@@ -0,0 +1,86 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// environmentReference matches the inside of a ${VAR} or ${VAR:-default} reference
+var environmentReference = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)(:-(.*))?$`)
+
+// expandEnvironment replaces the ${VAR} references in the values of an image
+// definition with the value of the environment variable VAR, which must be set.
+// With ${VAR:-default}, default is used when VAR is not set or empty, as in the
+// shell. Anything else starting with a $, like $VAR or the $6$ of a password hash,
+// is kept as it is. The YAML is parsed before the references are expanded, so
+// that the ones in comments are left alone, and the expanded values are written
+// back quoted when needed, so that they can't change the structure of the document
+func expandEnvironment(data []byte) ([]byte, error) {
+	var document yaml.Node
+	// the error is reported when the image definition is decoded
+	if err := yaml.Unmarshal(data, &document); err != nil || document.Kind == 0 {
+		return data, nil
+	}
+	if err := expandNodeEnvironment(&document); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(&document)
+}
+
+// expandNodeEnvironment expands the references of the scalars of node and of its children
+func expandNodeEnvironment(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode && strings.Contains(node.Value, "${") {
+		value, err := expandReferences(node.Value)
+		if err != nil {
+			return fmt.Errorf("line %d: %s", node.Line, err.Error())
+		}
+		node.Value = value
+		// unquoted values get the type of the expanded value, as if it had been
+		// written in the image definition
+		if node.Style == 0 {
+			node.Tag = ""
+		}
+	}
+	for _, child := range node.Content {
+		if err := expandNodeEnvironment(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expandReferences replaces the ${VAR} references of value
+func expandReferences(value string) (string, error) {
+	var expanded strings.Builder
+	for {
+		start := strings.Index(value, "${")
+		if start == -1 {
+			expanded.WriteString(value)
+			return expanded.String(), nil
+		}
+		expanded.WriteString(value[:start])
+		end := strings.IndexByte(value[start:], '}')
+		if end == -1 {
+			return "", fmt.Errorf("unterminated reference to an environment variable")
+		}
+		reference := value[start+2 : start+end]
+		match := environmentReference.FindStringSubmatch(reference)
+		if match == nil {
+			return "", fmt.Errorf("invalid reference \"${%s}\" to an environment variable", reference)
+		}
+		variable, isSet := os.LookupEnv(match[1])
+		switch {
+		case match[2] != "" && variable == "":
+			variable = match[3]
+		case !isSet:
+			return "", fmt.Errorf("environment variable %s is not set, and \"${%s}\" has no default",
+				match[1], reference)
+		}
+		expanded.WriteString(variable)
+		value = value[start+end+1:]
+	}
+}
@@ -0,0 +1,59 @@
+package statemachine
+
+import (
+	"encoding/json"
+	"net"
+	"time"
+)
+
+// eventSocketTimeout bounds the time spent connecting and writing to the
+// --event-socket, so that a slow listener never holds up the build
+var eventSocketTimeout = 100 * time.Millisecond
+
+// stateStatusStarted is the status of the events sent when a state starts
+const stateStatusStarted = "started"
+
+// buildEvent is sent over the --event-socket for each state transition
+type buildEvent struct {
+	State  string    `json:"state"`
+	Status string    `json:"status"`
+	Time   time.Time `json:"timestamp"`
+}
+
+// eventPublisher sends build events as newline-delimited JSON to a Unix
+// domain socket. It only connects when the first event is sent, and tries
+// again with the next events if nobody was listening. Events that can't be
+// sent are dropped
+type eventPublisher struct {
+	socketPath string
+	conn       net.Conn
+}
+
+// publish sends an event for the given state, if --event-socket was given
+func (publisher *eventPublisher) publish(stateName, status string) {
+	if publisher.socketPath == "" {
+		return
+	}
+	if publisher.conn == nil {
+		conn, err := net.DialTimeout("unix", publisher.socketPath, eventSocketTimeout)
+		if err != nil {
+			return
+		}
+		publisher.conn = conn
+	}
+	// errors can't happen when encoding a struct made of basic types
+	data, _ := json.Marshal(buildEvent{State: stateName, Status: status, Time: time.Now()})
+	publisher.conn.SetWriteDeadline(time.Now().Add(eventSocketTimeout))
+	if _, err := publisher.conn.Write(append(data, '\n')); err != nil {
+		// the listener went away, connect again for the next event
+		publisher.close()
+	}
+}
+
+// close closes the connection to the event socket, if there is one
+func (publisher *eventPublisher) close() {
+	if publisher.conn != nil {
+		publisher.conn.Close()
+		publisher.conn = nil
+	}
+}
@@ -0,0 +1,165 @@
+package statemachine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// extVariants are the ext filesystems an ext4 structure of gadget.yaml can be
+// created as with ext-variant, for the bootloaders that can't read ext4
+var extVariants = []string{"ext2", "ext3", "ext4"}
+
+// extFeatures are the features of ext filesystems that mke2fs knows, with extents
+// named extent like in mke2fs. The value of each feature is whether it requires
+// an ext4 filesystem
+var extFeatures = map[string]bool{
+	"64bit":              true,
+	"bigalloc":           true,
+	"casefold":           true,
+	"dir_index":          false,
+	"dir_nlink":          true,
+	"ea_inode":           true,
+	"encrypt":            true,
+	"ext_attr":           false,
+	"extent":             true,
+	"extra_isize":        true,
+	"filetype":           false,
+	"flex_bg":            true,
+	"has_journal":        false,
+	"huge_file":          true,
+	"inline_data":        true,
+	"large_dir":          true,
+	"large_file":         false,
+	"meta_bg":            false,
+	"metadata_csum":      true,
+	"metadata_csum_seed": true,
+	"mmp":                false,
+	"orphan_file":        true,
+	"project":            true,
+	"quota":              false,
+	"resize_inode":       false,
+	"sparse_super":       false,
+	"sparse_super2":      false,
+	"stable_inodes":      true,
+	"uninit_bg":          true,
+	"verity":             true,
+}
+
+// extDefaultFeatures are the features mke2fs enables by default for each ext
+// variant, from the base_features and the features of the variant in mke2fs.conf
+var extDefaultFeatures = map[string][]string{
+	"ext2": {"dir_index", "ext_attr", "filetype", "large_file", "resize_inode", "sparse_super"},
+	"ext3": {"dir_index", "ext_attr", "filetype", "has_journal", "large_file", "resize_inode",
+		"sparse_super"},
+	"ext4": {"64bit", "dir_index", "dir_nlink", "ext_attr", "extent", "extra_isize", "filetype",
+		"flex_bg", "has_journal", "huge_file", "large_file", "metadata_csum", "resize_inode",
+		"sparse_super"},
+}
+
+// grubLegacyFeatures are the features of ext filesystems that GRUB legacy can't
+// read a filesystem with
+var grubLegacyFeatures = map[string]bool{
+	"64bit":              true,
+	"bigalloc":           true,
+	"casefold":           true,
+	"encrypt":            true,
+	"extent":             true,
+	"flex_bg":            true,
+	"huge_file":          true,
+	"inline_data":        true,
+	"large_dir":          true,
+	"metadata_csum":      true,
+	"metadata_csum_seed": true,
+}
+
+// extFilesystemOptions returns the options of mkfs.ext4 creating an ext4 structure
+// as the ext-variant of gadget.yaml, with its ext-features enabled, or disabled when
+// prefixed with "^" like for mke2fs -O. Incompatible features are rejected, and a
+// warning is returned for each feature known to break GRUB legacy that the filesystem
+// ends up with, including the ones mke2fs enables by default for the variant
+func extFilesystemOptions(variant string, features []string) ([]string, []string, error) {
+	if variant != "" && !helper.SliceHasElement(extVariants, variant) {
+		return nil, nil, fmt.Errorf("invalid ext-variant \"%s\", it must be one of %s",
+			variant, strings.Join(extVariants, ", "))
+	}
+	if variant == "" {
+		variant = "ext4"
+	}
+
+	enabled := make(map[string]bool)
+	disabled := make(map[string]bool)
+	for _, feature := range features {
+		name := strings.TrimPrefix(feature, "^")
+		if name == "extents" {
+			name = "extent"
+		}
+		requiresExt4, known := extFeatures[name]
+		if !known {
+			return nil, nil, fmt.Errorf("unknown ext feature \"%s\"", name)
+		}
+		if enabled[name] || disabled[name] {
+			return nil, nil, fmt.Errorf("ext feature %s is given more than once", name)
+		}
+		if strings.HasPrefix(feature, "^") {
+			disabled[name] = true
+			continue
+		}
+		if requiresExt4 && variant != "ext4" {
+			return nil, nil, fmt.Errorf("ext feature %s requires an ext4 filesystem", name)
+		}
+		enabled[name] = true
+	}
+
+	// the features of the filesystem, with the defaults of mke2fs that are not disabled
+	effective := make(map[string]bool)
+	for _, name := range extDefaultFeatures[variant] {
+		effective[name] = !disabled[name]
+	}
+	for name := range enabled {
+		effective[name] = true
+	}
+	has64bit := effective["64bit"]
+	switch {
+	case variant == "ext2" && enabled["has_journal"]:
+		return nil, nil, fmt.Errorf("ext feature has_journal can not be enabled for ext2, " +
+			"use the ext3 ext-variant instead")
+	case disabled["extent"] && has64bit:
+		return nil, nil, fmt.Errorf("ext feature 64bit requires extents, disable 64bit as well")
+	case disabled["extent"] && enabled["bigalloc"]:
+		return nil, nil, fmt.Errorf("ext feature bigalloc requires extents")
+	case enabled["metadata_csum_seed"] && disabled["metadata_csum"]:
+		return nil, nil, fmt.Errorf("ext feature metadata_csum_seed requires metadata_csum")
+	}
+
+	var grubLegacyBreaking []string
+	for name, isEnabled := range effective {
+		if isEnabled && grubLegacyFeatures[name] {
+			grubLegacyBreaking = append(grubLegacyBreaking, name)
+		}
+	}
+	sort.Strings(grubLegacyBreaking)
+	var warnings []string
+	switch len(grubLegacyBreaking) {
+	case 0:
+	case 1:
+		warnings = append(warnings, fmt.Sprintf("ext feature %s is known to keep "+
+			"GRUB legacy from reading the filesystem", grubLegacyBreaking[0]))
+	default:
+		last := len(grubLegacyBreaking) - 1
+		warnings = append(warnings, fmt.Sprintf("ext features %s and %s are known to keep "+
+			"GRUB legacy from reading the filesystem",
+			strings.Join(grubLegacyBreaking[:last], ", "), grubLegacyBreaking[last]))
+	}
+
+	var options []string
+	if variant != "ext4" {
+		options = append(options, "-t", variant)
+	}
+	if len(features) > 0 {
+		options = append(options, "-O", strings.Join(features, ","))
+	}
+	return options, warnings, nil
+}
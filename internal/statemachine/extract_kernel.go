@@ -0,0 +1,61 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// rootfsBootFile returns the path of the kernel or the initrd of the rootfs,
+// following the link of /boot the kernel packages keep to the latest one
+func rootfsBootFile(rootfs, name string) (string, error) {
+	bootFile := filepath.Join(rootfs, "boot", name)
+	target, err := os.Readlink(bootFile)
+	if err != nil {
+		if _, err := os.Stat(bootFile); err != nil {
+			return "", fmt.Errorf("/boot/%s was not found in the rootfs, which must have a "+
+				"kernel installed", name)
+		}
+		return bootFile, nil
+	}
+	if filepath.IsAbs(target) {
+		return filepath.Join(rootfs, target), nil
+	}
+	return filepath.Join(rootfs, "boot", target), nil
+}
+
+// extractedKernelNames returns the paths of the kernel and the initrd written to the
+// output directory by --extract-kernel, both named after the image
+func (stateMachine *StateMachine) extractedKernelNames() (string, string) {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	imageName := classicStateMachine.ImageDef.ImageName
+	return filepath.Join(stateMachine.commonFlags.OutputDir, imageName+".vmlinuz"),
+		filepath.Join(stateMachine.commonFlags.OutputDir, imageName+".initrd")
+}
+
+// extractKernel copies the kernel and the initrd of the rootfs to the output
+// directory, so that the image can be netbooted. They are the same files the live
+// ISO is made with, the ones /boot/vmlinuz and /boot/initrd.img point to
+func (stateMachine *StateMachine) extractKernel() error {
+	kernelDst, initrdDst := stateMachine.extractedKernelNames()
+	bootFiles := [][2]string{{"vmlinuz", kernelDst}, {"initrd.img", initrdDst}}
+	for _, bootFile := range bootFiles {
+		source, err := rootfsBootFile(stateMachine.tempDirs.rootfs, bootFile[0])
+		if err != nil {
+			return fmt.Errorf("Error extracting the kernel: %s", err.Error())
+		}
+		// a kernel extracted by an earlier run is replaced
+		if err := osRemoveAll(bootFile[1]); err != nil {
+			return fmt.Errorf("Error removing the previously extracted %s: %s",
+				filepath.Base(bootFile[1]), err.Error())
+		}
+		if err := osutilCopySpecialFile(source, bootFile[1]); err != nil {
+			return fmt.Errorf("Error copying /boot/%s to the output directory: %s",
+				bootFile[0], err.Error())
+		}
+		stateMachine.addArtifact(bootFile[1])
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package statemachine
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+	"github.com/snapcore/snapd/gadget"
+)
+
+// fstabMountOptions are the mount options of the entries generated from gadget.yaml
+// for each filesystem. The other filesystems are mounted with "defaults"
+var fstabMountOptions = map[string]string{
+	"ext4":    "discard,errors=remount-ro",
+	"vfat":    "umask=0077",
+	"vfat-16": "umask=0077",
+	"vfat-32": "umask=0077",
+}
+
+// renderFstabEntry returns the fstab line of an fstab entry of the image definition
+func renderFstabEntry(fstab *imagedefinition.Fstab) string {
+	dumpString := "0"
+	if fstab.Dump {
+		dumpString = "1"
+	}
+	return fmt.Sprintf("LABEL=%s\t%s\t%s\t%s\t%s\t%d",
+		fstab.Label,
+		fstab.Mountpoint,
+		fstab.FSType,
+		fstab.MountOptions,
+		dumpString,
+		fstab.FsckOrder,
+	)
+}
+
+// structureMountPoint returns where the filesystem of a structure of gadget.yaml is
+// mounted in the image, or "" if it isn't. The EFI system partition of grub is mounted
+// on /boot/efi, and the boot partitions of the other bootloaders on /boot/firmware
+func (stateMachine *StateMachine) structureMountPoint(volume *gadget.Volume, volumeName string,
+	structureNumber int, structure gadget.VolumeStructure) string {
+	switch {
+	case structure.Filesystem == "":
+		return ""
+	case structure.Role == gadget.SystemData:
+		return "/"
+	case stateMachine.MountPoints[volumeName][structureNumber] != "":
+		return stateMachine.MountPoints[volumeName][structureNumber]
+	case isESP(structure) && volume.Bootloader == "grub":
+		return "/boot/efi"
+	case isESP(structure):
+		return "/boot/firmware"
+	}
+	return ""
+}
+
+// structureFstabEntry returns the fstab entry mounting the filesystem of a structure of
+// gadget.yaml on mountPoint. Filesystems are mounted by UUID when it is known before they
+// are created, from gadget.yaml or --deterministic-uuid, and by label otherwise
+func (stateMachine *StateMachine) structureFstabEntry(volumeName string, structureNumber int,
+	structure gadget.VolumeStructure, mountPoint string) (string, error) {
+	label := structure.Label
+	if label == "" && structure.Role == gadget.SystemData {
+		label = "writable"
+	}
+	source := "LABEL=" + label
+	if fsUUID := stateMachine.filesystemUUID(volumeName, structureNumber,
+		structure); fsUUID != "" {
+		source = "UUID=" + fsUUID
+	} else if label == "" {
+		return "", fmt.Errorf("volumes:%s:structure:%d: the filesystem mounted on %s "+
+			"needs a filesystem-label or a filesystem-uuid to be written to fstab",
+			volumeName, structureNumber, mountPoint)
+	}
+	options, found := fstabMountOptions[structure.Filesystem]
+	if !found {
+		options = "defaults"
+	}
+	fsckOrder := 2
+	if mountPoint == "/" {
+		fsckOrder = 1
+	}
+	return fmt.Sprintf("%s\t%s\t%s\t%s\t0\t%d", source, mountPoint,
+		strings.Split(structure.Filesystem, "-")[0], options, fsckOrder), nil
+}
+
+// gadgetFstabEntries returns the fstab entries mounting the filesystems of gadget.yaml,
+// by mount point
+func (stateMachine *StateMachine) gadgetFstabEntries() (map[string]string, error) {
+	entries := make(map[string]string)
+	for volumeName, volume := range stateMachine.GadgetInfo.Volumes {
+		for structureNumber, structure := range volume.Structure {
+			mountPoint := stateMachine.structureMountPoint(volume, volumeName,
+				structureNumber, structure)
+			if mountPoint == "" {
+				continue
+			}
+			if otherEntry, found := entries[mountPoint]; found {
+				return nil, fmt.Errorf("volumes:%s:structure:%d: %s is already mounted by \"%s\"",
+					volumeName, structureNumber, mountPoint, otherEntry)
+			}
+			entry, err := stateMachine.structureFstabEntry(volumeName, structureNumber,
+				structure, mountPoint)
+			if err != nil {
+				return nil, err
+			}
+			entries[mountPoint] = entry
+		}
+	}
+	return entries, nil
+}
+
+// generateFstab writes the fstab of the rootfs from the partitions of gadget.yaml,
+// in the order of their mount points so that /var is mounted before /var/log. The
+// fstab entries of the image definition are appended, and replace the generated entry
+// of their mount point
+func (stateMachine *StateMachine) generateFstab() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	entries, err := stateMachine.gadgetFstabEntries()
+	if err != nil {
+		return fmt.Errorf("Error generating fstab: %s", err.Error())
+	}
+	for _, fstab := range classicStateMachine.ImageDef.Customization.Fstab {
+		delete(entries, fstab.Mountpoint)
+	}
+	var mountPoints []string
+	for mountPoint := range entries {
+		mountPoints = append(mountPoints, mountPoint)
+	}
+	sort.Strings(mountPoints)
+
+	fstabLines := []string{"# /etc/fstab: generated by ubuntu-image from gadget.yaml"}
+	for _, mountPoint := range mountPoints {
+		fstabLines = append(fstabLines, entries[mountPoint])
+	}
+	for _, fstab := range classicStateMachine.ImageDef.Customization.Fstab {
+		fstabLines = append(fstabLines, renderFstabEntry(fstab))
+	}
+	fstabPath := filepath.Join(stateMachine.tempDirs.rootfs, "etc", "fstab")
+	err = osWriteFile(fstabPath, []byte(strings.Join(fstabLines, "\n")+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("Error writing to fstab: %s", err.Error())
+	}
+	return nil
+}
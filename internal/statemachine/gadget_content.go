@@ -0,0 +1,106 @@
+package statemachine
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/snapcore/snapd/gadget"
+)
+
+// contentSources tracks which content entry of gadget.yaml wrote each file of a
+// partition, so that the entries overwriting the files of an earlier one are
+// reported. It is the observer of the MountedFilesystemWriter
+type contentSources struct {
+	// the content entry being written
+	source string
+	// the content entry that wrote each file, by its path in the partition
+	written map[string]string
+	// the files of an earlier content entry the current one overwrote, by entry
+	overwritten map[string][]string
+}
+
+// newContentSources returns a tracker for the content of a partition
+func newContentSources() *contentSources {
+	return &contentSources{written: make(map[string]string)}
+}
+
+// start records that the files written from now on come from source
+func (sources *contentSources) start(source string) {
+	sources.source = source
+	sources.overwritten = make(map[string][]string)
+}
+
+// record records that a file of the partition was written by the current entry
+func (sources *contentSources) record(path string) {
+	path = filepath.Clean("/" + path)
+	if previous, found := sources.written[path]; found && previous != sources.source {
+		sources.overwritten[previous] = append(sources.overwritten[previous], path)
+	}
+	sources.written[path] = sources.source
+}
+
+// Observe implements gadget.ContentObserver to record the files written by the
+// MountedFilesystemWriter, without changing what it writes
+func (sources *contentSources) Observe(op gadget.ContentOperation, partRole,
+	targetRootDir, relativeTargetPath string, data *gadget.ContentChange) (gadget.ContentChangeAction, error) {
+	if op == gadget.ContentWrite {
+		sources.record(relativeTargetPath)
+	}
+	return gadget.ChangeApply, nil
+}
+
+// warnOverwritten prints a warning for each earlier content entry the current one
+// overwrote files of
+func (stateMachine *StateMachine) warnOverwritten(sources *contentSources, partition string) {
+	if stateMachine.commonFlags.Quiet {
+		return
+	}
+	var previousSources []string
+	for previous := range sources.overwritten {
+		previousSources = append(previousSources, previous)
+	}
+	sort.Strings(previousSources)
+	for _, previous := range previousSources {
+		paths := sources.overwritten[previous]
+		sort.Strings(paths)
+		stateMachine.printWarning("the content \"%s\" of partition \"%s\" overwrites %d "+
+			"file(s) of the content \"%s\" listed before it in gadget.yaml, like %s",
+			sources.source, partition, len(paths), previous, paths[0])
+	}
+}
+
+// writeStructureContent writes the content of a structure with a filesystem to the
+// directory of its partition. The content entries of gadget.yaml, which can be
+// directory trees and files of the gadget, tarballs and assets of the kernel, are
+// applied in the order they are listed, so that the later ones override the files
+// of the earlier ones
+func (stateMachine *StateMachine) writeStructureContent(structure *gadget.LaidOutStructure,
+	targetDir string, preserve []string) error {
+	partition := ""
+	if structure.VolumeStructure != nil {
+		partition = structurePartitionName(*structure.VolumeStructure)
+	}
+	sources := newContentSources()
+	for _, content := range structure.ResolvedContent {
+		sources.start(content.UnresolvedSource)
+		if isContentTarball(content.ResolvedSource) {
+			if err := stateMachine.extractContentTarball(content, targetDir, sources); err != nil {
+				return err
+			}
+		} else {
+			// the writer only writes the content entry being applied
+			contentStructure := *structure
+			contentStructure.ResolvedContent = []gadget.ResolvedContent{content}
+			mountedFilesystemWriter, err := gadgetNewMountedFilesystemWriter(&contentStructure, sources)
+			if err != nil {
+				return fmt.Errorf("Error creating NewMountedFilesystemWriter: %s", err.Error())
+			}
+			if err := mountedFilesystemWriter.Write(targetDir, preserve); err != nil {
+				return fmt.Errorf("Error in mountedFilesystem.Write(): %s", err.Error())
+			}
+		}
+		stateMachine.warnOverwritten(sources, partition)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// runBuildHook runs the --post-build-hook of a successful build, or the
+// --on-failure-hook of a build that failed or was cancelled. The hook is a shell
+// command that gets the outcome of the build in its environment
+func (stateMachine *StateMachine) runBuildHook() error {
+	hook := stateMachine.commonFlags.PostBuildHook
+	hookName := "--post-build-hook"
+	if stateMachine.runErr != nil {
+		hook = stateMachine.commonFlags.OnFailureHook
+		hookName = "--on-failure-hook"
+	}
+	// builds are only reported once their states started running
+	if hook == "" || stateMachine.runStart.IsZero() {
+		return nil
+	}
+
+	hookCmd := execCommand("sh", "-c", hook)
+	// Env is sometimes used for mocking command calls in tests,
+	// so only overwrite env if it is nil
+	if hookCmd.Env == nil {
+		hookCmd.Env = os.Environ()
+	}
+	hookCmd.Env = append(hookCmd.Env, stateMachine.buildHookEnvironment()...)
+	hookCmd.Stdout = os.Stdout
+	hookCmd.Stderr = os.Stderr
+	// the --on-failure-hook also runs when the build was cancelled
+	if err := runCommand(withoutCancel(stateMachine.context()), hookCmd); err != nil {
+		return fmt.Errorf("Error running %s \"%s\": %s", hookName, hook, err.Error())
+	}
+	return nil
+}
+
+// buildHookEnvironment returns the environment variables describing the build to its
+// hooks. Lists of paths are separated by newlines, since paths can contain spaces
+func (stateMachine *StateMachine) buildHookEnvironment() []string {
+	var imageFiles []string
+	for _, imageFile := range stateMachine.ImageFiles {
+		if _, err := os.Stat(imageFile); err == nil {
+			imageFiles = append(imageFiles, imageFile)
+		}
+	}
+	environment := []string{
+		"UBUNTU_IMAGE_IMAGE_TYPE=" + stateMachine.imageType(),
+		"UBUNTU_IMAGE_STATUS=" + stateMachine.buildStatus(),
+		"UBUNTU_IMAGE_OUTPUT_DIR=" + stateMachine.outputDirectory(),
+		"UBUNTU_IMAGE_RESULT_FILE=" + stateMachine.resultFilePath(),
+		"UBUNTU_IMAGE_IMAGE_FILES=" + strings.Join(imageFiles, "\n"),
+		"UBUNTU_IMAGE_ARTIFACTS=" + strings.Join(stateMachine.existingArtifacts(), "\n"),
+	}
+	if stateMachine.runErr != nil {
+		environment = append(environment,
+			"UBUNTU_IMAGE_FAILED_STATE="+stateMachine.failedState,
+			"UBUNTU_IMAGE_ERROR="+stateMachine.runErr.Error(),
+		)
+	}
+	return environment
+}
@@ -0,0 +1,286 @@
+package statemachine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// buildHashSuffix is appended to the name of the image definition to get the
+// name of the file recording the hash of the last build in the output directory
+const buildHashSuffix = ".build-hash"
+
+// buildRecord is the content of the build hash file
+type buildRecord struct {
+	Hash  string   `json:"hash"`
+	Files []string `json:"files"`
+}
+
+// buildInputs holds everything that the hash of a classic build is calculated on
+type buildInputs struct {
+	ImageDefinition interface{}            `json:"image-definition"`
+	Options         map[string]interface{} `json:"options"`
+	SnapRevisions   map[string]string      `json:"snap-revisions"`
+	Files           map[string]string      `json:"files"`
+}
+
+// shouldSkipUnchangedBuild returns whether the build can be skipped when its inputs did
+// not change since the last build. Partial and resumed runs always run their states, and
+// an image definition read from stdin can only be parsed once
+func (classicStateMachine *ClassicStateMachine) shouldSkipUnchangedBuild() bool {
+	flags := classicStateMachine.stateMachineFlags
+	imageDefinition := classicStateMachine.Args.ImageDefinition
+	return imageDefinition != "" && imageDefinition != "-" &&
+		!classicStateMachine.Opts.Force && !flags.Resume && flags.ResumeFrom == "" &&
+		flags.Until == "" && flags.Thru == "" && !flags.ValidateOnly && !flags.DryRun &&
+		!flags.ListStates && !flags.ListSnapsResolved && !flags.PrintConfig &&
+		classicStateMachine.commonFlags.OutputDevice == ""
+}
+
+// buildHashFile returns the path of the file recording the hash of the last build
+func (stateMachine *StateMachine) buildHashFile(imageName string) string {
+	return filepath.Join(stateMachine.outputDirectory(), imageName+buildHashSuffix)
+}
+
+// buildHash returns the hash of the inputs of the build, calculating it the first
+// time. The hash is kept when resuming, so that the recorded hash matches the inputs
+// of the first run
+func (classicStateMachine *ClassicStateMachine) buildHash() (string, error) {
+	if classicStateMachine.BuildHash == "" {
+		buildHash, err := classicStateMachine.calculateBuildHash()
+		if err != nil {
+			return "", err
+		}
+		classicStateMachine.BuildHash = buildHash
+	}
+	return classicStateMachine.BuildHash, nil
+}
+
+// calculateBuildHash calculates the hash of the inputs of a classic build: the image
+// definition as it was parsed, the options changing the resulting image, the revisions
+// of the snaps the store serves and the content of the local files and directories
+// the image is built from
+func (classicStateMachine *ClassicStateMachine) calculateBuildHash() (string, error) {
+	inputs := buildInputs{
+		ImageDefinition: classicStateMachine.ImageDef,
+		Options:         classicStateMachine.buildOptions(),
+		SnapRevisions:   make(map[string]string),
+		Files:           make(map[string]string),
+	}
+
+	resolvedSnaps, err := classicStateMachine.resolveSnaps()
+	if err != nil {
+		return "", err
+	}
+	for _, resolved := range resolvedSnaps {
+		inputs.SnapRevisions[resolved.name] = resolved.info.Revision.String()
+	}
+
+	for _, inputPath := range classicStateMachine.localBuildInputs() {
+		inputHash, err := hashBuildInput(inputPath)
+		if err != nil {
+			return "", err
+		}
+		inputs.Files[inputPath] = inputHash
+	}
+
+	inputsJSON, err := json.Marshal(inputs)
+	if err != nil {
+		return "", fmt.Errorf("Error encoding the build inputs: %s", err.Error())
+	}
+	inputsHash := sha256.Sum256(inputsJSON)
+	return hex.EncodeToString(inputsHash[:]), nil
+}
+
+// buildOptions returns the options the resulting image depends on, by their flag. The
+// other options only change how the build is run and reported, so a new option is
+// only part of the build hash once it is added here
+func (classicStateMachine *ClassicStateMachine) buildOptions() map[string]interface{} {
+	commonFlags := classicStateMachine.commonFlags
+	opts := classicStateMachine.Opts
+	return map[string]interface{}{
+		"image-size":                commonFlags.Size,
+		"disk-info":                 commonFlags.DiskInfo,
+		"channel":                   commonFlags.Channel,
+		"force-channel":             commonFlags.ForceChannel,
+		"sector-size":               commonFlags.SectorSize,
+		"deterministic-uuid":        commonFlags.DeterministicUUID,
+		"hybrid-mbr":                commonFlags.HybridMBR,
+		"no-sparse":                 commonFlags.NoSparse,
+		"validation":                commonFlags.Validation,
+		"snap-dir":                  commonFlags.SnapDir,
+		"snap-snapshot":             commonFlags.SnapSnapshot,
+		"offline":                   commonFlags.Offline,
+		"allow-base-mismatch":       commonFlags.AllowBaseMismatch,
+		"manifest":                  commonFlags.Manifest,
+		"manifest-path":             commonFlags.ManifestPath,
+		"checksum":                  commonFlags.Checksum,
+		"compress":                  commonFlags.Compress,
+		"compress-threads":          commonFlags.CompressThreads,
+		"sign-key":                  commonFlags.SignKey,
+		"measure":                   commonFlags.Measure,
+		"verify-fs":                 commonFlags.VerifyFS,
+		"apt-params":                opts.AptParams,
+		"format":                    opts.Format,
+		"arch":                      opts.Arch,
+		"series":                    opts.Series,
+		"rootfs-tarball":            opts.RootfsTarball,
+		"bootloader":                opts.Bootloader,
+		"sbom":                      opts.SBOM,
+		"comp":                      opts.Comp,
+		"cloud-init-user-data":      opts.CloudInitUserData,
+		"cloud-init-meta-data":      opts.CloudInitMetaData,
+		"cloud-init-network-config": opts.CloudInitNetworkConfig,
+		"cloud-init-seed-partition": opts.CloudInitSeedPartition,
+		"extra-package":             opts.ExtraPackages,
+		"extra-ppa":                 opts.ExtraPPAs,
+		"no-install-recommends":     opts.NoInstallRecommends,
+		"no-install-suggests":       opts.NoInstallSuggests,
+		"no-auto-deps":              opts.NoAutoDeps,
+		"unprivileged":              opts.Unprivileged,
+		"no-loop":                   opts.NoLoop,
+		"no-env-expand":             opts.NoEnvExpand,
+		"extract-kernel":            opts.ExtractKernel,
+		"rootfs-only":               opts.RootfsOnly,
+	}
+}
+
+// localBuildInputs returns the local files and directories referenced by the image
+// definition and the command line that the content of the image depends on
+func (classicStateMachine *ClassicStateMachine) localBuildInputs() []string {
+	var inputs []string
+	addInput := func(location string) {
+		if location != "" && !isRemoteURL(location) {
+			inputs = append(inputs, strings.TrimPrefix(location, "file://"))
+		}
+	}
+	imageDef := classicStateMachine.ImageDef
+	if imageDef.Gadget != nil && imageDef.Gadget.GadgetType != "git" {
+		addInput(imageDef.Gadget.GadgetURL)
+	}
+	addInput(imageDef.ModelAssertion)
+	if imageDef.Recovery != nil {
+		addInput(imageDef.Recovery.ModelAssertion)
+	}
+	if imageDef.Rootfs != nil && imageDef.Rootfs.Tarball != nil {
+		addInput(imageDef.Rootfs.Tarball.TarballURL)
+	}
+	if imageDef.Customization != nil {
+		if imageDef.Customization.Manual != nil {
+			for _, copyFile := range imageDef.Customization.Manual.CopyFile {
+				sources, _ := filepath.Glob(copyFile.Source)
+				for _, source := range sources {
+					addInput(source)
+				}
+			}
+		}
+		for _, overlay := range imageDef.Customization.Overlays {
+			addInput(overlay.Source)
+		}
+		for _, encrypted := range imageDef.Customization.EncryptedPartitions {
+			addInput(encrypted.KeyFile)
+		}
+	}
+	addInput(classicStateMachine.commonFlags.DiskInfo)
+	addInput(classicStateMachine.commonFlags.SnapDir)
+	addInput(classicStateMachine.commonFlags.SnapSnapshot)
+	addInput(classicStateMachine.Opts.CloudInitUserData)
+	addInput(classicStateMachine.Opts.CloudInitMetaData)
+	addInput(classicStateMachine.Opts.CloudInitNetworkConfig)
+	return inputs
+}
+
+// hashBuildInput returns the hash of a file, or of all the files in a directory
+// along with their names. Inputs that do not exist are hashed as missing
+func hashBuildInput(inputPath string) (string, error) {
+	if _, err := os.Lstat(inputPath); os.IsNotExist(err) {
+		return "missing", nil
+	}
+	hasher := sha256.New()
+	err := filepath.WalkDir(inputPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relativePath, _ := filepath.Rel(inputPath, path)
+		switch {
+		case entry.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(hasher, "link %s %s\n", relativePath, target)
+		case entry.Type().IsRegular():
+			fileHash, err := helper.CalculateSHA256(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(hasher, "file %s %s\n", relativePath, fileHash)
+		case entry.IsDir():
+			fmt.Fprintf(hasher, "dir %s\n", relativePath)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("Error calculating the hash of build input \"%s\": %s",
+			inputPath, err.Error())
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// isBuildUpToDate returns whether the last build recorded in the output directory
+// had the same hash, and all the files it created still exist. The hash is only
+// calculated when there is such a build, since it asks the store for the snaps
+func (classicStateMachine *ClassicStateMachine) isBuildUpToDate() (bool, error) {
+	recordBytes, err := osReadFile(classicStateMachine.buildHashFile(
+		classicStateMachine.ImageDef.ImageName))
+	if err != nil {
+		return false, nil
+	}
+	var record buildRecord
+	if err := json.Unmarshal(recordBytes, &record); err != nil || len(record.Files) == 0 {
+		return false, nil
+	}
+	for _, file := range record.Files {
+		if _, err := os.Stat(file); err != nil {
+			return false, nil
+		}
+	}
+	buildHash, err := classicStateMachine.buildHash()
+	if err != nil {
+		return false, err
+	}
+	return record.Hash == buildHash, nil
+}
+
+// recordBuildHash writes the hash of the build inputs along with the files
+// that were created to the output directory, so that the next build with the
+// same inputs can be skipped
+func (stateMachine *StateMachine) recordBuildHash() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	buildHash, err := classicStateMachine.buildHash()
+	if err != nil {
+		return err
+	}
+	record := buildRecord{
+		Hash:  buildHash,
+		Files: append(append([]string{}, stateMachine.ImageFiles...), stateMachine.Artifacts...),
+	}
+	recordBytes, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error encoding the build hash: %s", err.Error())
+	}
+	hashFile := stateMachine.buildHashFile(classicStateMachine.ImageDef.ImageName)
+	if err := osWriteFile(hashFile, append(recordBytes, '\n'), 0644); err != nil {
+		return fmt.Errorf("Error writing the build hash: %s", err.Error())
+	}
+	return nil
+}
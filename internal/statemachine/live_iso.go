@@ -0,0 +1,198 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// liveIsoFormat is the value of --format making a live ISO instead of disk images
+const liveIsoFormat = "iso"
+
+// liveIsoVolumeIDLength is the maximum length of the volume ID of an ISO9660 image
+const liveIsoVolumeIDLength = 32
+
+// liveIsoGrubPlatforms are the grub platforms the live ISOs of each architecture
+// boot with, through El Torito for BIOS and an EFI system partition for UEFI
+var liveIsoGrubPlatforms = map[string][]string{
+	"amd64": {"i386-pc", "x86_64-efi"},
+	"arm64": {"arm64-efi"},
+}
+
+// grubPlatformPackages are the packages installing the grub images of each platform
+var grubPlatformPackages = map[string]string{
+	"i386-pc":    "grub-pc-bin",
+	"x86_64-efi": "grub-efi-amd64-bin",
+	"arm64-efi":  "grub-efi-arm64-bin",
+}
+
+// validateLiveIso makes sure that the image definition and the options can be
+// built as a live ISO, which boots the rootfs from a squashfs instead of partitions
+func (classicStateMachine *ClassicStateMachine) validateLiveIso() error {
+	imageDef := classicStateMachine.ImageDef
+	opts := classicStateMachine.Opts
+	switch {
+	case opts.RootfsOnly != "":
+		return fmt.Errorf("--format iso can not be used with --rootfs-only")
+	case opts.CloudInitSeedPartition != "":
+		return fmt.Errorf("--cloud-init-seed-partition can not be used with --format iso, " +
+			"which makes no partitions")
+	case classicStateMachine.commonFlags.OutputDevice != "":
+		return fmt.Errorf("--output-device can not be used with --format iso, which makes no disk image")
+	case opts.Bootloader != "":
+		return fmt.Errorf("--bootloader can not be used with --format iso, which always boots with grub")
+	case liveIsoGrubPlatforms[imageDef.Architecture] == nil:
+		return fmt.Errorf("--format iso is only supported for amd64 and arm64 images, not %s",
+			imageDef.Architecture)
+	case imageDef.Artifacts.Img == nil || len(*imageDef.Artifacts.Img) != 1:
+		return fmt.Errorf("--format iso makes a single live ISO named after the img artifact, " +
+			"so the image definition must have exactly one img artifact")
+	case imageDef.Artifacts.Qcow2 != nil:
+		return fmt.Errorf("qcow2 artifacts can not be made with --format iso, which makes no disk image")
+	case imageDef.Recovery != nil:
+		return fmt.Errorf("recovery can not be used with --format iso, which makes no partitions")
+	case imageDef.Customization != nil && imageDef.Customization.GenerateFstab:
+		return fmt.Errorf("generate-fstab can not be used with --format iso, which makes no partitions")
+	}
+	return nil
+}
+
+// checkIsoTools makes sure that the tools making the live ISO are installed on the
+// host, along with the grub images of the platforms the ISO boots on, so that the
+// build does not fail once the rootfs is built
+func (stateMachine *StateMachine) checkIsoTools() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	tools := [][2]string{
+		{"grub-mkrescue", "grub-common"},
+		{"xorriso", "xorriso"},
+		{"mformat", "mtools"},
+	}
+	for _, tool := range tools {
+		if _, err := execLookPath(tool[0]); err != nil {
+			return fmt.Errorf("Cannot create the live ISO: %s was not found. Install %s to create it",
+				tool[0], tool[1])
+		}
+	}
+	for _, platform := range liveIsoGrubPlatforms[classicStateMachine.ImageDef.Architecture] {
+		if _, err := os.Stat(filepath.Join(grubLibDir, platform)); err != nil {
+			return fmt.Errorf("Cannot create the live ISO: the grub images for %s were not "+
+				"found in %s. Install %s to create it", platform, grubLibDir,
+				grubPlatformPackages[platform])
+		}
+	}
+	return nil
+}
+
+// liveIsoName returns the path of the live ISO, named after the img artifact
+func (stateMachine *StateMachine) liveIsoName() string {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	imgName := (*classicStateMachine.ImageDef.Artifacts.Img)[0].ImgName
+	return filepath.Join(stateMachine.commonFlags.OutputDir,
+		strings.TrimSuffix(imgName, filepath.Ext(imgName))+".iso")
+}
+
+// liveIsoVolumeID returns the volume ID of the live ISO, made from the name of
+// the image with the characters ISO9660 allows in it
+func liveIsoVolumeID(imageName string) string {
+	volumeID := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		}
+		return '_'
+	}, imageName)
+	if len(volumeID) > liveIsoVolumeIDLength {
+		volumeID = volumeID[:liveIsoVolumeIDLength]
+	}
+	return volumeID
+}
+
+// liveIsoGrubConfig returns the grub.cfg of the live ISO, booting the kernel of
+// the rootfs with casper, which mounts the squashfs of the rootfs as /
+func liveIsoGrubConfig(displayName, kernelCmdline string) string {
+	cmdline := "boot=casper"
+	if kernelCmdline != "" {
+		cmdline += " " + kernelCmdline
+	}
+	return fmt.Sprintf("set timeout=5\n\nmenuentry \"%s\" {\n"+
+		"\tlinux /casper/vmlinuz %s ---\n"+
+		"\tinitrd /casper/initrd\n}\n",
+		strings.ReplaceAll(displayName, "\"", "\\\""), cmdline)
+}
+
+// makeLiveIso makes a bootable live ISO from the rootfs: the rootfs is packed in a
+// squashfs that casper mounts at boot, next to the kernel and initrd of the rootfs,
+// and grub-mkrescue makes the ISO9660 image booting them with El Torito on BIOS
+// and an EFI system partition on UEFI
+func (stateMachine *StateMachine) makeLiveIso() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	rootfs := stateMachine.tempDirs.rootfs
+	if _, err := os.Stat(filepath.Join(rootfs, "usr", "share", "initramfs-tools",
+		"scripts", "casper")); err != nil {
+		return fmt.Errorf("Error creating the live ISO: the rootfs can not boot from it " +
+			"without casper. Add casper to the extra-packages of the image definition")
+	}
+
+	// the content of the ISO, with the squashfs of the rootfs, is staged in --tmp-dir
+	isoDir := filepath.Join(stateMachine.tempDir(stateMachine.tempDirs.scratch), "iso")
+	if err := osRemoveAll(isoDir); err != nil {
+		return fmt.Errorf("Error removing the previous content of the live ISO: %s", err.Error())
+	}
+	for _, dir := range []string{"casper", filepath.Join("boot", "grub")} {
+		if err := osMkdirAll(filepath.Join(isoDir, dir), 0755); err != nil {
+			return fmt.Errorf("Error creating the content directory of the live ISO: %s", err.Error())
+		}
+	}
+
+	bootFiles := [][2]string{{"vmlinuz", "vmlinuz"}, {"initrd.img", "initrd"}}
+	for _, bootFile := range bootFiles {
+		source, err := rootfsBootFile(rootfs, bootFile[0])
+		if err != nil {
+			return fmt.Errorf("Error creating the live ISO: %s", err.Error())
+		}
+		if err := osutilCopySpecialFile(source, filepath.Join(isoDir, "casper", bootFile[1])); err != nil {
+			return fmt.Errorf("Error copying /boot/%s to the live ISO: %s", bootFile[0], err.Error())
+		}
+	}
+
+	grubConfig := liveIsoGrubConfig(classicStateMachine.ImageDef.DisplayName,
+		classicStateMachine.ImageDef.KernelCmdline)
+	if err := osWriteFile(filepath.Join(isoDir, "boot", "grub", "grub.cfg"),
+		[]byte(grubConfig), 0644); err != nil {
+		return fmt.Errorf("Error writing the grub configuration of the live ISO: %s", err.Error())
+	}
+
+	if err := stateMachine.packRootfsSquashfs(
+		filepath.Join(isoDir, "casper", "filesystem.squashfs")); err != nil {
+		return err
+	}
+
+	// grub-mkrescue uses the images of all the platforms installed on the host,
+	// unless it is pointed at the only one the ISO has to boot on
+	isoFile := stateMachine.liveIsoName()
+	mkrescueArgs := []string{"--output=" + isoFile}
+	if platforms := liveIsoGrubPlatforms[classicStateMachine.ImageDef.Architecture]; len(platforms) == 1 {
+		mkrescueArgs = append(mkrescueArgs, "--directory="+filepath.Join(grubLibDir, platforms[0]))
+	}
+	mkrescueArgs = append(mkrescueArgs, isoDir, "--", "-volid",
+		liveIsoVolumeID(classicStateMachine.ImageDef.ImageName))
+	mkrescueCmd := execCommand("grub-mkrescue", mkrescueArgs...)
+	mkrescueOutput := helper.SetCommandOutput(mkrescueCmd, classicStateMachine.commonFlags.Debug)
+	if err := runCommand(stateMachine.context(), mkrescueCmd); err != nil {
+		return fmt.Errorf("Error running command \"%s\". Error is \"%s\". Output is: \n%s",
+			mkrescueCmd.String(), err.Error(), mkrescueOutput.String())
+	}
+	stateMachine.addImageFile(isoFile)
+	return nil
+}
@@ -0,0 +1,207 @@
+package statemachine
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+	"github.com/snapcore/snapd/gadget"
+	"github.com/snapcore/snapd/gadget/quantity"
+)
+
+// luksHeaderSize is the space reserved for the LUKS2 header at the start of
+// encrypted partitions, before their filesystem
+const luksHeaderSize = 16 * quantity.SizeMiB
+
+// luksKeySize is the size in bytes of the keys generated for encrypted partitions
+const luksKeySize = 64
+
+// structurePartitionName returns the name of the partition of a structure
+func structurePartitionName(structure gadget.VolumeStructure) string {
+	if structure.Role == gadget.SystemData && structure.Name == "" {
+		return "writable"
+	}
+	return structure.Name
+}
+
+// partitionEncryption returns how a structure of gadget.yaml is encrypted, as
+// set in the image definition of classic images, or nil if it isn't encrypted
+func (stateMachine *StateMachine) partitionEncryption(structure gadget.VolumeStructure) *imagedefinition.EncryptedPartition {
+	classicStateMachine, ok := stateMachine.parent.(*ClassicStateMachine)
+	if !ok || classicStateMachine.ImageDef.Customization == nil {
+		return nil
+	}
+	for _, encrypted := range classicStateMachine.ImageDef.Customization.EncryptedPartitions {
+		if encrypted.PartitionName == structurePartitionName(structure) {
+			return encrypted
+		}
+	}
+	return nil
+}
+
+// validateEncryptedPartitions makes sure that the encrypted partitions of the
+// image definition are partitions of gadget.yaml with a filesystem
+func (stateMachine *StateMachine) validateEncryptedPartitions() error {
+	classicStateMachine, ok := stateMachine.parent.(*ClassicStateMachine)
+	if !ok || classicStateMachine.ImageDef.Customization == nil {
+		return nil
+	}
+	for _, encrypted := range classicStateMachine.ImageDef.Customization.EncryptedPartitions {
+		found := false
+		for _, volume := range stateMachine.GadgetInfo.Volumes {
+			for _, structure := range volume.Structure {
+				if structurePartitionName(structure) != encrypted.PartitionName {
+					continue
+				}
+				if structure.Filesystem == "" {
+					return fmt.Errorf("Encrypted partition \"%s\" has no filesystem",
+						encrypted.PartitionName)
+				}
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("Encrypted partition \"%s\" is not a partition of gadget.yaml",
+				encrypted.PartitionName)
+		}
+	}
+	return nil
+}
+
+// luksKeyFile returns the key file of an encrypted partition. When the image
+// definition doesn't give one, a random key is generated next to the disk images
+func (stateMachine *StateMachine) luksKeyFile(volumeName string,
+	encrypted *imagedefinition.EncryptedPartition) (string, error) {
+	if encrypted.KeyFile != "" {
+		return encrypted.KeyFile, nil
+	}
+	key := make([]byte, luksKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("Error generating LUKS key: %s", err.Error())
+	}
+	keyFile := filepath.Join(stateMachine.commonFlags.OutputDir,
+		volumeName+"-"+encrypted.PartitionName+".key")
+	if err := osWriteFile(keyFile, key, 0600); err != nil {
+		return "", fmt.Errorf("Error writing LUKS key: %s", err.Error())
+	}
+	stateMachine.addArtifact(keyFile)
+	return keyFile, nil
+}
+
+// runEncryptionCommand runs one of the commands setting up the devices of encrypted
+// partitions, and returns its output
+func runEncryptionCommand(ctx context.Context, name string, args ...string) (string, error) {
+	cmd := execCommand(name, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := runCommand(ctx, cmd); err != nil {
+		return "", fmt.Errorf("Error running command \"%s\". Error is \"%s\". Output is: \n%s",
+			cmd.String(), err.Error(), stderr.String())
+	}
+	return stdout.String(), nil
+}
+
+// encryptPartitions formats the encrypted partitions of a disk image with LUKS,
+// and copies their filesystem to them through the mapped device
+func (stateMachine *StateMachine) encryptPartitions(volumeName string, volume *gadget.Volume,
+	imgName string) error {
+	for structureNumber, structure := range volume.Structure {
+		encrypted := stateMachine.partitionEncryption(structure)
+		if encrypted == nil || shouldSkipStructure(structure, stateMachine.IsSeeded) {
+			continue
+		}
+		if classicStateMachine, ok := stateMachine.parent.(*ClassicStateMachine); ok &&
+			classicStateMachine.noLoop() {
+			return fmt.Errorf("Structure \"%s\" of volume \"%s\" can not be encrypted without "+
+				"loop devices, since a loop device and device-mapper are needed to encrypt it",
+				structure.Name, volumeName)
+		}
+		keyFile, err := stateMachine.luksKeyFile(volumeName, encrypted)
+		if err != nil {
+			return err
+		}
+		partImg := filepath.Join(stateMachine.tempDirs.volumes, volumeName,
+			"part"+strconv.Itoa(structureNumber)+".img")
+		mapperName := fmt.Sprintf("ubuntu-image-%d-%s-%d", os.Getpid(), volumeName, structureNumber)
+		if err := stateMachine.encryptPartition(structure, keyFile, partImg,
+			imgName, mapperName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encryptPartition sets up a loop device for a partition of the disk image,
+// formats it with LUKS and copies the filesystem of partImg to the mapped device.
+// The devices are always closed before returning
+func (stateMachine *StateMachine) encryptPartition(structure gadget.VolumeStructure,
+	keyFile, partImg, imgName, mapperName string) (err error) {
+	defer func() {
+		if closeErr := stateMachine.closeEncryptedDevices(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	ctx := stateMachine.context()
+	loopDevice, err := runEncryptionCommand(ctx, "losetup", "--find", "--show",
+		"--offset", strconv.FormatUint(uint64(getStructureOffset(structure)), 10),
+		"--sizelimit", strconv.FormatUint(uint64(structure.Size), 10), imgName)
+	if err != nil {
+		return err
+	}
+	loopDevice = strings.TrimSpace(loopDevice)
+	stateMachine.loopDevices = append(stateMachine.loopDevices, loopDevice)
+
+	// the data offset is given in 512 byte sectors, whatever the sector size
+	if _, err := runEncryptionCommand(ctx, "cryptsetup", "luksFormat", "--batch-mode",
+		"--type", "luks2", "--offset", strconv.FormatUint(uint64(luksHeaderSize/512), 10),
+		"--key-file", keyFile, loopDevice); err != nil {
+		return err
+	}
+	if _, err := runEncryptionCommand(ctx, "cryptsetup", "open", "--key-file", keyFile,
+		loopDevice, mapperName); err != nil {
+		return err
+	}
+	stateMachine.luksMappings = append(stateMachine.luksMappings, mapperName)
+
+	fsSize := structure.Size - luksHeaderSize
+	ddArgs := []string{
+		"if=" + partImg,
+		"of=" + filepath.Join("/dev/mapper", mapperName),
+		"bs=" + strconv.FormatUint(uint64(stateMachine.SectorSize), 10),
+		"count=" + strconv.FormatUint(uint64(fsSize/stateMachine.SectorSize), 10),
+		"conv=fsync",
+	}
+	if err := helperCopyBlob(stateMachine.commandRunner(), ddArgs); err != nil {
+		return fmt.Errorf("Error writing encrypted partition: %s", err.Error())
+	}
+	return nil
+}
+
+// closeEncryptedDevices closes the LUKS mappings and loop devices that are still
+// open, even if the build was cancelled
+func (stateMachine *StateMachine) closeEncryptedDevices() error {
+	var err error
+	for i := len(stateMachine.luksMappings) - 1; i >= 0; i-- {
+		if _, closeErr := runEncryptionCommand(context.Background(), "cryptsetup", "close",
+			stateMachine.luksMappings[i]); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	stateMachine.luksMappings = nil
+	for i := len(stateMachine.loopDevices) - 1; i >= 0; i-- {
+		if _, detachErr := runEncryptionCommand(context.Background(), "losetup", "--detach",
+			stateMachine.loopDevices[i]); detachErr != nil && err == nil {
+			err = detachErr
+		}
+	}
+	stateMachine.loopDevices = nil
+	return err
+}
@@ -0,0 +1,184 @@
+package statemachine
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// manualStep is one manual customization of the image definition, run by the
+// handler of its kind. Steps with a name can be referenced by the after list of
+// other steps, which are then run once all of the steps they reference are done
+type manualStep struct {
+	kind        string
+	index       int
+	name        string
+	after       []string
+	inputData   interface{}
+	handlerFunc func(context.Context, interface{}, string, bool) error
+}
+
+// description returns how a step is referred to in errors
+func (step *manualStep) description() string {
+	if step.name != "" {
+		return fmt.Sprintf("\"%s\"", step.name)
+	}
+	return fmt.Sprintf("customization:manual:%s:%d", step.kind, step.index)
+}
+
+// manualSteps returns the manual customizations in the order they run by default:
+// all the copy-file ones first, then execute, touch-file, add-group and add-user,
+// each of them in the order they are listed
+func manualSteps(manual *imagedefinition.Manual) []*manualStep {
+	var steps []*manualStep
+	if manual == nil {
+		return steps
+	}
+	for _, customization := range []struct {
+		kind        string
+		inputData   interface{}
+		handlerFunc func(context.Context, interface{}, string, bool) error
+	}{
+		{"copy-file", manual.CopyFile, manualCopyFile},
+		{"execute", manual.Execute, manualExecute},
+		{"touch-file", manual.TouchFile, manualTouchFile},
+		{"add-group", manual.AddGroup, manualAddGroup},
+		{"add-user", manual.AddUser, manualAddUser},
+	} {
+		customizationSlice := reflect.ValueOf(customization.inputData)
+		for i := 0; i < customizationSlice.Len(); i++ {
+			// every kind of customization has the same step and after fields
+			customizationValue := customizationSlice.Index(i)
+			step := &manualStep{
+				kind:        customization.kind,
+				index:       i,
+				name:        customizationValue.Elem().FieldByName("StepName").String(),
+				after:       customizationValue.Elem().FieldByName("After").Interface().([]string),
+				inputData:   reflect.Append(reflect.MakeSlice(customizationSlice.Type(), 0, 1), customizationValue).Interface(),
+				handlerFunc: customization.handlerFunc,
+			}
+			steps = append(steps, step)
+		}
+	}
+	return steps
+}
+
+// isCustomizationKey reports whether name is the key of a customization of the image
+// definition, like extra-ppas or extra-packages. These are run by their own states,
+// in a fixed order, so the manual customizations can't be ordered relative to them
+func isCustomizationKey(name string) bool {
+	customizationType := reflect.TypeOf(imagedefinition.Customization{})
+	for i := 0; i < customizationType.NumField(); i++ {
+		if strings.Split(customizationType.Field(i).Tag.Get("yaml"), ",")[0] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// orderManualSteps orders the manual customizations so that each of them runs
+// after the steps of its after list. The default order is kept for the steps that
+// are not constrained, so that image definitions without any after list are
+// customized like before. Unknown or duplicated step names and cycles are errors,
+// as are references to the other customizations, which run in a fixed order
+func orderManualSteps(manual *imagedefinition.Manual) ([]*manualStep, error) {
+	steps := manualSteps(manual)
+
+	stepsByName := make(map[string]*manualStep)
+	for _, step := range steps {
+		if step.name == "" {
+			continue
+		}
+		if previous, found := stepsByName[step.name]; found {
+			return nil, fmt.Errorf("customization:manual:%s:%d and customization:manual:%s:%d "+
+				"have the same step name \"%s\"", previous.kind, previous.index,
+				step.kind, step.index, step.name)
+		}
+		stepsByName[step.name] = step
+	}
+
+	// count the steps each step waits for, and which steps wait for it
+	waitingFor := make(map[*manualStep]int)
+	waitedBy := make(map[*manualStep][]*manualStep)
+	for _, step := range steps {
+		for _, name := range step.after {
+			previous, found := stepsByName[name]
+			if !found && isCustomizationKey(name) {
+				return nil, fmt.Errorf("%s is ordered after \"%s\", but only the manual "+
+					"customizations can be ordered. The other customizations run in a fixed "+
+					"order: the extra PPAs and sources are added before the extra "+
+					"packages are installed, and the packages before the extra snaps",
+					step.description(), name)
+			}
+			if !found {
+				return nil, fmt.Errorf("%s is ordered after the step \"%s\", but no manual "+
+					"customization has this step name", step.description(), name)
+			}
+			if previous == step {
+				return nil, fmt.Errorf("%s can not be ordered after itself", step.description())
+			}
+			waitingFor[step]++
+			waitedBy[previous] = append(waitedBy[previous], step)
+		}
+	}
+
+	// always run the first step of the default order that is ready, so that the
+	// order is the same from one build to the next
+	position := make(map[*manualStep]int)
+	var ready []*manualStep
+	for i, step := range steps {
+		position[step] = i
+		if waitingFor[step] == 0 {
+			ready = append(ready, step)
+		}
+	}
+	ordered := make([]*manualStep, 0, len(steps))
+	for len(ready) > 0 {
+		step := ready[0]
+		ready = ready[1:]
+		ordered = append(ordered, step)
+		for _, next := range waitedBy[step] {
+			waitingFor[next]--
+			if waitingFor[next] == 0 {
+				ready = append(ready, next)
+			}
+		}
+		sort.SliceStable(ready, func(i, j int) bool {
+			return position[ready[i]] < position[ready[j]]
+		})
+	}
+
+	if len(ordered) < len(steps) {
+		var cycle []string
+		for _, step := range steps {
+			if waitingFor[step] > 0 {
+				cycle = append(cycle, step.description())
+			}
+		}
+		return nil, fmt.Errorf("the manual customizations can not be ordered, because of a "+
+			"cycle in the after lists of these steps: %s", strings.Join(cycle, ", "))
+	}
+	return ordered, nil
+}
+
+// groupManualSteps merges the consecutive steps of the same kind, so that their
+// handler runs once for all of them, like when they were not ordered. The scripts
+// of execute are then all run with /dev, /proc and /sys mounted once
+func groupManualSteps(steps []*manualStep) []*manualStep {
+	var grouped []*manualStep
+	for _, step := range steps {
+		if len(grouped) > 0 && grouped[len(grouped)-1].kind == step.kind {
+			last := grouped[len(grouped)-1]
+			last.inputData = reflect.AppendSlice(reflect.ValueOf(last.inputData),
+				reflect.ValueOf(step.inputData)).Interface()
+			continue
+		}
+		groupedStep := *step
+		grouped = append(grouped, &groupedStep)
+	}
+	return grouped
+}
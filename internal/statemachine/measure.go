@@ -0,0 +1,263 @@
+package statemachine
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	efi "github.com/canonical/go-efilib"
+	"github.com/snapcore/snapd/snap"
+	"github.com/snapcore/snapd/snap/snapfile"
+)
+
+// measuredBootPCR is the PCR the firmware measures the EFI applications it loads to
+const measuredBootPCR = 4
+
+// efiBootOptionAction is the event the firmware measures before the first EFI
+// application of a boot option is loaded
+const efiBootOptionAction = "Calling EFI Application from Boot Option"
+
+// pcrEvent is an event measured to a PCR, as it appears in the TCG event log
+type pcrEvent struct {
+	Type        string `json:"type"`
+	Description string `json:"description"`
+	Digest      string `json:"digest"`
+}
+
+// pcrPrediction is the value a PCR is expected to have once the events were measured
+type pcrPrediction struct {
+	PCR    int        `json:"pcr"`
+	Value  string     `json:"value"`
+	Events []pcrEvent `json:"events"`
+}
+
+// bootMeasurements are the PCR values predicted for the boot of an image, written
+// to the file of --measure
+type bootMeasurements struct {
+	Algorithm string          `json:"algorithm"`
+	PCRs      []pcrPrediction `json:"pcrs"`
+}
+
+// extend measures an event to the PCR, like the TPM does
+func (prediction *pcrPrediction) extend(eventType, description string, digest []byte) {
+	value, _ := hex.DecodeString(prediction.Value)
+	extended := sha256.Sum256(append(value, digest...))
+	prediction.Value = hex.EncodeToString(extended[:])
+	prediction.Events = append(prediction.Events, pcrEvent{
+		Type:        eventType,
+		Description: description,
+		Digest:      hex.EncodeToString(digest),
+	})
+}
+
+// findFileFold returns the path of a file below dir, matching the components of
+// its relative path without case like the FAT filesystem of the ESP does, or an
+// empty string if there is no such file
+func findFileFold(dir, relativePath string) string {
+	path := dir
+	for _, component := range strings.Split(relativePath, "/") {
+		entries, err := osReadDir(path)
+		if err != nil {
+			return ""
+		}
+		found := ""
+		for _, entry := range entries {
+			if strings.EqualFold(entry.Name(), component) {
+				found = entry.Name()
+				break
+			}
+		}
+		if found == "" {
+			return ""
+		}
+		path = filepath.Join(path, found)
+	}
+	return path
+}
+
+// measuredApplication is an EFI application measured when the image boots, with
+// the path it has in the image
+type measuredApplication struct {
+	path        string
+	description string
+}
+
+// efiBootApplications returns the EFI applications found in the removable media
+// boot path of the ESP, which the firmware of a new machine boots: the boot
+// application and, if it is shim, the grub it loads from the same directory
+func efiBootApplications(espDir string) []measuredApplication {
+	bootDir := findFileFold(espDir, "EFI/BOOT")
+	if bootDir == "" {
+		return nil
+	}
+	entries, err := osReadDir(bootDir)
+	if err != nil {
+		return nil
+	}
+	for _, entry := range entries {
+		name := strings.ToLower(entry.Name())
+		if !strings.HasPrefix(name, "boot") || !strings.HasSuffix(name, ".efi") {
+			continue
+		}
+		paths := []string{filepath.Join(bootDir, entry.Name())}
+		// the architecture suffix, like x64 in bootx64.efi, is the one of grub too
+		suffix := strings.TrimSuffix(strings.TrimPrefix(name, "boot"), ".efi")
+		if grub := findFileFold(bootDir, "grub"+suffix+".efi"); grub != "" {
+			paths = append(paths, grub)
+		}
+		var applications []measuredApplication
+		for _, path := range paths {
+			relativePath, _ := filepath.Rel(espDir, path)
+			applications = append(applications, measuredApplication{path, "/" + relativePath})
+		}
+		return applications
+	}
+	return nil
+}
+
+// peImageDigest returns the Authenticode digest of an EFI application, which is
+// what the firmware measures, leaving out its signatures
+func peImageDigest(path string) ([]byte, error) {
+	image, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening EFI application \"%s\": %s", path, err.Error())
+	}
+	defer image.Close()
+	imageInfo, err := image.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading EFI application \"%s\": %s", path, err.Error())
+	}
+	digest, err := efi.ComputePeImageDigest(crypto.SHA256, image, imageInfo.Size())
+	if err != nil {
+		return nil, fmt.Errorf("Error computing the digest of EFI application \"%s\": %s",
+			path, err.Error())
+	}
+	return digest, nil
+}
+
+// measuredKernel returns the path of the kernel the bootloader loads as an EFI
+// application. Classic images boot /boot/vmlinuz of the rootfs, and Ubuntu Core
+// images the kernel.efi of the kernel snap, which is extracted to scratchDir. No
+// kernel is returned when it is not an EFI application
+func (stateMachine *StateMachine) measuredKernel(scratchDir string) (*measuredApplication, error) {
+	if _, isClassic := stateMachine.parent.(*ClassicStateMachine); isClassic {
+		kernel := filepath.Join(stateMachine.tempDirs.rootfs, "boot", "vmlinuz")
+		// the link is relative to the rootfs, not to the host
+		if target, err := os.Readlink(kernel); err == nil {
+			if filepath.IsAbs(target) {
+				kernel = filepath.Join(stateMachine.tempDirs.rootfs, target)
+			} else {
+				kernel = filepath.Join(filepath.Dir(kernel), target)
+			}
+		}
+		if _, err := os.Stat(kernel); err != nil {
+			return nil, nil
+		}
+		relativePath, _ := filepath.Rel(stateMachine.tempDirs.rootfs, kernel)
+		return &measuredApplication{kernel, "/" + relativePath}, nil
+	}
+
+	seedSnaps, err := readSeedSnaps(stateMachine.tempDirs.rootfs)
+	if err != nil {
+		return nil, err
+	}
+	for _, seedSnap := range seedSnaps {
+		if seedSnap.EssentialType != snap.TypeKernel {
+			continue
+		}
+		container, err := snapfile.Open(seedSnap.Path)
+		if err != nil {
+			return nil, fmt.Errorf("Error opening the kernel snap \"%s\": %s", seedSnap.Path, err.Error())
+		}
+		// the kernels of the images without a grade are not EFI applications
+		kernelEFI, err := container.ReadFile("kernel.efi")
+		if err != nil {
+			return nil, nil
+		}
+		kernel := filepath.Join(scratchDir, "kernel.efi")
+		if err := osWriteFile(kernel, kernelEFI, 0644); err != nil {
+			return nil, fmt.Errorf("Error extracting the kernel of snap \"%s\": %s",
+				seedSnap.SnapName(), err.Error())
+		}
+		return &measuredApplication{kernel, seedSnap.SnapName() + ":kernel.efi"}, nil
+	}
+	return nil, nil
+}
+
+// measureBootComponents predicts the value of PCR 4 once the firmware of a UEFI
+// machine booted the image: it measures the EFI application of the removable media
+// boot path of the ESP, the grub shim loads and the kernel grub loads, each by its
+// Authenticode digest. This is a best effort prediction of the common shim and grub
+// boot path, which assumes that the firmware loads no other EFI application, like
+// a boot manager of its own, before the one of the image
+func (stateMachine *StateMachine) measureBootComponents() error {
+	var applications []measuredApplication
+	for _, volumeName := range stateMachine.VolumeOrder {
+		volume := stateMachine.GadgetInfo.Volumes[volumeName]
+		for structureNumber, structure := range volume.Structure {
+			if !isESP(structure) {
+				continue
+			}
+			partDir := filepath.Join(stateMachine.tempDirs.volumes, volumeName,
+				"part"+strconv.Itoa(structureNumber))
+			if applications = efiBootApplications(partDir); len(applications) > 0 {
+				break
+			}
+		}
+		if len(applications) > 0 {
+			break
+		}
+	}
+	if len(applications) == 0 {
+		return fmt.Errorf("--measure could not find an EFI application in the EFI/BOOT " +
+			"directory of an EFI system partition of the gadget")
+	}
+
+	scratchDir := filepath.Join(stateMachine.tempDir(stateMachine.tempDirs.scratch), "measure")
+	if err := osMkdirAll(scratchDir, 0755); err != nil {
+		return fmt.Errorf("Error creating the directory to measure the kernel in: %s", err.Error())
+	}
+	kernel, err := stateMachine.measuredKernel(scratchDir)
+	if err != nil {
+		return err
+	}
+	if kernel == nil {
+		if !stateMachine.commonFlags.Quiet {
+			stateMachine.printWarning("the kernel of the image is not an EFI application loaded " +
+				"by the bootloader, the predicted measurements leave it out")
+		}
+	} else {
+		applications = append(applications, *kernel)
+	}
+
+	prediction := pcrPrediction{PCR: measuredBootPCR, Value: hex.EncodeToString(make([]byte, sha256.Size))}
+	actionDigest := sha256.Sum256([]byte(efiBootOptionAction))
+	prediction.extend("EV_EFI_ACTION", efiBootOptionAction, actionDigest[:])
+	separatorDigest := sha256.Sum256(make([]byte, 4))
+	prediction.extend("EV_SEPARATOR", "", separatorDigest[:])
+	for _, application := range applications {
+		digest, err := peImageDigest(application.path)
+		if err != nil {
+			return err
+		}
+		prediction.extend("EV_EFI_BOOT_SERVICES_APPLICATION", application.description, digest)
+	}
+
+	measurements := bootMeasurements{Algorithm: "sha256", PCRs: []pcrPrediction{prediction}}
+	measurementsBytes, err := json.MarshalIndent(measurements, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error encoding the predicted measurements: %s", err.Error())
+	}
+	outputPath := stateMachine.commonFlags.Measure
+	if err := osWriteFile(outputPath, append(measurementsBytes, '\n'), 0644); err != nil {
+		return fmt.Errorf("Error writing the predicted measurements: %s", err.Error())
+	}
+	stateMachine.addArtifact(outputPath)
+	return nil
+}
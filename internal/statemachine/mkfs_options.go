@@ -0,0 +1,217 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/snapcore/snapd/gadget"
+	"github.com/snapcore/snapd/gadget/quantity"
+	"github.com/snapcore/snapd/strutil/shlex"
+)
+
+// reservedMkfsOptions are the options of each filesystem supporting mkfs-options that
+// ubuntu-image sets itself or that would keep the filesystem from being created, with
+// the reason they are rejected
+var reservedMkfsOptions = map[string]map[string]string{
+	"ext4": {
+		"-d": "the content of the structure is copied by ubuntu-image",
+		"-L": "use filesystem-label instead",
+		"-U": "use filesystem-uuid instead",
+		"-n": "it would not create the filesystem",
+		"-t": "use ext-variant instead",
+	},
+	"vfat": {
+		"-C": "the partition image is created by ubuntu-image",
+		"-i": "use filesystem-uuid instead",
+		"-n": "use filesystem-label instead",
+	},
+}
+
+// parseMkfsOptions reads the extra options passed to mkfs for the structures of
+// gadget.yaml, which snapd ignores, along with the options selecting the ext-variant
+// and ext-features of ext4 structures. They are returned by volume name and index of
+// the structure in the volume, for the structures that have any, with the warnings
+// about the ext features that are known to break GRUB legacy
+func parseMkfsOptions(gadgetYaml *gadgetYamlExtensions,
+	gadgetInfo *gadget.Info) (map[string]map[int][]string, []string, error) {
+	mkfsOptions := make(map[string]map[int][]string)
+	var warnings []string
+	for volumeName, volume := range gadgetYaml.Volumes {
+		for structureNumber, structure := range volume.Structure {
+			where := fmt.Sprintf("volumes:%s:structure:%d", volumeName, structureNumber)
+			filesystem := gadgetInfo.Volumes[volumeName].Structure[structureNumber].Filesystem
+			var options []string
+			if structure.ExtVariant != "" || len(structure.ExtFeatures) > 0 {
+				if filesystem != "ext4" {
+					return nil, nil, fmt.Errorf("%s: ext-variant and ext-features can only "+
+						"be set on ext4 filesystems", where)
+				}
+				extOptions, extWarnings, err := extFilesystemOptions(structure.ExtVariant,
+					structure.ExtFeatures)
+				if err != nil {
+					return nil, nil, fmt.Errorf("%s: %s", where, err.Error())
+				}
+				options = extOptions
+				for _, warning := range extWarnings {
+					warnings = append(warnings, where+": "+warning)
+				}
+			}
+			if len(structure.MkfsOptions) > 0 {
+				if err := checkMkfsOptions(filesystem, structure.MkfsOptions); err != nil {
+					return nil, nil, fmt.Errorf("%s: %s", where, err.Error())
+				}
+				options = append(options, structure.MkfsOptions...)
+			}
+			// an ext4 ext-variant without features is the default
+			if len(options) == 0 {
+				continue
+			}
+			if mkfsOptions[volumeName] == nil {
+				mkfsOptions[volumeName] = make(map[int][]string)
+			}
+			mkfsOptions[volumeName][structureNumber] = options
+		}
+	}
+	sort.Strings(warnings)
+	return mkfsOptions, warnings, nil
+}
+
+// checkMkfsOptions makes sure that the mkfs options of a structure look like options
+// of mkfs: they must start with an option, and each option can be followed by at most
+// one value. The options ubuntu-image sets itself are rejected
+func checkMkfsOptions(filesystem string, options []string) error {
+	reserved, supported := reservedMkfsOptions[filesystem]
+	if !supported {
+		return fmt.Errorf("mkfs options can only be set on ext4 and vfat filesystems")
+	}
+	previousIsValue := true
+	for _, option := range options {
+		if strings.TrimSpace(option) != option || option == "" || strings.ContainsAny(option, "\n\x00") {
+			return fmt.Errorf("invalid mkfs option \"%s\"", option)
+		}
+		if !strings.HasPrefix(option, "-") {
+			if previousIsValue {
+				return fmt.Errorf("invalid mkfs options \"%s\": \"%s\" is not an option nor "+
+					"the value of one", strings.Join(options, " "), option)
+			}
+			previousIsValue = true
+			continue
+		}
+		previousIsValue = false
+		// the short options can be given with their value, like -i4096
+		name := option
+		if !strings.HasPrefix(option, "--") && len(option) > 2 {
+			name = option[:2]
+		}
+		if reason, found := reserved[name]; found {
+			return fmt.Errorf("mkfs option %s can not be set for %s filesystems: %s",
+				name, filesystem, reason)
+		}
+	}
+	return nil
+}
+
+// fakerootCommand returns the fakeroot command that mkfs runs through when not
+// running as root, with the flags of the FAKEROOT_FLAGS environment variable, as
+// snapd does. In the classic snap, they give the location of the libfakeroot of
+// the snap, which is otherwise loaded from the host
+func fakerootCommand() ([]string, error) {
+	fakerootArgs := []string{"fakeroot"}
+	fakerootFlags := os.Getenv("FAKEROOT_FLAGS")
+	if fakerootFlags == "" {
+		return fakerootArgs, nil
+	}
+	flags, err := shlex.Split(fakerootFlags)
+	if err != nil {
+		return nil, fmt.Errorf("Error splitting FAKEROOT_FLAGS: %s", err.Error())
+	}
+	return append(append(fakerootArgs, flags...), "--"), nil
+}
+
+// mkfsWithOptions creates a filesystem the way mkfs.MakeWithContent of snapd
+// does, with the extra mkfs options of the structure appended to the arguments
+// of mkfs, so that they override the ones ubuntu-image sets otherwise
+func (stateMachine *StateMachine) mkfsWithOptions(filesystem, partImg, label, contentRoot string,
+	deviceSize, sectorSize quantity.Size, options []string) error {
+	var entries []os.DirEntry
+	if contentRoot != "" {
+		var err error
+		entries, err = osReadDir(contentRoot)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Error listing contents of \"%s\": %s", contentRoot, err.Error())
+		}
+	}
+
+	var mkfsArgs []string
+	switch filesystem {
+	case "ext4":
+		mkfsArgs = []string{"mkfs.ext4"}
+		// small filesystems use 1k blocks, or the sector size if it is larger
+		if deviceSize != 0 && deviceSize <= 32*quantity.SizeMiB {
+			blockSize := quantity.SizeKiB
+			if sectorSize > blockSize {
+				blockSize = sectorSize
+			}
+			mkfsArgs = append(mkfsArgs, "-b", blockSize.String())
+		}
+		if len(entries) > 0 {
+			mkfsArgs = append(mkfsArgs, "-d", contentRoot)
+		}
+		if label != "" {
+			mkfsArgs = append(mkfsArgs, "-L", label)
+		}
+		mkfsArgs = append(append(mkfsArgs, options...), partImg)
+		// the files of the filesystem are owned by root
+		if osGeteuid() != 0 {
+			fakerootArgs, err := fakerootCommand()
+			if err != nil {
+				return err
+			}
+			mkfsArgs = append(fakerootArgs, mkfsArgs...)
+		}
+	case "vfat":
+		vfatSectorSize := quantity.Size(512)
+		if sectorSize > vfatSectorSize {
+			vfatSectorSize = sectorSize
+		}
+		mkfsArgs = []string{"mkfs.vfat", "-S", vfatSectorSize.String(), "-s", "1", "-F", "32"}
+		if label != "" {
+			mkfsArgs = append(mkfsArgs, "-n", label)
+		}
+		mkfsArgs = append(append(mkfsArgs, options...), partImg)
+	}
+
+	ctx := stateMachine.context()
+	if filesystem == "ext4" {
+		ctx = stateMachine.e2fsprogsContext()
+	}
+	cmds := [][]string{mkfsArgs}
+	// mkfs.vfat can't populate the filesystem, so the content is copied with mcopy
+	if filesystem == "vfat" && len(entries) > 0 {
+		mcopyArgs := []string{"mcopy", "-s", "-i", partImg}
+		for _, entry := range entries {
+			mcopyArgs = append(mcopyArgs, filepath.Join(contentRoot, entry.Name()))
+		}
+		cmds = append(cmds, append(mcopyArgs, "::"))
+	}
+	for _, args := range cmds {
+		cmd := execCommand(args[0], args[1:]...)
+		if args[0] == "mcopy" {
+			// skip the checks of mtools, which only print warnings
+			if cmd.Env == nil {
+				cmd.Env = os.Environ()
+			}
+			cmd.Env = append(cmd.Env, "MTOOLS_SKIP_CHECK=1")
+		}
+		cmdOutput := helper.SetCommandOutput(cmd, stateMachine.commonFlags.Debug)
+		if err := runCommand(ctx, cmd); err != nil {
+			return fmt.Errorf("Error running command \"%s\". Error is \"%s\". Output is: \n%s",
+				cmd.String(), err.Error(), cmdOutput.String())
+		}
+	}
+	return nil
+}
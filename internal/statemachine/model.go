@@ -0,0 +1,289 @@
+package statemachine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/snap"
+	"github.com/snapcore/snapd/snap/channel"
+)
+
+// readModelAssertion reads and decodes a model assertion file
+func readModelAssertion(modelFile string) (*asserts.Model, error) {
+	modelData, err := osReadFile(modelFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading model assertion: %s", err.Error())
+	}
+	modelAssertion, err := asserts.Decode(modelData)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding model assertion: %s", err.Error())
+	}
+	model, ok := modelAssertion.(*asserts.Model)
+	if !ok {
+		return nil, fmt.Errorf("Error decoding model assertion: assertion is not a model")
+	}
+	return model, nil
+}
+
+// checkModelStore makes sure that the brand store passed with --store is the one
+// of the model assertion. snapd downloads the snaps from the store of the model,
+// so an image can only be built for another store with a model signed for it
+func (snapStateMachine *SnapStateMachine) checkModelStore() error {
+	if snapStateMachine.Opts.Store == "" || snapStateMachine.Args.ModelAssertion == "" {
+		return nil
+	}
+	model, err := readModelAssertion(snapStateMachine.Args.ModelAssertion)
+	if err != nil {
+		return err
+	}
+	if model.Store() != snapStateMachine.Opts.Store {
+		modelStore := model.Store()
+		if modelStore == "" {
+			modelStore = "the global snap store"
+		}
+		return fmt.Errorf("--store %s does not match the store of model %s/%s: %s",
+			snapStateMachine.Opts.Store, model.BrandID(), model.Model(), modelStore)
+	}
+	return nil
+}
+
+// modelBases returns the bases a model allows to be seeded: its own base, the core
+// snap of models without one, and the base snaps it lists
+func modelBases(model *asserts.Model) []string {
+	bases := []string{model.Base()}
+	if model.Base() == "" {
+		bases = []string{"core"}
+	}
+	for _, modelSnap := range model.SnapsWithoutEssential() {
+		if modelSnap.SnapType == "base" && modelSnap.SnapName() != bases[0] {
+			bases = append(bases, modelSnap.SnapName())
+		}
+	}
+	return bases
+}
+
+// checkBaseSnap makes sure that the base of --base-snap is allowed by the model.
+// The model assertion is signed, so the base it requires can't be replaced by
+// another one, only seeded from another channel or revision
+func (snapStateMachine *SnapStateMachine) checkBaseSnap() error {
+	if snapStateMachine.Opts.BaseSnap == "" {
+		return nil
+	}
+	snapNames, _, _, err := parseSnapsAndChannels([]string{snapStateMachine.Opts.BaseSnap})
+	if err != nil {
+		return fmt.Errorf("Invalid --base-snap %s: %s", snapStateMachine.Opts.BaseSnap, err.Error())
+	}
+	if snapStateMachine.Args.ModelAssertion == "" {
+		return nil
+	}
+	model, err := readModelAssertion(snapStateMachine.Args.ModelAssertion)
+	if err != nil {
+		return err
+	}
+	bases := modelBases(model)
+	for _, base := range bases {
+		if base == snapNames[0] {
+			return nil
+		}
+	}
+	return fmt.Errorf("--base-snap %s is not a base of model %s/%s, which allows: %s",
+		snapNames[0], model.BrandID(), model.Model(), strings.Join(bases, ", "))
+}
+
+// snapArgs returns the snaps passed with --snap, followed by the one of --base-snap,
+// which replaces the base if it is passed with --snap too
+func (snapStateMachine *SnapStateMachine) snapArgs() []string {
+	if snapStateMachine.Opts.BaseSnap == "" {
+		return snapStateMachine.Opts.Snaps
+	}
+	baseName := strings.SplitN(snapStateMachine.Opts.BaseSnap, "=", 2)[0]
+	var snapArgs []string
+	for _, snapArg := range snapStateMachine.Opts.Snaps {
+		if strings.SplitN(snapArg, "=", 2)[0] != baseName {
+			snapArgs = append(snapArgs, snapArg)
+		}
+	}
+	return append(snapArgs, snapStateMachine.Opts.BaseSnap)
+}
+
+// channelTrack returns the track of a channel, "latest" if it has none
+func channelTrack(channelName string) (string, error) {
+	parsed, err := channel.Parse(channelName, "")
+	if err != nil {
+		return "", err
+	}
+	if parsed.Track == "" {
+		return "latest", nil
+	}
+	return parsed.Track, nil
+}
+
+// checkModelSnaps makes sure that the seeded snaps follow the constraints of the model
+// assertion: the required snaps are seeded, with the snap ID of the model and from
+// the track of their default channel, and models that are not of the dangerous grade
+// only have the snaps they list. All the violations are reported at once
+func (stateMachine *StateMachine) checkModelSnaps() error {
+	var snapStateMachine *SnapStateMachine
+	snapStateMachine = stateMachine.parent.(*SnapStateMachine)
+
+	model, err := readModelAssertion(snapStateMachine.Args.ModelAssertion)
+	if err != nil {
+		return err
+	}
+	seedSnaps, err := readSeedSnaps(stateMachine.tempDirs.rootfs)
+	if err != nil {
+		return err
+	}
+
+	var violations []string
+	seeded := make(map[string]bool)
+	modelSnaps := append(model.EssentialSnaps(), model.SnapsWithoutEssential()...)
+	for _, seedSnap := range seedSnaps {
+		snapName := seedSnap.SnapName()
+		seeded[snapName] = true
+		var modelSnap *asserts.ModelSnap
+		for _, candidate := range modelSnaps {
+			if candidate.SnapName() == snapName {
+				modelSnap = candidate
+				break
+			}
+		}
+		if modelSnap == nil {
+			// snapd seeds the snaps that older models only imply
+			grade := model.Grade()
+			if grade != asserts.ModelGradeUnset && grade != asserts.ModelDangerous {
+				violations = append(violations, fmt.Sprintf(
+					"snap %s is not part of the model, which is of grade %s", snapName, grade))
+			}
+			continue
+		}
+		if modelSnap.SnapID != "" && seedSnap.ID() != "" && modelSnap.SnapID != seedSnap.ID() {
+			violations = append(violations, fmt.Sprintf(
+				"snap %s has snap ID %s instead of %s", snapName, seedSnap.ID(), modelSnap.SnapID))
+		}
+		modelChannel := modelSnap.DefaultChannel
+		if modelChannel == "" {
+			modelChannel = modelSnap.PinnedTrack
+		}
+		if modelChannel == "" || seedSnap.Channel == "" {
+			continue
+		}
+		modelTrack, err := channelTrack(modelChannel)
+		if err != nil {
+			return fmt.Errorf("Error parsing the channel of snap %s in the model: %s",
+				snapName, err.Error())
+		}
+		seededTrack, err := channelTrack(seedSnap.Channel)
+		if err != nil {
+			return fmt.Errorf("Error parsing the channel of seeded snap %s: %s",
+				snapName, err.Error())
+		}
+		if seededTrack != modelTrack {
+			violations = append(violations, fmt.Sprintf(
+				"snap %s follows channel %s, which is not in track %s of the model",
+				snapName, seedSnap.Channel, modelTrack))
+		}
+	}
+	for _, required := range model.RequiredWithEssentialSnaps() {
+		if !seeded[required.SnapName()] {
+			violations = append(violations, fmt.Sprintf(
+				"snap %s is required by the model but is not seeded", required.SnapName()))
+		}
+	}
+
+	if len(violations) > 0 {
+		return fmt.Errorf("The seeded snaps do not match model %s/%s:\n%s",
+			model.BrandID(), model.Model(), strings.Join(violations, "\n"))
+	}
+	return nil
+}
+
+// snapBaseConflicts returns a report of the snaps built for a base that is not one
+// of the bases the model allows. The bases, kernels and snapd have no base to check
+func snapBaseConflicts(model *asserts.Model, snapInfos []*snap.Info) []string {
+	bases := modelBases(model)
+	var conflicts []string
+	for _, snapInfo := range snapInfos {
+		switch snapInfo.Type() {
+		case snap.TypeBase, snap.TypeOS, snap.TypeSnapd, snap.TypeKernel:
+			continue
+		}
+		snapBase := snapInfo.Base
+		if snapBase == "none" {
+			continue
+		}
+		// the snaps without a base run on the core snap
+		if snapBase == "" {
+			snapBase = "core"
+		}
+		allowed := false
+		for _, base := range bases {
+			allowed = allowed || base == snapBase
+		}
+		if !allowed {
+			conflicts = append(conflicts, fmt.Sprintf("snap %s requires base %s",
+				snapInfo.SnapName(), snapBase))
+		}
+	}
+	sort.Strings(conflicts)
+	return conflicts
+}
+
+// checkSnapBases makes sure that the seeded snaps are built for one of the bases
+// of the model, since they may not run, or the image may not boot, otherwise. All
+// the conflicts are reported at once, and only as warnings with --allow-base-mismatch.
+// Classic models without a base are not checked, because the snaps of a classic
+// system each run on their own base, which check_seed makes sure is seeded
+func (stateMachine *StateMachine) checkSnapBases() error {
+	var modelFile, seedRoot string
+	if classicStateMachine, isClassic := stateMachine.parent.(*ClassicStateMachine); isClassic {
+		modelFile = strings.TrimPrefix(classicStateMachine.ImageDef.ModelAssertion, "file://")
+		seedRoot = stateMachine.tempDirs.chroot
+	} else {
+		modelFile = stateMachine.parent.(*SnapStateMachine).Args.ModelAssertion
+		seedRoot = stateMachine.tempDirs.rootfs
+	}
+	if modelFile == "" {
+		return nil
+	}
+	model, err := readModelAssertion(modelFile)
+	if err != nil {
+		return err
+	}
+	if model.Classic() && model.Base() == "" {
+		return nil
+	}
+
+	seedSnaps, err := readSeedSnaps(seedRoot)
+	if err != nil {
+		return err
+	}
+	var snapInfos []*snap.Info
+	for _, seedSnap := range seedSnaps {
+		snapInfo, err := readLocalSnapInfo(seedSnap.Path)
+		if err != nil {
+			return err
+		}
+		snapInfos = append(snapInfos, snapInfo)
+	}
+
+	conflicts := snapBaseConflicts(model, snapInfos)
+	if len(conflicts) == 0 {
+		return nil
+	}
+	bases := strings.Join(modelBases(model), ", ")
+	if stateMachine.commonFlags.AllowBaseMismatch {
+		if !stateMachine.commonFlags.Quiet {
+			for _, conflict := range conflicts {
+				stateMachine.printWarning("%s, which is not a base of model %s/%s: %s",
+					conflict, model.BrandID(), model.Model(), bases)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("The seeded snaps are not built for the bases of model %s/%s, which are: %s\n%s\n"+
+		"Use --allow-base-mismatch to build the image anyway",
+		model.BrandID(), model.Model(), bases, strings.Join(conflicts, "\n"))
+}
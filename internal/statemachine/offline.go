@@ -0,0 +1,378 @@
+package statemachine
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/image"
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/snap"
+	"github.com/snapcore/snapd/snap/snapfile"
+)
+
+// localSnapFile returns the path of the snap file for snapName in snapDir, as
+// downloaded by "snap download", or an empty string if there is none. If the
+// revision of the snap is pinned, only the file of that revision is used.
+// Otherwise the most recent revision in snapDir is used
+func localSnapFile(snapDir, snapName string, revision snap.Revision) string {
+	if snapDir == "" {
+		return ""
+	}
+	if !revision.Unset() {
+		snapFile := filepath.Join(snapDir, fmt.Sprintf("%s_%s.snap", snapName, revision))
+		if !osutil.FileExists(snapFile) {
+			return ""
+		}
+		return snapFile
+	}
+	snapFiles, _ := filepath.Glob(filepath.Join(snapDir, snapName+"_*.snap"))
+	var snapFile string
+	var snapRevision snap.Revision
+	for _, candidate := range snapFiles {
+		revisionString := strings.TrimSuffix(
+			strings.TrimPrefix(filepath.Base(candidate), snapName+"_"), ".snap")
+		candidateRevision, err := snap.ParseRevision(revisionString)
+		if err != nil {
+			continue
+		}
+		if snapFile == "" || candidateRevision.N > snapRevision.N {
+			snapFile = candidate
+			snapRevision = candidateRevision
+		}
+	}
+	return snapFile
+}
+
+// readLocalSnapInfo reads the snap.yaml of a snap file
+func readLocalSnapInfo(snapPath string) (*snap.Info, error) {
+	container, err := snapfile.Open(snapPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening snap file \"%s\": %s", snapPath, err.Error())
+	}
+	// only the base of the snap is needed, so plug/slot sanitization is a no-op
+	snap.SanitizePlugsSlots = func(snapInfo *snap.Info) {}
+	snapInfo, err := snap.ReadInfoFromSnapFile(container, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the info of snap file \"%s\": %s", snapPath, err.Error())
+	}
+	return snapInfo, nil
+}
+
+// missingLocalSnaps returns the snaps, and the bases and default providers of
+// these snaps, that are not in the --snap-dir, sorted by name
+func (stateMachine *StateMachine) missingLocalSnaps(snapNames []string,
+	revisions map[string]snap.Revision) ([]string, error) {
+	var missing []string
+	checked := make(map[string]bool)
+	for len(snapNames) > 0 {
+		snapName := snapNames[0]
+		snapNames = snapNames[1:]
+		if checked[snapName] {
+			continue
+		}
+		checked[snapName] = true
+		snapFile := localSnapFile(stateMachine.commonFlags.SnapDir, snapName, revisions[snapName])
+		if snapFile == "" {
+			missing = append(missing, snapName)
+			continue
+		}
+		snapInfo, err := readLocalSnapInfo(snapFile)
+		if err != nil {
+			return nil, err
+		}
+		snapNames = append(snapNames, snapDependencies(snapInfo)...)
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
+
+// checkOfflineSnaps makes sure that all the given snaps, and their bases, can
+// be taken from the --snap-dir when building with --offline
+func (stateMachine *StateMachine) checkOfflineSnaps(snapNames []string,
+	revisions map[string]snap.Revision) error {
+	if !stateMachine.commonFlags.Offline {
+		return nil
+	}
+	missing, err := stateMachine.missingLocalSnaps(snapNames, revisions)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("The following snaps are missing from --snap-dir %s, "+
+			"which is required with --offline: %s",
+			stateMachine.commonFlags.SnapDir, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// modelSnapNames returns the names of the snaps a model assertion requires,
+// including the ones that are implied by the type of the model
+func modelSnapNames(modelFile string) ([]string, error) {
+	model, err := readModelAssertion(modelFile)
+	if err != nil {
+		return nil, err
+	}
+	var snapNames []string
+	for _, modelSnap := range model.RequiredWithEssentialSnaps() {
+		snapNames = append(snapNames, modelSnap.SnapName())
+	}
+	// snapd is only listed by UC20+ models, but UC18 ones need it as well,
+	// while UC16 ones rely on the core snap
+	if !model.Classic() && model.Base() == "" {
+		snapNames = append(snapNames, "core")
+	} else if !model.Classic() {
+		snapNames = append(snapNames, "snapd")
+	}
+	return snapNames, nil
+}
+
+// checkOfflineImageDefinition makes sure that a classic image definition can be
+// built with --offline. The snaps of the seeds are only known once the seeds have
+// been germinated, so they are checked when the snaps are staged instead
+func (stateMachine *StateMachine) checkOfflineImageDefinition() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	if remote := offlineRemoteSources(&classicStateMachine.ImageDef); len(remote) > 0 {
+		return fmt.Errorf("The following sources of the image definition can't be "+
+			"fetched with --offline: %s", strings.Join(remote, ", "))
+	}
+
+	var snapNames []string
+	if classicStateMachine.ImageDef.ModelAssertion != "" {
+		modelSnaps, err := modelSnapNames(
+			strings.TrimPrefix(classicStateMachine.ImageDef.ModelAssertion, "file://"))
+		if err != nil {
+			return err
+		}
+		snapNames = append(snapNames, modelSnaps...)
+	}
+	revisions := make(map[string]snap.Revision)
+	if classicStateMachine.ImageDef.Customization != nil {
+		for _, extraSnap := range classicStateMachine.ImageDef.Customization.ExtraSnaps {
+			snapNames = append(snapNames, extraSnap.SnapName)
+			if extraSnap.SnapRevision != 0 {
+				revisions[extraSnap.SnapName] = snap.R(extraSnap.SnapRevision)
+			}
+		}
+	}
+	if classicStateMachine.ImageDef.Recovery != nil {
+		modelSnaps, err := modelSnapNames(
+			strings.TrimPrefix(classicStateMachine.ImageDef.Recovery.ModelAssertion, "file://"))
+		if err != nil {
+			return err
+		}
+		snapNames = append(snapNames, modelSnaps...)
+		for _, extraSnap := range classicStateMachine.ImageDef.Recovery.ExtraSnaps {
+			snapNames = append(snapNames, extraSnap.SnapName)
+			if extraSnap.SnapRevision != 0 {
+				revisions[extraSnap.SnapName] = snap.R(extraSnap.SnapRevision)
+			}
+		}
+	}
+	return stateMachine.checkOfflineSnaps(snapNames, revisions)
+}
+
+// useLocalSnaps replaces the snaps of imageOpts that are in the --snap-dir with
+// the path of their snap file, so that image.Prepare uses them instead of
+// downloading them. The local snaps of modelSnaps, which are only required by
+// the model, are added as well. With --offline, a store that only serves the
+// assertions of the --snap-dir is started, and its URL is returned so that
+// runImagePrepare uses it instead of the snap store. The returned function stops it
+func (stateMachine *StateMachine) useLocalSnaps(imageOpts *image.Options,
+	modelSnaps []string) (string, func(), error) {
+	if stateMachine.commonFlags.SnapDir == "" {
+		return "", func() {}, nil
+	}
+	// with --snap-snapshot, the bases and default providers of the snaps are
+	// taken from the --snap-dir too, at the revision of the snapshot
+	snapshotSnaps, err := stateMachine.applySnapSnapshot(
+		append(append([]string{}, imageOpts.Snaps...), modelSnaps...), imageOpts.Revisions)
+	if err != nil {
+		return "", nil, err
+	}
+	if stateMachine.snapSnapshot != nil {
+		imageOpts.Snaps = snapshotSnaps
+	}
+	if err := stateMachine.checkOfflineSnaps(append(modelSnaps, imageOpts.Snaps...),
+		imageOpts.Revisions); err != nil {
+		return "", nil, err
+	}
+
+	var localSnaps []string
+	for _, snapName := range append(imageOpts.Snaps, modelSnaps...) {
+		snapFile := localSnapFile(stateMachine.commonFlags.SnapDir, snapName, imageOpts.Revisions[snapName])
+		if snapFile == "" {
+			if !helper.SliceHasElement(modelSnaps, snapName) {
+				localSnaps = append(localSnaps, snapName)
+			}
+			continue
+		}
+		if helper.SliceHasElement(localSnaps, snapFile) {
+			continue
+		}
+		localSnaps = append(localSnaps, snapFile)
+		// the channel the snap follows after being installed is still the one requested
+		if snapChannel, found := imageOpts.SnapChannels[snapName]; found {
+			imageOpts.SnapChannels[snapFile] = snapChannel
+		}
+	}
+	imageOpts.Snaps = localSnaps
+
+	if !stateMachine.commonFlags.Offline {
+		return "", func() {}, nil
+	}
+	return startLocalAssertionStore(stateMachine.commonFlags.SnapDir)
+}
+
+// runImagePrepare runs image.Prepare with the global state of snapd it relies on
+// set for this build, and restores that state afterwards: image.Stdout is silenced
+// unless --verbose or --debug is given, and the tooling store is pointed at storeURL
+// with UBUNTU_STORE_URL, if it is not empty. Neither image.Options nor the store
+// config of snapd can set the URL of the tooling store, so the environment variable
+// of the process is set for the duration of the call and its previous value is
+// restored afterwards. It must be called with imagePrepareMutex held, so that the
+// store of the other image.Prepare call is not replaced. The rest of the process
+// still sees the variable while image.Prepare runs, which is why the builds of a
+// process that use --offline can't run concurrently with the other builds
+func (stateMachine *StateMachine) runImagePrepare(imageOpts *image.Options, storeURL string) error {
+	if !stateMachine.commonFlags.Debug && !stateMachine.commonFlags.Verbose {
+		oldImageStdout := image.Stdout
+		image.Stdout = io.Discard
+		defer func() {
+			image.Stdout = oldImageStdout
+		}()
+	}
+	if storeURL != "" {
+		oldStoreURL, hadStoreURL := os.LookupEnv("UBUNTU_STORE_URL")
+		os.Setenv("UBUNTU_STORE_URL", storeURL)
+		defer func() {
+			if hadStoreURL {
+				os.Setenv("UBUNTU_STORE_URL", oldStoreURL)
+			} else {
+				os.Unsetenv("UBUNTU_STORE_URL")
+			}
+		}()
+	}
+	return imagePrepare(imageOpts)
+}
+
+// localAssertionStore serves the assertions found in the .assert files of a
+// directory with the API of the snap store. Every other request fails, so
+// that nothing is ever fetched from the network
+type localAssertionStore struct {
+	// the encoded assertions, by type and primary key
+	assertions map[string][]byte
+}
+
+// assertionStorePath returns the path under which the store serves an assertion
+func assertionStorePath(assertType *asserts.AssertionType, primaryKey []string) string {
+	return path.Join("/v2/assertions", assertType.Name,
+		path.Join(asserts.ReducePrimaryKey(assertType, primaryKey)...))
+}
+
+// startLocalAssertionStore reads the assertions of snapDir and serves them on a
+// local port until the returned function is called
+func startLocalAssertionStore(snapDir string) (string, func(), error) {
+	localStore := &localAssertionStore{assertions: make(map[string][]byte)}
+	assertFiles, _ := filepath.Glob(filepath.Join(snapDir, "*.assert"))
+	for _, assertFile := range assertFiles {
+		assertData, err := osReadFile(assertFile)
+		if err != nil {
+			return "", nil, fmt.Errorf("Error reading assertions file: %s", err.Error())
+		}
+		decoder := asserts.NewDecoder(bytes.NewReader(assertData))
+		for {
+			assertion, err := decoder.Decode()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return "", nil, fmt.Errorf("Error decoding assertions file \"%s\": %s",
+					assertFile, err.Error())
+			}
+			localStore.assertions[assertionStorePath(assertion.Type(),
+				assertion.Ref().PrimaryKey)] = asserts.Encode(assertion)
+		}
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, fmt.Errorf("Error starting the local assertion store: %s", err.Error())
+	}
+	server := &http.Server{Handler: localStore}
+	go server.Serve(listener)
+	storeURL := url.URL{Scheme: "http", Host: listener.Addr().String(), Path: "/"}
+	return storeURL.String(), func() { server.Close() }, nil
+}
+
+// ServeHTTP answers the requests of the snap store client
+func (localStore *localAssertionStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if assertion, found := localStore.assertions[r.URL.Path]; found {
+		w.Header().Set("Content-Type", asserts.MediaType)
+		w.Write(assertion)
+		return
+	}
+	message := "not available with --offline"
+	if strings.HasPrefix(r.URL.Path, "/v2/assertions/") {
+		message = "assertion not found in --snap-dir"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprintf(w, `{"error-list":[{"code":"not-found","message":%q}]}`, message)
+}
+
+// isRemoteURL returns whether a URL from the image definition needs network access
+func isRemoteURL(location string) bool {
+	parsed, err := url.Parse(location)
+	return err == nil && parsed.Scheme != "" && parsed.Scheme != "file"
+}
+
+// offlineRemoteSources returns the sources of a classic image definition that
+// would have to be fetched from the network
+func offlineRemoteSources(imageDef *imagedefinition.ImageDefinition) []string {
+	var remote []string
+	if imageDef.Gadget != nil && (imageDef.Gadget.GadgetType == "git" ||
+		imageDef.Gadget.GadgetType == "tarball") && isRemoteURL(imageDef.Gadget.GadgetURL) {
+		remote = append(remote, "gadget "+imageDef.Gadget.GadgetURL)
+	}
+	if imageDef.Rootfs != nil {
+		if imageDef.Rootfs.Tarball != nil {
+			if isRemoteURL(imageDef.Rootfs.Tarball.TarballURL) {
+				remote = append(remote, "rootfs tarball "+imageDef.Rootfs.Tarball.TarballURL)
+			}
+		} else if isRemoteURL(imageDef.Rootfs.Mirror) {
+			remote = append(remote, "mirror "+imageDef.Rootfs.Mirror)
+		}
+		if imageDef.Rootfs.Seed != nil {
+			for _, seedURL := range imageDef.Rootfs.Seed.SeedURLs {
+				if isRemoteURL(seedURL) {
+					remote = append(remote, "seed "+seedURL)
+				}
+			}
+		}
+	}
+	if imageDef.Customization != nil {
+		for _, ppa := range imageDef.Customization.ExtraPPAs {
+			remote = append(remote, "ppa "+ppa.PPAName)
+		}
+		for _, source := range imageDef.Customization.ExtraSources {
+			if isRemoteURL(source.URI) {
+				remote = append(remote, "apt source "+source.URI)
+			}
+		}
+	}
+	return remote
+}
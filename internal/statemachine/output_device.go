@@ -0,0 +1,260 @@
+package statemachine
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// sysBlockDir is where the kernel lists the whole disk block devices, with
+// their partitions and attributes
+var sysBlockDir = "/sys/block"
+
+// procMountsFile lists the filesystems that are mounted
+var procMountsFile = "/proc/self/mounts"
+
+// outputDeviceChunkSize is the amount of data written to, and read back from,
+// the output device at once
+var outputDeviceChunkSize = 4 << 20
+
+// outputDeviceName returns the name the kernel knows the output device by, like
+// sdb for /dev/sdb, following the links of /dev/disk
+func outputDeviceName(device string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return "", fmt.Errorf("Error reading the output device \"%s\": %s", device, err.Error())
+	}
+	name := filepath.Base(resolved)
+	if _, err := os.Stat(filepath.Join(sysBlockDir, name)); err != nil {
+		return "", fmt.Errorf("The output device \"%s\" is not a whole disk block device", device)
+	}
+	return name, nil
+}
+
+// mountedDevicePath returns the path of the first filesystem of a disk, or of one
+// of its partitions, that is mounted, along with where it is mounted
+func mountedDevicePath(name string) (string, string, error) {
+	mounts, err := os.Open(procMountsFile)
+	if err != nil {
+		return "", "", fmt.Errorf("Error reading the mounted filesystems: %s", err.Error())
+	}
+	defer mounts.Close()
+
+	scanner := bufio.NewScanner(mounts)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "/") {
+			continue
+		}
+		source := fields[0]
+		if resolved, err := filepath.EvalSymlinks(source); err == nil {
+			source = resolved
+		}
+		sourceName := filepath.Base(source)
+		if sourceName == name {
+			return fields[0], fields[1], nil
+		}
+		// the partitions of a disk are listed in its directory
+		if _, err := os.Stat(filepath.Join(sysBlockDir, name, sourceName)); err == nil {
+			return fields[0], fields[1], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", fmt.Errorf("Error reading the mounted filesystems: %s", err.Error())
+	}
+	return "", "", nil
+}
+
+// checkOutputDevice makes sure that the disk image can be written to the output
+// device without destroying data by mistake: the device must be a removable
+// whole disk, unless --force-device is given, and nothing on it can be mounted
+func (stateMachine *StateMachine) checkOutputDevice() error {
+	device := stateMachine.commonFlags.OutputDevice
+	name, err := outputDeviceName(device)
+	if err != nil {
+		return err
+	}
+
+	if !stateMachine.commonFlags.ForceDevice {
+		removable, err := os.ReadFile(filepath.Join(sysBlockDir, name, "removable"))
+		if err != nil {
+			return fmt.Errorf("Error reading whether the output device \"%s\" is removable: %s",
+				device, err.Error())
+		}
+		if strings.TrimSpace(string(removable)) != "1" {
+			return fmt.Errorf("The output device \"%s\" is not a removable device. "+
+				"Use --force-device to write the image to it anyway", device)
+		}
+	}
+
+	mountedPath, mountPoint, err := mountedDevicePath(name)
+	if err != nil {
+		return err
+	}
+	if mountedPath != "" {
+		return fmt.Errorf("Refusing to write the image to the output device \"%s\": %s is "+
+			"mounted on %s. Unmount it first", device, mountedPath, mountPoint)
+	}
+	return nil
+}
+
+// outputDeviceSize returns the size of the output device in bytes
+func outputDeviceSize(name string) (int64, error) {
+	// the size is always given in 512 byte sectors, whatever the sector size of the device
+	sectors, err := os.ReadFile(filepath.Join(sysBlockDir, name, "size"))
+	if err != nil {
+		return 0, fmt.Errorf("Error reading the size of the output device: %s", err.Error())
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(string(sectors)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Error reading the size of the output device: %s", err.Error())
+	}
+	return size * 512, nil
+}
+
+// outputDeviceImage returns the path of the disk image written to the output
+// device, which must be the only one the build made
+func (stateMachine *StateMachine) outputDeviceImage() (string, error) {
+	var images []string
+	for _, volumeName := range stateMachine.VolumeOrder {
+		if _, found := stateMachine.VolumeNames[volumeName]; !found ||
+			stateMachine.IntermediateVolumes[volumeName] {
+			continue
+		}
+		images = append(images, stateMachine.volumeImagePath(volumeName))
+	}
+	if len(images) != 1 {
+		return "", fmt.Errorf("--output-device can only write a single disk image to the device, "+
+			"but %d were created", len(images))
+	}
+	return images[0], nil
+}
+
+// writeImageToDevice writes a disk image to the output device and returns the
+// checksum of what was written
+func (stateMachine *StateMachine) writeImageToDevice(imageFile string, imageSize int64) ([]byte, error) {
+	device := stateMachine.commonFlags.OutputDevice
+	image, err := os.Open(imageFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening disk image \"%s\": %s", imageFile, err.Error())
+	}
+	defer image.Close()
+
+	// the kernel refuses to open a block device exclusively if it is in use
+	output, err := osOpenFile(device, os.O_WRONLY|os.O_EXCL, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening the output device \"%s\": %s", device, err.Error())
+	}
+	defer output.Close()
+
+	chunkSize := int64(outputDeviceChunkSize)
+	progress := stateMachine.newProgress(fmt.Sprintf("Writing %s to %s", filepath.Base(imageFile), device),
+		int((imageSize+chunkSize-1)/chunkSize))
+	defer progress.finish()
+
+	imageHash := sha256.New()
+	buffer := make([]byte, chunkSize)
+	for written := int64(0); written < imageSize; written += chunkSize {
+		length, err := io.ReadFull(image, buffer)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("Error reading disk image \"%s\": %s", imageFile, err.Error())
+		}
+		if _, err := output.Write(buffer[:length]); err != nil {
+			return nil, fmt.Errorf("Error writing to the output device \"%s\": %s", device, err.Error())
+		}
+		imageHash.Write(buffer[:length])
+		progress.increment()
+	}
+	if err := output.Sync(); err != nil {
+		return nil, fmt.Errorf("Error flushing the output device \"%s\": %s", device, err.Error())
+	}
+	return imageHash.Sum(nil), nil
+}
+
+// readBackDevice returns the checksum of the first size bytes of the output device
+func (stateMachine *StateMachine) readBackDevice(size int64) ([]byte, error) {
+	device := stateMachine.commonFlags.OutputDevice
+	input, err := osOpenFile(device, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening the output device \"%s\": %s", device, err.Error())
+	}
+	defer input.Close()
+	// drop what the page cache kept of the writes, so that the data is read from the device
+	_ = unix.Fadvise(int(input.Fd()), 0, 0, unix.FADV_DONTNEED)
+
+	chunkSize := int64(outputDeviceChunkSize)
+	progress := stateMachine.newProgress(fmt.Sprintf("Verifying %s", device),
+		int((size+chunkSize-1)/chunkSize))
+	defer progress.finish()
+
+	deviceHash := sha256.New()
+	for read := int64(0); read < size; read += chunkSize {
+		length := chunkSize
+		if size-read < length {
+			length = size - read
+		}
+		if _, err := io.CopyN(deviceHash, input, length); err != nil {
+			return nil, fmt.Errorf("Error reading back the output device \"%s\": %s", device, err.Error())
+		}
+		progress.increment()
+	}
+	return deviceHash.Sum(nil), nil
+}
+
+// writeOutputDevice writes the disk image to the block device given with
+// --output-device, and reads it back to make sure that it was written correctly
+func (stateMachine *StateMachine) writeOutputDevice() error {
+	imageFile, err := stateMachine.outputDeviceImage()
+	if err != nil {
+		return err
+	}
+	// the device may have been mounted, or replaced, while the image was built
+	if err := stateMachine.checkOutputDevice(); err != nil {
+		return err
+	}
+	device := stateMachine.commonFlags.OutputDevice
+	name, err := outputDeviceName(device)
+	if err != nil {
+		return err
+	}
+
+	imageInfo, err := os.Stat(imageFile)
+	if err != nil {
+		return fmt.Errorf("Error reading disk image \"%s\": %s", imageFile, err.Error())
+	}
+	deviceSize, err := outputDeviceSize(name)
+	if err != nil {
+		return err
+	}
+	if deviceSize < imageInfo.Size() {
+		return fmt.Errorf("The output device \"%s\" is too small for the disk image: it has %d bytes, "+
+			"but the image has %d bytes", device, deviceSize, imageInfo.Size())
+	}
+
+	imageChecksum, err := stateMachine.writeImageToDevice(imageFile, imageInfo.Size())
+	if err != nil {
+		return err
+	}
+	deviceChecksum, err := stateMachine.readBackDevice(imageInfo.Size())
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(imageChecksum, deviceChecksum) {
+		return fmt.Errorf("Error verifying the output device \"%s\": the data read back has the "+
+			"sha256 checksum %s, but the disk image has %s", device,
+			hex.EncodeToString(deviceChecksum), hex.EncodeToString(imageChecksum))
+	}
+	if !stateMachine.commonFlags.Quiet {
+		fmt.Printf("Wrote %s to %s\n", filepath.Base(imageFile), device)
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package statemachine
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// whiteoutPrefix starts the name of the files of an overlay marking that the file
+// without the prefix is removed from the rootfs, as done by overlayfs and OCI layers
+const whiteoutPrefix = ".wh."
+
+// opaqueWhiteout marks that the contents of its directory in the rootfs are removed
+const opaqueWhiteout = whiteoutPrefix + whiteoutPrefix + ".opq"
+
+// overlayWhiteouts returns the directories to empty and the files to remove from the
+// rootfs, relative to it, as marked by the whiteout files of an overlay
+func overlayWhiteouts(source string) (opaqueDirs []string, removed []string, err error) {
+	err = filepath.WalkDir(source, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, whiteoutPrefix) {
+			return nil
+		}
+		relDir, _ := filepath.Rel(source, filepath.Dir(path))
+		if name == opaqueWhiteout {
+			opaqueDirs = append(opaqueDirs, relDir)
+		} else {
+			removed = append(removed, filepath.Join(relDir, strings.TrimPrefix(name, whiteoutPrefix)))
+		}
+		return nil
+	})
+	return opaqueDirs, removed, err
+}
+
+// isRootfsDirectory returns whether a path of the rootfs is a directory, without
+// following symlinks, which could point to the host
+func isRootfsDirectory(rootfs string, relPath string) bool {
+	path := rootfs
+	for _, component := range strings.Split(relPath, string(filepath.Separator)) {
+		path = filepath.Join(path, component)
+		fileInfo, err := os.Lstat(path)
+		if err != nil || !fileInfo.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// applyWhiteouts removes from the rootfs what the whiteout files of an overlay mark as
+// removed. Opaque directories are emptied first, so that the overlay then fills them
+func applyWhiteouts(rootfs string, source string) error {
+	opaqueDirs, removed, err := overlayWhiteouts(source)
+	if err != nil {
+		return err
+	}
+	for _, opaqueDir := range opaqueDirs {
+		if !isRootfsDirectory(rootfs, opaqueDir) {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(rootfs, opaqueDir))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := os.RemoveAll(filepath.Join(rootfs, opaqueDir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	for _, removedPath := range removed {
+		if !isRootfsDirectory(rootfs, filepath.Dir(removedPath)) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(rootfs, removedPath)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rsyncOverlayArgs returns the arguments of the rsync runs merging an overlay into the
+// rootfs. The entries of the overlay are given one by one so that the root directory of
+// the rootfs keeps its own mode and owner. Owners are kept as IDs, since the users of the
+// rootfs aren't the ones of the host. rsync runs on the host, so it must not follow the
+// symlinks of the rootfs, like /var/run pointing to /run: the directories of the overlay
+// whose path in the rootfs is a symlink to a directory, like /bin, are merged by their
+// own run into that directory, resolved inside the rootfs, instead of replacing the symlink
+func rsyncOverlayArgs(overlay *imagedefinition.Overlay, rootfs string) ([][]string, error) {
+	return rsyncOverlayDirArgs(overlay, rootfs, overlay.Source, rootfs)
+}
+
+// rsyncOverlayDirArgs returns the arguments of the rsync runs merging the directory
+// sourceDir of an overlay into destDir, a directory of the rootfs without symlinks
+func rsyncOverlayDirArgs(overlay *imagedefinition.Overlay, rootfs string,
+	sourceDir string, destDir string) ([][]string, error) {
+	args := []string{"--archive", "--hard-links", "--acls", "--xattrs", "--numeric-ids"}
+	if overlay.Whiteouts {
+		args = append(args, "--exclude="+whiteoutPrefix+"*")
+	}
+	var linkedRuns [][]string
+	linkedDirs := make(map[string]bool)
+	err := filepath.WalkDir(sourceDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() || path == sourceDir {
+			return nil
+		}
+		relPath, _ := filepath.Rel(sourceDir, path)
+		fileInfo, err := os.Lstat(filepath.Join(destDir, relPath))
+		if err != nil || fileInfo.Mode()&fs.ModeSymlink == 0 {
+			return nil
+		}
+		rootfsPath, _ := filepath.Rel(rootfs, filepath.Join(destDir, relPath))
+		target, err := chrootPath(rootfs, rootfsPath)
+		if err != nil {
+			return err
+		}
+		// rsync replaces the symlinks that don't point to a directory
+		if fileInfo, err := os.Stat(target); err != nil || !fileInfo.IsDir() {
+			return filepath.SkipDir
+		}
+		runs, err := rsyncOverlayDirArgs(overlay, rootfs, path, target)
+		if err != nil {
+			return err
+		}
+		linkedRuns = append(linkedRuns, runs...)
+		linkedDirs[relPath] = true
+		if filepath.Dir(relPath) != "." {
+			// the patterns starting with a slash match from the directory of the sources
+			args = append(args, "--exclude=/"+relPath)
+		}
+		return filepath.SkipDir
+	})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(sourceDir)
+	if err != nil {
+		return nil, err
+	}
+	var sources []string
+	for _, entry := range entries {
+		if (overlay.Whiteouts && strings.HasPrefix(entry.Name(), whiteoutPrefix)) ||
+			linkedDirs[entry.Name()] {
+			continue
+		}
+		sources = append(sources, filepath.Join(sourceDir, entry.Name()))
+	}
+	if len(sources) == 0 {
+		return linkedRuns, nil
+	}
+	args = append(args, sources...)
+	args = append(args, destDir+string(filepath.Separator))
+	return append([][]string{args}, linkedRuns...), nil
+}
+
+// applyOverlays merges the overlay directories of the image definition into the rootfs,
+// in order, so that the files of an overlay replace the ones of the previous overlays.
+// The modes, owners, ACLs and extended attributes of the files are kept
+func (stateMachine *StateMachine) applyOverlays() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	for _, overlay := range classicStateMachine.ImageDef.Customization.Overlays {
+		fileInfo, err := os.Stat(overlay.Source)
+		if err != nil {
+			return fmt.Errorf("Error applying overlay \"%s\": %s", overlay.Source, err.Error())
+		}
+		if !fileInfo.IsDir() {
+			return fmt.Errorf("Error applying overlay \"%s\": it is not a directory", overlay.Source)
+		}
+		if overlay.Whiteouts {
+			if err := applyWhiteouts(stateMachine.tempDirs.chroot, overlay.Source); err != nil {
+				return fmt.Errorf("Error applying the whiteouts of overlay \"%s\": %s",
+					overlay.Source, err.Error())
+			}
+		}
+		rsyncRuns, err := rsyncOverlayArgs(overlay, stateMachine.tempDirs.chroot)
+		if err != nil {
+			return fmt.Errorf("Error applying overlay \"%s\": %s", overlay.Source, err.Error())
+		}
+		for _, rsyncArgs := range rsyncRuns {
+			rsyncCmd := execCommand("rsync", rsyncArgs...)
+			rsyncOutput := helper.SetCommandOutput(rsyncCmd, classicStateMachine.commonFlags.Debug)
+			if err := runCommand(stateMachine.context(), rsyncCmd); err != nil {
+				return fmt.Errorf("Error running command \"%s\". Error is \"%s\". Output is: \n%s",
+					rsyncCmd.String(), err.Error(), rsyncOutput.String())
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// partialBuildOutput is an intermediate result of the build found in the work
+// directory when the states stop running early with --until or --thru
+type partialBuildOutput struct {
+	description string
+	path        string
+}
+
+// partialBuildOutputs returns the intermediate results of the states that ran, from
+// the least to the most complete. Empty directories are left out
+func (stateMachine *StateMachine) partialBuildOutputs() []partialBuildOutput {
+	candidates := []partialBuildOutput{
+		{"chroot of the rootfs", stateMachine.tempDirs.chroot},
+		{"rootfs", stateMachine.tempDirs.rootfs},
+		{"unpacked gadget and snaps", stateMachine.tempDirs.unpack},
+		{"contents of the partitions", stateMachine.tempDirs.volumes},
+	}
+	for _, volumeName := range stateMachine.VolumeOrder {
+		if stateMachine.IntermediateVolumes[volumeName] {
+			candidates = append(candidates, partialBuildOutput{
+				fmt.Sprintf("disk image of volume %s", volumeName),
+				stateMachine.volumeImagePath(volumeName),
+			})
+		}
+	}
+	var outputs []partialBuildOutput
+	for _, candidate := range candidates {
+		if candidate.path == "" {
+			continue
+		}
+		fileInfo, err := os.Stat(candidate.path)
+		if err != nil {
+			continue
+		}
+		if fileInfo.IsDir() {
+			entries, err := osReadDir(candidate.path)
+			if err != nil || len(entries) == 0 {
+				continue
+			}
+		}
+		outputs = append(outputs, candidate)
+	}
+	return outputs
+}
+
+// exportPartialBuild makes the intermediate results of a build stopped with --until
+// or --thru available. With --output-dir, they are linked from the output directory
+// as partial-<name>, or moved there if the work directory is temporary. Otherwise a
+// temporary work directory is kept, since they would be removed with it
+func (stateMachine *StateMachine) exportPartialBuild(lastState string) error {
+	outputs := stateMachine.partialBuildOutputs()
+	if len(outputs) == 0 {
+		return nil
+	}
+	workDirRemoved := stateMachine.cleanWorkDir && !stateMachine.stateMachineFlags.KeepWorkDir
+	if !stateMachine.outputDirRequested {
+		stateMachine.keepPartialBuild = workDirRemoved
+	} else {
+		if err := osMkdirAll(stateMachine.commonFlags.OutputDir, 0755); err != nil {
+			return fmt.Errorf("Error creating OutputDir: %s", err.Error())
+		}
+		for i, output := range outputs {
+			exported := filepath.Join(stateMachine.commonFlags.OutputDir,
+				"partial-"+filepath.Base(output.path))
+			// replace what a previous partial build exported
+			if err := osRemoveAll(exported); err != nil {
+				return fmt.Errorf("Error removing %s: %s", exported, err.Error())
+			}
+			if workDirRemoved {
+				err := osRename(output.path, exported)
+				if err != nil {
+					// the work directory can be on another filesystem
+					err = osutilCopySpecialFile(output.path, exported)
+				}
+				if err != nil {
+					return fmt.Errorf("Error moving %s to %s: %s", output.path, exported, err.Error())
+				}
+			} else if err := os.Symlink(output.path, exported); err != nil {
+				return fmt.Errorf("Error linking %s to %s: %s", exported, output.path, err.Error())
+			}
+			outputs[i].path = exported
+		}
+	}
+
+	if stateMachine.commonFlags.Quiet || stateMachine.commonFlags.LogFormat == logFormatJSON {
+		return nil
+	}
+	fmt.Printf("The build stopped after state %s. The partially built outputs are:\n", lastState)
+	for _, output := range outputs {
+		fmt.Printf("  %s: %s\n", output.description, output.path)
+	}
+	return nil
+}
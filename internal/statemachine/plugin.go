@@ -0,0 +1,225 @@
+package statemachine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// the stages of the customization of the rootfs the plugins can run at
+const (
+	pluginStageBefore = "before-customization"
+	pluginStageAfter  = "after-customization"
+)
+
+// pluginProtocolVersion is the version of the protocol the plugins are run with. It
+// is passed to them so that they can refuse to run with a version they don't know
+const pluginProtocolVersion = 1
+
+// the statuses a plugin can report
+const (
+	pluginStatusProgress = "progress"
+	pluginStatusSuccess  = "success"
+	pluginStatusError    = "error"
+)
+
+// pluginInput is the JSON object a plugin gets on stdin
+type pluginInput struct {
+	ProtocolVersion int                    `json:"protocol_version"`
+	Name            string                 `json:"name"`
+	Stage           string                 `json:"stage"`
+	Rootfs          string                 `json:"rootfs"`
+	Architecture    string                 `json:"architecture"`
+	Series          string                 `json:"series"`
+	Config          map[string]interface{} `json:"config"`
+}
+
+// pluginStatus is a line of JSON a plugin prints on stdout to report its status
+type pluginStatus struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// pluginOutput records the output of a plugin and handles the statuses it reports
+// as they are printed. The other lines are only shown with --debug, or when the
+// plugin fails
+type pluginOutput struct {
+	name    string
+	quiet   bool
+	debug   bool
+	mutex   sync.Mutex
+	output  bytes.Buffer
+	partial []byte
+	errors  []string
+}
+
+// Write records the output of the plugin and handles each complete line of it
+func (output *pluginOutput) Write(data []byte) (int, error) {
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+	output.output.Write(data)
+	if output.debug {
+		os.Stdout.Write(data)
+	}
+	output.partial = append(output.partial, data...)
+	for {
+		end := bytes.IndexByte(output.partial, '\n')
+		if end < 0 {
+			break
+		}
+		output.handleLine(output.partial[:end])
+		output.partial = output.partial[end+1:]
+	}
+	return len(data), nil
+}
+
+// handleLine handles a line of output of the plugin reporting its status
+func (output *pluginOutput) handleLine(line []byte) {
+	line = bytes.TrimSpace(line)
+	if !bytes.HasPrefix(line, []byte("{")) {
+		return
+	}
+	var status pluginStatus
+	if err := json.Unmarshal(line, &status); err != nil || status.Status == "" {
+		return
+	}
+	switch status.Status {
+	case pluginStatusProgress, pluginStatusSuccess:
+		// the line was already printed with --debug
+		if status.Message != "" && !output.quiet && !output.debug {
+			fmt.Printf("%s: %s\n", output.name, status.Message)
+		}
+	case pluginStatusError:
+		output.errors = append(output.errors, status.Message)
+	default:
+		output.errors = append(output.errors, fmt.Sprintf("unknown status \"%s\" reported", status.Status))
+	}
+}
+
+// pluginConfigValue converts a value decoded from YAML into one that can be encoded
+// as JSON, whose objects only have string keys
+func pluginConfigValue(value interface{}) interface{} {
+	switch typedValue := value.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(typedValue))
+		for key, element := range typedValue {
+			converted[fmt.Sprintf("%v", key)] = pluginConfigValue(element)
+		}
+		return converted
+	case map[string]interface{}:
+		converted := make(map[string]interface{}, len(typedValue))
+		for key, element := range typedValue {
+			converted[key] = pluginConfigValue(element)
+		}
+		return converted
+	case []interface{}:
+		converted := make([]interface{}, len(typedValue))
+		for i, element := range typedValue {
+			converted[i] = pluginConfigValue(element)
+		}
+		return converted
+	}
+	return value
+}
+
+// convertPluginConfigs makes the configurations of the plugins of an image definition
+// encodable as JSON, which they are passed as and validated as
+func convertPluginConfigs(imageDef *imagedefinition.ImageDefinition) {
+	if imageDef.Customization == nil {
+		return
+	}
+	for _, plugin := range imageDef.Customization.Plugins {
+		if plugin.Config != nil {
+			plugin.Config = pluginConfigValue(plugin.Config).(map[string]interface{})
+		}
+	}
+}
+
+// hasPluginsAt reports whether any plugin of the image definition runs at stage
+func hasPluginsAt(customization *imagedefinition.Customization, stage string) bool {
+	for _, plugin := range customization.Plugins {
+		if plugin.Stage == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// runPlugin runs a plugin on the rootfs. The plugin fails the build by exiting
+// with a non-zero status or by reporting an error
+func (stateMachine *StateMachine) runPlugin(plugin *imagedefinition.Plugin) error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	config := plugin.Config
+	if config == nil {
+		config = map[string]interface{}{}
+	}
+	input, err := json.Marshal(pluginInput{
+		ProtocolVersion: pluginProtocolVersion,
+		Name:            plugin.PluginName,
+		Stage:           plugin.Stage,
+		Rootfs:          stateMachine.tempDirs.chroot,
+		Architecture:    classicStateMachine.ImageDef.Architecture,
+		Series:          classicStateMachine.ImageDef.Series,
+		Config:          config,
+	})
+	if err != nil {
+		return fmt.Errorf("Error encoding the input of plugin \"%s\": %s", plugin.PluginName, err.Error())
+	}
+
+	output := &pluginOutput{
+		name:  plugin.PluginName,
+		quiet: stateMachine.commonFlags.Quiet,
+		debug: stateMachine.commonFlags.Debug,
+	}
+	pluginCmd := execCommand(plugin.Path)
+	pluginCmd.Stdin = bytes.NewReader(input)
+	pluginCmd.Stdout = output
+	pluginCmd.Stderr = output
+	err = runCommand(stateMachine.context(), pluginCmd)
+	// the last line may not end with a newline
+	output.handleLine(output.partial)
+	if err != nil {
+		return fmt.Errorf("Error running plugin \"%s\". Error is \"%s\". Output is: \n%s",
+			plugin.PluginName, err.Error(), output.output.String())
+	}
+	if len(output.errors) > 0 {
+		return fmt.Errorf("Plugin \"%s\" failed: %s", plugin.PluginName, strings.Join(output.errors, ", "))
+	}
+	return nil
+}
+
+// runPluginsAt runs the plugins of the image definition for a stage of the
+// customization, in the order they are listed
+func (stateMachine *StateMachine) runPluginsAt(stage string) error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	for _, plugin := range classicStateMachine.ImageDef.Customization.Plugins {
+		if plugin.Stage != stage {
+			continue
+		}
+		if err := stateMachine.runPlugin(plugin); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runPluginsBeforeCustomization runs the plugins that customize the rootfs before
+// the other customizations of the image definition
+func (stateMachine *StateMachine) runPluginsBeforeCustomization() error {
+	return stateMachine.runPluginsAt(pluginStageBefore)
+}
+
+// runPluginsAfterCustomization runs the plugins that customize the rootfs once the
+// other customizations of the image definition are done
+func (stateMachine *StateMachine) runPluginsAfterCustomization() error {
+	return stateMachine.runPluginsAt(pluginStageAfter)
+}
@@ -0,0 +1,177 @@
+package statemachine
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/asserts/sysdb"
+	"github.com/snapcore/snapd/image"
+	"github.com/snapcore/snapd/snap"
+	"github.com/snapcore/snapd/snap/naming"
+	"github.com/snapcore/snapd/store/tooling"
+)
+
+// toolingStoreFromModel creates the store image.Prepare downloads the snaps of a model from
+var toolingStoreFromModel = tooling.NewToolingStoreFromModel
+
+// imageToolingStore returns the store image.Prepare downloads the snaps of imageOpts
+// from, with the same credentials. Classic builds without a model use the generic
+// classic model, like image.Prepare does
+func imageToolingStore(imageOpts *image.Options) (*tooling.ToolingStore, *asserts.Model, error) {
+	model := sysdb.GenericClassicModel()
+	if imageOpts.ModelFile != "" {
+		var err error
+		model, err = readModelAssertion(imageOpts.ModelFile)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	toolingStore, err := toolingStoreFromModel(model, imageOpts.Architecture)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error connecting to the snap store: %s", err.Error())
+	}
+	toolingStore.Stdout = io.Discard
+	return toolingStore, model, nil
+}
+
+// imageSnapRequests returns the snaps of imageOpts that image.Prepare seeds, with the
+// snaps of the model first
+func imageSnapRequests(imageOpts *image.Options) ([]snapRequest, error) {
+	var requests []snapRequest
+	if imageOpts.ModelFile != "" {
+		var err error
+		requests, _, err = modelSnapRequests(imageOpts.ModelFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var snapNames []string
+	for _, snapName := range imageOpts.Snaps {
+		// useLocalSnaps replaces the snaps of --snap-dir with the path of their file
+		if !strings.HasSuffix(snapName, ".snap") {
+			snapNames = append(snapNames, snapName)
+		}
+	}
+	return addSnapRequests(requests, snapNames, imageOpts.SnapChannels, imageOpts.Revisions), nil
+}
+
+// storeSnapsToDownload returns the snaps of imageOpts that image.Prepare downloads
+// from the store, with the channel or the revision it downloads them at. The snaps
+// of the model come first. The snaps of --snap-dir are skipped, as image.Prepare
+// uses their file
+func (stateMachine *StateMachine) storeSnapsToDownload(imageOpts *image.Options,
+	model *asserts.Model) ([]tooling.SnapToDownload, error) {
+	requests, err := imageSnapRequests(imageOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	_, defaultChannel := modelStoreDefaults(model)
+	var snaps []tooling.SnapToDownload
+	for _, request := range requests {
+		if localSnapFile(stateMachine.commonFlags.SnapDir, request.name, request.revision) != "" {
+			continue
+		}
+		snapToDownload := tooling.SnapToDownload{Snap: naming.Snap(request.name),
+			Revision: request.revision}
+		if request.revision.Unset() {
+			request.defaultChannel = defaultChannel
+			snapChannel, err := resolveSnapChannel(request, imageOpts.Channel)
+			if err != nil {
+				return nil, err
+			}
+			snapToDownload.Channel = snapChannel
+		}
+		snaps = append(snaps, snapToDownload)
+	}
+	return snaps, nil
+}
+
+// prefetchSnaps downloads the snaps of imageOpts into seedSnapsDir before image.Prepare
+// runs, with up to --parallel-downloads downloads at the same time. image.Prepare
+// downloads the snaps one after the other, but uses the files already in the seed
+// when their digest matches the revision it gets from the store. This is only an
+// optimization: snaps that fail to download are left to image.Prepare, which reports
+// the error. The paths of the downloaded files are returned, so that the ones that
+// image.Prepare did not use can be removed with removeUnusedSnaps
+func (stateMachine *StateMachine) prefetchSnaps(imageOpts *image.Options, seedSnapsDir string) ([]string, error) {
+	// the local assertion store of --offline does not serve snaps
+	if stateMachine.commonFlags.Offline {
+		return nil, nil
+	}
+	toolingStore, model, err := imageToolingStore(imageOpts)
+	if err != nil {
+		return nil, err
+	}
+	snapsToDownload, err := stateMachine.storeSnapsToDownload(imageOpts, model)
+	if err != nil {
+		return nil, err
+	}
+	if err := osMkdirAll(seedSnapsDir, 0755); err != nil {
+		return nil, fmt.Errorf("Error creating seed snaps directory: %s", err.Error())
+	}
+
+	var mutex sync.Mutex
+	var snapFiles []string
+	downloadErrs := make([]error, len(snapsToDownload))
+	enforceValidation := imageOpts.Customizations.Validation == "enforce"
+	downloads, stopTracking := stateMachine.trackDownloads("Downloading snaps")
+	defer stopTracking()
+	err = stateMachine.runParallel(stateMachine.context(), len(snapsToDownload), downloads, func(ctx context.Context, i int,
+		warn warningFunc) error {
+		snapName := snapsToDownload[i].Snap.SnapName()
+		err := stateMachine.retryDownloadWarning(ctx, "Downloading snap "+snapName, warn, func() error {
+			_, err := toolingStore.DownloadMany(snapsToDownload[i:i+1], nil, tooling.DownloadManyOptions{
+				BeforeDownloadFunc: func(snapInfo *snap.Info) (string, error) {
+					// this is where image.Prepare looks for the snap
+					snapFile := filepath.Join(seedSnapsDir, snapInfo.Filename())
+					mutex.Lock()
+					defer mutex.Unlock()
+					snapFiles = append(snapFiles, snapFile)
+					return snapFile, ctx.Err()
+				},
+				EnforceValidation: enforceValidation,
+			})
+			return err
+		})
+		// every job writes to its own element
+		downloadErrs[i] = err
+		return nil
+	}, func(i int) {
+		if downloadErrs[i] != nil && (stateMachine.commonFlags.Debug || stateMachine.commonFlags.Verbose) {
+			fmt.Printf("Could not download snap %s ahead of image.Prepare: %s\n",
+				snapsToDownload[i].Snap.SnapName(), downloadErrs[i].Error())
+		}
+	})
+	return snapFiles, err
+}
+
+// removeUnusedSnaps removes the snap files that were put in the seed of seedRoot before
+// image.Prepare ran, but that are not part of the seed it wrote. This happens when the
+// store returns another revision to image.Prepare than it did before
+func removeUnusedSnaps(seedRoot string, snapFiles []string) error {
+	if len(snapFiles) == 0 {
+		return nil
+	}
+	seedSnaps, err := readSeedSnaps(seedRoot)
+	if err != nil {
+		return err
+	}
+	usedSnaps := make(map[string]bool)
+	for _, seedSnap := range seedSnaps {
+		usedSnaps[seedSnap.Path] = true
+	}
+	for _, snapFile := range snapFiles {
+		if !usedSnaps[snapFile] {
+			if err := osRemoveAll(snapFile); err != nil {
+				return fmt.Errorf("Error removing unused snap \"%s\": %s", snapFile, err.Error())
+			}
+		}
+	}
+	return nil
+}
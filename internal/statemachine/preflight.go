@@ -0,0 +1,119 @@
+package statemachine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// referencedPath is a local file or directory the image definition references,
+// with the key of the image definition it is referenced by
+type referencedPath struct {
+	key   string
+	path  string
+	isDir bool
+}
+
+// referencedPaths returns the local files and directories of the image definition
+// that the build reads from the host. The scripts of execute are run from the
+// rootfs, which does not exist yet, so they are not part of them. The plugins are
+// run from the host, so they are
+func (classicStateMachine *ClassicStateMachine) referencedPaths() []referencedPath {
+	var paths []referencedPath
+	addPath := func(key, location string, isDir bool) {
+		if location != "" && !isRemoteURL(location) {
+			paths = append(paths, referencedPath{key, strings.TrimPrefix(location, "file://"), isDir})
+		}
+	}
+	imageDef := classicStateMachine.ImageDef
+	if imageDef.Gadget != nil && imageDef.Gadget.GadgetType != "git" {
+		addPath("gadget:url", imageDef.Gadget.GadgetURL, imageDef.Gadget.GadgetType != "tarball")
+	}
+	addPath("model-assertion", imageDef.ModelAssertion, false)
+	if imageDef.Recovery != nil {
+		addPath("recovery:model-assertion", imageDef.Recovery.ModelAssertion, false)
+	}
+	if imageDef.Rootfs != nil && imageDef.Rootfs.Tarball != nil {
+		addPath("rootfs:tarball:url", imageDef.Rootfs.Tarball.TarballURL, false)
+	}
+	if imageDef.Customization == nil {
+		return paths
+	}
+	for i, source := range imageDef.Customization.ExtraSources {
+		addPath(fmt.Sprintf("customization:extra-sources:%d:signing-key", i), source.SigningKey, false)
+	}
+	if imageDef.Customization.Manual != nil {
+		for i, copyFile := range imageDef.Customization.Manual.CopyFile {
+			// the glob patterns are checked for matching files instead
+			if !strings.ContainsAny(copyFile.Source, "*?[") {
+				addPath(fmt.Sprintf("customization:manual:copy-file:%d:source", i), copyFile.Source, false)
+			}
+		}
+	}
+	for i, overlay := range imageDef.Customization.Overlays {
+		addPath(fmt.Sprintf("customization:overlays:%d:source", i), overlay.Source, true)
+	}
+	for i, plugin := range imageDef.Customization.Plugins {
+		addPath(fmt.Sprintf("customization:plugins:%d:path", i), plugin.Path, false)
+	}
+	for i, encrypted := range imageDef.Customization.EncryptedPartitions {
+		addPath(fmt.Sprintf("customization:encrypted-partitions:%d:key-file", i), encrypted.KeyFile, false)
+	}
+	return paths
+}
+
+// checkReferencedPath returns why a referenced file or directory can't be used,
+// or an empty string if it can be read
+func checkReferencedPath(path referencedPath) string {
+	info, err := os.Stat(path.path)
+	if err == nil {
+		var file *os.File
+		file, err = os.Open(path.path)
+		if err == nil {
+			file.Close()
+		}
+	}
+	var pathErr *os.PathError
+	switch {
+	case err != nil && errors.As(err, &pathErr):
+		return pathErr.Err.Error()
+	case err != nil:
+		return err.Error()
+	case path.isDir && !info.IsDir():
+		return "not a directory"
+	case !path.isDir && info.IsDir():
+		return "is a directory"
+	}
+	return ""
+}
+
+// checkReferencedPaths makes sure that the local files and directories referenced
+// by the image definition exist and can be read before anything is built, so that
+// the build doesn't fail in the state using them. All the problems are reported at once
+func (classicStateMachine *ClassicStateMachine) checkReferencedPaths() error {
+	var problems []string
+	for _, path := range classicStateMachine.referencedPaths() {
+		if problem := checkReferencedPath(path); problem != "" {
+			problems = append(problems, fmt.Sprintf("%s \"%s\" (%s)", path.key, path.path, problem))
+		}
+	}
+	if classicStateMachine.ImageDef.Customization != nil &&
+		classicStateMachine.ImageDef.Customization.Manual != nil {
+		for i, copyFile := range classicStateMachine.ImageDef.Customization.Manual.CopyFile {
+			if !strings.ContainsAny(copyFile.Source, "*?[") {
+				continue
+			}
+			if matches, err := filepath.Glob(copyFile.Source); err != nil || len(matches) == 0 {
+				problems = append(problems, fmt.Sprintf("customization:manual:copy-file:%d:source "+
+					"\"%s\" (no file matches the pattern)", i, copyFile.Source))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("The following local files of the image definition are missing or "+
+			"can't be read: %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package statemachine
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/snapcore/snapd/gadget/quantity"
+	snapprogress "github.com/snapcore/snapd/progress"
+)
+
+// progressLogInterval is the minimum time between two progress lines
+// when stdout is not a terminal
+var progressLogInterval = 10 * time.Second
+
+// the number of characters of the progress bar drawn on terminals
+const progressBarWidth = 30
+
+// stdoutIsTerminal reports whether stdout is a terminal, in which case
+// the progress is drawn as a bar that is updated in place
+var stdoutIsTerminal = helper.StdoutIsTerminal
+
+// progressIndicator shows the progress of a state made of a known
+// number of steps, like downloads or filesystems to create
+type progressIndicator struct {
+	description string
+	total       int64
+	done        int64
+	sizes       bool
+	disabled    bool
+	terminal    bool
+	color       bool
+	lastLog     time.Time
+	logged      bool
+	lastDrawn   string
+}
+
+// newProgress creates a progress indicator for total steps. On terminals a
+// progress bar is drawn, otherwise a line is printed every progressLogInterval
+// so that long states are still visible in build logs. Nothing is printed with
+// --quiet or the json log format. With --verbose or --debug the bar is replaced
+// by log lines as well, so that it doesn't get mixed with the other output
+func (stateMachine *StateMachine) newProgress(description string, total int) *progressIndicator {
+	progress := &progressIndicator{
+		description: description,
+		total:       int64(total),
+		disabled: stateMachine.commonFlags.Quiet || total == 0 ||
+			stateMachine.commonFlags.LogFormat == logFormatJSON,
+		terminal: stateMachine.outputIsTerminal() &&
+			!stateMachine.commonFlags.Verbose && !stateMachine.commonFlags.Debug,
+		color:   helper.UseColor(stateMachine.commonFlags.Color, stateMachine.outputIsTerminal()),
+		lastLog: time.Now(),
+	}
+	if !progress.disabled && progress.terminal {
+		progress.draw()
+	}
+	return progress
+}
+
+// newDownloadProgress creates a progress indicator for downloads, whose total size
+// grows as the downloads start. The progress is shown as the downloaded and the total
+// sizes, and nothing is printed until a download has started
+func (stateMachine *StateMachine) newDownloadProgress(description string) *progressIndicator {
+	progress := stateMachine.newProgress(description, 0)
+	progress.sizes = true
+	progress.disabled = stateMachine.commonFlags.Quiet ||
+		stateMachine.commonFlags.LogFormat == logFormatJSON
+	return progress
+}
+
+// increment records that one more step has finished. Like the other
+// methods, it does nothing on a nil progress indicator
+func (progress *progressIndicator) increment() {
+	progress.advance(1)
+}
+
+// grow adds steps to the total, like the size of a download that started
+func (progress *progressIndicator) grow(steps int64) {
+	if progress == nil || progress.disabled {
+		return
+	}
+	progress.total += steps
+	if progress.terminal {
+		progress.draw()
+	}
+}
+
+// advance records that steps more have finished
+func (progress *progressIndicator) advance(steps int64) {
+	if progress == nil || progress.disabled || progress.done == progress.total {
+		return
+	}
+	progress.done += steps
+	if progress.done > progress.total {
+		progress.done = progress.total
+	}
+	if progress.terminal {
+		progress.draw()
+		return
+	}
+	// the last line is only needed to close the ones printed before
+	if time.Since(progress.lastLog) >= progressLogInterval ||
+		(progress.done == progress.total && progress.logged) {
+		fmt.Printf("%s: %s\n", progress.description, progress.counts())
+		progress.lastLog = time.Now()
+		progress.logged = true
+	}
+}
+
+// finish ends the progress bar so that the next output starts on a new line.
+// It must be called even if the state fails before all the steps are done
+func (progress *progressIndicator) finish() {
+	if progress == nil || progress.disabled || !progress.terminal {
+		return
+	}
+	if progress.lastDrawn != "" {
+		fmt.Println()
+	}
+	progress.disabled = true
+}
+
+// interrupt ends the line of the progress bar so that other output can be printed.
+// The bar is drawn again on the next line when it progresses
+func (progress *progressIndicator) interrupt() {
+	if progress == nil || progress.disabled || !progress.terminal || progress.lastDrawn == "" {
+		return
+	}
+	fmt.Println()
+	progress.lastDrawn = ""
+}
+
+// warningAbove returns a warningFunc that prints the warnings on their own line,
+// instead of after the progress bar. It must be called by the goroutine updating
+// the progress
+func (stateMachine *StateMachine) warningAbove(progress *progressIndicator) warningFunc {
+	return func(format string, args ...interface{}) {
+		progress.interrupt()
+		stateMachine.printWarning(format, args...)
+	}
+}
+
+// counts returns the finished and the total steps
+func (progress *progressIndicator) counts() string {
+	if progress.sizes {
+		return quantity.Size(progress.done).IECString() + "/" + quantity.Size(progress.total).IECString()
+	}
+	return strconv.FormatInt(progress.done, 10) + "/" + strconv.FormatInt(progress.total, 10)
+}
+
+// draw redraws the progress bar over the current terminal line, if it changed
+func (progress *progressIndicator) draw() {
+	filled := 0
+	if progress.total > 0 {
+		filled = int(progressBarWidth * progress.done / progress.total)
+	}
+	line := fmt.Sprintf("\r%s [%s%s] %s", progress.description,
+		helper.Colorize(progress.color, helper.ColorGreen, strings.Repeat("#", filled)),
+		strings.Repeat(" ", progressBarWidth-filled), progress.counts())
+	if line != progress.lastDrawn {
+		fmt.Print(line)
+		progress.lastDrawn = line
+	}
+}
+
+// progressMeter is a snapd progress.Meter that adds the downloads of the snap store
+// to a download progress indicator. The store reports the progress of a download by
+// writing the downloaded data to the meter, so several downloads can share it
+type progressMeter struct {
+	mutex    sync.Mutex
+	progress *progressIndicator
+}
+
+// Start adds the size of a download that starts to the total
+func (meter *progressMeter) Start(label string, total float64) {
+	meter.mutex.Lock()
+	defer meter.mutex.Unlock()
+	meter.progress.grow(int64(total))
+}
+
+// Write records that the data was downloaded
+func (meter *progressMeter) Write(p []byte) (int, error) {
+	meter.mutex.Lock()
+	defer meter.mutex.Unlock()
+	meter.progress.advance(int64(len(p)))
+	return len(p), nil
+}
+
+// the store only reports the progress of the downloads through Start and Write
+func (meter *progressMeter) Set(current float64)    {}
+func (meter *progressMeter) SetTotal(total float64) {}
+func (meter *progressMeter) Finished()              {}
+func (meter *progressMeter) Spin(msg string)        {}
+func (meter *progressMeter) Notify(msg string)      {}
+
+// trackDownloads shows the progress of the snap downloads. snapd creates the meter of
+// every download with progress.MakeProgressBar, which returns the meter set with
+// progress.MockMeter if there is one. That meter is global, so downloads are only
+// tracked while imagePrepareMutex is held. The returned function finishes the
+// progress bar and stops tracking the downloads
+func (stateMachine *StateMachine) trackDownloads(description string) (*progressIndicator, func()) {
+	downloads := stateMachine.newDownloadProgress(description)
+	restoreMeter := snapprogress.MockMeter(&progressMeter{progress: downloads})
+	return downloads, func() {
+		restoreMeter()
+		downloads.finish()
+	}
+}
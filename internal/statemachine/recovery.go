@@ -0,0 +1,306 @@
+package statemachine
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/gadget"
+	"github.com/snapcore/snapd/image"
+	"github.com/snapcore/snapd/snap"
+)
+
+// imagePrepareMutex is held while image.Prepare runs, since it swaps global state
+// of snapd like image.Stdout, and the store used with --offline. The seed of the
+// recovery system is prepared in the background, while the main system is built,
+// but the two image.Prepare calls still run one after the other
+var imagePrepareMutex sync.Mutex
+
+// recoverySeed is the seed of the recovery system being prepared in the background
+type recoverySeed struct {
+	// the error the seed was prepared with, once it is ready
+	done chan error
+	// stops retrying the downloads of the seed
+	cancel context.CancelFunc
+
+	// the warnings of the seed, printed once it is ready
+	mutex    sync.Mutex
+	warnings []string
+}
+
+// warn records a warning of the recovery seed
+func (seed *recoverySeed) warn(format string, args ...interface{}) {
+	seed.mutex.Lock()
+	defer seed.mutex.Unlock()
+	seed.warnings = append(seed.warnings, fmt.Sprintf(format, args...))
+}
+
+// RecoveryStructure is the structure of gadget.yaml marked as recovery, which
+// holds the seed of the recovery system of classic images
+type RecoveryStructure struct {
+	VolumeName      string
+	StructureNumber int
+}
+
+// parseRecoveryStructure reads the structure of gadget.yaml marked as recovery,
+// which snapd ignores. It is returned by volume name and index of the structure
+// in the volume, or nil if there is none
+func parseRecoveryStructure(gadgetYaml *gadgetYamlExtensions,
+	gadgetInfo *gadget.Info) (*RecoveryStructure, error) {
+	var recovery *RecoveryStructure
+	for volumeName, volume := range gadgetYaml.Volumes {
+		for structureNumber, structure := range volume.Structure {
+			if !structure.Recovery {
+				continue
+			}
+			where := fmt.Sprintf("volumes:%s:structure:%d", volumeName, structureNumber)
+			gadgetStructure := gadgetInfo.Volumes[volumeName].Structure[structureNumber]
+			switch {
+			case gadgetStructure.Filesystem == "":
+				return nil, fmt.Errorf("%s: the recovery structure must have a filesystem", where)
+			case gadgetStructure.Role != "":
+				return nil, fmt.Errorf("%s: the recovery structure can not have the %s role",
+					where, gadgetStructure.Role)
+			case len(gadgetStructure.Content) > 0:
+				return nil, fmt.Errorf("%s: the recovery structure is filled with the recovery "+
+					"seed, so it can not have content", where)
+			case structure.MountPoint != "":
+				return nil, fmt.Errorf("%s: the recovery structure can not have a mount point", where)
+			case recovery != nil:
+				return nil, fmt.Errorf("%s: only one structure can be marked as recovery, "+
+					"volumes:%s:structure:%d is already", where, recovery.VolumeName,
+					recovery.StructureNumber)
+			}
+			recovery = &RecoveryStructure{volumeName, structureNumber}
+		}
+	}
+	return recovery, nil
+}
+
+// checkRecoveryStructure makes sure that gadget.yaml has a recovery structure if,
+// and only if, the image definition has a recovery system
+func (stateMachine *StateMachine) checkRecoveryStructure() error {
+	classicStateMachine, ok := stateMachine.parent.(*ClassicStateMachine)
+	if !ok {
+		if stateMachine.Recovery != nil {
+			return fmt.Errorf("a recovery structure can only be set in the gadget.yaml of classic images")
+		}
+		return nil
+	}
+	switch {
+	case classicStateMachine.ImageDef.Recovery != nil && stateMachine.Recovery == nil:
+		return fmt.Errorf("the image definition has a recovery system, but no structure " +
+			"of gadget.yaml is marked as recovery")
+	case classicStateMachine.ImageDef.Recovery == nil && stateMachine.Recovery != nil:
+		return fmt.Errorf("volumes:%s:structure:%d is marked as recovery, but the image "+
+			"definition has no recovery system", stateMachine.Recovery.VolumeName,
+			stateMachine.Recovery.StructureNumber)
+	}
+	return nil
+}
+
+// recoveryPrepareDir returns the directory the recovery seed is prepared in
+func (stateMachine *StateMachine) recoveryPrepareDir() string {
+	return filepath.Join(stateMachine.stateMachineFlags.WorkDir, "recovery")
+}
+
+// readRecoveryModel reads the model assertion of the recovery system, which must
+// have a grade to be seeded as a recovery system
+func (stateMachine *StateMachine) readRecoveryModel() (*asserts.Model, error) {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	modelFile := strings.TrimPrefix(classicStateMachine.ImageDef.Recovery.ModelAssertion, "file://")
+	model, err := readModelAssertion(modelFile)
+	if err != nil {
+		return nil, err
+	}
+	if model.Grade() == asserts.ModelGradeUnset {
+		return nil, fmt.Errorf("The model assertion of the recovery system has no grade, so it "+
+			"can't be seeded as a recovery system: %s", modelFile)
+	}
+	return model, nil
+}
+
+// startRecoverySeed checks the model of the recovery system, and starts preparing
+// its seed in the background so that its snaps are resolved while the main system
+// is built. Both image.Prepare calls are serialized on imagePrepareMutex, so the
+// seed is only prepared at the same time as the states that don't prepare the
+// main seed. It is copied to the recovery partition by populateRecoveryPartition
+func (stateMachine *StateMachine) startRecoverySeed() error {
+	if _, err := stateMachine.readRecoveryModel(); err != nil {
+		return err
+	}
+	// the seed outlives the state starting it, so it doesn't use the context of the
+	// state, which is replaced by the one of the next state with --state-timeout
+	ctx, cancel := context.WithCancel(stateMachine.runContext())
+	seed := &recoverySeed{done: make(chan error, 1), cancel: cancel}
+	stateMachine.recoverySeed = seed
+	go func() {
+		seed.done <- stateMachine.prepareRecoverySeed(ctx, seed.warn)
+	}()
+	return nil
+}
+
+// waitRecoverySeed waits for the recovery seed prepared in the background, if
+// it was started, prints its warnings and returns the error it was prepared with
+func (stateMachine *StateMachine) waitRecoverySeed() error {
+	seed := stateMachine.recoverySeed
+	if seed == nil {
+		return nil
+	}
+	err := <-seed.done
+	seed.cancel()
+	stateMachine.recoverySeed = nil
+	for _, warning := range seed.warnings {
+		stateMachine.printWarning("%s", warning)
+	}
+	return err
+}
+
+// stopRecoverySeed stops the recovery seed prepared in the background, if it was
+// started, and waits for it. The downloads are not retried anymore and image.Prepare
+// is not called if it did not start yet, but image.Prepare can't be interrupted
+func (stateMachine *StateMachine) stopRecoverySeed() {
+	if stateMachine.recoverySeed == nil {
+		return
+	}
+	stateMachine.recoverySeed.cancel()
+	stateMachine.waitRecoverySeed()
+}
+
+// prepareRecoverySeed calls image.Prepare to seed the recovery system from its own
+// model, extra snaps and channel, independently of the seed of the main system.
+// The downloads stop being retried when ctx is done, and the warnings are passed
+// to warn
+func (stateMachine *StateMachine) prepareRecoverySeed(ctx context.Context, warn warningFunc) error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+	recovery := classicStateMachine.ImageDef.Recovery
+
+	model, err := stateMachine.readRecoveryModel()
+	if err != nil {
+		return err
+	}
+
+	// image.Prepare refuses to write over the seed of an interrupted build
+	prepareDir := stateMachine.recoveryPrepareDir()
+	if err := osRemoveAll(prepareDir); err != nil {
+		return fmt.Errorf("Error removing the previous recovery seed: %s", err.Error())
+	}
+
+	var imageOpts image.Options
+	imageOpts.ModelFile = strings.TrimPrefix(recovery.ModelAssertion, "file://")
+	imageOpts.Classic = model.Classic()
+	imageOpts.Architecture = classicStateMachine.ImageDef.Architecture
+	imageOpts.PrepareDir = prepareDir
+	imageOpts.Channel = stateMachine.commonFlags.Channel
+	if recovery.Channel != "" {
+		imageOpts.Channel = recovery.Channel
+	}
+	imageOpts.SnapChannels = make(map[string]string)
+	imageOpts.Revisions = make(map[string]snap.Revision)
+	cohorts := make(map[string]string)
+	for _, extraSnap := range recovery.ExtraSnaps {
+		if !helper.SliceHasElement(imageOpts.Snaps, extraSnap.SnapName) {
+			imageOpts.Snaps = append(imageOpts.Snaps, extraSnap.SnapName)
+		}
+		if extraSnap.Channel != "" {
+			imageOpts.SnapChannels[extraSnap.SnapName] = extraSnap.Channel
+		}
+		if extraSnap.SnapRevision != 0 {
+			imageOpts.Revisions[extraSnap.SnapName] = snap.Revision{N: extraSnap.SnapRevision}
+		}
+		if extraSnap.Cohort != "" {
+			cohorts[extraSnap.SnapName] = extraSnap.Cohort
+		}
+	}
+	stateMachine.forceChannel(imageOpts.Snaps, imageOpts.SnapChannels, imageOpts.Revisions)
+	// the manifest only lists the snaps of the main system
+	if _, err := stateMachine.pinCohortRevisions(ctx, warn, &imageOpts, cohorts); err != nil {
+		return err
+	}
+	imageOpts.Customizations.Validation = stateMachine.commonFlags.Validation
+
+	imagePrepareMutex.Lock()
+	defer imagePrepareMutex.Unlock()
+	// the main seed may have been prepared while waiting for it
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("Error preparing the recovery seed: %s", err.Error())
+	}
+
+	// plug/slot sanitization not used by snap image.Prepare, make it no-op.
+	snap.SanitizePlugsSlots = func(snapInfo *snap.Info) {}
+
+	// use the snaps of --snap-dir, including the ones that are only listed in the model
+	var modelSnaps []string
+	if stateMachine.commonFlags.SnapDir != "" {
+		modelSnaps, err = modelSnapNames(imageOpts.ModelFile)
+		if err != nil {
+			return err
+		}
+	}
+	storeURL, stopStore, err := stateMachine.useLocalSnaps(&imageOpts, modelSnaps)
+	if err != nil {
+		return err
+	}
+	defer stopStore()
+
+	err = stateMachine.retryDownloadWarning(ctx, "Preparing the recovery seed", warn, func() error {
+		return stateMachine.runImagePrepare(&imageOpts, storeURL)
+	})
+	if err != nil {
+		return fmt.Errorf("Error preparing the recovery seed: %s", err.Error())
+	}
+	return nil
+}
+
+// populateRecoveryPartition waits for the recovery seed, or prepares it when the
+// build was resumed after it was started, and copies it to the content of the
+// recovery partition, which must be large enough to hold it
+func (stateMachine *StateMachine) populateRecoveryPartition() error {
+	var err error
+	if stateMachine.recoverySeed != nil {
+		err = stateMachine.waitRecoverySeed()
+	} else {
+		err = stateMachine.prepareRecoverySeed(stateMachine.context(), stateMachine.printWarning)
+	}
+	if err != nil {
+		return err
+	}
+
+	recovery := stateMachine.Recovery
+	structure := stateMachine.GadgetInfo.Volumes[recovery.VolumeName].Structure[recovery.StructureNumber]
+	seedDir := filepath.Join(stateMachine.recoveryPrepareDir(), "system-seed")
+	seedSize, err := helper.Du(stateMachine.commandRunner(), seedDir)
+	if err != nil {
+		return fmt.Errorf("Error getting the size of the recovery seed: %s", err.Error())
+	}
+	if seedSize > structure.Size {
+		return fmt.Errorf("The recovery seed needs %s, but the recovery partition \"%s\" is only %s",
+			seedSize.IECString(), structurePartitionName(structure), structure.Size.IECString())
+	}
+
+	targetDir := filepath.Join(stateMachine.tempDirs.volumes, recovery.VolumeName,
+		"part"+strconv.Itoa(recovery.StructureNumber))
+	if err := osMkdirAll(targetDir, 0755); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("Error creating the content directory of the recovery partition: %s",
+			err.Error())
+	}
+	seedFiles, err := osReadDir(seedDir)
+	if err != nil {
+		return fmt.Errorf("Error reading the recovery seed: %s", err.Error())
+	}
+	for _, seedFile := range seedFiles {
+		if err := osutilCopySpecialFile(filepath.Join(seedDir, seedFile.Name()), targetDir); err != nil {
+			return fmt.Errorf("Error copying the recovery seed to its partition: %s", err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package statemachine
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/diskfs/go-diskfs/partition"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/google/uuid"
+	"golang.org/x/sys/unix"
+)
+
+// sourceDateEpochSeed is the seed of --deterministic-uuid that stands for the
+// value of the SOURCE_DATE_EPOCH environment variable
+const sourceDateEpochSeed = "SOURCE_DATE_EPOCH"
+
+// validateSourceDateEpoch makes sure that SOURCE_DATE_EPOCH, if it is set, is a
+// number of seconds, and that it is set when --deterministic-uuid uses it
+func (stateMachine *StateMachine) validateSourceDateEpoch() error {
+	_, isSet, err := helper.SourceDateEpoch()
+	if err != nil {
+		return err
+	}
+	if !isSet && stateMachine.commonFlags.DeterministicUUID == sourceDateEpochSeed {
+		return fmt.Errorf("--deterministic-uuid %s requires the SOURCE_DATE_EPOCH "+
+			"environment variable to be set", sourceDateEpochSeed)
+	}
+	return nil
+}
+
+// e2fsprogsFakeTime returns the value of E2FSPROGS_FAKE_TIME matching SOURCE_DATE_EPOCH,
+// which mke2fs, e2fsck and tune2fs read to set the timestamps of the superblock of
+// ext4 filesystems. It is "" when SOURCE_DATE_EPOCH is not set
+func e2fsprogsFakeTime() string {
+	sourceDateEpoch, isSet, err := helper.SourceDateEpoch()
+	if err != nil || !isSet {
+		return ""
+	}
+	return strconv.FormatInt(sourceDateEpoch.Unix(), 10)
+}
+
+// e2fsprogsContext returns the context to run the tools of e2fsprogs with, which
+// sets E2FSPROGS_FAKE_TIME in their environment with SOURCE_DATE_EPOCH
+func (stateMachine *StateMachine) e2fsprogsContext() context.Context {
+	if fakeTime := e2fsprogsFakeTime(); fakeTime != "" {
+		return withCommandEnv(stateMachine.context(), "E2FSPROGS_FAKE_TIME="+fakeTime)
+	}
+	return stateMachine.context()
+}
+
+// deterministicSeed returns the seed of --deterministic-uuid, "" if it is not used
+func (stateMachine *StateMachine) deterministicSeed() string {
+	if stateMachine.commonFlags.DeterministicUUID == sourceDateEpochSeed {
+		return os.Getenv("SOURCE_DATE_EPOCH")
+	}
+	return stateMachine.commonFlags.DeterministicUUID
+}
+
+// deterministicUUID derives a UUID from the seed of --deterministic-uuid and a name
+// that is unique to what the UUID identifies
+func (stateMachine *StateMachine) deterministicUUID(name string) uuid.UUID {
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte(stateMachine.deterministicSeed()+"/"+name))
+}
+
+// setDeterministicGUIDs sets the disk GUID and the partition GUIDs of a GPT partition
+// table from the seed of --deterministic-uuid, instead of letting go-diskfs generate
+// random ones. MBR partition tables have no GUIDs
+func (stateMachine *StateMachine) setDeterministicGUIDs(volumeName string, partitionTable partition.Table) {
+	gptTable, isGPT := partitionTable.(*gpt.Table)
+	if stateMachine.deterministicSeed() == "" || !isGPT {
+		return
+	}
+	gptTable.GUID = stateMachine.deterministicUUID(volumeName + "/disk").String()
+	for i, gptPartition := range gptTable.Partitions {
+		gptPartition.GUID = stateMachine.deterministicUUID(
+			fmt.Sprintf("%s/partition/%d", volumeName, i)).String()
+	}
+}
+
+// deterministicDiskID returns the MBR disk identifier of a volume derived from the seed
+// of --deterministic-uuid
+func (stateMachine *StateMachine) deterministicDiskID(volumeName string) []byte {
+	hash := sha1.Sum([]byte(stateMachine.deterministicSeed() + "/" + volumeName + "/disk-id"))
+	return hash[:4]
+}
+
+// clampMtimes sets the modification time of the files of the rootfs and of the
+// partition contents that are more recent than SOURCE_DATE_EPOCH to SOURCE_DATE_EPOCH,
+// so that the filesystems and artifacts built from them are reproducible
+func (stateMachine *StateMachine) clampMtimes() error {
+	sourceDateEpoch, isSet, err := helper.SourceDateEpoch()
+	if err != nil || !isSet {
+		return err
+	}
+	times := []unix.Timespec{
+		unix.NsecToTimespec(sourceDateEpoch.UnixNano()),
+		unix.NsecToTimespec(sourceDateEpoch.UnixNano()),
+	}
+	for _, dir := range []string{stateMachine.tempDirs.rootfs, stateMachine.tempDirs.volumes} {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			continue
+		}
+		err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			fileInfo, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			if !fileInfo.ModTime().After(sourceDateEpoch) {
+				return nil
+			}
+			// symbolic links are clamped themselves, not the files they point to
+			return unix.UtimesNanoAt(unix.AT_FDCWD, path, times, unix.AT_SYMLINK_NOFOLLOW)
+		})
+		if err != nil {
+			return fmt.Errorf("Error clamping the modification times of %s to SOURCE_DATE_EPOCH: %s",
+				dir, err.Error())
+		}
+	}
+	return nil
+}
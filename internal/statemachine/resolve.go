@@ -0,0 +1,434 @@
+package statemachine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/image"
+	"github.com/snapcore/snapd/snap"
+	"github.com/snapcore/snapd/snap/channel"
+	"github.com/snapcore/snapd/snap/naming"
+	"github.com/snapcore/snapd/store"
+	"github.com/snapcore/snapd/store/tooling"
+)
+
+// snapRequest is a snap that the build asks the store for, before it is resolved.
+// defaultChannel is the channel used when none is given for the snap or with --channel
+type snapRequest struct {
+	name           string
+	channel        string
+	defaultChannel string
+	revision       snap.Revision
+	cohort         string
+	modelSnap      *asserts.ModelSnap
+}
+
+// errSnapResolved stops tooling.DownloadMany once the store resolved a snap,
+// before the snap is downloaded
+var errSnapResolved = errors.New("snap resolved")
+
+// storeSnapInfos asks the store image.Prepare downloads the snaps from for the
+// revision it serves of each snap, the same way the snaps are looked up before they
+// are downloaded, but without downloading them. tooling.DownloadMany stops at the
+// first snap it is not allowed to download, so every snap is looked up on its own,
+// with up to --parallel-downloads lookups at the same time. The infos are returned
+// in the order of the snaps, and are nil for the snaps the store returned nothing for.
+// The warnings about the retries are passed to warn
+func (stateMachine *StateMachine) storeSnapInfos(ctx context.Context, warn warningFunc, description string,
+	toolingStore *tooling.ToolingStore, snapsToDownload []tooling.SnapToDownload,
+	enforceValidation bool) ([]*snap.Info, error) {
+	snapInfos := make([]*snap.Info, len(snapsToDownload))
+	err := stateMachine.runParallelWarning(ctx, warn, len(snapsToDownload), nil, func(ctx context.Context, i int,
+		warn warningFunc) error {
+		return stateMachine.retryDownloadWarning(ctx, description, warn, func() error {
+			_, err := toolingStore.DownloadMany(snapsToDownload[i:i+1], nil, tooling.DownloadManyOptions{
+				BeforeDownloadFunc: func(snapInfo *snap.Info) (string, error) {
+					// every job writes to its own element
+					snapInfos[i] = snapInfo
+					return "", errSnapResolved
+				},
+				EnforceValidation: enforceValidation,
+			})
+			if err == errSnapResolved {
+				return nil
+			}
+			return err
+		})
+	}, func(i int) {})
+	return snapInfos, err
+}
+
+// resolveSnapChannel returns the channel a snap is downloaded from, as snapd resolves
+// it: the channel given for the snap or with --channel is applied to the default
+// channel of the snap, and must stay on the track the model pins
+func resolveSnapChannel(request snapRequest, channelOpt string) (string, error) {
+	optChannel := request.channel
+	if optChannel == "" {
+		optChannel = channelOpt
+	}
+	if request.modelSnap != nil && request.modelSnap.PinnedTrack != "" {
+		resolved, err := channel.ResolvePinned(request.modelSnap.PinnedTrack, optChannel)
+		if err != nil {
+			return "", fmt.Errorf("channel \"%s\" of snap %s does not match the track \"%s\" "+
+				"pinned by the model", optChannel, request.name, request.modelSnap.PinnedTrack)
+		}
+		return resolved, nil
+	}
+	defaultChannel := request.defaultChannel
+	if request.modelSnap != nil && request.modelSnap.DefaultChannel != "" {
+		defaultChannel = request.modelSnap.DefaultChannel
+	}
+	resolved, err := channel.Resolve(defaultChannel, optChannel)
+	if err != nil {
+		return "", fmt.Errorf("invalid channel \"%s\" for snap %s: %s",
+			optChannel, request.name, err.Error())
+	}
+	return resolved, nil
+}
+
+// modelSnapRequests returns the snaps of the model, with the snap
+// that provides snapd, in the order they are seeded
+func modelSnapRequests(modelFile string) ([]snapRequest, *asserts.Model, error) {
+	snapNames, err := modelSnapNames(modelFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	model, err := readModelAssertion(modelFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	modelSnaps := make(map[string]*asserts.ModelSnap)
+	for _, modelSnap := range append(model.EssentialSnaps(), model.SnapsWithoutEssential()...) {
+		modelSnaps[modelSnap.SnapName()] = modelSnap
+	}
+	var requests []snapRequest
+	listed := make(map[string]bool)
+	for _, snapName := range snapNames {
+		if !listed[snapName] {
+			listed[snapName] = true
+			requests = append(requests, snapRequest{name: snapName, modelSnap: modelSnaps[snapName]})
+		}
+	}
+	return requests, model, nil
+}
+
+// addSnapRequests adds the snaps given on the command line or in the image definition
+// to the snaps of the model, and applies the channels and revisions given for them.
+// A snap of the model keeps its constraints
+func addSnapRequests(requests []snapRequest, snapNames []string, snapChannels map[string]string,
+	snapRevisions map[string]snap.Revision) []snapRequest {
+	for _, snapName := range snapNames {
+		found := false
+		for _, request := range requests {
+			found = found || request.name == snapName
+		}
+		if !found {
+			requests = append(requests, snapRequest{name: snapName})
+		}
+	}
+	for i := range requests {
+		if snapChannel, found := snapChannels[requests[i].name]; found {
+			requests[i].channel = snapChannel
+		}
+		if snapRevision, found := snapRevisions[requests[i].name]; found {
+			requests[i].revision = snapRevision
+		}
+	}
+	return requests
+}
+
+// modelStoreDefaults returns the store the snaps of a model are downloaded from and
+// the channel they default to. Like snapd, models with a grade default to the
+// latest track
+func modelStoreDefaults(model *asserts.Model) (storeID string, defaultChannel string) {
+	defaultChannel = "stable"
+	if model != nil {
+		storeID = model.Store()
+		if model.Grade() != asserts.ModelGradeUnset {
+			defaultChannel = "latest/stable"
+		}
+	}
+	return storeID, defaultChannel
+}
+
+// cohortPinnedError is returned for a snap given both a cohort key and a revision,
+// as the revision of a cohort is the one the store serves to it
+func cohortPinnedError(snapName string, revision snap.Revision) error {
+	return fmt.Errorf("Snap %s cannot be pinned to revision %s and follow a cohort at the same time",
+		snapName, revision)
+}
+
+// pinCohortRevisions asks the store for the revision it serves to the cohort of each
+// snap given a cohort key, and pins the snap to that revision so that image.Prepare
+// downloads it. image.Prepare passes a single cohort key to the store for all the
+// snaps, so the snaps are resolved with their own cohort key before. The snaps found
+// in --snap-dir are used as they are. The snaps that were pinned are returned with
+// their cohort key. The lookups stop when ctx is done, and their warnings are passed to warn
+func (stateMachine *StateMachine) pinCohortRevisions(ctx context.Context, warn warningFunc,
+	imageOpts *image.Options, cohorts map[string]string) (map[string]string, error) {
+	pinned := make(map[string]string)
+	if len(cohorts) == 0 || stateMachine.commonFlags.Offline {
+		return pinned, nil
+	}
+
+	var model *asserts.Model
+	modelSnaps := make(map[string]*asserts.ModelSnap)
+	if imageOpts.ModelFile != "" {
+		var requests []snapRequest
+		var err error
+		requests, model, err = modelSnapRequests(imageOpts.ModelFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, request := range requests {
+			modelSnaps[request.name] = request.modelSnap
+		}
+	}
+	_, defaultChannel := modelStoreDefaults(model)
+
+	var snapNames []string
+	for snapName := range cohorts {
+		snapNames = append(snapNames, snapName)
+	}
+	sort.Strings(snapNames)
+
+	var snapsToDownload []tooling.SnapToDownload
+	for _, snapName := range snapNames {
+		if _, found := modelSnaps[snapName]; !found && !helper.SliceHasElement(imageOpts.Snaps, snapName) {
+			return nil, fmt.Errorf("A cohort key was given for snap %s, which is not installed "+
+				"in the image", snapName)
+		}
+		if revision, found := imageOpts.Revisions[snapName]; found {
+			return nil, cohortPinnedError(snapName, revision)
+		}
+		if localSnapFile(stateMachine.commonFlags.SnapDir, snapName, snap.Revision{}) != "" {
+			continue
+		}
+		request := snapRequest{
+			name:           snapName,
+			channel:        imageOpts.SnapChannels[snapName],
+			defaultChannel: defaultChannel,
+			cohort:         cohorts[snapName],
+			modelSnap:      modelSnaps[snapName],
+		}
+		snapChannel, err := resolveSnapChannel(request, imageOpts.Channel)
+		if err != nil {
+			return nil, err
+		}
+		snapsToDownload = append(snapsToDownload, tooling.SnapToDownload{Snap: naming.Snap(snapName),
+			Channel: snapChannel, CohortKey: request.cohort})
+	}
+	if len(snapsToDownload) == 0 {
+		return pinned, nil
+	}
+
+	toolingStore, _, err := imageToolingStore(imageOpts)
+	if err != nil {
+		return nil, err
+	}
+	snapInfos, err := stateMachine.storeSnapInfos(ctx, warn, "Resolving the cohorts of the snaps", toolingStore,
+		snapsToDownload, imageOpts.Customizations.Validation == "enforce")
+	if err != nil {
+		if cohortErr := cohortError(err, snapsToDownload); cohortErr != nil {
+			return nil, cohortErr
+		}
+		return nil, fmt.Errorf("Error resolving the cohorts of the snaps: %s", err.Error())
+	}
+	for i, snapInfo := range snapInfos {
+		snapName := snapsToDownload[i].Snap.SnapName()
+		if snapInfo == nil {
+			return nil, fmt.Errorf("Error resolving the cohorts of the snaps: the store returned no "+
+				"revision for snap %s in its cohort", snapName)
+		}
+		imageOpts.Revisions[snapName] = snapInfo.Revision
+		pinned[snapName] = snapsToDownload[i].CohortKey
+	}
+	return pinned, nil
+}
+
+// cohortError returns an error naming the cohort key the store rejected, if the
+// error of the store is about a snap that was asked for with a cohort key
+func cohortError(err error, snapsToDownload []tooling.SnapToDownload) error {
+	var snapActionErr *store.SnapActionError
+	if errors.As(err, &snapActionErr) {
+		for _, snapToDownload := range snapsToDownload {
+			snapName := snapToDownload.Snap.SnapName()
+			if snapErr, found := snapActionErr.Download[snapName]; found &&
+				snapToDownload.CohortKey != "" {
+				return fmt.Errorf("The store rejected the cohort key \"%s\" of snap %s: %s",
+					snapToDownload.CohortKey, snapName, snapErr.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// resolvedSnap is a snap the build seeds, as resolved by the store, or read from
+// its file in --snap-dir, in which case its channel is "local"
+type resolvedSnap struct {
+	name    string
+	info    *snap.Info
+	channel string
+}
+
+// listResolvedSnaps prints the revision, channel and base of every snap the build
+// would seed, as resolved by the store, without downloading the snaps. The snaps
+// found in --snap-dir are listed with the revision of their file. Like with
+// --dry-run, only the states computing the list of states are run first
+func (stateMachine *StateMachine) listResolvedSnaps() error {
+	for i := 0; i < len(stateMachine.states); i++ {
+		if dryRunStates[stateMachine.states[i].name] {
+			if err := stateMachine.states[i].function(stateMachine); err != nil {
+				return err
+			}
+		}
+	}
+	resolvedSnaps, err := stateMachine.resolveSnaps()
+	if err != nil {
+		return err
+	}
+	for _, resolved := range resolvedSnaps {
+		fmt.Printf("%s\t%s\t%s\t%s\n", resolved.name, resolved.info.Revision,
+			valueOrDash(resolved.channel), valueOrDash(resolved.info.Base))
+	}
+	return nil
+}
+
+// seedImageOptions returns the options image.Prepare is called with by the build,
+// with the revisions of the cohorts pinned. For classic images, the seeds are
+// germinated in a temporary directory if the build has not done it yet, and the
+// bases, default providers and snapd the snaps need are added. The snaps preseeded
+// in a rootfs tarball are only known once it is extracted
+func (stateMachine *StateMachine) seedImageOptions() (*image.Options, error) {
+	switch parent := stateMachine.parent.(type) {
+	case *SnapStateMachine:
+		imageOpts, err := stateMachine.snapImageOptions()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := stateMachine.pinCohortRevisions(stateMachine.context(), stateMachine.printWarning,
+			imageOpts, parent.Opts.Cohorts); err != nil {
+			return nil, err
+		}
+		return imageOpts, nil
+	case *ClassicStateMachine:
+		seedSnaps := parent.Snaps
+		if parent.ImageDef.Rootfs != nil && parent.ImageDef.Rootfs.Seed != nil &&
+			len(parent.Packages) == 0 && len(parent.Snaps) == 0 {
+			germinateDir, err := osMkdirTemp(stateMachine.tempDir("/tmp"), "ubuntu-image-germinate")
+			if err != nil {
+				return nil, fmt.Errorf("Error creating germinate directory: \"%s\"", err.Error())
+			}
+			defer osRemoveAll(germinateDir)
+			_, seedSnaps, err = stateMachine.germinateSeeds(germinateDir)
+			if err != nil {
+				return nil, err
+			}
+		}
+		imageOpts, cohorts, err := stateMachine.classicImageOptions(seedSnaps)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := stateMachine.pinCohortRevisions(stateMachine.context(), stateMachine.printWarning,
+			imageOpts, cohorts); err != nil {
+			return nil, err
+		}
+		if _, err := stateMachine.addSeedDependencies(imageOpts); err != nil {
+			return nil, err
+		}
+		return imageOpts, nil
+	}
+	return nil, fmt.Errorf("snaps can not be resolved for this image type")
+}
+
+// resolveSnaps asks the store image.Prepare downloads the snaps from for the revision
+// of every snap the build would seed, without downloading the snaps. The snaps are the
+// ones image.Prepare is called with, along with the snaps of the model. The snaps of
+// --snap-snapshot are resolved from it, and the snaps found in --snap-dir are read
+// from their file
+func (stateMachine *StateMachine) resolveSnaps() ([]resolvedSnap, error) {
+	imageOpts, err := stateMachine.seedImageOptions()
+	if err != nil {
+		return nil, err
+	}
+	// the snaps of the --snap-snapshot are resolved from it instead of by the store
+	if stateMachine.snapSnapshot != nil {
+		var modelSnaps []string
+		if imageOpts.ModelFile != "" {
+			modelSnaps, err = modelSnapNames(imageOpts.ModelFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+		imageOpts.Snaps, err = stateMachine.applySnapSnapshot(
+			append(append([]string{}, imageOpts.Snaps...), modelSnaps...), imageOpts.Revisions)
+		if err != nil {
+			return nil, err
+		}
+	}
+	requests, err := imageSnapRequests(imageOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := make(map[string]*snap.Info)
+	requested := make(map[string]string)
+	toolingStore, model, err := imageToolingStore(imageOpts)
+	if err != nil {
+		return nil, err
+	}
+	snapsToDownload, err := stateMachine.storeSnapsToDownload(imageOpts, model)
+	if err != nil {
+		return nil, err
+	}
+	if len(snapsToDownload) > 0 {
+		snapInfos, err := stateMachine.storeSnapInfos(stateMachine.context(), stateMachine.printWarning, "Resolving the snaps", toolingStore,
+			snapsToDownload, imageOpts.Customizations.Validation == "enforce")
+		if err != nil {
+			return nil, fmt.Errorf("Error resolving the snaps: %s", err.Error())
+		}
+		for i, snapInfo := range snapInfos {
+			snapName := snapsToDownload[i].Snap.SnapName()
+			if snapInfo != nil {
+				resolved[snapName] = snapInfo
+			}
+			requested[snapName] = snapsToDownload[i].Channel
+		}
+	}
+
+	var resolvedSnaps []resolvedSnap
+	for _, request := range requests {
+		snapInfo, found := resolved[request.name]
+		snapChannel := "local"
+		if snapFile := localSnapFile(stateMachine.commonFlags.SnapDir, request.name,
+			request.revision); snapFile != "" {
+			snapInfo, err = readLocalSnapInfo(snapFile)
+			if err != nil {
+				return nil, err
+			}
+		} else if !found {
+			return nil, fmt.Errorf("Error resolving the snaps: the store returned no revision "+
+				"for snap %s", request.name)
+		} else {
+			snapChannel = snapInfo.Channel
+			if snapChannel == "" {
+				snapChannel = requested[request.name]
+			}
+		}
+		resolvedSnaps = append(resolvedSnaps, resolvedSnap{name: request.name, info: snapInfo,
+			channel: snapChannel})
+	}
+	return resolvedSnaps, nil
+}
+
+// valueOrDash returns "-" in place of an empty column of --list-snaps-resolved
+func valueOrDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
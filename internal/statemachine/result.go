@@ -0,0 +1,204 @@
+package statemachine
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// buildResultFileName is the default name of the build result file in the output directory
+const buildResultFileName = "build-result.json"
+
+// the status of a build in the build result file
+const (
+	buildStatusSuccess   = "success"
+	buildStatusFailure   = "failure"
+	buildStatusCancelled = "cancelled"
+)
+
+// buildResult is the machine-readable outcome of a build, written by Teardown,
+// or by Setup when it fails
+type buildResult struct {
+	ImageType   string           `json:"image-type"`
+	Status      string           `json:"status"`
+	Duration    float64          `json:"duration"`
+	Artifacts   []resultArtifact `json:"artifacts"`
+	FailedState string           `json:"failed-state,omitempty"`
+	Error       string           `json:"error,omitempty"`
+}
+
+// resultArtifact is a file created by the build
+type resultArtifact struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// buildSummarySchemaVersion is the version of the schema of the build summary of
+// --summary-json. It is only increased when a field is changed or removed, so that
+// the tools reading the summary keep working when fields are added
+const buildSummarySchemaVersion = 1
+
+// buildSummary is the summary of a successful build written with --summary-json
+type buildSummary struct {
+	SchemaVersion int              `json:"schema-version"`
+	ImageType     string           `json:"image-type"`
+	Duration      float64          `json:"duration"`
+	Artifacts     []resultArtifact `json:"artifacts"`
+	SnapCount     int              `json:"snap-count"`
+	PackageCount  int              `json:"package-count"`
+}
+
+// resultFilePath returns the path the build result is written to
+func (stateMachine *StateMachine) resultFilePath() string {
+	if stateMachine.commonFlags.ResultFile != "" {
+		return stateMachine.commonFlags.ResultFile
+	}
+	return filepath.Join(stateMachine.outputDirectory(), buildResultFileName)
+}
+
+// imageType returns the type of image built by the state machine
+func (stateMachine *StateMachine) imageType() string {
+	if _, ok := stateMachine.parent.(*ClassicStateMachine); ok {
+		return "classic"
+	}
+	return "snap"
+}
+
+// buildStatus returns whether the build succeeded, failed or was cancelled
+func (stateMachine *StateMachine) buildStatus() string {
+	if stateMachine.runErr == nil {
+		return buildStatusSuccess
+	}
+	if stateMachine.runContext().Err() != nil {
+		return buildStatusCancelled
+	}
+	return buildStatusFailure
+}
+
+// existingArtifacts returns the disk images and the other artifacts created by the
+// build. Files that were recorded but do not exist anymore, like the raw images that
+// were converted or compressed, are left out
+func (stateMachine *StateMachine) existingArtifacts() []string {
+	var artifacts []string
+	for _, file := range append(append([]string{}, stateMachine.ImageFiles...), stateMachine.Artifacts...) {
+		if _, err := os.Stat(file); err == nil {
+			artifacts = append(artifacts, file)
+		}
+	}
+	return artifacts
+}
+
+// resultArtifacts returns the files created by the build with their size and checksum
+func (stateMachine *StateMachine) resultArtifacts() ([]resultArtifact, error) {
+	artifacts := []resultArtifact{}
+	for _, file := range stateMachine.existingArtifacts() {
+		fileInfo, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		checksum, err := helper.CalculateSHA256(file)
+		if err != nil {
+			return nil, fmt.Errorf("Error calculating the checksum of %s: %s", file, err.Error())
+		}
+		artifacts = append(artifacts, resultArtifact{
+			Path:   file,
+			Size:   fileInfo.Size(),
+			SHA256: checksum,
+		})
+	}
+	return artifacts, nil
+}
+
+// writeBuildResult writes the outcome of the build started at buildStart,
+// along with the files it created
+func (stateMachine *StateMachine) writeBuildResult(buildStart time.Time, artifacts []resultArtifact) error {
+	result := buildResult{
+		ImageType: stateMachine.imageType(),
+		Status:    stateMachine.buildStatus(),
+		Duration:  time.Since(buildStart).Seconds(),
+		Artifacts: artifacts,
+	}
+	if stateMachine.runErr != nil {
+		result.FailedState = stateMachine.failedState
+		result.Error = stateMachine.runErr.Error()
+	}
+
+	resultBytes, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error encoding the build result: %s", err.Error())
+	}
+	if err := osWriteFile(stateMachine.resultFilePath(), append(resultBytes, '\n'), 0644); err != nil {
+		return fmt.Errorf("Error writing the build result: %s", err.Error())
+	}
+	return nil
+}
+
+// recordSetupResult writes the build result of a Setup started at setupStart that
+// failed with setupErr, since Teardown is not called then. setupErr is returned,
+// along with the error writing the result if there is one
+func (stateMachine *StateMachine) recordSetupResult(setupStart time.Time, setupErr error) error {
+	if setupErr == nil {
+		return nil
+	}
+	stateMachine.runErr = setupErr
+	if err := stateMachine.writeBuildResult(setupStart, []resultArtifact{}); err != nil {
+		return fmt.Errorf("%s\n%s", setupErr.Error(), err.Error())
+	}
+	return setupErr
+}
+
+// countInstalledPackages returns the number of deb packages installed in the
+// rootfs, read from the dpkg database. Rootfs without one, like the ones of snap
+// images, have none
+func countInstalledPackages(rootfs string) (int, error) {
+	status, err := os.ReadFile(filepath.Join(rootfs, "var", "lib", "dpkg", "status"))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Error reading the dpkg database: %s", err.Error())
+	}
+	count := 0
+	for _, line := range strings.Split(string(status), "\n") {
+		// the packages that were removed but not purged are still listed
+		if strings.TrimSpace(line) == "Status: install ok installed" {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// writeBuildSummary writes the --summary-json of a successful build
+func (stateMachine *StateMachine) writeBuildSummary(artifacts []resultArtifact) error {
+	seedSnaps, err := readSeedSnaps(stateMachine.tempDirs.rootfs)
+	if err != nil {
+		return err
+	}
+	packageCount, err := countInstalledPackages(stateMachine.tempDirs.rootfs)
+	if err != nil {
+		return err
+	}
+	summary := buildSummary{
+		SchemaVersion: buildSummarySchemaVersion,
+		ImageType:     stateMachine.imageType(),
+		Duration:      time.Since(stateMachine.runStart).Seconds(),
+		Artifacts:     artifacts,
+		SnapCount:     len(seedSnaps),
+		PackageCount:  packageCount,
+	}
+
+	summaryBytes, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error encoding the build summary: %s", err.Error())
+	}
+	if err := osWriteFile(stateMachine.commonFlags.SummaryJSON, append(summaryBytes, '\n'), 0644); err != nil {
+		return fmt.Errorf("Error writing the build summary: %s", err.Error())
+	}
+	return nil
+}
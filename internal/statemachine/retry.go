@@ -0,0 +1,116 @@
+package statemachine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// networkErrorMessages are found in the errors of the commands that download
+// something, like apt-get, debootstrap or git, when they fail because of the
+// network. Those errors are only known through the output of the commands
+var networkErrorMessages = []string{
+	"temporary failure resolving",
+	"temporary failure in name resolution",
+	"could not resolve",
+	"connection timed out",
+	"connection reset by peer",
+	"connection refused",
+	"network is unreachable",
+	"no route to host",
+	"unable to connect to",
+	"failed to fetch",
+	"hash sum mismatch",
+	"tls handshake timeout",
+	"i/o timeout",
+}
+
+// retriableErrnos are the system errors of network connections that could go away
+var retriableErrnos = []syscall.Errno{
+	syscall.ECONNRESET,
+	syscall.ECONNREFUSED,
+	syscall.ETIMEDOUT,
+	syscall.ENETUNREACH,
+	syscall.EHOSTUNREACH,
+}
+
+// IsRetriableError returns whether a build that failed with err could succeed
+// when it is run again, because it failed with a network or snap store error.
+// Cancelled and timed out builds, and errors about files, packages or snaps
+// that don't exist are not retriable, and neither is anything else, like an
+// invalid image definition, which would fail the same way every time
+func IsRetriableError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if isTransientStoreError(err) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	for _, errno := range retriableErrnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+
+	// most errors only carry the output of the commands that failed
+	errMsg := strings.ToLower(err.Error())
+	if strings.Contains(errMsg, "not found") {
+		return false
+	}
+	for _, message := range networkErrorMessages {
+		if strings.Contains(errMsg, message) {
+			return true
+		}
+	}
+	return false
+}
+
+// ResetWorkDir removes what a failed build left in the working directory, so that
+// it can be run again from a clean state with --retry-build. The temporary working
+// directory is removed altogether, while only what the build created is removed
+// from the one given with --workdir, which can hold other files: the temporary
+// directories, the state file and everything that was not in the work directory
+// when the build started
+func (stateMachine *StateMachine) ResetWorkDir() error {
+	workDir := stateMachine.stateMachineFlags.WorkDir
+	if workDir == "" {
+		return nil
+	}
+	if stateMachine.cleanWorkDir {
+		return stateMachine.cleanup()
+	}
+	buildPaths := []string{stateMachine.stateFilePath()}
+	for _, tempDir := range []string{stateMachine.tempDirs.rootfs, stateMachine.tempDirs.unpack,
+		stateMachine.tempDirs.volumes, stateMachine.tempDirs.chroot, stateMachine.tempDirs.scratch} {
+		if tempDir != "" {
+			buildPaths = append(buildPaths, tempDir)
+		}
+	}
+	// the work dir is only listed once the build started
+	if stateMachine.workDirEntries != nil {
+		entries, err := osReadDir(workDir)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Error cleaning up workDir: %s", err.Error())
+		}
+		for _, entry := range entries {
+			if !stateMachine.workDirEntries[entry.Name()] {
+				buildPaths = append(buildPaths, filepath.Join(workDir, entry.Name()))
+			}
+		}
+	}
+	for _, buildPath := range buildPaths {
+		if err := osRemoveAll(buildPath); err != nil {
+			return fmt.Errorf("Error cleaning up workDir: %s", err.Error())
+		}
+	}
+	return nil
+}
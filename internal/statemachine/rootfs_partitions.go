@@ -0,0 +1,278 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/snapcore/snapd/gadget"
+	"github.com/snapcore/snapd/gadget/quantity"
+)
+
+// rootfsOnlyDirs are the directories of the rootfs that are needed before the other
+// filesystems are mounted, so they can't be given a partition of their own
+var rootfsOnlyDirs = map[string]bool{
+	"/bin":  true,
+	"/dev":  true,
+	"/etc":  true,
+	"/lib":  true,
+	"/proc": true,
+	"/run":  true,
+	"/sbin": true,
+	"/sys":  true,
+	"/usr":  true,
+}
+
+// parseMountPoints reads the mount points of the structures of gadget.yaml that hold
+// a part of the rootfs, like /home or /var, which snapd ignores. They are returned
+// by volume name and index of the structure in the volume, for the structures that
+// have one
+func parseMountPoints(gadgetYaml *gadgetYamlExtensions,
+	gadgetInfo *gadget.Info) (map[string]map[int]string, error) {
+	mountPoints := make(map[string]map[int]string)
+	usedBy := make(map[string]string)
+	for volumeName, volume := range gadgetYaml.Volumes {
+		for structureNumber, structure := range volume.Structure {
+			mountPoint := structure.MountPoint
+			if mountPoint == "" {
+				continue
+			}
+			where := fmt.Sprintf("volumes:%s:structure:%d", volumeName, structureNumber)
+			gadgetStructure := gadgetInfo.Volumes[volumeName].Structure[structureNumber]
+			switch {
+			case !filepath.IsAbs(mountPoint) || filepath.Clean(mountPoint) != mountPoint ||
+				mountPoint == "/":
+				return nil, fmt.Errorf("%s: invalid mount point \"%s\", it must be a clean "+
+					"absolute path other than /", where, mountPoint)
+			case rootfsOnlyDirs[mountPoint]:
+				return nil, fmt.Errorf("%s: %s is needed to boot before the other filesystems "+
+					"are mounted, so it can't have a partition of its own", where, mountPoint)
+			case gadgetStructure.Filesystem == "":
+				return nil, fmt.Errorf("%s: a mount point can only be set on a structure "+
+					"with a filesystem", where)
+			case gadgetStructure.Role != "":
+				return nil, fmt.Errorf("%s: a mount point can not be set on a structure "+
+					"with the %s role", where, gadgetStructure.Role)
+			case len(gadgetStructure.Content) > 0:
+				return nil, fmt.Errorf("%s: a structure with a mount point is filled from "+
+					"the rootfs, so it can not have content", where)
+			case gadgetStructure.Label == "" && structure.FilesystemUUID == "":
+				return nil, fmt.Errorf("%s: a structure with a mount point needs a "+
+					"filesystem-label or a filesystem-uuid to be mounted at boot", where)
+			case usedBy[mountPoint] != "":
+				return nil, fmt.Errorf("%s: mount point %s is already set by %s",
+					where, mountPoint, usedBy[mountPoint])
+			}
+			usedBy[mountPoint] = where
+			if mountPoints[volumeName] == nil {
+				mountPoints[volumeName] = make(map[int]string)
+			}
+			mountPoints[volumeName][structureNumber] = mountPoint
+		}
+	}
+	return mountPoints, nil
+}
+
+// rootfsPartition is a structure of gadget.yaml holding a part of the rootfs
+type rootfsPartition struct {
+	volumeName      string
+	structureNumber int
+	mountPoint      string
+}
+
+// rootfsPartitions returns the structures holding a part of the rootfs, with the
+// deepest mount points first, so that /var/log is split out of /var before /var is
+func (stateMachine *StateMachine) rootfsPartitions() []rootfsPartition {
+	var partitions []rootfsPartition
+	for volumeName, volumeMountPoints := range stateMachine.MountPoints {
+		for structureNumber, mountPoint := range volumeMountPoints {
+			partitions = append(partitions, rootfsPartition{volumeName, structureNumber, mountPoint})
+		}
+	}
+	sort.Slice(partitions, func(i, j int) bool {
+		depthI := strings.Count(partitions[i].mountPoint, "/")
+		depthJ := strings.Count(partitions[j].mountPoint, "/")
+		if depthI != depthJ {
+			return depthI > depthJ
+		}
+		return partitions[i].mountPoint < partitions[j].mountPoint
+	})
+	return partitions
+}
+
+// splitRootfs moves the parts of the rootfs that have a partition of their own out of
+// it, leaving an empty mount point with the same mode, owner and modification time in
+// place. The directories holding the content of each of these partitions are returned
+// by volume name and index of the structure
+func (stateMachine *StateMachine) splitRootfs() (map[string]map[int]string, error) {
+	splitRoots := make(map[string]map[int]string)
+	for _, partition := range stateMachine.rootfsPartitions() {
+		rootfsDir := filepath.Join(stateMachine.tempDirs.rootfs, partition.mountPoint)
+		splitRoot := filepath.Join(stateMachine.tempDirs.volumes, partition.volumeName,
+			"rootfs-part"+strconv.Itoa(partition.structureNumber))
+		if splitRoots[partition.volumeName] == nil {
+			splitRoots[partition.volumeName] = make(map[int]string)
+		}
+
+		fileInfo, err := os.Lstat(rootfsDir)
+		if os.IsNotExist(err) {
+			// the partition is empty, but it still needs a mount point
+			if err := osMkdirAll(rootfsDir, 0755); err != nil {
+				return splitRoots, fmt.Errorf("Error creating mount point %s in the rootfs: %s",
+					partition.mountPoint, err.Error())
+			}
+			if err := osMkdirAll(splitRoot, 0755); err != nil {
+				return splitRoots, fmt.Errorf("Error creating the content directory of %s: %s",
+					partition.mountPoint, err.Error())
+			}
+			splitRoots[partition.volumeName][partition.structureNumber] = splitRoot
+			continue
+		}
+		if err != nil {
+			return splitRoots, fmt.Errorf("Error splitting %s out of the rootfs: %s",
+				partition.mountPoint, err.Error())
+		}
+		if !fileInfo.IsDir() {
+			return splitRoots, fmt.Errorf("Error splitting %s out of the rootfs: it is not a "+
+				"directory", partition.mountPoint)
+		}
+
+		if err := osRename(rootfsDir, splitRoot); err != nil {
+			return splitRoots, fmt.Errorf("Error splitting %s out of the rootfs: %s",
+				partition.mountPoint, err.Error())
+		}
+		splitRoots[partition.volumeName][partition.structureNumber] = splitRoot
+		if err := osMkdir(rootfsDir, fileInfo.Mode().Perm()); err != nil {
+			return splitRoots, fmt.Errorf("Error creating mount point %s in the rootfs: %s",
+				partition.mountPoint, err.Error())
+		}
+		// the mode is set again since the umask applies to os.Mkdir
+		if err := os.Chmod(rootfsDir, fileInfo.Mode()); err != nil {
+			return splitRoots, fmt.Errorf("Error setting the mode of mount point %s: %s",
+				partition.mountPoint, err.Error())
+		}
+		if stat, ok := fileInfo.Sys().(*syscall.Stat_t); ok {
+			if err := os.Lchown(rootfsDir, int(stat.Uid), int(stat.Gid)); err != nil {
+				return splitRoots, fmt.Errorf("Error setting the owner of mount point %s: %s",
+					partition.mountPoint, err.Error())
+			}
+		}
+		if err := os.Chtimes(rootfsDir, fileInfo.ModTime(), fileInfo.ModTime()); err != nil {
+			return splitRoots, fmt.Errorf("Error setting the modification time of mount "+
+				"point %s: %s", partition.mountPoint, err.Error())
+		}
+	}
+	return splitRoots, nil
+}
+
+// joinRootfs moves the parts of the rootfs split out by splitRootfs back in place,
+// in the reverse order, so that the states building artifacts from the rootfs after
+// the partitions are created still get all of it
+func (stateMachine *StateMachine) joinRootfs(splitRoots map[string]map[int]string) error {
+	partitions := stateMachine.rootfsPartitions()
+	for i := len(partitions) - 1; i >= 0; i-- {
+		partition := partitions[i]
+		splitRoot, found := splitRoots[partition.volumeName][partition.structureNumber]
+		if !found {
+			continue
+		}
+		rootfsDir := filepath.Join(stateMachine.tempDirs.rootfs, partition.mountPoint)
+		// the mount point is empty, unless the partition was empty too
+		if err := os.Remove(rootfsDir); err != nil {
+			return fmt.Errorf("Error removing mount point %s from the rootfs: %s",
+				partition.mountPoint, err.Error())
+		}
+		if err := osRename(splitRoot, rootfsDir); err != nil {
+			return fmt.Errorf("Error moving %s back into the rootfs: %s",
+				partition.mountPoint, err.Error())
+		}
+	}
+	return nil
+}
+
+// rootfsPartitionsSize returns the size of the parts of the rootfs that have a
+// partition of their own, which the rootfs partition doesn't need room for
+func (stateMachine *StateMachine) rootfsPartitionsSize() (quantity.Size, error) {
+	var size quantity.Size
+	for _, partition := range stateMachine.rootfsPartitions() {
+		rootfsDir := filepath.Join(stateMachine.tempDirs.rootfs, partition.mountPoint)
+		if _, err := os.Lstat(rootfsDir); os.IsNotExist(err) {
+			continue
+		}
+		// the nested mount points are included in the size of their parent already
+		nested := false
+		for _, other := range stateMachine.rootfsPartitions() {
+			nested = nested || strings.HasPrefix(partition.mountPoint, other.mountPoint+"/")
+		}
+		if nested {
+			continue
+		}
+		partitionSize, err := helper.Du(stateMachine.commandRunner(), rootfsDir)
+		if err != nil {
+			return 0, err
+		}
+		size += partitionSize
+	}
+	return size, nil
+}
+
+// rootfsPartitionsFstab returns the fstab entries mounting the partitions that
+// hold a part of the rootfs, as generate_fstab writes them
+func (stateMachine *StateMachine) rootfsPartitionsFstab() (map[string]string, error) {
+	entries := make(map[string]string)
+	for _, partition := range stateMachine.rootfsPartitions() {
+		structure := stateMachine.GadgetInfo.Volumes[partition.volumeName].Structure[partition.structureNumber]
+		entry, err := stateMachine.structureFstabEntry(partition.volumeName, partition.structureNumber,
+			structure, partition.mountPoint)
+		if err != nil {
+			return nil, err
+		}
+		entries[partition.mountPoint] = entry
+	}
+	return entries, nil
+}
+
+// addRootfsPartitionsToFstab adds the entries mounting the partitions that hold a part
+// of the rootfs to its fstab, in the order of their mount points, so that /var is
+// mounted before /var/log. The mount points that already have an entry are kept
+func (stateMachine *StateMachine) addRootfsPartitionsToFstab() error {
+	entries, err := stateMachine.rootfsPartitionsFstab()
+	if err != nil {
+		return fmt.Errorf("Error generating fstab: %s", err.Error())
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	fstabPath := filepath.Join(stateMachine.tempDirs.rootfs, "etc", "fstab")
+	fstabBytes, err := osReadFile(fstabPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error reading fstab: %s", err.Error())
+	}
+	fstab := string(fstabBytes)
+	for _, line := range strings.Split(fstab, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 1 && !strings.HasPrefix(fields[0], "#") {
+			delete(entries, fields[1])
+		}
+	}
+	var mountPoints []string
+	for mountPoint := range entries {
+		mountPoints = append(mountPoints, mountPoint)
+	}
+	sort.Strings(mountPoints)
+	if fstab != "" && !strings.HasSuffix(fstab, "\n") {
+		fstab += "\n"
+	}
+	for _, mountPoint := range mountPoints {
+		fstab += entries[mountPoint] + "\n"
+	}
+	if err := osWriteFile(fstabPath, []byte(fstab), 0644); err != nil {
+		return fmt.Errorf("Error writing to fstab: %s", err.Error())
+	}
+	return nil
+}
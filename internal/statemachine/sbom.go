@@ -0,0 +1,366 @@
+package statemachine
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/google/uuid"
+)
+
+// the format of the SBOMs that can be generated with --sbom
+const sbomFormatSPDX = "spdx"
+
+// spdxLicenseIDs maps the license names commonly used in machine-readable
+// debian/copyright files to their SPDX license identifier
+var spdxLicenseIDs = map[string]string{
+	"apache-2.0":       "Apache-2.0",
+	"artistic":         "Artistic-1.0",
+	"artistic-2.0":     "Artistic-2.0",
+	"bsd-2-clause":     "BSD-2-Clause",
+	"bsd-3-clause":     "BSD-3-Clause",
+	"bsd-4-clause":     "BSD-4-Clause",
+	"cc0-1.0":          "CC0-1.0",
+	"expat":            "MIT",
+	"gpl-1":            "GPL-1.0-only",
+	"gpl-1+":           "GPL-1.0-or-later",
+	"gpl-2":            "GPL-2.0-only",
+	"gpl-2+":           "GPL-2.0-or-later",
+	"gpl-3":            "GPL-3.0-only",
+	"gpl-3+":           "GPL-3.0-or-later",
+	"isc":              "ISC",
+	"lgpl-2":           "LGPL-2.0-only",
+	"lgpl-2+":          "LGPL-2.0-or-later",
+	"lgpl-2.1":         "LGPL-2.1-only",
+	"lgpl-2.1+":        "LGPL-2.1-or-later",
+	"lgpl-3":           "LGPL-3.0-only",
+	"lgpl-3+":          "LGPL-3.0-or-later",
+	"mit":              "MIT",
+	"mpl-1.1":          "MPL-1.1",
+	"mpl-2.0":          "MPL-2.0",
+	"openssl":          "OpenSSL",
+	"python-2.0":       "Python-2.0",
+	"zlib":             "Zlib",
+	"ofl-1.1":          "OFL-1.1",
+	"unicode-dfs-2016": "Unicode-DFS-2016",
+}
+
+// characters that are not allowed in SPDX identifiers
+var invalidSPDXIDChars = regexp.MustCompile("[^A-Za-z0-9.-]+")
+
+// debPackage is a package installed in the rootfs, as listed by dpkg-query
+type debPackage struct {
+	name          string
+	version       string
+	architecture  string
+	sourceName    string
+	sourceVersion string
+}
+
+// spdxDocument is an SPDX 2.3 document, as described in
+// https://spdx.github.io/spdx-spec/v2.3/
+type spdxDocument struct {
+	SPDXVersion                string                       `json:"spdxVersion"`
+	DataLicense                string                       `json:"dataLicense"`
+	SPDXID                     string                       `json:"SPDXID"`
+	Name                       string                       `json:"name"`
+	DocumentNamespace          string                       `json:"documentNamespace"`
+	CreationInfo               spdxCreationInfo             `json:"creationInfo"`
+	Packages                   []spdxPackage                `json:"packages"`
+	Relationships              []spdxRelationship           `json:"relationships"`
+	HasExtractedLicensingInfos []spdxExtractedLicensingInfo `json:"hasExtractedLicensingInfos,omitempty"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name             string            `json:"name"`
+	SPDXID           string            `json:"SPDXID"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	LicenseConcluded string            `json:"licenseConcluded"`
+	LicenseDeclared  string            `json:"licenseDeclared"`
+	CopyrightText    string            `json:"copyrightText"`
+	SourceInfo       string            `json:"sourceInfo,omitempty"`
+	PrimaryPurpose   string            `json:"primaryPackagePurpose,omitempty"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+type spdxExtractedLicensingInfo struct {
+	LicenseID     string `json:"licenseId"`
+	ExtractedText string `json:"extractedText"`
+	Name          string `json:"name"`
+}
+
+// parseDpkgQueryOutput parses the output of dpkg-query run with
+// sbomDpkgQueryFormat, skipping the packages that are not fully installed
+func parseDpkgQueryOutput(output string) []debPackage {
+	var packages []debPackage
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 6 || strings.TrimSpace(fields[0]) != "ii" {
+			continue
+		}
+		pkg := debPackage{
+			name:          fields[1],
+			version:       fields[2],
+			architecture:  fields[3],
+			sourceName:    fields[4],
+			sourceVersion: fields[5],
+		}
+		// dpkg-query leaves the source fields empty when they are the
+		// same as the binary package
+		if pkg.sourceName == "" {
+			pkg.sourceName = pkg.name
+		}
+		if pkg.sourceVersion == "" {
+			pkg.sourceVersion = pkg.version
+		}
+		packages = append(packages, pkg)
+	}
+	sort.Slice(packages, func(i, j int) bool { return packages[i].name < packages[j].name })
+	return packages
+}
+
+// the dpkg-query format parsed by parseDpkgQueryOutput
+const sbomDpkgQueryFormat = "${db:Status-Abbrev}\t${Package}\t${Version}\t${Architecture}\t" +
+	"${source:Package}\t${source:Version}\n"
+
+// readCopyrightLicenses returns the licenses listed in a machine-readable
+// debian/copyright file. Each License field becomes one entry, in the order
+// they first appear. Nothing is returned for files in any other format
+func readCopyrightLicenses(copyrightFile string) []string {
+	copyrightBytes, err := osReadFile(copyrightFile)
+	if err != nil {
+		return nil
+	}
+	lines := strings.Split(string(copyrightBytes), "\n")
+	if !strings.HasPrefix(lines[0], "Format:") {
+		return nil
+	}
+
+	var licenses []string
+	seen := make(map[string]bool)
+	for _, line := range lines {
+		// continuation lines start with a space and hold the license text
+		if !strings.HasPrefix(line, "License:") {
+			continue
+		}
+		license := strings.TrimSpace(strings.TrimPrefix(line, "License:"))
+		if license != "" && !seen[license] {
+			seen[license] = true
+			licenses = append(licenses, license)
+		}
+	}
+	return licenses
+}
+
+// spdxLicenseExpression converts the licenses of a debian/copyright file to an
+// SPDX license expression. Licenses without an SPDX identifier are referenced
+// with a LicenseRef, which is recorded in extractedLicenses
+func spdxLicenseExpression(licenses []string, extractedLicenses map[string]string) string {
+	if len(licenses) == 0 {
+		return "NOASSERTION"
+	}
+	var expressions []string
+	for _, license := range licenses {
+		// the files of a package can be under a choice of licenses
+		var choices []string
+		for _, choice := range strings.Split(license, " or ") {
+			choice = strings.TrimSpace(choice)
+			spdxID, found := spdxLicenseIDs[strings.ToLower(choice)]
+			if !found {
+				spdxID = "LicenseRef-" + strings.Trim(invalidSPDXIDChars.ReplaceAllString(choice, "-"), "-")
+				extractedLicenses[spdxID] = choice
+			}
+			choices = append(choices, spdxID)
+		}
+		if len(choices) > 1 {
+			expressions = append(expressions, "("+strings.Join(choices, " OR ")+")")
+		} else {
+			expressions = append(expressions, choices[0])
+		}
+	}
+	if len(expressions) == 1 {
+		return strings.TrimSuffix(strings.TrimPrefix(expressions[0], "("), ")")
+	}
+	return strings.Join(expressions, " AND ")
+}
+
+// spdxCreationTime returns the creation time of the SBOM. SOURCE_DATE_EPOCH is
+// honored so that the SBOM of a reproducible build is reproducible as well
+func spdxCreationTime() string {
+	created := time.Now()
+	if sourceDateEpoch, isSet, err := helper.SourceDateEpoch(); err == nil && isSet {
+		created = sourceDateEpoch
+	}
+	return created.UTC().Format(time.RFC3339)
+}
+
+// spdxDocumentID returns the unique part of the namespace of the SBOM. It is derived
+// from SOURCE_DATE_EPOCH when it is set, and random otherwise
+func spdxDocumentID(imageName string) string {
+	if sourceDateEpoch, isSet, err := helper.SourceDateEpoch(); err == nil && isSet {
+		return uuid.NewSHA1(uuid.NameSpaceURL,
+			[]byte(fmt.Sprintf("%s/%d", imageName, sourceDateEpoch.Unix()))).String()
+	}
+	return uuid.NewString()
+}
+
+// newSPDXDocument creates an SPDX document for an image that contains the given deb
+// packages. Every binary package is related to the source package it was built from
+func newSPDXDocument(imageName, series, rootfs string, packages []debPackage) *spdxDocument {
+	document := &spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              imageName,
+		DocumentNamespace: "https://ubuntu.com/ubuntu-image/spdx/" + url.PathEscape(imageName) + "-" + spdxDocumentID(imageName),
+		CreationInfo: spdxCreationInfo{
+			Created:  spdxCreationTime(),
+			Creators: []string{"Tool: ubuntu-image"},
+		},
+	}
+
+	imageID := "SPDXRef-Image"
+	document.Packages = append(document.Packages, spdxPackage{
+		Name:             imageName,
+		SPDXID:           imageID,
+		DownloadLocation: "NOASSERTION",
+		LicenseConcluded: "NOASSERTION",
+		LicenseDeclared:  "NOASSERTION",
+		CopyrightText:    "NOASSERTION",
+		PrimaryPurpose:   "OPERATING-SYSTEM",
+	})
+	document.Relationships = append(document.Relationships, spdxRelationship{
+		SPDXElementID:      document.SPDXID,
+		RelationshipType:   "DESCRIBES",
+		RelatedSPDXElement: imageID,
+	})
+
+	// SPDX identifiers only allow a few characters, so make sure that the
+	// package names that only differ in the other ones still get unique IDs
+	usedIDs := make(map[string]bool)
+	spdxID := func(prefix, name string) string {
+		id := prefix + invalidSPDXIDChars.ReplaceAllString(name, "-")
+		uniqueID := id
+		for i := 2; usedIDs[uniqueID]; i++ {
+			uniqueID = fmt.Sprintf("%s-%d", id, i)
+		}
+		usedIDs[uniqueID] = true
+		return uniqueID
+	}
+
+	extractedLicenses := make(map[string]string)
+	sourceIDs := make(map[string]string)
+	for _, pkg := range packages {
+		copyrightFile := filepath.Join(rootfs, "usr", "share", "doc", pkg.name, "copyright")
+		binaryID := spdxID("SPDXRef-Package-deb-", pkg.name)
+		document.Packages = append(document.Packages, spdxPackage{
+			Name:             pkg.name,
+			SPDXID:           binaryID,
+			VersionInfo:      pkg.version,
+			DownloadLocation: "NOASSERTION",
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  spdxLicenseExpression(readCopyrightLicenses(copyrightFile), extractedLicenses),
+			CopyrightText:    "NOASSERTION",
+			SourceInfo:       fmt.Sprintf("built package from: %s %s", pkg.sourceName, pkg.sourceVersion),
+			ExternalRefs: []spdxExternalRef{{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator: fmt.Sprintf("pkg:deb/ubuntu/%s@%s?arch=%s&distro=%s",
+					url.PathEscape(pkg.name), url.QueryEscape(pkg.version), pkg.architecture, series),
+			}},
+		})
+		document.Relationships = append(document.Relationships, spdxRelationship{
+			SPDXElementID:      imageID,
+			RelationshipType:   "CONTAINS",
+			RelatedSPDXElement: binaryID,
+		})
+
+		// several binary packages are usually built from the same source package
+		sourceKey := pkg.sourceName + " " + pkg.sourceVersion
+		sourceID, found := sourceIDs[sourceKey]
+		if !found {
+			sourceID = spdxID("SPDXRef-Package-source-", pkg.sourceName)
+			sourceIDs[sourceKey] = sourceID
+			document.Packages = append(document.Packages, spdxPackage{
+				Name:             pkg.sourceName,
+				SPDXID:           sourceID,
+				VersionInfo:      pkg.sourceVersion,
+				DownloadLocation: "NOASSERTION",
+				LicenseConcluded: "NOASSERTION",
+				LicenseDeclared:  "NOASSERTION",
+				CopyrightText:    "NOASSERTION",
+				PrimaryPurpose:   "SOURCE",
+				ExternalRefs: []spdxExternalRef{{
+					ReferenceCategory: "PACKAGE-MANAGER",
+					ReferenceType:     "purl",
+					ReferenceLocator: fmt.Sprintf("pkg:deb/ubuntu/%s@%s?arch=source&distro=%s",
+						url.PathEscape(pkg.sourceName), url.QueryEscape(pkg.sourceVersion), series),
+				}},
+			})
+		}
+		document.Relationships = append(document.Relationships, spdxRelationship{
+			SPDXElementID:      binaryID,
+			RelationshipType:   "GENERATED_FROM",
+			RelatedSPDXElement: sourceID,
+		})
+	}
+
+	licenseIDs := make([]string, 0, len(extractedLicenses))
+	for licenseID := range extractedLicenses {
+		licenseIDs = append(licenseIDs, licenseID)
+	}
+	sort.Strings(licenseIDs)
+	for _, licenseID := range licenseIDs {
+		document.HasExtractedLicensingInfos = append(document.HasExtractedLicensingInfos,
+			spdxExtractedLicensingInfo{
+				LicenseID: licenseID,
+				Name:      extractedLicenses[licenseID],
+				ExtractedText: fmt.Sprintf("The \"%s\" license, as named in the debian/copyright "+
+					"file of the packages using it", extractedLicenses[licenseID]),
+			})
+	}
+
+	return document
+}
+
+// writeSPDXDocument writes the document as indented JSON
+func writeSPDXDocument(document *spdxDocument, outputPath string) error {
+	documentBytes, err := json.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error encoding the SBOM: %s", err.Error())
+	}
+	sbomFile, err := osCreate(outputPath)
+	if err != nil {
+		return fmt.Errorf("Error creating SBOM file: %s", err.Error())
+	}
+	defer sbomFile.Close()
+	if _, err := sbomFile.Write(append(documentBytes, '\n')); err != nil {
+		return fmt.Errorf("Error writing SBOM file: %s", err.Error())
+	}
+	return nil
+}
@@ -1,7 +1,11 @@
 package statemachine
 
 import (
+	"time"
+
 	"github.com/canonical/ubuntu-image/internal/commands"
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/snapcore/snapd/snap"
 )
 
 // snapStates are the names and function variables to be executed by the state machine for snap images
@@ -9,14 +13,18 @@ var snapStates = []stateFunc{
 	{"make_temporary_directories", (*StateMachine).makeTemporaryDirectories},
 	{"determine_output_directory", (*StateMachine).determineOutputDirectory},
 	{"prepare_image", (*StateMachine).prepareImage},
+	{"validate_gadget_yaml", (*StateMachine).validateGadgetYaml},
 	{"load_gadget_yaml", (*StateMachine).loadGadgetYaml},
 	{"set_artifact_names", (*StateMachine).setArtifactNames},
 	{"populate_rootfs_contents", (*StateMachine).populateSnapRootfsContents},
+	{"check_model_snaps", (*StateMachine).checkModelSnaps},
+	{"check_snap_bases", (*StateMachine).checkSnapBases},
 	{"generate_disk_info", (*StateMachine).generateDiskInfo},
 	{"calculate_rootfs_size", (*StateMachine).calculateRootfsSize},
 	{"populate_bootfs_contents", (*StateMachine).populateBootfsContents},
 	{"populate_prepare_partitions", (*StateMachine).populatePreparePartitions},
 	{"make_disk", (*StateMachine).makeDisk},
+	{"verify_partition_tables", (*StateMachine).verifyPartitionTables},
 	{"generate_manifest", (*StateMachine).generateSnapManifest},
 	{"finish", (*StateMachine).finish},
 }
@@ -31,12 +39,73 @@ type SnapStateMachine struct {
 // Setup assigns variables and calls other functions that must be executed before Run(). It is
 // exported so it can be used as a polymorphism in main
 func (snapStateMachine *SnapStateMachine) Setup() error {
+	setupStart := time.Now()
+	return snapStateMachine.recordSetupResult(setupStart, snapStateMachine.setup())
+}
+
+// setup validates the options and sets up the states of the build. Its error
+// is recorded in the build result by Setup
+func (snapStateMachine *SnapStateMachine) setup() error {
 	// set the parent pointer of the embedded struct
 	snapStateMachine.parent = snapStateMachine
 
 	// set the states that will be used for this image type
 	snapStateMachine.states = snapStates
 
+	// the filesystems are checked before they are written to the disk images
+	if snapStateMachine.commonFlags.VerifyFS {
+		snapStateMachine.states = insertStatesAfter(snapStateMachine.states,
+			"populate_prepare_partitions",
+			stateFunc{"verify_filesystems", (*StateMachine).verifyFilesystems})
+	}
+
+	// with SOURCE_DATE_EPOCH, the modification times are clamped once the contents
+	// of all the partitions are in place, before their filesystems are created
+	if _, isSet, _ := helper.SourceDateEpoch(); isSet {
+		snapStateMachine.states = insertStatesAfter(snapStateMachine.states,
+			"populate_bootfs_contents",
+			stateFunc{"clamp_mtimes", (*StateMachine).clampMtimes})
+	}
+
+	// the boot components are measured once they are in the ESP
+	if snapStateMachine.commonFlags.Measure != "" {
+		snapStateMachine.states = insertStatesAfter(snapStateMachine.states,
+			"populate_bootfs_contents",
+			stateFunc{"measure_boot_components", (*StateMachine).measureBootComponents})
+	}
+
+	// the disk image is written to the device before it is compressed
+	if snapStateMachine.commonFlags.OutputDevice != "" {
+		snapStateMachine.states = insertStatesBeforeFinish(snapStateMachine.states,
+			stateFunc{"write_output_device", (*StateMachine).writeOutputDevice})
+	}
+
+	// the disk images are compressed once they have been created
+	if snapStateMachine.commonFlags.Compress != "" {
+		snapStateMachine.states = insertStatesBeforeFinish(snapStateMachine.states,
+			stateFunc{"compress_disk_images", (*StateMachine).compressDiskImages})
+	}
+
+	// the build manifest is named after the disk images, so it is written once
+	// they have been created
+	if snapStateMachine.commonFlags.Manifest || snapStateMachine.commonFlags.ManifestPath != "" {
+		snapStateMachine.states = insertStatesBeforeFinish(snapStateMachine.states,
+			stateFunc{"generate_build_manifest", (*StateMachine).generateBuildManifest})
+	}
+
+	// checksums are calculated once all the disk images have been created
+	if snapStateMachine.commonFlags.Checksum != "" {
+		snapStateMachine.states = insertStatesBeforeFinish(snapStateMachine.states,
+			stateFunc{"generate_checksums", (*StateMachine).generateChecksums})
+	}
+
+	// the final artifacts are signed last, once they are compressed and their
+	// checksums are known
+	if snapStateMachine.commonFlags.SignKey != "" {
+		snapStateMachine.states = insertStatesBeforeFinish(snapStateMachine.states,
+			stateFunc{"sign_artifacts", (*StateMachine).signArtifacts})
+	}
+
 	// do the validation common to all image types
 	if err := snapStateMachine.validateInput(); err != nil {
 		return err
@@ -47,6 +116,34 @@ func (snapStateMachine *SnapStateMachine) Setup() error {
 		return err
 	}
 
+	// the store is determined by the model, so make sure it is the expected one
+	if err := snapStateMachine.checkModelStore(); err != nil {
+		return err
+	}
+
+	// the base can only be seeded from another channel if the model allows it
+	if err := snapStateMachine.checkBaseSnap(); err != nil {
+		return err
+	}
+
+	// with --offline, make sure that all the snaps are available before building anything
+	if snapStateMachine.commonFlags.Offline {
+		modelSnaps, err := modelSnapNames(snapStateMachine.Args.ModelAssertion)
+		if err != nil {
+			return err
+		}
+		snapNames, _, revisions, err := parseSnapsAndChannels(snapStateMachine.snapArgs())
+		if err != nil {
+			return err
+		}
+		for snapName, snapRev := range snapStateMachine.Opts.Revisions {
+			revisions[snapName] = snap.R(snapRev)
+		}
+		if err := snapStateMachine.checkOfflineSnaps(append(modelSnaps, snapNames...), revisions); err != nil {
+			return err
+		}
+	}
+
 	// if --resume was passed, figure out where to start
 	if err := snapStateMachine.readMetadata(); err != nil {
 		return err
@@ -2,11 +2,12 @@ package statemachine
 
 import (
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 
+	"github.com/snapcore/snapd/asserts"
 	"github.com/snapcore/snapd/image"
+	"github.com/snapcore/snapd/osutil"
 	"github.com/snapcore/snapd/snap"
 )
 
@@ -15,13 +16,101 @@ func (stateMachine *StateMachine) prepareImage() error {
 	var snapStateMachine *SnapStateMachine
 	snapStateMachine = stateMachine.parent.(*SnapStateMachine)
 
+	// image.Prepare and the download progress rely on global state of snapd
+	imagePrepareMutex.Lock()
+	defer imagePrepareMutex.Unlock()
+
+	imageOpts, err := stateMachine.snapImageOptions()
+	if err != nil {
+		return err
+	}
+	stateMachine.recordPinnedRevisions(imageOpts.Revisions)
+	stateMachine.SnapCohorts, err = stateMachine.pinCohortRevisions(stateMachine.context(),
+		stateMachine.printWarning, imageOpts, snapStateMachine.Opts.Cohorts)
+	if err != nil {
+		return err
+	}
+
+	// use the snaps of --snap-dir, including the ones that are only listed in the model
+	var modelSnaps []string
+	if stateMachine.commonFlags.SnapDir != "" {
+		modelSnaps, err = modelSnapNames(imageOpts.ModelFile)
+		if err != nil {
+			return err
+		}
+	}
+	storeURL, stopStore, err := stateMachine.useLocalSnaps(imageOpts, modelSnaps)
+	if err != nil {
+		return err
+	}
+	defer stopStore()
+
+	// plug/slot sanitization not used by snap image.Prepare, make it no-op.
+	snap.SanitizePlugsSlots = func(snapInfo *snap.Info) {}
+
+	// image.Prepare refuses to write over a seed left behind by a previous build
+	if err := osRemoveAll(stateMachine.tempDirs.unpack); err != nil {
+		return fmt.Errorf("Error removing the partially prepared image: %s", err.Error())
+	}
+	seedRoot := filepath.Join(stateMachine.tempDirs.unpack, "image")
+	seedSnapsDir := filepath.Join(seedRoot, "var", "lib", "snapd", "seed", "snaps")
+	model, err := readModelAssertion(imageOpts.ModelFile)
+	if err != nil {
+		return err
+	}
+	if model.Grade() != asserts.ModelGradeUnset {
+		seedRoot = filepath.Join(stateMachine.tempDirs.unpack, "system-seed")
+		seedSnapsDir = filepath.Join(seedRoot, "snaps")
+	}
+	prefetchedSnaps, err := stateMachine.prefetchSnaps(imageOpts, seedSnapsDir)
+	if err != nil {
+		return err
+	}
+
+	downloads, stopTracking := stateMachine.trackDownloads("Downloading snaps")
+	attempts := 0
+	err = stateMachine.retryDownloadWarning(stateMachine.context(), "Preparing the image",
+		stateMachine.warningAbove(downloads), func() error {
+			// and a seed left behind by a failed attempt, which removes the prefetched snaps
+			attempts++
+			if attempts > 1 {
+				if err := osRemoveAll(stateMachine.tempDirs.unpack); err != nil {
+					return fmt.Errorf("Error removing the partially prepared image: %s", err.Error())
+				}
+			}
+			return stateMachine.runImagePrepare(imageOpts, storeURL)
+		})
+	stopTracking()
+	if err != nil {
+		return fmt.Errorf("Error preparing image: %s", err.Error())
+	}
+	if err := removeUnusedSnaps(seedRoot, prefetchedSnaps); err != nil {
+		return err
+	}
+	if osutil.FileExists(imageOpts.SeedManifestPath) {
+		stateMachine.addArtifact(imageOpts.SeedManifestPath)
+	}
+
+	// set the gadget yaml location
+	snapStateMachine.YamlFilePath = filepath.Join(stateMachine.tempDirs.unpack, "gadget", "meta", "gadget.yaml")
+
+	return nil
+}
+
+// snapImageOptions returns the options image.Prepare is called with for the model,
+// the snaps and the customizations of the command line. The revisions of the cohorts
+// are not pinned yet
+func (stateMachine *StateMachine) snapImageOptions() (*image.Options, error) {
+	var snapStateMachine *SnapStateMachine
+	snapStateMachine = stateMachine.parent.(*SnapStateMachine)
+
 	var imageOpts image.Options
 
 	var err error
-	imageOpts.Snaps, imageOpts.SnapChannels, err = parseSnapsAndChannels(
-		snapStateMachine.Opts.Snaps)
+	imageOpts.Snaps, imageOpts.SnapChannels, imageOpts.Revisions, err = parseSnapsAndChannels(
+		snapStateMachine.snapArgs())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	imageOpts.PrepareDir = snapStateMachine.tempDirs.unpack
@@ -29,11 +118,11 @@ func (stateMachine *StateMachine) prepareImage() error {
 	if snapStateMachine.commonFlags.Channel != "" {
 		imageOpts.Channel = snapStateMachine.commonFlags.Channel
 	}
-	imageOpts.Revisions = make(map[string]snap.Revision)
+	// --revision takes precedence over the revisions given with --snap
 	for snapName, snapRev := range snapStateMachine.Opts.Revisions {
-		fmt.Printf("WARNING: revision %d for snap %s may not be the latest available version!\n", snapRev, snapName)
 		imageOpts.Revisions[snapName] = snap.Revision{N: snapRev}
 	}
+	stateMachine.forceChannel(imageOpts.Snaps, imageOpts.SnapChannels, imageOpts.Revisions)
 
 	// preseeding-related
 	imageOpts.Preseed = snapStateMachine.Opts.Preseed
@@ -52,27 +141,7 @@ func (stateMachine *StateMachine) prepareImage() error {
 	customizations.Validation = stateMachine.commonFlags.Validation
 	imageOpts.Customizations = customizations
 
-	// plug/slot sanitization not used by snap image.Prepare, make it no-op.
-	snap.SanitizePlugsSlots = func(snapInfo *snap.Info) {}
-
-	// image.Prepare automatically has some output that we only want for
-	// verbose or greater logging
-	if !stateMachine.commonFlags.Debug && !stateMachine.commonFlags.Verbose {
-		oldImageStdout := image.Stdout
-		image.Stdout = io.Discard
-		defer func() {
-			image.Stdout = oldImageStdout
-		}()
-	}
-
-	if err := imagePrepare(&imageOpts); err != nil {
-		return fmt.Errorf("Error preparing image: %s", err.Error())
-	}
-
-	// set the gadget yaml location
-	snapStateMachine.YamlFilePath = filepath.Join(stateMachine.tempDirs.unpack, "gadget", "meta", "gadget.yaml")
-
-	return nil
+	return &imageOpts, nil
 }
 
 // for snap/core image builds, the image name is always <volume-name>.img for
@@ -133,5 +202,9 @@ func (stateMachine *StateMachine) generateSnapManifest() error {
 	// snaps.manifest
 	outputPath := filepath.Join(stateMachine.commonFlags.OutputDir, "snaps.manifest")
 	snapsDir := filepath.Join(stateMachine.tempDirs.rootfs, "system-data", "var", "lib", "snapd", "snaps")
-	return WriteSnapManifest(snapsDir, outputPath)
+	if err := WriteSnapManifest(snapsDir, outputPath); err != nil {
+		return err
+	}
+	stateMachine.addArtifact(outputPath)
+	return nil
 }
@@ -6,9 +6,11 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"runtime"
 	"strconv"
@@ -16,8 +18,12 @@ import (
 	"testing"
 
 	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/snapcore/snapd/asserts"
 	"github.com/snapcore/snapd/image"
+	"github.com/snapcore/snapd/seed"
+	"github.com/snapcore/snapd/snap"
 	"github.com/snapcore/snapd/store"
+	"github.com/snapcore/snapd/store/tooling"
 )
 
 // TestFailedValidateInputSnap tests a failure in the Setup() function when validating common input
@@ -44,6 +50,7 @@ func TestFailedSnapSetup(t *testing.T) {
 			stateMachine.parent = &stateMachine
 			stateMachine.stateMachineFlags.Until = tc.until
 			stateMachine.stateMachineFlags.Thru = tc.thru
+			stateMachine.commonFlags.ResultFile = filepath.Join(t.TempDir(), "build-result.json")
 
 			err := stateMachine.Setup()
 			asserter.AssertErrContains(err, tc.errMsg)
@@ -64,6 +71,7 @@ func TestFailedReadMetadataSnap(t *testing.T) {
 		stateMachine.parent = &stateMachine
 		stateMachine.stateMachineFlags.Resume = true
 		stateMachine.stateMachineFlags.WorkDir = testDir
+		stateMachine.commonFlags.ResultFile = filepath.Join(t.TempDir(), "build-result.json")
 
 		err := stateMachine.Setup()
 		asserter.AssertErrContains(err, "error reading metadata file")
@@ -189,6 +197,7 @@ func TestFailedPrepareImage(t *testing.T) {
 		stateMachine.parent = &stateMachine
 		stateMachine.Args.ModelAssertion = filepath.Join("testdata", "modelAssertion20")
 		stateMachine.Opts.DisableConsoleConf = true
+		stateMachine.commonFlags.ResultFile = filepath.Join(t.TempDir(), "build-result.json")
 
 		err := stateMachine.Setup()
 		asserter.AssertErrNil(err, true)
@@ -638,6 +647,65 @@ func TestGadgetEdgeCases(t *testing.T) {
 	})
 }
 
+// TestForceChannel tests that --channel only replaces the channels given with --snap
+// when --force-channel is passed, and never the channel of the pinned snaps
+func TestForceChannel(t *testing.T) {
+	testCases := []struct {
+		name             string
+		forceChannel     bool
+		expectedChannels map[string]string
+	}{
+		{"default_channel", false, map[string]string{"hello": "candidate", "core20": "beta"}},
+		{"force_channel", true, map[string]string{"hello": "edge", "core20": "beta", "lxd": "edge"}},
+	}
+	for _, tc := range testCases {
+		t.Run("test_force_channel_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			saveCWD := helper.SaveCWD()
+			defer saveCWD()
+
+			var calledOpts *image.Options
+			imagePrepare = func(opts *image.Options) error {
+				calledOpts = opts
+				return nil
+			}
+			defer func() {
+				imagePrepare = image.Prepare
+			}()
+
+			var stateMachine SnapStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.parent = &stateMachine
+			stateMachine.Args.ModelAssertion = filepath.Join("testdata", "modelAssertionValidation")
+			workDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(workDir)
+			stateMachine.stateMachineFlags.WorkDir = workDir
+			stateMachine.stateMachineFlags.Thru = "prepare_image"
+			stateMachine.commonFlags.Channel = "edge"
+			stateMachine.commonFlags.ForceChannel = tc.forceChannel
+			stateMachine.Opts.Snaps = []string{"hello=candidate", "core20=beta", "lxd"}
+			stateMachine.Opts.Revisions = map[string]int{"core20": 1234}
+
+			err = stateMachine.Setup()
+			asserter.AssertErrNil(err, true)
+
+			err = stateMachine.Run()
+			asserter.AssertErrNil(err, true)
+
+			if calledOpts.Channel != "edge" {
+				t.Errorf("Expected the default channel to be edge, but got %s", calledOpts.Channel)
+			}
+			if !reflect.DeepEqual(calledOpts.SnapChannels, tc.expectedChannels) {
+				t.Errorf("Expected snap channels %v, but got %v", tc.expectedChannels, calledOpts.SnapChannels)
+			}
+
+			err = stateMachine.Teardown()
+			asserter.AssertErrNil(err, true)
+		})
+	}
+}
+
 func TestPreseedFlag(t *testing.T) {
 	t.Run("test_preseed_flag", func(t *testing.T) {
 		asserter := helper.Asserter{T: t}
@@ -694,3 +762,559 @@ func TestPreseedFlag(t *testing.T) {
 		asserter.AssertErrNil(err, true)
 	})
 }
+
+// TestSnapChecksumState tests that --checksum adds the generate_checksums state
+// right before finish without modifying the default list of snap states
+func TestSnapChecksumState(t *testing.T) {
+	t.Run("test_snap_checksum_state", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine SnapStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.commonFlags.Checksum = "sha256"
+		stateMachine.parent = &stateMachine
+		stateMachine.Args.ModelAssertion = filepath.Join("testdata", "modelAssertion20")
+		workDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(workDir)
+		stateMachine.stateMachineFlags.WorkDir = workDir
+
+		err = stateMachine.Setup()
+		asserter.AssertErrNil(err, true)
+
+		numStates := len(stateMachine.states)
+		if numStates != len(snapStates)+1 {
+			t.Fatalf("Expected %d states, but got %d", len(snapStates)+1, numStates)
+		}
+		if stateMachine.states[numStates-2].name != "generate_checksums" {
+			t.Errorf("Expected generate_checksums to be run before finish, but got %s",
+				stateMachine.states[numStates-2].name)
+		}
+		for _, state := range snapStates {
+			if state.name == "generate_checksums" {
+				t.Errorf("generate_checksums was added to the default snap states")
+			}
+		}
+	})
+}
+
+// TestSnapSignState tests that --sign-key adds the sign_artifacts state after
+// the checksums are generated, so that the checksum file is signed too
+func TestSnapSignState(t *testing.T) {
+	t.Run("test_snap_sign_state", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine SnapStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.commonFlags.Checksum = "sha256"
+		stateMachine.commonFlags.Compress = "xz"
+		stateMachine.commonFlags.SignKey = "0123456789ABCDEF"
+		stateMachine.parent = &stateMachine
+		stateMachine.Args.ModelAssertion = filepath.Join("testdata", "modelAssertion20")
+
+		err := stateMachine.Setup()
+		asserter.AssertErrNil(err, true)
+
+		numStates := len(stateMachine.states)
+		lastStates := []string{
+			stateMachine.states[numStates-4].name,
+			stateMachine.states[numStates-3].name,
+			stateMachine.states[numStates-2].name,
+			stateMachine.states[numStates-1].name,
+		}
+		expected := []string{"compress_disk_images", "generate_checksums", "sign_artifacts", "finish"}
+		if !reflect.DeepEqual(lastStates, expected) {
+			t.Errorf("Expected final states %v, but got %v", expected, lastStates)
+		}
+	})
+}
+
+// TestSnapOutputDeviceState tests that --output-device adds the write_output_device
+// state before the disk images are compressed
+func TestSnapOutputDeviceState(t *testing.T) {
+	t.Run("test_snap_output_device_state", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine SnapStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.commonFlags.Compress = "xz"
+		stateMachine.parent = &stateMachine
+		stateMachine.Args.ModelAssertion = filepath.Join("testdata", "modelAssertion20")
+
+		tmpDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(tmpDir)
+		stateMachine.commonFlags.OutputDevice = fakeOutputDevice(t, tmpDir, "1", 1<<20, "")
+		defer func() {
+			sysBlockDir = "/sys/block"
+			procMountsFile = "/proc/self/mounts"
+		}()
+
+		err = stateMachine.Setup()
+		asserter.AssertErrNil(err, true)
+
+		numStates := len(stateMachine.states)
+		lastStates := []string{
+			stateMachine.states[numStates-3].name,
+			stateMachine.states[numStates-2].name,
+			stateMachine.states[numStates-1].name,
+		}
+		expected := []string{"write_output_device", "compress_disk_images", "finish"}
+		if !reflect.DeepEqual(lastStates, expected) {
+			t.Errorf("Expected final states %v, but got %v", expected, lastStates)
+		}
+	})
+}
+
+// TestSnapVerifyFSState tests that --verify-fs adds the verify_filesystems state
+// right after the partition images are populated
+func TestSnapVerifyFSState(t *testing.T) {
+	t.Run("test_snap_verify_fs_state", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine SnapStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.commonFlags.VerifyFS = true
+		stateMachine.parent = &stateMachine
+		stateMachine.Args.ModelAssertion = filepath.Join("testdata", "modelAssertion20")
+		workDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+		asserter.AssertErrNil(err, true)
+		defer os.RemoveAll(workDir)
+		stateMachine.stateMachineFlags.WorkDir = workDir
+
+		err = stateMachine.Setup()
+		asserter.AssertErrNil(err, true)
+
+		if len(stateMachine.states) != len(snapStates)+1 {
+			t.Fatalf("Expected %d states, but got %d", len(snapStates)+1, len(stateMachine.states))
+		}
+		for i, state := range stateMachine.states {
+			if state.name == "verify_filesystems" {
+				if stateMachine.states[i-1].name != "populate_prepare_partitions" ||
+					stateMachine.states[i+1].name != "make_disk" {
+					t.Errorf("Expected verify_filesystems to run between "+
+						"populate_prepare_partitions and make_disk, but got %s and %s",
+						stateMachine.states[i-1].name, stateMachine.states[i+1].name)
+				}
+				return
+			}
+		}
+		t.Errorf("verify_filesystems was not added to the states")
+	})
+}
+
+// TestCheckModelStore tests that --store must be the store of the model assertion
+func TestCheckModelStore(t *testing.T) {
+	t.Run("test_check_model_store", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine SnapStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.Args.ModelAssertion = filepath.Join("testdata", "modelAssertion20")
+
+		err := stateMachine.checkModelStore()
+		asserter.AssertErrNil(err, true)
+
+		stateMachine.Opts.Store = "brand-store"
+		err = stateMachine.checkModelStore()
+		asserter.AssertErrContains(err, "--store brand-store does not match the store of "+
+			"model canonical/ubuntu-core-20-amd64: the global snap store")
+
+		stateMachine.Args.ModelAssertion = filepath.Join("testdata", "missing")
+		err = stateMachine.checkModelStore()
+		asserter.AssertErrContains(err, "Error reading model assertion")
+	})
+}
+
+// TestCheckBaseSnap tests that --base-snap must be a base allowed by the model, and
+// that it replaces the base passed with --snap
+func TestCheckBaseSnap(t *testing.T) {
+	t.Run("test_check_base_snap", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine SnapStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.Args.ModelAssertion = filepath.Join("testdata", "modelAssertion20")
+
+		err := stateMachine.checkBaseSnap()
+		asserter.AssertErrNil(err, true)
+
+		stateMachine.Opts.BaseSnap = "core20=edge"
+		stateMachine.Opts.Snaps = []string{"hello=candidate", "core20=beta"}
+		err = stateMachine.checkBaseSnap()
+		asserter.AssertErrNil(err, true)
+		expectedArgs := []string{"hello=candidate", "core20=edge"}
+		if !reflect.DeepEqual(stateMachine.snapArgs(), expectedArgs) {
+			t.Errorf("Expected snaps %v, but got %v", expectedArgs, stateMachine.snapArgs())
+		}
+
+		stateMachine.Opts.BaseSnap = "core22=edge"
+		err = stateMachine.checkBaseSnap()
+		asserter.AssertErrContains(err, "--base-snap core22 is not a base of model "+
+			"canonical/ubuntu-core-20-amd64, which allows: core20")
+
+		stateMachine.Opts.BaseSnap = "core20=edge=beta"
+		err = stateMachine.checkBaseSnap()
+		asserter.AssertErrContains(err, "Invalid --base-snap core20=edge=beta")
+
+		// UC18 models list their base outside of their snaps
+		stateMachine.Args.ModelAssertion = filepath.Join("testdata", "modelAssertion18")
+		stateMachine.Opts.BaseSnap = "core18=edge"
+		err = stateMachine.checkBaseSnap()
+		asserter.AssertErrNil(err, true)
+	})
+}
+
+// TestCheckModelSnaps tests that the seeded snaps that do not follow the
+// constraints of the model assertion are all reported
+func TestCheckModelSnaps(t *testing.T) {
+	modelSnaps := func() []*seed.Snap {
+		return []*seed.Snap{
+			{SideInfo: &snap.SideInfo{RealName: "pc", SnapID: "UqFziVZDHLSyO3TqSWgNBoAdHbLI4dAH"},
+				Channel: "20/stable"},
+			{SideInfo: &snap.SideInfo{RealName: "pc-kernel", SnapID: "pYVQrBcKmBa0mZ4CCN7ExT6jH8rY1hza"},
+				Channel: "20/edge"},
+			{SideInfo: &snap.SideInfo{RealName: "core20", SnapID: "DLqre5XGLbDqg9jPtiAhRRjDuPVa5X1q"},
+				Channel: "stable"},
+			{SideInfo: &snap.SideInfo{RealName: "snapd", SnapID: "PMrrV4ml8uWuEUDBT8dSGnKUYbevVhc4"},
+				Channel: "latest/stable"},
+		}
+	}
+	testCases := []struct {
+		name       string
+		model      string
+		seedSnaps  func() []*seed.Snap
+		violations []string
+	}{
+		{"valid", "modelAssertion20", modelSnaps, nil},
+		{
+			"violations",
+			"modelAssertion20",
+			func() []*seed.Snap {
+				seedSnaps := modelSnaps()
+				seedSnaps[1].Channel = "22/stable"
+				seedSnaps[2].SideInfo.SnapID = "other-id"
+				return append(seedSnaps[1:], &seed.Snap{
+					SideInfo: &snap.SideInfo{RealName: "hello"}, Channel: "stable"})
+			},
+			[]string{
+				"snap pc-kernel follows channel 22/stable, which is not in track 20 of the model",
+				"snap core20 has snap ID other-id instead of DLqre5XGLbDqg9jPtiAhRRjDuPVa5X1q",
+				"snap hello is not part of the model, which is of grade signed",
+				"snap pc is required by the model but is not seeded",
+			},
+		},
+		{
+			"extra_snap_dangerous",
+			"modelAssertion20Dangerous",
+			func() []*seed.Snap {
+				return append(modelSnaps(), &seed.Snap{
+					SideInfo: &snap.SideInfo{RealName: "hello"}, Channel: "stable"})
+			},
+			nil,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run("test_check_model_snaps_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine SnapStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.parent = &stateMachine
+			stateMachine.Args.ModelAssertion = filepath.Join("testdata", tc.model)
+
+			tmpDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(tmpDir)
+			stateMachine.tempDirs.rootfs = tmpDir
+			err = os.MkdirAll(filepath.Join(tmpDir, "systems", "20230101"), 0755)
+			asserter.AssertErrNil(err, true)
+
+			// the seeded snaps are told apart by their path
+			seedSnaps := tc.seedSnaps()
+			for _, seedSnap := range seedSnaps {
+				seedSnap.Path = filepath.Join(tmpDir, "snaps", seedSnap.SnapName()+".snap")
+			}
+			seedOpen = func(string, string) (seed.Seed, error) {
+				return &fakeSeed{snaps: seedSnaps}, nil
+			}
+			defer func() {
+				seedOpen = seed.Open
+			}()
+
+			err = stateMachine.checkModelSnaps()
+			if tc.violations == nil {
+				asserter.AssertErrNil(err, true)
+				return
+			}
+			asserter.AssertErrContains(err, "The seeded snaps do not match model canonical/ubuntu-core-20-amd64")
+			for _, violation := range tc.violations {
+				asserter.AssertErrContains(err, violation)
+			}
+		})
+	}
+}
+
+// TestCheckSnapBases tests that the seeded snaps built for a base the model does not
+// allow fail the build, or are only reported with --allow-base-mismatch
+func TestCheckSnapBases(t *testing.T) {
+	testCases := []struct {
+		name      string
+		model     string
+		snapYamls map[string]string
+		allow     bool
+		conflicts []string
+	}{
+		{
+			"compatible",
+			"modelAssertion20",
+			map[string]string{
+				"core20":    "name: core20\nversion: 20\ntype: base\n",
+				"pc":        "name: pc\nversion: 20\ntype: gadget\nbase: core20\n",
+				"pc-kernel": "name: pc-kernel\nversion: 5.4\ntype: kernel\n",
+				"themes":    "name: themes\nversion: 0.1\nbase: none\n",
+			},
+			false,
+			nil,
+		},
+		{
+			"mismatch",
+			"modelAssertion20",
+			map[string]string{
+				"core20": "name: core20\nversion: 20\ntype: base\n",
+				"pc":     "name: pc\nversion: 22\ntype: gadget\nbase: core22\n",
+				"hello":  "name: hello\nversion: 1.0\n",
+			},
+			false,
+			[]string{"snap hello requires base core", "snap pc requires base core22"},
+		},
+		{
+			"mismatch_allowed",
+			"modelAssertion20",
+			map[string]string{"hello": "name: hello\nversion: 1.0\nbase: core22\n"},
+			true,
+			nil,
+		},
+		{
+			"classic_without_base",
+			"modelAssertionClassic",
+			map[string]string{"hello": "name: hello\nversion: 1.0\nbase: core22\n"},
+			false,
+			nil,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run("test_check_snap_bases_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine SnapStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.parent = &stateMachine
+			stateMachine.Args.ModelAssertion = filepath.Join("testdata", tc.model)
+			stateMachine.commonFlags.AllowBaseMismatch = tc.allow
+
+			tmpDir, err := os.MkdirTemp("/tmp", "ubuntu-image-")
+			asserter.AssertErrNil(err, true)
+			defer os.RemoveAll(tmpDir)
+			stateMachine.tempDirs.rootfs = tmpDir
+			err = os.MkdirAll(filepath.Join(tmpDir, "systems", "20230101"), 0755)
+			asserter.AssertErrNil(err, true)
+
+			// snap files can also be unpacked snaps
+			var seedSnaps []*seed.Snap
+			for snapName, snapYaml := range tc.snapYamls {
+				snapPath := filepath.Join(tmpDir, "snaps", snapName+".snap")
+				err = os.MkdirAll(filepath.Join(snapPath, "meta"), 0755)
+				asserter.AssertErrNil(err, true)
+				err = os.WriteFile(filepath.Join(snapPath, "meta", "snap.yaml"), []byte(snapYaml), 0644)
+				asserter.AssertErrNil(err, true)
+				seedSnaps = append(seedSnaps, &seed.Snap{
+					Path:     snapPath,
+					SideInfo: &snap.SideInfo{RealName: snapName},
+				})
+			}
+			seedOpen = func(string, string) (seed.Seed, error) {
+				return &fakeSeed{snaps: seedSnaps}, nil
+			}
+			defer func() {
+				seedOpen = seed.Open
+			}()
+
+			stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+			asserter.AssertErrNil(err, true)
+			err = stateMachine.checkSnapBases()
+			restoreStdout()
+			readStdout, readErr := io.ReadAll(stdout)
+			asserter.AssertErrNil(readErr, true)
+			if tc.allow && !strings.Contains(string(readStdout),
+				"snap hello requires base core22, which is not a base of model") {
+				t.Errorf("Expected a warning about the base of snap hello, but got \"%s\"",
+					string(readStdout))
+			}
+			if tc.conflicts == nil {
+				asserter.AssertErrNil(err, true)
+				return
+			}
+			asserter.AssertErrContains(err, "The seeded snaps are not built for the bases of model "+
+				"canonical/ubuntu-core-20-amd64, which are: core20")
+			for _, conflict := range tc.conflicts {
+				asserter.AssertErrContains(err, conflict+"\n")
+			}
+			asserter.AssertErrContains(err, "Use --allow-base-mismatch")
+		})
+	}
+}
+
+// TestListSnapsResolved tests that --list-snaps-resolved prints the snaps of the model
+// and the extra snaps as resolved by the store, with the channels snapd would use
+func TestListSnapsResolved(t *testing.T) {
+	t.Run("test_list_snaps_resolved", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var stateMachine SnapStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.parent = &stateMachine
+		stateMachine.stateMachineFlags.ListSnapsResolved = true
+		stateMachine.commonFlags.Channel = "candidate"
+		stateMachine.commonFlags.ResultFile = filepath.Join(t.TempDir(), "build-result.json")
+		stateMachine.Args.ModelAssertion = filepath.Join("testdata", "modelAssertion20")
+		stateMachine.Opts.Snaps = []string{"hello=edge", "pc-kernel=rev:42", "lxd"}
+
+		err := stateMachine.Setup()
+		asserter.AssertErrNil(err, true)
+
+		fakeStore := &fakeToolingStore{
+			revisions: map[string]int{"snapd": 100, "pc-kernel": 101, "core20": 102, "pc": 103,
+				"hello": 104, "lxd": 105},
+			bases: map[string]string{"pc-kernel": "core20", "pc": "core20", "hello": "core20",
+				"lxd": "core20"},
+		}
+		toolingStoreFromModel = func(model *asserts.Model, fallbackArchitecture string) (*tooling.ToolingStore, error) {
+			if model.Architecture() != "amd64" {
+				t.Errorf("Expected the snaps to be resolved for amd64, but got %s", model.Architecture())
+			}
+			return tooling.MockToolingStore(fakeStore), nil
+		}
+		defer func() {
+			toolingStoreFromModel = tooling.NewToolingStoreFromModel
+		}()
+
+		stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+		defer restoreStdout()
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.Run()
+		asserter.AssertErrNil(err, true)
+		err = stateMachine.Teardown()
+		asserter.AssertErrNil(err, true)
+		restoreStdout()
+		readStdout, err := io.ReadAll(stdout)
+		asserter.AssertErrNil(err, true)
+
+		expectedActions := []string{
+			"core20 latest/candidate",
+			"hello latest/edge",
+			"lxd latest/candidate",
+			"pc 20/candidate",
+			"pc-kernel 42",
+			"snapd latest/candidate",
+		}
+		if gotActions := fakeStore.askedFor(); !reflect.DeepEqual(gotActions, expectedActions) {
+			t.Errorf("Expected the store to be asked for %v, but got %v", expectedActions, gotActions)
+		}
+
+		expectedOutput := `snapd	100	latest/candidate	-
+pc-kernel	42	-	core20
+core20	102	latest/candidate	-
+pc	103	20/candidate	core20
+hello	104	latest/edge	core20
+lxd	105	latest/candidate	core20
+`
+		if string(readStdout) != expectedOutput {
+			t.Errorf("Expected the resolved snaps:\n%s\nbut got:\n%s", expectedOutput, string(readStdout))
+		}
+
+		// --list-snaps-resolved can not be combined with --list-states
+		stateMachine.stateMachineFlags.ListStates = true
+		err = stateMachine.Setup()
+		asserter.AssertErrContains(err, "cannot specify --list-snaps-resolved with --dry-run or --list-states")
+	})
+}
+
+// TestPinCohortRevisions tests that the snaps given a cohort key are pinned to the
+// revision the store serves to their cohort, in the channel they are seeded from
+func TestPinCohortRevisions(t *testing.T) {
+	testCases := []struct {
+		name      string
+		cohorts   map[string]string
+		revisions map[string]snap.Revision
+		offline   bool
+		storeErr  error
+		noResults bool
+		pinned    map[string]string
+		actions   []string
+		errMsg    string
+	}{
+		{"success", map[string]string{"pc": "MSBwYw", "hello": "MSBoZWxsbw"}, nil, false, nil, false,
+			map[string]string{"pc": "MSBwYw", "hello": "MSBoZWxsbw"},
+			[]string{"hello latest/edge MSBoZWxsbw", "pc 20/candidate MSBwYw"}, ""},
+		{"offline", map[string]string{"hello": "MSBoZWxsbw"}, nil, true, nil, false,
+			map[string]string{}, nil, ""},
+		{"pinned_revision", map[string]string{"hello": "MSBoZWxsbw"},
+			map[string]snap.Revision{"hello": snap.R(2)}, false, nil, false, nil, nil,
+			"Snap hello cannot be pinned to revision 2 and follow a cohort at the same time"},
+		{"not_installed", map[string]string{"lxd": "MSBseGQ"}, nil, false, nil, false, nil, nil,
+			"A cohort key was given for snap lxd, which is not installed in the image"},
+		{"rejected_cohort", map[string]string{"hello": "MSBoZWxsbw"}, nil, false,
+			&store.SnapActionError{Download: map[string]error{"hello": fmt.Errorf("invalid cohort key")}},
+			false, nil, nil, "The store rejected the cohort key \"MSBoZWxsbw\" of snap hello: invalid cohort key"},
+		{"store_error", map[string]string{"hello": "MSBoZWxsbw"}, nil, false, store.ErrSnapNotFound,
+			false, nil, nil, "Error resolving the cohorts of the snaps: snap not found"},
+		{"no_revision", map[string]string{"hello": "MSBoZWxsbw"}, nil, false, nil, true, nil, nil,
+			"the store returned no revision for snap hello in its cohort"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_pin_cohort_revisions_"+tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine SnapStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.parent = &stateMachine
+			stateMachine.commonFlags.Offline = tc.offline
+
+			imageOpts := image.Options{
+				ModelFile:    filepath.Join("testdata", "modelAssertion20"),
+				Snaps:        []string{"hello"},
+				SnapChannels: map[string]string{"hello": "edge"},
+				Revisions:    map[string]snap.Revision{},
+				Channel:      "candidate",
+			}
+			for snapName, revision := range tc.revisions {
+				imageOpts.Revisions[snapName] = revision
+			}
+
+			fakeStore := &fakeToolingStore{
+				revisions: map[string]int{"hello": 100, "pc": 101},
+				err:       tc.storeErr,
+				noResults: tc.noResults,
+			}
+			toolingStoreFromModel = func(model *asserts.Model, fallbackArchitecture string) (*tooling.ToolingStore, error) {
+				return tooling.MockToolingStore(fakeStore), nil
+			}
+			defer func() {
+				toolingStoreFromModel = tooling.NewToolingStoreFromModel
+			}()
+
+			pinned, err := stateMachine.pinCohortRevisions(context.Background(), stateMachine.printWarning,
+				&imageOpts, tc.cohorts)
+			if tc.errMsg != "" {
+				asserter.AssertErrContains(err, tc.errMsg)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			if !reflect.DeepEqual(pinned, tc.pinned) {
+				t.Errorf("Expected the snaps %v to be pinned, but got %v", tc.pinned, pinned)
+			}
+			if actions := fakeStore.askedFor(); !reflect.DeepEqual(actions, tc.actions) {
+				t.Errorf("Expected the store to be asked for %v, but got %v", tc.actions, actions)
+			}
+			if !tc.offline && (imageOpts.Revisions["hello"] != snap.R(100) ||
+				imageOpts.Revisions["pc"] != snap.R(101)) {
+				t.Errorf("Expected the snaps to be pinned to the revisions of their cohort, "+
+					"but got %v", imageOpts.Revisions)
+			}
+			if tc.offline && len(imageOpts.Revisions) != 0 {
+				t.Errorf("Expected no snap to be pinned offline, but got %v", imageOpts.Revisions)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package statemachine
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/snapcore/snapd/snap"
+)
+
+// readSnapSnapshot reads a --snap-snapshot, a JSON object mapping the names of
+// the snaps to the revision the store served for their channel when it was taken,
+// like {"core22": 1033, "snapd": 21759}
+func readSnapSnapshot(snapshotPath string) (map[string]snap.Revision, error) {
+	snapshotData, err := osReadFile(snapshotPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading --snap-snapshot: %s", err.Error())
+	}
+	var snapshotRevisions map[string]int
+	if err := json.Unmarshal(snapshotData, &snapshotRevisions); err != nil {
+		return nil, fmt.Errorf("Error parsing --snap-snapshot %s: %s", snapshotPath, err.Error())
+	}
+	snapshot := make(map[string]snap.Revision)
+	for snapName, revision := range snapshotRevisions {
+		if err := snap.ValidateName(snapName); err != nil {
+			return nil, fmt.Errorf("Error parsing --snap-snapshot %s: %s", snapshotPath, err.Error())
+		}
+		if revision <= 0 {
+			return nil, fmt.Errorf("Error parsing --snap-snapshot %s: invalid revision %d for snap %s",
+				snapshotPath, revision, snapName)
+		}
+		snapshot[snapName] = snap.R(revision)
+	}
+	return snapshot, nil
+}
+
+// loadSnapSnapshot reads the --snap-snapshot, and makes sure that the file of
+// every snap it lists is in the --snap-dir, before anything is built
+func (stateMachine *StateMachine) loadSnapSnapshot() error {
+	if stateMachine.commonFlags.SnapSnapshot == "" {
+		return nil
+	}
+	if stateMachine.commonFlags.SnapDir == "" {
+		return fmt.Errorf("--snap-snapshot requires --snap-dir")
+	}
+	snapshot, err := readSnapSnapshot(stateMachine.commonFlags.SnapSnapshot)
+	if err != nil {
+		return err
+	}
+	var missing []string
+	for snapName, revision := range snapshot {
+		if localSnapFile(stateMachine.commonFlags.SnapDir, snapName, revision) == "" {
+			missing = append(missing, fmt.Sprintf("%s_%s.snap", snapName, revision))
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("The following snaps of --snap-snapshot %s are missing from --snap-dir %s: %s",
+			stateMachine.commonFlags.SnapSnapshot, stateMachine.commonFlags.SnapDir,
+			strings.Join(missing, ", "))
+	}
+	stateMachine.snapSnapshot = snapshot
+	return nil
+}
+
+// applySnapSnapshot pins the snaps, and their bases and default providers, to the
+// revisions of the --snap-snapshot, so that the store is never asked which revision
+// their channel serves. Every snap must be listed by the snapshot, and the revisions
+// pinned on the command line or in the image definition must match it. The names
+// of all the snaps, including the dependencies, are returned
+func (stateMachine *StateMachine) applySnapSnapshot(snapNames []string,
+	revisions map[string]snap.Revision) ([]string, error) {
+	if stateMachine.snapSnapshot == nil {
+		return snapNames, nil
+	}
+	var allSnaps, unlisted, mismatched []string
+	checked := make(map[string]bool)
+	for len(snapNames) > 0 {
+		snapName := snapNames[0]
+		snapNames = snapNames[1:]
+		if checked[snapName] {
+			continue
+		}
+		checked[snapName] = true
+		allSnaps = append(allSnaps, snapName)
+		revision, listed := stateMachine.snapSnapshot[snapName]
+		if !listed {
+			unlisted = append(unlisted, snapName)
+			continue
+		}
+		if pinned, found := revisions[snapName]; found && pinned != revision {
+			mismatched = append(mismatched, fmt.Sprintf("%s (revision %s pinned, %s in the snapshot)",
+				snapName, pinned, revision))
+			continue
+		}
+		revisions[snapName] = revision
+		snapFile := localSnapFile(stateMachine.commonFlags.SnapDir, snapName, revision)
+		if snapFile == "" {
+			return nil, fmt.Errorf("Snap %s revision %s of --snap-snapshot is missing from --snap-dir %s",
+				snapName, revision, stateMachine.commonFlags.SnapDir)
+		}
+		snapInfo, err := readLocalSnapInfo(snapFile)
+		if err != nil {
+			return nil, err
+		}
+		snapNames = append(snapNames, snapDependencies(snapInfo)...)
+	}
+	if len(unlisted) > 0 {
+		sort.Strings(unlisted)
+		return nil, fmt.Errorf("The following snaps are not listed in --snap-snapshot %s: %s",
+			stateMachine.commonFlags.SnapSnapshot, strings.Join(unlisted, ", "))
+	}
+	if len(mismatched) > 0 {
+		sort.Strings(mismatched)
+		return nil, fmt.Errorf("The revisions of the following snaps do not match --snap-snapshot %s: %s",
+			stateMachine.commonFlags.SnapSnapshot, strings.Join(mismatched, ", "))
+	}
+	return allSnaps, nil
+}
@@ -0,0 +1,135 @@
+package statemachine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// sparseBlockSize is the size of the blocks of zeros that are turned into holes,
+// which is the block size of most filesystems
+const sparseBlockSize = 4096
+
+// sparseChunkSize is the amount of data read at once when looking for blocks of zeros
+var sparseChunkSize = 256 * sparseBlockSize
+
+// errSparseNotSupported is returned when the filesystem of a file can't punch holes in it
+var errSparseNotSupported = errors.New("the filesystem does not support sparse files")
+
+// punchHole deallocates a range of a file, which then reads as zeros.
+// The size of the file is unchanged
+func punchHole(file *os.File, offset int64, length int64) error {
+	err := unix.Fallocate(int(file.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE,
+		offset, length)
+	if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOSYS) {
+		return errSparseNotSupported
+	}
+	return err
+}
+
+// makeSparse turns the blocks of zeros of a file into holes, so that they take no
+// space on disk, without changing its content. The ranges that are already holes
+// are skipped rather than read back. errSparseNotSupported is returned if the
+// filesystem of the file doesn't support it
+func makeSparse(fileName string) error {
+	file, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	buffer := make([]byte, sparseChunkSize)
+	zeros := make([]byte, sparseBlockSize)
+	var offset int64
+	// the start of the run of blocks of zeros being read, or -1 if there is none
+	holeStart := int64(-1)
+	for {
+		dataStart, err := unix.Seek(int(file.Fd()), offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			// the rest of the file is a hole already
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if dataStart > offset && holeStart < 0 {
+			holeStart = offset
+		}
+		offset = dataStart
+
+		n, err := file.ReadAt(buffer, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		for i := 0; i < n; i += sparseBlockSize {
+			end := i + sparseBlockSize
+			if end > n {
+				end = n
+			}
+			blockOffset := offset + int64(i)
+			if bytes.Equal(buffer[i:end], zeros[:end-i]) {
+				if holeStart < 0 {
+					holeStart = blockOffset
+				}
+				continue
+			}
+			if holeStart >= 0 {
+				if err := punchHole(file, holeStart, blockOffset-holeStart); err != nil {
+					return err
+				}
+				holeStart = -1
+			}
+		}
+		offset += int64(n)
+		if err == io.EOF || n == 0 {
+			break
+		}
+	}
+	if holeStart >= 0 && offset > holeStart {
+		return punchHole(file, holeStart, offset-holeStart)
+	}
+	return nil
+}
+
+// allocateFile allocates every block of a file, including its holes, so that it is
+// not sparse anymore. This is a no-op on filesystems that don't support sparse files
+func allocateFile(fileName string) error {
+	file, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	err = unix.Fallocate(int(file.Fd()), 0, 0, fileInfo.Size())
+	if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOSYS) {
+		return nil
+	}
+	return err
+}
+
+// writeSparseImage makes a disk image sparse once it is assembled, unless --no-sparse
+// was given, in which case all of its blocks are allocated. The images are left as
+// they are on filesystems that can't punch holes
+func (stateMachine *StateMachine) writeSparseImage(imgName string) error {
+	if stateMachine.commonFlags.NoSparse {
+		if err := allocateFile(imgName); err != nil {
+			return fmt.Errorf("Error allocating disk image \"%s\": %s", imgName, err.Error())
+		}
+		return nil
+	}
+	err := makeSparse(imgName)
+	if errors.Is(err, errSparseNotSupported) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error making disk image \"%s\" sparse: %s", imgName, err.Error())
+	}
+	return nil
+}
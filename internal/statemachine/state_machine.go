@@ -3,9 +3,11 @@
 package statemachine
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -15,10 +17,13 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/canonical/ubuntu-image/internal/commands"
 	"github.com/canonical/ubuntu-image/internal/helper"
 	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/go-git/go-git/v5"
 	"github.com/snapcore/snapd/gadget"
 	"github.com/snapcore/snapd/gadget/quantity"
 	"github.com/snapcore/snapd/image"
@@ -26,6 +31,7 @@ import (
 	"github.com/snapcore/snapd/osutil"
 	"github.com/snapcore/snapd/osutil/mkfs"
 	"github.com/snapcore/snapd/seed"
+	"github.com/snapcore/snapd/snap"
 	"github.com/xeipuuv/gojsonschema"
 
 	"gopkg.in/yaml.v2"
@@ -40,6 +46,7 @@ var helperCheckEmptyFields = helper.CheckEmptyFields
 var helperCheckTags = helper.CheckTags
 var helperBackupAndCopyResolvConf = helper.BackupAndCopyResolvConf
 var helperRestoreResolvConf = helper.RestoreResolvConf
+var helperCalculateChecksum = helper.CalculateChecksum
 var ioReadAll = io.ReadAll
 var osReadDir = os.ReadDir
 var osReadFile = os.ReadFile
@@ -51,6 +58,7 @@ var osOpen = os.Open
 var osOpenFile = os.OpenFile
 var osRemoveAll = os.RemoveAll
 var osRename = os.Rename
+var gitPlainCloneContext = git.PlainCloneContext
 var osCreate = os.Create
 var osTruncate = os.Truncate
 var osutilCopyFile = osutil.CopyFile
@@ -62,12 +70,28 @@ var diskfsCreate = diskfs.Create
 var randRead = rand.Read
 var seedOpen = seed.Open
 var imagePrepare = image.Prepare
+var storeSnapInfo = getStoreSnapInfo
 var preseedClassicReset = preseed.ClassicReset
-var httpGet = http.Get
+var httpDo = (*http.Client).Do
 var jsonUnmarshal = json.Unmarshal
 var yamlMarshal = yaml.Marshal
 var gojsonschemaValidate = gojsonschema.Validate
 var filepathRel = filepath.Rel
+var syscallFlock = syscall.Flock
+var execLookPath = exec.LookPath
+var osGeteuid = os.Geteuid
+
+// the directory in which the kernel lists the registered binfmt_misc handlers
+var binfmtMiscDir = "/proc/sys/fs/binfmt_misc"
+
+// the directory in which grub installs the modules and images of each platform
+var grubLibDir = "/usr/lib/grub"
+
+// the file in which the kernel lists the user IDs mapped in the user namespace
+var uidMapPath = "/proc/self/uid_map"
+
+// the delay before the first retry of a failed download, doubled after every retry
+var downloadRetryDelay = time.Second
 
 var mockableBlockSize string = "1" //used for mocking dd calls
 
@@ -75,7 +99,9 @@ var mockableBlockSize string = "1" //used for mocking dd calls
 type SmInterface interface {
 	Setup() error
 	Run() error
+	RunContext(ctx context.Context) error
 	Teardown() error
+	ResetWorkDir() error
 }
 
 // stateFunc allows us easy access to the function names, which will help with --resume and debug statements
@@ -84,6 +110,120 @@ type stateFunc struct {
 	function func(*StateMachine) error
 }
 
+// logFormatJSON is the value of --log-format that prints one JSON object per state
+const logFormatJSON = "json"
+
+// the statuses of the states reported with --log-format=json
+const (
+	stateStatusSuccess   = "success"
+	stateStatusError     = "error"
+	stateStatusCancelled = "cancelled"
+	stateStatusTimeout   = "timeout"
+)
+
+// stateEvent is printed for each state that was run when --log-format=json is used
+type stateEvent struct {
+	Step     int       `json:"step"`
+	State    string    `json:"state"`
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration_seconds"`
+	Status   string    `json:"status"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// stateDuration records how long a state took to run
+type stateDuration struct {
+	name     string
+	duration time.Duration
+}
+
+// stateDescriptions holds a one line description of each state, printed by --dry-run
+var stateDescriptions = map[string]string{
+	"add_apt_pins":                 "Pin the versions of packages from the image definition and check them against the apt sources",
+	"add_extra_ppas":               "Add the extra PPAs from the image definition to the chroot",
+	"add_extra_sources":            "Add the extra apt sources from the image definition to the chroot",
+	"apply_overlays":               "Merge the overlay directories from the image definition into the chroot",
+	"build_gadget_tree":            "Build the gadget tree from its source",
+	"build_rootfs_from_tasks":      "Build the rootfs from the seeded tasks",
+	"calculate_rootfs_size":        "Calculate the size of the rootfs",
+	"calculate_states":             "Determine the states needed to build the image definition",
+	"check_iso_tools":              "Check that the tools and grub images making the live ISO are installed",
+	"check_mksquashfs":             "Check that mksquashfs supports the compressor requested with --comp",
+	"check_model_snaps":            "Check that the seeded snaps follow the constraints of the model assertion",
+	"check_qemu_user":              "Check that qemu-user-static can run the binaries of the target architecture",
+	"check_seed":                   "Check that the bases and default providers of the seeded snaps are seeded",
+	"check_snap_bases":             "Check that the seeded snaps are built for the bases of the model assertion",
+	"clamp_mtimes":                 "Clamp the modification times of the rootfs and partition contents to SOURCE_DATE_EPOCH",
+	"compress_disk_images":         "Compress the raw disk images with --compress",
+	"configure_kernel_cmdline":     "Add the kernel-cmdline of the image definition to the bootloader configuration",
+	"convert_disk_images":          "Convert the raw disk images to the requested --format",
+	"create_chroot":                "Create a chroot using debootstrap",
+	"customize_cloud_init":         "Install the cloud-init configuration in the rootfs",
+	"customize_fstab":              "Write the fstab from the image definition to the rootfs",
+	"customize_hostname":           "Set the hostname from the image definition in the rootfs",
+	"customize_locale":             "Generate the locale from the image definition and make it the default",
+	"customize_machine_id":         "Clear or set the machine ID of the rootfs from the image definition",
+	"customize_timezone":           "Set the timezone from the image definition in the rootfs",
+	"customize_users":              "Create the users from the image definition in the rootfs",
+	"determine_output_directory":   "Determine the directory the artifacts are written to",
+	"embed_cloud_init_seed":        "Write the cloud-init NoCloud seed passed on the command line",
+	"extract_kernel":               "Copy the kernel and the initrd of the rootfs to the output directory",
+	"extract_rootfs_tar":           "Extract the rootfs tarball from the image definition",
+	"finish":                       "Finish the build",
+	"generate_build_manifest":      "Write a manifest of the installed packages and seeded snaps",
+	"generate_checksums":           "Write the checksums of the disk image files",
+	"generate_disk_info":           "Write the --disk-info file to the rootfs",
+	"generate_filelist":            "Write the list of files in the rootfs",
+	"generate_fstab":               "Write the fstab of the rootfs from the partitions of gadget.yaml",
+	"generate_manifest":            "Write the manifest of the packages or snaps in the image",
+	"generate_rootfs_squashfs":     "Create a squashfs image of the rootfs",
+	"generate_rootfs_tarball":      "Create a tarball of the rootfs",
+	"generate_sbom":                "Write an SBOM of the packages installed in the rootfs",
+	"germinate":                    "Determine the packages and snaps to install from the seed",
+	"install_extra_packages":       "Install the extra packages from the image definition",
+	"install_extra_snaps":          "Install the extra snaps from the image definition",
+	"install_packages":             "Install the packages in the chroot",
+	"load_gadget_yaml":             "Load and validate the gadget.yaml file",
+	"make_disk":                    "Assemble the disk images from the volumes",
+	"make_live_iso":                "Make the bootable live ISO of --format iso from the rootfs",
+	"make_qcow2_image":             "Create the qcow2 artifact from the raw disk image",
+	"make_temporary_directories":   "Create the working directories",
+	"measure_boot_components":      "Predict the PCR values of the boot components with --measure",
+	"parse_image_definition":       "Parse and validate the image definition",
+	"perform_manual_customization": "Run the manual customizations from the image definition",
+	"populate_bootfs_contents":     "Populate the contents of the boot partitions",
+	"populate_prepare_partitions":  "Prepare the images of the non-rootfs partitions",
+	"populate_recovery_partition":  "Copy the recovery seed to the recovery partition",
+	"populate_rootfs_contents":     "Copy the rootfs contents to their final location",
+	"prepare_gadget_tree":          "Prepare the gadget tree for use in the image",
+	"prepare_image":                "Prepare the image using snapd",
+	"preseed_extra_snaps":          "Preseed the snaps in the chroot",
+	"preseed_image":                "Preseed the image using snapd",
+	"record_build_hash":            "Record the hash of the build inputs to skip unchanged rebuilds",
+	"remove_extra_ppas":            "Remove the extra PPAs that are not kept enabled from the chroot",
+	"remove_extra_sources":         "Remove the extra apt sources that are not kept enabled from the chroot",
+	"remove_packages":              "Purge the packages listed in remove-packages from the base rootfs",
+	"run_plugins_after_customize":  "Run the plugins of the image definition once the rootfs is customized",
+	"run_plugins_before_customize": "Run the plugins of the image definition before the rootfs is customized",
+	"set_artifact_names":           "Determine the names of the disk image files",
+	"sign_artifacts":               "Sign the disk images and the checksum file with --sign-key",
+	"start_recovery_seed":          "Start seeding the recovery system from its model in the background",
+	"strip_rootfs":                 "Remove the documentation and locales of the strip customization from the rootfs",
+	"update_bootloader":            "Install the bootloader in the disk images",
+	"validate_gadget_yaml":         "Check the volumes in gadget.yaml and report all the problems found",
+	"verify_artifact_names":        "Verify the artifact names in the image definition",
+	"verify_filesystems":           "Check the filesystems of the partition images with --verify-fs",
+	"verify_partition_tables":      "Check the partition tables of the disk images against gadget.yaml",
+	"write_output_device":          "Write the disk image to the block device of --output-device",
+}
+
+// dryRunStates are the states that are still run during --dry-run. They only
+// parse input and compute the list of states, so they have no side effects
+var dryRunStates = map[string]bool{
+	"parse_image_definition": true,
+	"calculate_states":       true,
+}
+
 // temporaryDirectories organizes the state machines, rootfs, unpack, and volumes dirs
 type temporaryDirectories struct {
 	rootfs  string
@@ -91,6 +231,7 @@ type temporaryDirectories struct {
 	volumes string
 	chroot  string
 	scratch string
+	tmp     string
 }
 
 // StateMachine will hold the command line data, track the current state, and handle all function calls
@@ -104,6 +245,12 @@ type StateMachine struct {
 	RootfsSize   quantity.Size
 	tempDirs     temporaryDirectories
 
+	// the files that were in the --workdir before the build started
+	workDirEntries map[string]bool
+
+	// alignment required for the disk images by the --format that was requested
+	imageAlignment quantity.Size
+
 	// The flags that were passed in on the command line
 	commonFlags       *commands.CommonOpts
 	stateMachineFlags *commands.StateMachineOpts
@@ -113,6 +260,38 @@ type StateMachine struct {
 	// used to access image type specific variables from state functions
 	parent SmInterface
 
+	// context of the current run, cancelling it kills the external commands
+	ctx context.Context
+
+	// context of the state that runs with --state-timeout, cancelled when it times out
+	stateCtx context.Context
+
+	// the longest a single state can run for, from --state-timeout
+	stateTimeout time.Duration
+
+	// how long each of the states that were run in this invocation took
+	stateDurations []stateDuration
+
+	// the revisions of the snaps read from the --snap-snapshot, if it was given
+	snapSnapshot map[string]snap.Revision
+
+	// the fields of gadget.yaml that snapd ignores, read by load_gadget_yaml
+	gadgetExtensions *gadgetYamlExtensions
+
+	// sends the state transitions to the --event-socket
+	events eventPublisher
+
+	// serves the status of the build on the --status-addr, if it was given
+	status *statusServer
+
+	// restores the context the build was started with, without the TMPDIR
+	// of the commands, once the temporary directory of --tmp-dir is removed
+	restoreTmpDirEnv func()
+
+	// the LUKS mappings and loop devices of encrypted partitions that are open
+	luksMappings []string
+	loopDevices  []string
+
 	// imported from snapd, the info parsed from gadget.yaml
 	GadgetInfo *gadget.Info
 
@@ -120,8 +299,69 @@ type StateMachine struct {
 	ImageSizes  map[string]quantity.Size
 	VolumeOrder []string
 
+	// GPT partition attribute flags of the structures of each volume, by index
+	PartitionAttributes map[string]map[int]uint64
+
+	// UUIDs of the filesystems of the structures of each volume, by index
+	FilesystemUUIDs map[string]map[int]string
+
+	// mount points of the structures of each volume holding a part of the rootfs, by index
+	MountPoints map[string]map[int]string
+
+	// extra mkfs options of the structures of each volume, by index
+	MkfsOptions map[string]map[int][]string
+
+	// the structure holding the seed of the recovery system of classic images
+	Recovery *RecoveryStructure
+
+	// the recovery seed prepared in the background, until it is waited for
+	recoverySeed *recoverySeed
+
 	// names of images for each volume
 	VolumeNames map[string]string
+
+	// volumes whose image is only made to be converted to another artifact,
+	// and is written to the work directory instead of the output directory
+	IntermediateVolumes map[string]bool
+
+	// paths of the disk image files that have been created
+	ImageFiles []string
+
+	// paths of the other artifacts, like manifests, that have been created
+	Artifacts []string
+
+	// revisions of the snaps that were pinned instead of following a channel
+	SnapRevisions map[string]int
+
+	// cohort keys of the snaps that were installed from a cohort
+	SnapCohorts map[string]string
+
+	// hash of the inputs of a classic build, recorded in the output directory
+	BuildHash string
+
+	// the tarball passed with --rootfs-tarball, its sha256 sum and the release
+	// it contains, recorded in the build manifest
+	BaseRootfs string
+
+	// the URL of the git repository of the gadget and the commit that was
+	// checked out, recorded in the build manifest
+	GadgetCommit string
+
+	// the recorded hash of the last build matches, so nothing has to be built
+	buildUpToDate bool
+
+	// when the states started running, and the state that failed with its error
+	runStart    time.Time
+	failedState string
+	runErr      error
+
+	// Teardown already ran, for builds that were cancelled
+	tornDown bool
+
+	// --output-dir was given, and the temporary work directory holds the outputs
+	// of a build stopped with --until or --thru that were not exported
+	outputDirRequested bool
+	keepPartialBuild   bool
 }
 
 // SetCommonOpts stores the common options for all image types in the struct
@@ -238,8 +478,8 @@ func (stateMachine *StateMachine) postProcessGadgetYaml() error {
 		for ii, structure := range volume.Structure {
 			if structure.Role == "" && structure.Label == gadget.SystemBoot {
 				if !stateMachine.commonFlags.Quiet {
-					fmt.Printf("WARNING: volumes:%s:structure:%d:filesystem_label "+
-						"used for defining partition roles; use role instead\n",
+					stateMachine.printWarning("volumes:%s:structure:%d:filesystem_label "+
+						"used for defining partition roles; use role instead",
 						volumeName, ii)
 				}
 			} else if structure.Role == gadget.SystemData {
@@ -332,12 +572,18 @@ func (stateMachine *StateMachine) postProcessGadgetYaml() error {
 // readMetadata reads info about a partial state machine from disk
 func (stateMachine *StateMachine) readMetadata() error {
 	// handle the resume case
-	if stateMachine.stateMachineFlags.Resume {
-		// open the ubuntu-image.gob file and determine the state
+	resumeFrom := stateMachine.stateMachineFlags.ResumeFrom
+	if stateMachine.stateMachineFlags.Resume || resumeFrom != "" {
+		// open the state file and determine the state
 		var partialStateMachine = new(StateMachine)
-		gobfilePath := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "ubuntu-image.gob")
-		gobfile, err := os.Open(gobfilePath)
-		if err != nil {
+		gobfile, err := os.Open(stateMachine.stateFilePath())
+		if os.IsNotExist(err) && stateMachine.stateMachineFlags.StateFile != "" {
+			return fmt.Errorf("error reading metadata file: no saved state found in \"%s\"",
+				stateMachine.stateMachineFlags.StateFile)
+		} else if os.IsNotExist(err) {
+			return fmt.Errorf("error reading metadata file: no saved state found in work directory \"%s\"",
+				stateMachine.stateMachineFlags.WorkDir)
+		} else if err != nil {
 			return fmt.Errorf("error reading metadata file: %s", err.Error())
 		}
 		defer gobfile.Close()
@@ -354,20 +600,64 @@ func (stateMachine *StateMachine) readMetadata() error {
 		stateMachine.RootfsSize = partialStateMachine.RootfsSize
 		stateMachine.IsSeeded = partialStateMachine.IsSeeded
 		stateMachine.VolumeOrder = partialStateMachine.VolumeOrder
+		stateMachine.PartitionAttributes = partialStateMachine.PartitionAttributes
+		stateMachine.FilesystemUUIDs = partialStateMachine.FilesystemUUIDs
+		stateMachine.MountPoints = partialStateMachine.MountPoints
+		stateMachine.MkfsOptions = partialStateMachine.MkfsOptions
+		stateMachine.Recovery = partialStateMachine.Recovery
+		stateMachine.VolumeNames = partialStateMachine.VolumeNames
+		stateMachine.IntermediateVolumes = partialStateMachine.IntermediateVolumes
+		stateMachine.ImageFiles = partialStateMachine.ImageFiles
+		stateMachine.Artifacts = partialStateMachine.Artifacts
+		stateMachine.SnapRevisions = partialStateMachine.SnapRevisions
+		stateMachine.SnapCohorts = partialStateMachine.SnapCohorts
+		stateMachine.BuildHash = partialStateMachine.BuildHash
+		stateMachine.BaseRootfs = partialStateMachine.BaseRootfs
+		stateMachine.GadgetCommit = partialStateMachine.GadgetCommit
 		stateMachine.tempDirs.rootfs = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "root")
 		stateMachine.tempDirs.unpack = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "unpack")
 		stateMachine.tempDirs.volumes = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "volumes")
 
+		// with --resume-from, start again at the requested state instead
+		// of the one after the last saved checkpoint
+		if resumeFrom != "" {
+			stateIndex := -1
+			for i, state := range stateMachine.states {
+				if state.name == resumeFrom {
+					stateIndex = i
+					break
+				}
+			}
+			if stateIndex == -1 {
+				return fmt.Errorf("state %s is not a valid state name", resumeFrom)
+			}
+			if stateIndex > stateMachine.StepsTaken {
+				return fmt.Errorf("cannot resume from state %s: the saved run only completed %d states",
+					resumeFrom, stateMachine.StepsTaken)
+			}
+			stateMachine.StepsTaken = stateIndex
+			stateMachine.CurrentStep = resumeFrom
+		}
+
 		// delete all of the stateFuncs that have already run
 		stateMachine.states = stateMachine.states[stateMachine.StepsTaken:]
 	}
 	return nil
 }
 
+// stateFilePath returns the path of the file the state machine info is saved to,
+// which is ubuntu-image.gob in the work directory unless --state-file is given
+func (stateMachine *StateMachine) stateFilePath() string {
+	if stateMachine.stateMachineFlags.StateFile != "" {
+		return stateMachine.stateMachineFlags.StateFile
+	}
+	return filepath.Join(stateMachine.stateMachineFlags.WorkDir, "ubuntu-image.gob")
+}
+
 // writeMetadata writes the state machine info to disk. This will be used when resuming a
 // partial state machine run
 func (stateMachine *StateMachine) writeMetadata() error {
-	gobfilePath := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "ubuntu-image.gob")
+	gobfilePath := stateMachine.stateFilePath()
 	gobfile, err := os.OpenFile(gobfilePath, os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil && !os.IsExist(err) {
 		return fmt.Errorf("error opening metadata file for writing: %s", gobfilePath)
@@ -381,8 +671,9 @@ func (stateMachine *StateMachine) writeMetadata() error {
 }
 
 // handleContentSizes ensures that the sizes of the partitions are large enough and stores
-// safe values in the stateMachine struct for use during make_image
-func (stateMachine *StateMachine) handleContentSizes(farthestOffset quantity.Offset, volumeName string) {
+// safe values in the stateMachine struct for use during make_image. A size passed
+// with --image-size that can't hold the contents of the volume is an error
+func (stateMachine *StateMachine) handleContentSizes(farthestOffset quantity.Offset, volumeName string) error {
 	// store volume sizes in the stateMachine Struct. These will be used during
 	// the make_image step
 	calculated := quantity.Size((farthestOffset/quantity.OffsetMiB + 17) * quantity.OffsetMiB)
@@ -391,48 +682,418 @@ func (stateMachine *StateMachine) handleContentSizes(farthestOffset quantity.Off
 		stateMachine.ImageSizes[volumeName] = calculated
 	} else {
 		if volumeSize < calculated {
-			fmt.Printf("WARNING: ignoring image size smaller than "+
-				"minimum required size: vol:%s %d < %d\n",
+			return fmt.Errorf("The size of volume %s requested with --image-size (%d bytes) "+
+				"is smaller than the minimum size required for its contents (%d bytes)",
 				volumeName, uint64(volumeSize), uint64(calculated))
-			stateMachine.ImageSizes[volumeName] = calculated
-		} else {
-			stateMachine.ImageSizes[volumeName] = volumeSize
 		}
+		stateMachine.ImageSizes[volumeName] = volumeSize
 	}
+	return nil
 }
 
 // Run iterates through the state functions, stopping when appropriate based on --until and --thru
 func (stateMachine *StateMachine) Run() error {
+	return stateMachine.RunContext(context.Background())
+}
+
+// RunContext is like Run, but stops running states once ctx is cancelled.
+// External commands that are still running are killed and the state
+// machine is torn down before returning
+func (stateMachine *StateMachine) RunContext(ctx context.Context) error {
+	// the commands and the HTTP clients use the proxies of the proxy flags
+	stateMachine.ctx = withProxy(withCommandEnv(ctx, stateMachine.proxyCommandEnv()...),
+		stateMachine.proxyFunc())
+	if stateMachine.commonFlags.DebugCommands {
+		stateMachine.ctx = withCommandEcho(stateMachine.ctx, !stateMachine.commonFlags.Debug)
+	}
+	if stateMachine.stateMachineFlags.DryRun {
+		return stateMachine.dryRun()
+	}
+	if stateMachine.stateMachineFlags.ListStates {
+		return stateMachine.listStates()
+	}
+	if stateMachine.stateMachineFlags.ListSnapsResolved {
+		return stateMachine.listResolvedSnaps()
+	}
+	if stateMachine.stateMachineFlags.PrintConfig {
+		return stateMachine.printConfig()
+	}
+	if stateMachine.buildUpToDate {
+		return nil
+	}
+	// the snap store clients of snapd only read the proxies of the environment
+	if err := stateMachine.exportStoreProxies(); err != nil {
+		return err
+	}
+	stateMachine.events.socketPath = stateMachine.commonFlags.EventSocket
+	defer stateMachine.events.close()
+	// the status is served, with the output of the build, while the states run
+	if stateMachine.commonFlags.StatusAddr != "" {
+		status, err := newStatusServer(stateMachine.commonFlags.StatusAddr)
+		if err != nil {
+			return err
+		}
+		stateMachine.status = status
+		defer func() {
+			status.stop()
+			stateMachine.status = nil
+		}()
+		if !stateMachine.commonFlags.Quiet && stateMachine.commonFlags.LogFormat != logFormatJSON {
+			fmt.Printf("Serving the build status on http://%s/\n", status.address)
+		}
+		restoreOutput, err := status.teeOutput()
+		if err != nil {
+			return err
+		}
+		defer restoreOutput()
+	}
+	// the temporary files of the build are created in the directory of --tmp-dir
+	if err := stateMachine.makeBuildTmpDir(); err != nil {
+		return err
+	}
+	stateMachine.runStart = time.Now()
+	// the last state that ran, when --until or --thru stopped the build early
+	stoppedAfter := ""
 	// iterate through the states
 	for i := 0; i < len(stateMachine.states); i++ {
 		stateFunc := stateMachine.states[i]
 		if stateFunc.name == stateMachine.stateMachineFlags.Until {
+			if i > 0 {
+				stoppedAfter = stateMachine.states[i-1].name
+			}
 			break
 		}
-		if !stateMachine.commonFlags.Quiet {
-			fmt.Printf("[%d] %s\n", stateMachine.StepsTaken, stateFunc.name)
+		start := time.Now()
+		if ctx.Err() != nil {
+			stateMachine.logStateEnd(stateFunc.name, start, stateStatusCancelled, ctx.Err())
+			return stateMachine.cancelRun(stateFunc.name)
 		}
-		if err := stateFunc.function(stateMachine); err != nil {
-			// clean up work dir on error
-			stateMachine.cleanup()
-			return err
+		stateMachine.logStateStart(stateFunc.name)
+		timedOut, err := stateMachine.runState(stateFunc)
+		if timedOut {
+			stateMachine.logStateEnd(stateFunc.name, start, stateStatusTimeout, err)
+			return stateMachine.failRun(stateFunc.name, stateMachine.timeoutError(stateFunc.name, err))
+		}
+		if err != nil {
+			// the state most likely failed because its commands were killed
+			if ctx.Err() != nil {
+				stateMachine.logStateEnd(stateFunc.name, start, stateStatusCancelled, err)
+				return stateMachine.cancelRun(stateFunc.name)
+			}
+			stateMachine.logStateEnd(stateFunc.name, start, stateStatusError, err)
+			return stateMachine.failRun(stateFunc.name, err)
 		}
+		stateMachine.logStateEnd(stateFunc.name, start, stateStatusSuccess, nil)
+		stateMachine.stateDurations = append(stateMachine.stateDurations,
+			stateDuration{name: stateFunc.name, duration: time.Since(start)})
 		stateMachine.StepsTaken++
 		if stateFunc.name == stateMachine.stateMachineFlags.Thru {
+			if i < len(stateMachine.states)-1 && !stateMachine.stateMachineFlags.ValidateOnly {
+				stoppedAfter = stateFunc.name
+			}
 			break
 		}
 	}
+	if stoppedAfter != "" {
+		if err := stateMachine.exportPartialBuild(stoppedAfter); err != nil {
+			return err
+		}
+	}
+	stateMachine.printTimingSummary(time.Since(stateMachine.runStart))
 	return nil
 }
 
-// Teardown handles anything else that needs to happen after the states have finished running
+// runState runs a state. With --state-timeout, the state gets a context of its own
+// that is cancelled once the timeout expires, so that the commands it is still
+// running are killed. A state that returns after its timeout is reported as having
+// timed out, even if it succeeded. Some of the states, like the ones calling
+// image.Prepare, can't be interrupted, so the state runs in a goroutine to report
+// the timeout as soon as it fires. It is still waited for, so that the state machine
+// is only torn down once nothing changes it or writes to the work directory anymore
+func (stateMachine *StateMachine) runState(state stateFunc) (bool, error) {
+	if stateMachine.stateTimeout == 0 {
+		return false, state.function(stateMachine)
+	}
+	runCtx := stateMachine.runContext()
+	stateCtx, cancel := context.WithTimeout(runCtx, stateMachine.stateTimeout)
+	defer cancel()
+	stateMachine.stateCtx = stateCtx
+	defer func() {
+		stateMachine.stateCtx = nil
+	}()
+	stateErr := make(chan error, 1)
+	go func() {
+		stateErr <- state.function(stateMachine)
+	}()
+	var err error
+	select {
+	case err = <-stateErr:
+	case <-stateCtx.Done():
+		// the whole run being cancelled is not a timeout of the state, which returns
+		// once its commands are killed, as it does without --state-timeout
+		if runCtx.Err() == nil && !stateMachine.commonFlags.Quiet {
+			stateMachine.printWarning("state %s timed out after %s, waiting for it to stop",
+				state.name, stateMachine.stateTimeout)
+		}
+		err = <-stateErr
+	}
+	// the state may have returned because its commands were killed
+	timedOut := errors.Is(stateCtx.Err(), context.DeadlineExceeded) && runCtx.Err() == nil
+	return timedOut, err
+}
+
+// timeoutError returns the error of a state that ran for longer than --state-timeout,
+// with the error the state returned once its commands were killed, if any
+func (stateMachine *StateMachine) timeoutError(stateName string, err error) error {
+	if err == nil {
+		return fmt.Errorf("State %s timed out after %s", stateName, stateMachine.stateTimeout)
+	}
+	return fmt.Errorf("State %s timed out after %s: %w", stateName, stateMachine.stateTimeout, err)
+}
+
+// failRun records the state that failed and its error, and keeps the work dir
+func (stateMachine *StateMachine) failRun(stateName string, err error) error {
+	stateMachine.failedState = stateName
+	stateMachine.runErr = err
+	// keep the work dir on error so that it can be inspected
+	stateMachine.printKeptWorkDir()
+	return err
+}
+
+// printTimingSummary prints the total build time once all the states have run.
+// With --verbose or --debug, the time taken by each state is printed as well,
+// slowest first
+func (stateMachine *StateMachine) printTimingSummary(total time.Duration) {
+	// the duration of each state is already part of the JSON output
+	if stateMachine.commonFlags.Quiet || stateMachine.commonFlags.LogFormat == logFormatJSON {
+		return
+	}
+	if stateMachine.commonFlags.Verbose || stateMachine.commonFlags.Debug {
+		durations := make([]stateDuration, len(stateMachine.stateDurations))
+		copy(durations, stateMachine.stateDurations)
+		sort.SliceStable(durations, func(i, j int) bool {
+			return durations[i].duration > durations[j].duration
+		})
+		nameWidth := 0
+		for _, state := range durations {
+			if len(state.name) > nameWidth {
+				nameWidth = len(state.name)
+			}
+		}
+		fmt.Println("\nTime taken by each state:")
+		for _, state := range durations {
+			fmt.Printf("  %-*s  %s\n", nameWidth, state.name, state.duration.Round(time.Millisecond))
+		}
+	}
+	fmt.Printf("Total build time: %s\n", total.Round(time.Millisecond))
+}
+
+// logStateStart prints the state that is about to be run when using the text log format,
+// and sends its start to the --event-socket and the --status-addr endpoint
+func (stateMachine *StateMachine) logStateStart(stateName string) {
+	stateMachine.events.publish(stateName, stateStatusStarted)
+	stateMachine.status.update(stateMachine.StepsTaken, stateName, stateStatusStarted, nil)
+	if stateMachine.commonFlags.Quiet || stateMachine.commonFlags.LogFormat == logFormatJSON {
+		return
+	}
+	fmt.Printf("[%d] %s\n", stateMachine.StepsTaken, stateMachine.colorize(helper.ColorBold, stateName))
+}
+
+// colorize colors text in the human-readable output, when --color allows it
+func (stateMachine *StateMachine) colorize(color, text string) string {
+	return helper.Colorize(helper.UseColor(stateMachine.commonFlags.Color, stateMachine.outputIsTerminal()),
+		color, text)
+}
+
+// outputIsTerminal reports whether the output of the build goes to a terminal,
+// which stdout no longer is when the output is copied to the --status-addr log
+func (stateMachine *StateMachine) outputIsTerminal() bool {
+	if stateMachine.status != nil {
+		return stateMachine.status.terminal
+	}
+	return stdoutIsTerminal()
+}
+
+// printWarning prints a warning in the human-readable output. The callers decide
+// whether it is printed with --quiet
+func (stateMachine *StateMachine) printWarning(format string, args ...interface{}) {
+	fmt.Printf(stateMachine.colorize(helper.ColorYellow, "WARNING")+": "+format+"\n", args...)
+}
+
+// logStateEnd prints a JSON object describing a state that has finished running
+// when using the json log format. Errors are printed even with --quiet. The end
+// of the state is sent to the --event-socket and the --status-addr endpoint regardless
+// of the log format
+func (stateMachine *StateMachine) logStateEnd(stateName string, start time.Time, status string, err error) {
+	stateMachine.events.publish(stateName, status)
+	stateMachine.status.update(stateMachine.StepsTaken, stateName, status, err)
+	if stateMachine.commonFlags.LogFormat != logFormatJSON ||
+		(stateMachine.commonFlags.Quiet && status == stateStatusSuccess) {
+		return
+	}
+	event := stateEvent{
+		Step:     stateMachine.StepsTaken,
+		State:    stateName,
+		Start:    start,
+		Duration: time.Since(start).Seconds(),
+		Status:   status,
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	// errors can't happen when encoding a struct made of basic types
+	json.NewEncoder(os.Stdout).Encode(event)
+}
+
+// cancelRun tears down the state machine after the context of the run was cancelled
+func (stateMachine *StateMachine) cancelRun(stateName string) error {
+	stateMachine.failedState = stateName
+	stateMachine.runErr = fmt.Errorf("Build cancelled during state %s: %w", stateName, stateMachine.ctx.Err())
+	if err := stateMachine.Teardown(); err != nil {
+		return err
+	}
+	return stateMachine.runErr
+}
+
+// context returns the context the current state runs its commands with
+func (stateMachine *StateMachine) context() context.Context {
+	if stateMachine.stateCtx != nil {
+		return stateMachine.stateCtx
+	}
+	return stateMachine.runContext()
+}
+
+// runContext returns the context of the current run, which the timeout of a
+// state does not cancel
+func (stateMachine *StateMachine) runContext() context.Context {
+	if stateMachine.ctx == nil {
+		return context.Background()
+	}
+	return stateMachine.ctx
+}
+
+// walkStates calls visit with every state, in order, along with its step number and
+// whether it is reachable with --until and --thru. Only the states computing the list
+// of states are run, since the list can grow while iterating, e.g. with
+// calculate_states. With onlyReachable, the walk stops at the first unreachable state
+func (stateMachine *StateMachine) walkStates(onlyReachable bool,
+	visit func(step int, name string, reachable bool)) error {
+	step := stateMachine.StepsTaken
+	reachable := true
+	for i := 0; i < len(stateMachine.states); i++ {
+		stateFunc := stateMachine.states[i]
+		if stateFunc.name == stateMachine.stateMachineFlags.Until {
+			reachable = false
+		}
+		if !reachable && onlyReachable {
+			break
+		}
+		visit(step, stateFunc.name, reachable)
+		if dryRunStates[stateFunc.name] {
+			if err := stateFunc.function(stateMachine); err != nil {
+				return err
+			}
+		}
+		step++
+		if stateFunc.name == stateMachine.stateMachineFlags.Thru {
+			reachable = false
+		}
+	}
+	return nil
+}
+
+// dryRun prints the states that would be run along with their description,
+// without running any of the states that have side effects
+func (stateMachine *StateMachine) dryRun() error {
+	return stateMachine.walkStates(true, func(step int, name string, reachable bool) {
+		fmt.Printf("[%d] %s: %s\n", step, name, stateDescriptions[name])
+	})
+}
+
+// listStates prints the name of every state, in order, followed by whether it
+// is reachable with --until and --thru. Like with --dry-run, only the states
+// computing the list of states are run
+func (stateMachine *StateMachine) listStates() error {
+	return stateMachine.walkStates(false, func(step int, name string, reachable bool) {
+		status := "reachable"
+		if !reachable {
+			status = "unreachable"
+		}
+		fmt.Printf("%s\t%s\n", name, status)
+	})
+}
+
+// Teardown handles anything else that needs to happen after the states have finished running,
+// whether they succeeded or not. The result of the build is written, the temporary work
+// directory is removed unless --keep-work-dir was given or a state failed, and the
+// --post-build-hook or --on-failure-hook is run last
 func (stateMachine *StateMachine) Teardown() error {
-	if !stateMachine.cleanWorkDir {
-		if err := stateMachine.writeMetadata(); err != nil {
+	// nothing was created during a dry run or a skipped build, so there is
+	// nothing to save or clean up
+	if stateMachine.stateMachineFlags.DryRun || stateMachine.stateMachineFlags.ListStates ||
+		stateMachine.stateMachineFlags.ListSnapsResolved || stateMachine.stateMachineFlags.PrintConfig ||
+		stateMachine.buildUpToDate || stateMachine.tornDown {
+		return nil
+	}
+	stateMachine.tornDown = true
+	// the recovery seed prepared in the background is not needed anymore if it was
+	// not waited for, but must be done writing to the work directory before it is
+	// cleaned up. Its error only fails the build when the recovery partition is populated
+	stateMachine.stopRecoverySeed()
+	// the devices closed by cleanUpBuild may be mounted in the directory of --tmp-dir
+	err := stateMachine.cleanUpBuild()
+	if tmpDirErr := stateMachine.removeBuildTmpDir(); err == nil {
+		err = tmpDirErr
+	}
+	if err != nil {
+		return err
+	}
+	return stateMachine.runBuildHook()
+}
+
+// cleanUpBuild closes the devices opened during the build, writes its result and
+// removes or saves the work directory
+func (stateMachine *StateMachine) cleanUpBuild() error {
+	if err := stateMachine.closeEncryptedDevices(); err != nil {
+		return err
+	}
+	// builds are only reported once their states started running
+	if !stateMachine.runStart.IsZero() {
+		artifacts, err := stateMachine.resultArtifacts()
+		if err != nil {
 			return err
 		}
-	} else {
-		stateMachine.cleanup()
+		if err := stateMachine.writeBuildResult(stateMachine.runStart, artifacts); err != nil {
+			return err
+		}
+		// the rootfs the snaps and packages are counted in is still there
+		if stateMachine.commonFlags.SummaryJSON != "" && stateMachine.runErr == nil {
+			if err := stateMachine.writeBuildSummary(artifacts); err != nil {
+				return err
+			}
+		}
+	}
+	// keep the work dir on error so that it can be inspected
+	if stateMachine.runErr != nil && stateMachine.runContext().Err() == nil {
+		return nil
 	}
+	if stateMachine.cleanWorkDir && !stateMachine.stateMachineFlags.KeepWorkDir &&
+		!stateMachine.keepPartialBuild {
+		return stateMachine.cleanup()
+	}
+	if err := stateMachine.writeMetadata(); err != nil {
+		return err
+	}
+	stateMachine.printKeptWorkDir()
 	return nil
 }
+
+// printKeptWorkDir prints the path of the temporary work directory when it
+// is not removed, since users have no other way to know where it is
+func (stateMachine *StateMachine) printKeptWorkDir() {
+	if !stateMachine.cleanWorkDir || stateMachine.commonFlags.Quiet ||
+		stateMachine.commonFlags.LogFormat == logFormatJSON {
+		return
+	}
+	fmt.Printf("The working directory was kept at %s\n", stateMachine.stateMachineFlags.WorkDir)
+}
@@ -0,0 +1,185 @@
+package statemachine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// statusLogLines is the number of log lines kept for the --status-addr endpoint
+const statusLogLines = 100
+
+// statusShutdownTimeout bounds the time the requests still being served by the
+// --status-addr endpoint get to finish when the state machine is torn down
+var statusShutdownTimeout = time.Second
+
+// buildStatus is served as JSON by the --status-addr endpoint
+type buildStatus struct {
+	State   string    `json:"state"`
+	Status  string    `json:"status"`
+	Step    int       `json:"step"`
+	Start   time.Time `json:"start"`
+	Elapsed float64   `json:"elapsed"`
+	Log     []string  `json:"log"`
+}
+
+// statusServer serves the state being run, the time elapsed since the build
+// started and the last lines of its output over HTTP. It is updated by the state
+// machine and by the output of the build, while the requests are served from
+// other goroutines
+type statusServer struct {
+	mutex    sync.Mutex
+	server   *http.Server
+	address  string
+	start    time.Time
+	state    string
+	status   string
+	step     int
+	logLines []string
+	// the output written after the last complete line
+	partialLine []byte
+	// whether stdout was a terminal before it was replaced by teeOutput
+	terminal bool
+}
+
+// newStatusServer starts serving the status of the build on the TCP address
+// addr, like ":8080". The build fails right away if it can't be listened on
+func newStatusServer(addr string) (*statusServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Error listening on --status-addr %s: %s", addr, err.Error())
+	}
+	// the port chosen by the system is known once listening, with a port of 0
+	status := &statusServer{start: time.Now(), address: listener.Addr().String()}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", status.serveHTTP)
+	status.server = &http.Server{Handler: mux, ReadHeaderTimeout: statusShutdownTimeout}
+	go status.server.Serve(listener)
+	return status, nil
+}
+
+// serveHTTP writes the current status of the build as JSON
+func (status *statusServer) serveHTTP(writer http.ResponseWriter, request *http.Request) {
+	if request.URL.Path != "/" {
+		http.NotFound(writer, request)
+		return
+	}
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		writer.Header().Set("Allow", "GET, HEAD")
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status.mutex.Lock()
+	current := buildStatus{
+		State:   status.state,
+		Status:  status.status,
+		Step:    status.step,
+		Start:   status.start,
+		Elapsed: time.Since(status.start).Seconds(),
+		Log:     append([]string{}, status.logLines...),
+	}
+	status.mutex.Unlock()
+	writer.Header().Set("Content-Type", "application/json")
+	// errors can only happen when the client went away
+	json.NewEncoder(writer).Encode(current)
+}
+
+// update records the state being run and its status, along with a log line
+func (status *statusServer) update(step int, stateName string, stateStatus string, err error) {
+	if status == nil {
+		return
+	}
+	logLine := fmt.Sprintf("%s [%d] %s: %s", time.Now().Format(time.RFC3339), step,
+		stateName, stateStatus)
+	if err != nil {
+		logLine += ": " + err.Error()
+	}
+	status.mutex.Lock()
+	defer status.mutex.Unlock()
+	status.step = step
+	status.state = stateName
+	status.status = stateStatus
+	status.addLogLine(logLine)
+}
+
+// addLogLine adds a line to the log lines, dropping the oldest ones. It must be
+// called with the mutex held
+func (status *statusServer) addLogLine(logLine string) {
+	status.logLines = append(status.logLines, logLine)
+	if len(status.logLines) > statusLogLines {
+		status.logLines = status.logLines[len(status.logLines)-statusLogLines:]
+	}
+}
+
+// Write adds the complete lines of output to the log lines. A carriage return
+// starts the line again, as the progress bars are redrawn over the same line
+func (status *statusServer) Write(output []byte) (int, error) {
+	status.mutex.Lock()
+	defer status.mutex.Unlock()
+	for _, c := range output {
+		switch c {
+		case '\n':
+			status.addLogLine(string(status.partialLine))
+			status.partialLine = status.partialLine[:0]
+		case '\r':
+			status.partialLine = status.partialLine[:0]
+		default:
+			status.partialLine = append(status.partialLine, c)
+		}
+	}
+	return len(output), nil
+}
+
+// teeOutput replaces stdout and stderr with pipes copying what the build prints
+// to them, and to the log lines. The returned function restores them once all
+// the output was copied
+func (status *statusServer) teeOutput() (func(), error) {
+	status.terminal = stdoutIsTerminal()
+	var restores []func()
+	restore := func() {
+		for _, restoreFile := range restores {
+			restoreFile()
+		}
+	}
+	for _, file := range []**os.File{&os.Stdout, &os.Stderr} {
+		file := file
+		reader, writer, err := os.Pipe()
+		if err != nil {
+			restore()
+			return nil, fmt.Errorf("Error creating the pipe of the --status-addr log: %s", err.Error())
+		}
+		original := *file
+		copied := make(chan struct{})
+		go func() {
+			io.Copy(io.MultiWriter(original, status), reader)
+			close(copied)
+		}()
+		*file = writer
+		restores = append(restores, func() {
+			*file = original
+			writer.Close()
+			<-copied
+			reader.Close()
+		})
+	}
+	return restore, nil
+}
+
+// stop stops serving the status, once the requests being served have finished
+func (status *statusServer) stop() {
+	if status == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), statusShutdownTimeout)
+	defer cancel()
+	if err := status.server.Shutdown(ctx); err != nil {
+		// the requests that are still running are cut off
+		status.server.Close()
+	}
+}
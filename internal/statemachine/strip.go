@@ -0,0 +1,184 @@
+package statemachine
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// stripDpkgConfig is the dpkg configuration that keeps the packages installed in the
+// image from installing the stripped files again
+var stripDpkgConfig = filepath.Join("etc", "dpkg", "dpkg.cfg.d", "ubuntu-image-strip")
+
+// stripRule removes the files below a directory of the rootfs, except the ones
+// keep returns true for. keep gets the path relative to the directory. The
+// dpkg filters of the rule make dpkg skip the same files
+type stripRule struct {
+	dir         string
+	keep        func(relPath string) bool
+	dpkgFilters []string
+}
+
+// keptLocales returns the locales of /usr/share/locale that are not stripped: the ones
+// listed in the image definition and the language of the locale of the image
+func keptLocales(customization *imagedefinition.Customization) map[string]bool {
+	kept := make(map[string]bool)
+	for _, locale := range customization.Strip.KeepLocales {
+		kept[locale] = true
+	}
+	if customization.Locale != "" && !builtinLocales[customization.Locale] {
+		// fr_FR.UTF-8@euro is translated by the fr_FR and fr locales
+		locale := strings.FieldsFunc(customization.Locale, func(r rune) bool {
+			return r == '.' || r == '@'
+		})[0]
+		kept[locale] = true
+		kept[strings.Split(locale, "_")[0]] = true
+	}
+	return kept
+}
+
+// stripRules returns the rules that remove what the strip customization asks for
+func stripRules(customization *imagedefinition.Customization) []stripRule {
+	var rules []stripRule
+	if customization.Strip.Documentation {
+		rules = append(rules,
+			stripRule{
+				dir: filepath.Join("usr", "share", "doc"),
+				keep: func(relPath string) bool {
+					return filepath.Base(relPath) == "copyright"
+				},
+				dpkgFilters: []string{
+					"path-exclude=/usr/share/doc/*",
+					"path-include=/usr/share/doc/*/copyright",
+				},
+			},
+			stripRule{
+				dir:         filepath.Join("usr", "share", "man"),
+				keep:        func(string) bool { return false },
+				dpkgFilters: []string{"path-exclude=/usr/share/man/*"},
+			},
+			stripRule{
+				dir:         filepath.Join("usr", "share", "info"),
+				keep:        func(string) bool { return false },
+				dpkgFilters: []string{"path-exclude=/usr/share/info/*"},
+			},
+		)
+	}
+	if customization.Strip.Locales {
+		kept := keptLocales(customization)
+		localeRule := stripRule{
+			dir: filepath.Join("usr", "share", "locale"),
+			keep: func(relPath string) bool {
+				return relPath == "locale.alias" || kept[strings.Split(relPath, string(filepath.Separator))[0]]
+			},
+			dpkgFilters: []string{
+				"path-exclude=/usr/share/locale/*",
+				"path-include=/usr/share/locale/locale.alias",
+			},
+		}
+		var keptNames []string
+		for locale := range kept {
+			keptNames = append(keptNames, locale)
+		}
+		sort.Strings(keptNames)
+		for _, locale := range keptNames {
+			localeRule.dpkgFilters = append(localeRule.dpkgFilters,
+				"path-include=/usr/share/locale/"+locale+"/*")
+		}
+		rules = append(rules, localeRule)
+	}
+	return rules
+}
+
+// stripDirectory removes the files of a directory that the rule doesn't keep, and the
+// directories that are left empty. It returns the number of files removed
+func stripDirectory(rootfs string, rule stripRule) (int, error) {
+	dir := filepath.Join(rootfs, rule.dir)
+	if _, err := os.Lstat(dir); os.IsNotExist(err) {
+		return 0, nil
+	}
+	var paths []string
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	// the contents of a directory are listed after it, so they are removed first
+	for i := len(paths) - 1; i >= 0; i-- {
+		relPath, _ := filepath.Rel(dir, paths[i])
+		if rule.keep(relPath) {
+			continue
+		}
+		fileInfo, err := os.Lstat(paths[i])
+		if err != nil {
+			return removed, err
+		}
+		if fileInfo.IsDir() {
+			entries, err := os.ReadDir(paths[i])
+			if err != nil {
+				return removed, err
+			}
+			if len(entries) > 0 {
+				continue
+			}
+		}
+		if err := os.Remove(paths[i]); err != nil {
+			return removed, err
+		}
+		if !fileInfo.IsDir() {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// stripRootfs removes the documentation and the locales from the rootfs, as asked by the
+// strip customization. dpkg is configured to skip these files too, so that the packages
+// installed later, in the image or while it is built, don't bring them back
+func (stateMachine *StateMachine) stripRootfs() error {
+	var classicStateMachine *ClassicStateMachine
+	classicStateMachine = stateMachine.parent.(*ClassicStateMachine)
+
+	rules := stripRules(classicStateMachine.ImageDef.Customization)
+	if len(rules) == 0 {
+		return nil
+	}
+
+	dpkgConfig := []string{"# Written by ubuntu-image, the files of the strip customization are not installed"}
+	for _, rule := range rules {
+		dpkgConfig = append(dpkgConfig, rule.dpkgFilters...)
+	}
+	dpkgConfigPath := filepath.Join(stateMachine.tempDirs.chroot, stripDpkgConfig)
+	if err := osMkdirAll(filepath.Dir(dpkgConfigPath), 0755); err != nil {
+		return fmt.Errorf("Error creating the dpkg configuration directory: %s", err.Error())
+	}
+	err := osWriteFile(dpkgConfigPath, []byte(strings.Join(dpkgConfig, "\n")+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("Error writing the dpkg configuration of the strip customization: %s",
+			err.Error())
+	}
+
+	for _, rule := range rules {
+		removed, err := stripDirectory(stateMachine.tempDirs.chroot, rule)
+		if err != nil {
+			return fmt.Errorf("Error stripping /%s: %s", rule.dir, err.Error())
+		}
+		if stateMachine.commonFlags.Debug {
+			fmt.Printf("Removed %d files from /%s\n", removed, rule.dir)
+		}
+	}
+	return nil
+}
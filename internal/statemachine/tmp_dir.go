@@ -0,0 +1,111 @@
+package statemachine
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// validateTmpDir makes sure that the directory of --tmp-dir exists before the
+// build starts
+func (stateMachine *StateMachine) validateTmpDir() error {
+	tmpDir := stateMachine.commonFlags.TmpDir
+	if tmpDir == "" {
+		return nil
+	}
+	tmpDirInfo, err := os.Stat(tmpDir)
+	if err != nil || !tmpDirInfo.IsDir() {
+		return fmt.Errorf("--tmp-dir must be an existing directory, but \"%s\" is not", tmpDir)
+	}
+	return nil
+}
+
+// makeBuildTmpDir creates the directory of --tmp-dir in which the temporary files
+// of the build are created, and makes it the TMPDIR of the commands the build runs
+// so that they create their temporary files in it too. The environment of the
+// process is left alone, like for the other variables of the commands
+func (stateMachine *StateMachine) makeBuildTmpDir() error {
+	if stateMachine.commonFlags.TmpDir == "" || stateMachine.tempDirs.tmp != "" {
+		return nil
+	}
+	tmpDir, err := osMkdirTemp(stateMachine.commonFlags.TmpDir, "ubuntu-image-")
+	if err != nil {
+		return fmt.Errorf("Error creating the temporary directory of the build in --tmp-dir: %s",
+			err.Error())
+	}
+	stateMachine.tempDirs.tmp = tmpDir
+
+	// the commands cleaning up after the build once the directory is removed
+	// get the TMPDIR of the build environment again
+	runCtx := stateMachine.ctx
+	stateMachine.ctx = withCommandEnv(stateMachine.runContext(), "TMPDIR="+tmpDir)
+	stateMachine.restoreTmpDirEnv = func() {
+		stateMachine.ctx = runCtx
+	}
+	return nil
+}
+
+// mountedBelow returns the first mount point found below dir, if any
+func mountedBelow(dir string) (string, error) {
+	mounts, err := os.Open(procMountsFile)
+	if err != nil {
+		return "", fmt.Errorf("Error reading the mounted filesystems: %s", err.Error())
+	}
+	defer mounts.Close()
+
+	scanner := bufio.NewScanner(mounts)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		if fields[1] == dir || strings.HasPrefix(fields[1], dir+"/") {
+			return fields[1], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("Error reading the mounted filesystems: %s", err.Error())
+	}
+	return "", nil
+}
+
+// removeBuildTmpDir removes the temporary directory of the build, whether it
+// succeeded or not, and restores the TMPDIR it was started with. The directory is
+// kept, with a warning, if a filesystem is still mounted in it, so that nothing
+// is removed through the mount
+func (stateMachine *StateMachine) removeBuildTmpDir() error {
+	tmpDir := stateMachine.tempDirs.tmp
+	if tmpDir == "" {
+		return nil
+	}
+	stateMachine.restoreTmpDirEnv()
+	stateMachine.tempDirs.tmp = ""
+
+	mountPoint, err := mountedBelow(filepath.Clean(tmpDir))
+	if err != nil {
+		return err
+	}
+	if mountPoint != "" {
+		if !stateMachine.commonFlags.Quiet {
+			stateMachine.printWarning("the temporary directory of the build %s was not removed, "+
+				"since %s is still mounted", tmpDir, mountPoint)
+		}
+		return nil
+	}
+	if err := osRemoveAll(tmpDir); err != nil {
+		return fmt.Errorf("Error removing the temporary directory of the build: %s", err.Error())
+	}
+	return nil
+}
+
+// tempDir returns the directory in which a state creates its large temporary files
+// and mount points: the temporary directory of the build with --tmp-dir, or
+// defaultDir without it
+func (stateMachine *StateMachine) tempDir(defaultDir string) string {
+	if stateMachine.tempDirs.tmp != "" {
+		return stateMachine.tempDirs.tmp
+	}
+	return defaultDir
+}
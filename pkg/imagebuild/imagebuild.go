@@ -0,0 +1,137 @@
+// Package imagebuild provides a Go API to build images with ubuntu-image
+// without having to execute the ubuntu-image binary
+package imagebuild
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/canonical/ubuntu-image/internal/commands"
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/statemachine"
+)
+
+// The options are the same as the command line flags of ubuntu-image, so
+// they are aliased here instead of being duplicated
+type (
+	// CommonOptions are the options common to all image types
+	CommonOptions = commands.CommonOpts
+	// StateMachineOptions control how the state machine is run
+	StateMachineOptions = commands.StateMachineOpts
+	// ClassicOptions are the options specific to classic images
+	ClassicOptions = commands.ClassicOpts
+	// ClassicArgs are the positional arguments of classic images
+	ClassicArgs = commands.ClassicArgs
+	// SnapOptions are the options specific to snap images
+	SnapOptions = commands.SnapOpts
+	// SnapArgs are the positional arguments of snap images
+	SnapArgs = commands.SnapArgs
+)
+
+// ImageType is the type of image to build
+type ImageType string
+
+const (
+	// Classic builds a classic image from an image definition
+	Classic ImageType = "classic"
+	// Snap builds a snap based image from a model assertion
+	Snap ImageType = "snap"
+)
+
+// Config describes the image to build. Only the options and arguments of
+// the requested ImageType are used. Options that are left unset get the
+// same default values as the ubuntu-image command line flags
+type Config struct {
+	ImageType    ImageType
+	Common       CommonOptions
+	StateMachine StateMachineOptions
+	Classic      ClassicOptions
+	ClassicArgs  ClassicArgs
+	Snap         SnapOptions
+	SnapArgs     SnapArgs
+}
+
+// Result holds the paths of the files produced by a build
+type Result struct {
+	// OutputDir is the directory the artifacts were written to
+	OutputDir string
+	// Images are the disk image files that were created
+	Images []string
+	// Artifacts are the other files that were created, like manifests
+	Artifacts []string
+}
+
+// Builder builds images. The zero value is ready to use. The proxies of
+// CommonOptions are used for the commands, the git clones and the requests of
+// the build, but the snap store only reads them once per process: all the
+// builds of a process must be given the same proxies. Builds using the Offline
+// option point the snap store of the process at their local assertions while
+// the snaps are prepared, so they must not run concurrently with other builds
+type Builder struct{}
+
+// Build sets up, runs and tears down the state machine for the image described
+// by config. Cancelling the context stops the state machine between states,
+// kills the external commands it is running and tears it down
+func (builder *Builder) Build(ctx context.Context, config Config) (*Result, error) {
+	if err := setDefaults(&config); err != nil {
+		return nil, err
+	}
+
+	var stateMachineInterface statemachine.SmInterface
+	var stateMachine *statemachine.StateMachine
+	switch config.ImageType {
+	case Classic:
+		classicStateMachine := new(statemachine.ClassicStateMachine)
+		classicStateMachine.Opts = config.Classic
+		classicStateMachine.Args = config.ClassicArgs
+		classicStateMachine.SetCommonOpts(&config.Common, &config.StateMachine)
+		stateMachineInterface = classicStateMachine
+		stateMachine = &classicStateMachine.StateMachine
+	case Snap:
+		snapStateMachine := new(statemachine.SnapStateMachine)
+		snapStateMachine.Opts = config.Snap
+		snapStateMachine.Args = config.SnapArgs
+		snapStateMachine.SetCommonOpts(&config.Common, &config.StateMachine)
+		stateMachineInterface = snapStateMachine
+		stateMachine = &snapStateMachine.StateMachine
+	default:
+		return nil, fmt.Errorf("unsupported image type \"%s\"", config.ImageType)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := stateMachineInterface.Setup(); err != nil {
+		return nil, err
+	}
+
+	if err := stateMachineInterface.RunContext(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := stateMachineInterface.Teardown(); err != nil {
+		return nil, err
+	}
+
+	return &Result{
+		OutputDir: config.Common.OutputDir,
+		Images:    stateMachine.ImageFiles,
+		Artifacts: stateMachine.Artifacts,
+	}, nil
+}
+
+// setDefaults fills in the options that were not set in config the same
+// way go-flags does for the command line flags
+func setDefaults(config *Config) error {
+	for _, opts := range []interface{}{
+		&config.Common,
+		&config.StateMachine,
+		&config.Classic,
+		&config.Snap,
+	} {
+		if err := helper.SetDefaults(opts); err != nil {
+			return fmt.Errorf("Error setting default options: %s", err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package imagebuild
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// testImageDefinition is an image definition from the statemachine test data
+var testImageDefinition = filepath.Join("..", "..", "internal", "statemachine",
+	"testdata", "image_definitions", "test_raspi.yaml")
+
+// TestBuild tests that a classic build can be run through the Builder
+func TestBuild(t *testing.T) {
+	t.Run("test_build", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var builder Builder
+		config := Config{
+			ImageType:    Classic,
+			StateMachine: StateMachineOptions{DryRun: true},
+			ClassicArgs:  ClassicArgs{ImageDefinition: testImageDefinition},
+		}
+
+		result, err := builder.Build(context.Background(), config)
+		asserter.AssertErrNil(err, true)
+		if len(result.Images) != 0 || len(result.Artifacts) != 0 {
+			t.Errorf("Expected no artifacts from a dry run, but got %v and %v",
+				result.Images, result.Artifacts)
+		}
+	})
+}
+
+// TestSetDefaults tests that unset options get the same defaults as the command line flags
+func TestSetDefaults(t *testing.T) {
+	t.Run("test_set_defaults", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		config := Config{Common: CommonOptions{SectorSize: "4096"}}
+		err := setDefaults(&config)
+		asserter.AssertErrNil(err, true)
+
+		if config.Common.SectorSize != "4096" {
+			t.Errorf("Expected the sector size that was set to be kept, but got %s",
+				config.Common.SectorSize)
+		}
+		if config.Common.ParallelDownloads != 4 {
+			t.Errorf("Expected default of 4 parallel downloads, but got %d",
+				config.Common.ParallelDownloads)
+		}
+		if config.Classic.Format != "raw" {
+			t.Errorf("Expected default format raw, but got %s", config.Classic.Format)
+		}
+	})
+}
+
+// TestFailedBuild tests failures when building an image through the Builder
+func TestFailedBuild(t *testing.T) {
+	t.Run("test_failed_build", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		var builder Builder
+
+		// unknown image type
+		_, err := builder.Build(context.Background(), Config{ImageType: "core"})
+		asserter.AssertErrContains(err, "unsupported image type")
+
+		// invalid options are reported by Setup
+		config := Config{
+			ImageType:    Classic,
+			Common:       CommonOptions{ResultFile: filepath.Join(t.TempDir(), "build-result.json")},
+			StateMachine: StateMachineOptions{Until: "calculate_states", Thru: "finish"},
+			ClassicArgs:  ClassicArgs{ImageDefinition: testImageDefinition},
+		}
+		_, err = builder.Build(context.Background(), config)
+		asserter.AssertErrContains(err, "cannot specify both --until and --thru")
+
+		// cancelled context
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		config.StateMachine = StateMachineOptions{DryRun: true}
+		_, err = builder.Build(ctx, config)
+		asserter.AssertErrContains(err, "context canceled")
+	})
+}